@@ -1,11 +1,14 @@
 package authen
 
 import (
+	"context"
 	"math/rand"
+	"sync"
 	"time"
 
 	"src.goblgobl.com/authen/config"
 	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
 	"src.goblgobl.com/utils/log"
 )
 
@@ -15,6 +18,11 @@ func Init(config config.Config) error {
 	rand.Seed(time.Now().UnixNano())
 
 	Config = config
+	Keys = NewKeyRing(config.Keys)
+	if Keys.Empty() {
+		log.Warn("keys_missing").String("details", "no keys configured, login log payloads will be stored unencrypted").Log()
+	}
+
 	if seconds := config.ProjectUpdateFrequency; seconds != nil {
 		go reloadUpdatedProjects(time.Duration(*seconds) * time.Second)
 	}
@@ -43,7 +51,10 @@ func reloadUpdatedProjects(seconds time.Duration) {
 
 // extracted from reloadUpdatedProjects so we can test it...*eyeroll*
 func updateProjectsUpdatedSince(t time.Time) {
-	updatedProjects, err := storage.DB.GetUpdatedProjects(t)
+	ctx, cancel := storage.Context()
+	defer cancel()
+
+	updatedProjects, err := storage.DB.GetUpdatedProjects(ctx, t)
 	if err != nil {
 		log.Error("reload_projects").Err(err).Log()
 		return
@@ -60,10 +71,102 @@ func dbCleaner(seconds time.Duration) {
 	// and each is configured to run a dbCleaner with the same frequency
 	// they probably don't all run at the same time
 	rand.Int31n(int32(seconds.Seconds()))
+
+	opts := cleanOptions()
 	for {
-		if err := storage.DB.Clean(); err != nil {
-			log.Error("db_cleaner").Err(err).Log()
-		}
+		clean(opts)
 		time.Sleep(seconds)
 	}
 }
+
+func cleanOptions() data.Clean {
+	var opts data.Clean
+	if loginLog := Config.LoginLog; !Config.MultiTenancy && loginLog != nil {
+		opts.LoginLogRetention = data.LoginLogRetention{
+			Count: loginLog.RetainCount,
+			Days:  loginLog.RetainDays,
+		}
+	}
+	if batchSize := Config.DBCleanBatchSize; batchSize != nil {
+		opts.BatchSize = int(*batchSize)
+	}
+	if pause := Config.DBCleanPause; pause != nil {
+		opts.Pause = time.Duration(*pause) * time.Millisecond
+	}
+	opts.BatchTimeout = storage.Timeout()
+	return opts
+}
+
+// extracted from dbCleaner so we can test it. The storage timeout bounds
+// each statement (opts.BatchTimeout), not the whole run, which, with its
+// pauses, can take much longer. Whatever was deleted before an error (or
+// timeout) stays deleted and is counted.
+func clean(opts data.Clean) {
+	start := time.Now()
+	result, err := storage.DB.Clean(context.Background(), opts)
+	elapsed := time.Since(start)
+	recordClean(start, elapsed, result, err)
+
+	if err != nil {
+		log.Error("db_cleaner").Err(err).Log()
+	}
+	log.Info("db_clean").
+		Int("totps", result.TOTPs).
+		Int("tickets", result.Tickets).
+		Int("ticket_denylist", result.TicketDenylist).
+		Int("login_logs", result.LoginLogs).
+		Int("user_locks", result.UserLocks).
+		Int("partitions", result.Partitions).
+		Int64("ms", elapsed.Milliseconds()).
+		Log()
+}
+
+var (
+	cleanStats     CleanStats
+	cleanStatsLock sync.Mutex
+)
+
+// What the db cleaner has done since this instance started (exposed by
+// the info endpoint)
+type CleanStats struct {
+	Runs   int `json:"runs"`
+	Errors int `json:"errors"`
+
+	// rows removed by every run
+	Removed data.CleanResult `json:"removed"`
+
+	// the latest run, nil until the cleaner has run
+	Last *LastClean `json:"last,omitempty"`
+}
+
+type LastClean struct {
+	Start   time.Time        `json:"start"`
+	Ms      int64            `json:"ms"`
+	Error   bool             `json:"error"`
+	Removed data.CleanResult `json:"removed"`
+}
+
+func recordClean(start time.Time, elapsed time.Duration, result data.CleanResult, err error) {
+	cleanStatsLock.Lock()
+	defer cleanStatsLock.Unlock()
+
+	cleanStats.Runs += 1
+	if err != nil {
+		cleanStats.Errors += 1
+	}
+	cleanStats.Removed.Add(result)
+	cleanStats.Last = &LastClean{
+		Start:   start,
+		Ms:      elapsed.Milliseconds(),
+		Error:   err != nil,
+		Removed: result,
+	}
+}
+
+// A copy of the db cleaner's stats (Last is replaced, never modified,
+// so it can be shared)
+func CleanerStats() CleanStats {
+	cleanStatsLock.Lock()
+	defer cleanStatsLock.Unlock()
+	return cleanStats
+}
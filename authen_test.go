@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"src.goblgobl.com/authen/storage/data"
 	"src.goblgobl.com/authen/tests"
 	"src.goblgobl.com/tests/assert"
 )
@@ -31,3 +32,19 @@ func Test_UpdateProjectsUpdatedSince(t *testing.T) {
 	assert.Equal(t, p.TOTPSetupTTL, time.Second*123)
 	assert.Equal(t, p.TicketMax, 14)
 }
+
+func Test_Clean_Stats(t *testing.T) {
+	before := CleanerStats()
+
+	projectId := tests.String(10, 10)
+	tests.Factory.Ticket.Insert("project_id", projectId, "ticket", "t1", "uses", 0)
+	tests.Factory.Ticket.Insert("project_id", projectId, "ticket", "t2", "expires", time.Now().Add(-time.Second))
+	tests.Factory.Ticket.Insert("project_id", projectId, "ticket", "t3", "expires", time.Now().Add(-time.Second))
+	clean(data.Clean{BatchSize: 1})
+
+	stats := CleanerStats()
+	assert.Equal(t, stats.Runs, before.Runs+1)
+	assert.Equal(t, stats.Errors, before.Errors)
+	assert.True(t, stats.Last.Removed.Tickets >= 3)
+	assert.True(t, stats.Removed.Tickets >= before.Removed.Tickets+3)
+}
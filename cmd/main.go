@@ -2,9 +2,14 @@ package main
 
 import (
 	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"src.goblgobl.com/authen"
 	"src.goblgobl.com/authen/config"
+	"src.goblgobl.com/authen/events"
 	"src.goblgobl.com/authen/http"
 	"src.goblgobl.com/authen/storage"
 	"src.goblgobl.com/utils/log"
@@ -13,6 +18,9 @@ import (
 func main() {
 	configPath := flag.String("config", "config.json", "full path to config file")
 	migrations := flag.Bool("migrations", false, "only run migrations and exit")
+	encryptLoginLogs := flag.Bool("encrypt-login-logs", false, "encrypt existing plain text login log payloads and exit")
+	exportPath := flag.String("export", "", "write all of the storage's data to this file and exit")
+	importPath := flag.String("import", "", "load a file written by -export into the storage and exit")
 	flag.Parse()
 
 	config, err := config.Configure(*configPath)
@@ -26,6 +34,13 @@ func main() {
 		return
 	}
 
+	// authen migrate ..., which mustn't be preceded by the automatic
+	// migrations below (a status or dry run would be meaningless)
+	if args := flag.Args(); len(args) > 0 && args[0] == "migrate" {
+		migrateMain(args[1:])
+		return
+	}
+
 	if *migrations || config.Migrations == nil || *config.Migrations == true {
 		if err := storage.DB.EnsureMigrations(); err != nil {
 			log.Fatal("authen_migrations").Err(err).Log()
@@ -39,5 +54,99 @@ func main() {
 		return
 	}
 
+	// authen export PATH and authen import PATH are the same as the
+	// -export and -import flags
+	if args := flag.Args(); len(args) > 0 {
+		switch {
+		case len(args) == 2 && args[0] == "export":
+			*exportPath = args[1]
+		case len(args) == 2 && args[0] == "import":
+			*importPath = args[1]
+		default:
+			log.Fatal("unknown_command").String("command", strings.Join(args, " ")).Log()
+			return
+		}
+	}
+
+	if *encryptLoginLogs {
+		n, err := authen.EncryptLoginLogPayloads(1000)
+		if err != nil {
+			log.Fatal("encrypt_login_logs").Int("count", n).Err(err).Log()
+			return
+		}
+		log.Info("encrypt_login_logs").Int("count", n).Log()
+		return
+	}
+
+	if path := *exportPath; path != "" {
+		n, err := export(path)
+		if err != nil {
+			log.Fatal("export").String("path", path).Int("count", n).Err(err).Log()
+			return
+		}
+		log.Info("export").String("path", path).Int("count", n).Log()
+		return
+	}
+
+	if path := *importPath; path != "" {
+		n, err := load(path)
+		if err != nil {
+			log.Fatal("import").String("path", path).Int("count", n).Err(err).Log()
+			return
+		}
+		log.Info("import").String("path", path).Int("count", n).Log()
+		return
+	}
+
+	if err := events.Listen(); err != nil {
+		log.Fatal("events_listen").Err(err).Log()
+		return
+	}
+
+	go shutdown()
 	http.Listen()
 }
+
+func export(path string) (int, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := authen.Export(f)
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+	return n, f.Close()
+}
+
+func load(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Closed even if the import failed, since whatever was loaded is kept
+	// (and the memory storage only writes its snapshot on close).
+	n, err := authen.Import(f, 1000)
+	if closeErr := storage.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// Gives the storage a chance to clean up (e.g. the memory storage
+// writing its snapshot) before we exit.
+func shutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	log.Info("shutdown").String("signal", sig.String()).Log()
+	if err := storage.Close(); err != nil {
+		log.Error("storage_close").Err(err).Log()
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
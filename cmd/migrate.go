@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"src.goblgobl.com/authen/storage"
+)
+
+const migrateUsage = `usage: authen [-config PATH] migrate COMMAND
+
+commands:
+  status                     show the current and latest schema versions
+  up [-dry-run] [VERSION]    run pending migrations, up to VERSION (default: latest)
+  down [-dry-run] VERSION    undo every migration newer than VERSION
+
+-dry-run prints the SQL which would be executed, without executing it.
+Going down drops the tables and columns added by the undone migrations,
+along with their data.
+`
+
+// authen migrate ...
+// Only pg and sqlite have versioned migrations.
+func migrate(args []string, out io.Writer) error {
+	migrator, ok := storage.DB.(storage.Migrator)
+	if !ok {
+		return errors.New("storage does not support migration management")
+	}
+
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	current, latest, err := migrator.MigrationVersions()
+	if err != nil {
+		return err
+	}
+
+	command := args[0]
+	if command == "status" {
+		fmt.Fprintf(out, "current: %d\nlatest: %d\n", current, latest)
+		if pending := latest - current; pending > 0 {
+			fmt.Fprintf(out, "pending: %d\n", pending)
+		}
+		return nil
+	}
+
+	if command != "up" && command != "down" {
+		return errors.New(migrateUsage)
+	}
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(out)
+	dryRun := flags.Bool("dry-run", false, "print the SQL without executing it")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	version := latest
+	if flags.NArg() > 0 {
+		version, err = strconv.Atoi(flags.Arg(0))
+		if err != nil || version < 0 || version > latest {
+			return fmt.Errorf("version must be between 0 and %d", latest)
+		}
+	} else if command == "down" {
+		return errors.New("down requires a VERSION to go down to")
+	}
+
+	// don't let a typo'd version silently go the other way
+	if command == "up" && version < current {
+		return fmt.Errorf("version %d is older than the current version %d (use down)", version, current)
+	}
+	if command == "down" && version > current {
+		return fmt.Errorf("version %d is newer than the current version %d (use up)", version, current)
+	}
+
+	if version == current {
+		fmt.Fprintf(out, "already at version %d\n", current)
+		return nil
+	}
+
+	if *dryRun {
+		sql, err := migrator.MigrateToSQL(version)
+		if err != nil {
+			return err
+		}
+		for _, s := range sql {
+			fmt.Fprintln(out, s)
+		}
+		return nil
+	}
+
+	if err := migrator.MigrateTo(version); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "migrated from %d to %d\n", current, version)
+	return nil
+}
+
+func migrateMain(args []string) {
+	if err := migrate(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -3,6 +3,17 @@ package codes
 const (
 	VAL_NON_HEX_KEY       = 101_001
 	VAL_NON_BASE64_TICKET = 101_002
+	VAL_TICKET_FORMAT     = 101_003
+	VAL_TICKET_BATCH      = 101_004
+	VAL_LOGIN_LOG_STATUS  = 101_005
+	VAL_LOGIN_LOG_CURSOR  = 101_006
+	VAL_IP                = 101_007
+	VAL_COUNTRY           = 101_008
+	VAL_LOGIN_LOG_GROUP   = 101_009
+	VAL_LOGIN_LOG_FORMAT  = 101_010
+	VAL_LOGIN_LOG_IDS     = 101_011
+	VAL_TICKET_SCOPE      = 101_012
+	VAL_TICKET_UNLIMITED  = 101_013
 
 	RES_UNKNOWN_ROUTE          = 102_001
 	RES_MISSING_PROJECT_HEADER = 102_002
@@ -15,12 +26,22 @@ const (
 	RES_TICKET_MAX                = 102_009
 	RES_TICKET_MAX_PAYLOAD_LENGTH = 102_010
 	RES_TICKET_NOT_FOUND          = 102_011
+	RES_TICKET_CODE_COLLISION     = 102_014
+	RES_TICKET_EXTEND_EMPTY       = 102_015
+	RES_TICKET_SIGNING_NO_KEYS    = 102_016
+	RES_TICKET_SIGNED_UNSUPPORTED = 102_017
 
 	RES_LOGIN_LOG_MAX             = 102_012
 	RES_LOGIN_LOG_MAX_META_LENGTH = 102_013
+	RES_LOGIN_LOG_STATS_RANGE     = 102_018
+	RES_LOGIN_LOG_DELETE_EMPTY    = 102_019
+
+	RES_STORAGE_TIMEOUT = 102_020
 
 	ERR_READ_CONFIG              = 103_001
 	ERR_PARSE_CONFIG             = 103_002
 	ERR_INVALID_STORAGE_TYPE     = 103_003
+	ERR_INVALID_KEY              = 103_004
+	ERR_INVALID_LOCKOUT          = 103_005
 	ERR_MULTITENANCY_TOTP_CONFIG = 104_004
 )
@@ -1,10 +1,12 @@
 package config
 
 import (
+	"encoding/hex"
 	"os"
 
 	"src.goblgobl.com/authen/codes"
 	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
 	"src.goblgobl.com/utils/json"
 	"src.goblgobl.com/utils/log"
 	"src.goblgobl.com/utils/validation"
@@ -12,19 +14,25 @@ import (
 
 var (
 	defaultDBCleanFrequency       = uint16(120)
+	defaultDBCleanBatchSize       = uint32(1000)
+	defaultDBCleanPause           = uint32(100)
 	defaultProjectUpdateFrequency = uint16(120)
+	defaultHTTPStorageTimeout     = uint32(5000)
 )
 
 type Config struct {
 	InstanceId             uint8             `json:"instance_id"`
 	Migrations             *bool             `json:"migrations"`
 	DBCleanFrequency       *uint16           `json:"db_clean_frequency"`
+	DBCleanBatchSize       *uint32           `json:"db_clean_batch_size"`
+	DBCleanPause           *uint32           `json:"db_clean_pause"`
 	ProjectUpdateFrequency *uint16           `json:"project_update_frequency"`
 	MultiTenancy           bool              `json:"multi_tenancy"`
 	HTTP                   HTTP              `json:"http"`
 	TOTP                   *TOTP             `json:"totp"`
 	Ticket                 *Ticket           `json:"ticket"`
 	LoginLog               *LoginLog         `json:"login_log"`
+	Keys                   []Key             `json:"keys"`
 	Log                    log.Config        `json:"log"`
 	Storage                storage.Config    `json:"storage"`
 	Validation             validation.Config `json:"validation"`
@@ -32,6 +40,10 @@ type Config struct {
 
 type HTTP struct {
 	Listen string `json:"listen"`
+
+	// milliseconds a request has for all of its storage calls, after
+	// which it fails with a 503 (RES_STORAGE_TIMEOUT). 0 == no limit.
+	StorageTimeout *uint32 `json:"storage_timeout"`
 }
 
 type TOTP struct {
@@ -49,6 +61,34 @@ type Ticket struct {
 type LoginLog struct {
 	Max              int `json:"max"`
 	MaxPayloadLength int `json:"max_payload_length"`
+
+	// keep the last RetainCount logs per user and/or logs newer than
+	// RetainDays, 0 == no limit. Enforced by the db cleaner and, when
+	// RetainOnInsert is true, RetainCount is also enforced on insert.
+	// Max is ignored when either RetainCount or RetainDays is set.
+	RetainCount    int  `json:"retain_count"`
+	RetainDays     int  `json:"retain_days"`
+	RetainOnInsert bool `json:"retain_on_insert"`
+
+	// e.g. {"statuses": [2, 3], "failures": 5, "window": 900, "duration": 1800}
+	// locks a user for 30 minutes after 5 login logs with a status of 2 or 3
+	// within 15 minutes. window and duration are in seconds.
+	Lockout []data.LockoutRule `json:"lockout"`
+
+	// The statuses of a successful login. Only successful logins make
+	// an ip or device known, so new_ip and new_device are only ever set
+	// when this is.
+	SuccessStatuses []int `json:"success_statuses"`
+}
+
+// Server-side keys, used for anything which needs to be protected
+// by a secret that isn't stored alongside the data (e.g. encrypting
+// login log payloads). The key with the highest id is used for new
+// values; older keys are kept so that existing values can be read.
+type Key struct {
+	Id     int      `json:"id"`
+	Secret string   `json:"secret"`
+	Value  [32]byte `json:"-"`
 }
 
 func Configure(filePath string) (Config, error) {
@@ -107,14 +147,57 @@ func Configure(filePath string) (Config, error) {
 	if !config.MultiTenancy && loginLog == nil {
 		config.LoginLog = new(LoginLog)
 	}
+	if !config.MultiTenancy && loginLog != nil {
+		if err := validateLockout(loginLog.Lockout); err != nil {
+			return config, err
+		}
+	}
+
+	seen := make(map[int]struct{}, len(config.Keys))
+	for i, key := range config.Keys {
+		if key.Id < 1 {
+			return config, log.Errf(codes.ERR_INVALID_KEY, "keys[%d].id must be greater than 0", i)
+		}
+		if _, exists := seen[key.Id]; exists {
+			return config, log.Errf(codes.ERR_INVALID_KEY, "keys[%d].id is a duplicate", i)
+		}
+		seen[key.Id] = struct{}{}
+
+		secret, err := hex.DecodeString(key.Secret)
+		if err != nil || len(secret) != 32 {
+			return config, log.Errf(codes.ERR_INVALID_KEY, "keys[%d].secret must be a 64 character hex value", i)
+		}
+		config.Keys[i].Value = *(*[32]byte)(secret)
+	}
 
 	if config.DBCleanFrequency == nil {
 		config.DBCleanFrequency = &defaultDBCleanFrequency
 	}
 
+	if config.DBCleanBatchSize == nil {
+		config.DBCleanBatchSize = &defaultDBCleanBatchSize
+	}
+
+	if config.DBCleanPause == nil {
+		config.DBCleanPause = &defaultDBCleanPause
+	}
+
 	if config.ProjectUpdateFrequency == nil {
 		config.ProjectUpdateFrequency = &defaultProjectUpdateFrequency
 	}
 
+	if config.HTTP.StorageTimeout == nil {
+		config.HTTP.StorageTimeout = &defaultHTTPStorageTimeout
+	}
+
 	return config, nil
 }
+
+func validateLockout(rules []data.LockoutRule) error {
+	for i, rule := range rules {
+		if reason := rule.Invalid(); reason != "" {
+			return log.Errf(codes.ERR_INVALID_LOCKOUT, "login_log.lockout[%d].%s", i, reason)
+		}
+	}
+	return nil
+}
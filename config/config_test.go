@@ -59,6 +59,11 @@ func Test_Config_DefaultLoginLog(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, config.LoginLog.Max, 0)
 	assert.Equal(t, config.LoginLog.MaxPayloadLength, 0)
+	assert.Equal(t, config.LoginLog.RetainCount, 0)
+	assert.Equal(t, config.LoginLog.RetainDays, 0)
+	assert.False(t, config.LoginLog.RetainOnInsert)
+	assert.Equal(t, len(config.LoginLog.Lockout), 0)
+	assert.Equal(t, len(config.LoginLog.SuccessStatuses), 0)
 }
 
 func Test_Config_LoginLog(t *testing.T) {
@@ -66,6 +71,20 @@ func Test_Config_LoginLog(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, config.LoginLog.Max, 11)
 	assert.Equal(t, config.LoginLog.MaxPayloadLength, 92)
+	assert.Equal(t, config.LoginLog.RetainCount, 50)
+	assert.Equal(t, config.LoginLog.RetainDays, 90)
+	assert.True(t, config.LoginLog.RetainOnInsert)
+	assert.Equal(t, len(config.LoginLog.SuccessStatuses), 1)
+	assert.Equal(t, config.LoginLog.SuccessStatuses[0], 1)
+
+	assert.Equal(t, len(config.LoginLog.Lockout), 1)
+	rule := config.LoginLog.Lockout[0]
+	assert.Equal(t, len(rule.Statuses), 2)
+	assert.Equal(t, rule.Statuses[0], 2)
+	assert.Equal(t, rule.Statuses[1], 3)
+	assert.Equal(t, rule.Failures, 5)
+	assert.Equal(t, rule.Window, 900)
+	assert.Equal(t, rule.Duration, 1800)
 }
 
 func Test_Config_DBCleanFrequency(t *testing.T) {
@@ -78,6 +97,18 @@ func Test_Config_DBCleanFrequency(t *testing.T) {
 	assert.Equal(t, *config.DBCleanFrequency, 99)
 }
 
+func Test_Config_DBCleanBatching(t *testing.T) {
+	config, err := Configure(testConfigPath("minimal_config.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, *config.DBCleanBatchSize, 1000)
+	assert.Equal(t, *config.DBCleanPause, 100)
+
+	config, err = Configure(testConfigPath("maximal_config.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, *config.DBCleanBatchSize, 250)
+	assert.Equal(t, *config.DBCleanPause, 50)
+}
+
 func Test_Config_ProjectUpdateFrequency(t *testing.T) {
 	config, err := Configure(testConfigPath("minimal_config.json"))
 	assert.Nil(t, err)
@@ -88,6 +119,44 @@ func Test_Config_ProjectUpdateFrequency(t *testing.T) {
 	assert.Equal(t, *config.ProjectUpdateFrequency, 98)
 }
 
+func Test_Config_HTTPStorageTimeout(t *testing.T) {
+	config, err := Configure(testConfigPath("minimal_config.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, *config.HTTP.StorageTimeout, 5000)
+
+	config, err = Configure(testConfigPath("maximal_config.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, *config.HTTP.StorageTimeout, 2500)
+	assert.Equal(t, config.Storage.Timeout, 30000)
+}
+
+func Test_Config_DefaultKeys(t *testing.T) {
+	config, err := Configure(testConfigPath("minimal_config.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(config.Keys), 0)
+}
+
+func Test_Config_Keys(t *testing.T) {
+	config, err := Configure(testConfigPath("maximal_config.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(config.Keys), 2)
+	assert.Equal(t, config.Keys[0].Id, 1)
+	assert.Equal(t, config.Keys[0].Value[1], 1)
+	assert.Equal(t, config.Keys[0].Value[31], 31)
+	assert.Equal(t, config.Keys[1].Id, 3)
+	assert.Equal(t, config.Keys[1].Value[0], 255)
+}
+
+func Test_Config_InvalidKey(t *testing.T) {
+	_, err := Configure(testConfigPath("invalid_key_config.json"))
+	assert.Equal(t, err.Error(), "code: 103004 - keys[1].secret must be a 64 character hex value")
+}
+
+func Test_Config_InvalidLockout(t *testing.T) {
+	_, err := Configure(testConfigPath("invalid_lockout_config.json"))
+	assert.Equal(t, err.Error(), "code: 103005 - login_log.lockout[1].window must be between 1 and 86400")
+}
+
 func testConfigPath(file string) string {
 	return path.Join("../tests/data/", file)
 }
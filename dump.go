@@ -0,0 +1,207 @@
+package authen
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/json"
+)
+
+// largest line Import will read. A login log's payload is the only
+// thing which can get big.
+const maxDumpLine = 16 * 1024 * 1024
+
+// Version of the archive Export writes. Version 0 is a file of records
+// only (no header or footer), which Import still reads.
+const ARCHIVE_VERSION = 1
+
+// An archive is one json object per line: a header, every record and
+// a footer with the number of records of each kind (so that a truncated
+// archive can't be mistaken for a complete one). Records are a
+// data.DumpRecord, which is embedded so that its fields are at the top
+// level of the line.
+type archiveLine struct {
+	Header *archiveHeader `json:"header,omitempty"`
+	Footer *archiveFooter `json:"footer,omitempty"`
+	data.DumpRecord
+}
+
+type archiveHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type archiveFooter struct {
+	Counts map[string]int `json:"counts"`
+}
+
+// Writes every row of the storage to w as an archive. Used, with Import,
+// to move from one storage to another (e.g. from sqlite to pg).
+func Export(w io.Writer) (int, error) {
+	dumper, ok := storage.DB.(storage.Dumper)
+	if !ok {
+		return 0, errors.New("Export - storage does not support exporting")
+	}
+
+	out := bufio.NewWriter(w)
+	write := func(line archiveLine) error {
+		encoded, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(encoded); err != nil {
+			return err
+		}
+		return out.WriteByte('\n')
+	}
+
+	header := &archiveHeader{Format: "authen", Version: ARCHIVE_VERSION, Created: time.Now().UTC()}
+	if err := write(archiveLine{Header: header}); err != nil {
+		return 0, fmt.Errorf("Export (header) - %w", err)
+	}
+
+	n := 0
+	counts := make(map[string]int)
+	err := dumper.Dump(func(record data.DumpRecord) error {
+		if err := write(archiveLine{DumpRecord: record}); err != nil {
+			return err
+		}
+		n += 1
+		counts[record.Kind()] += 1
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("Export - %w", err)
+	}
+
+	if err := write(archiveLine{Footer: &archiveFooter{Counts: counts}}); err != nil {
+		return n, fmt.Errorf("Export (footer) - %w", err)
+	}
+	if err := out.Flush(); err != nil {
+		return n, fmt.Errorf("Export (flush) - %w", err)
+	}
+	return n, nil
+}
+
+// Loads what Export wrote, batchSize records at a time. The archive's
+// counts are checked against what was read and, afterwards, against the
+// storage, which has to have at least as many rows of each kind (more
+// if it wasn't empty to begin with).
+func Import(r io.Reader, batchSize int) (int, error) {
+	loader, ok := storage.DB.(storage.Loader)
+	if !ok {
+		return 0, errors.New("Import - storage does not support importing")
+	}
+
+	total := 0
+	counts := make(map[string]int)
+	batch := make([]data.DumpRecord, 0, batchSize)
+	flush := func() error {
+		if err := loader.Load(batch); err != nil {
+			return err
+		}
+		total += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	version := 0
+	var footer *archiveFooter
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxDumpLine)
+	for line := 1; scanner.Scan(); line++ {
+		if footer != nil {
+			return total, fmt.Errorf("Import (line %d) - data after the footer", line)
+		}
+
+		var l archiveLine
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			return total, fmt.Errorf("Import (line %d) - %w", line, err)
+		}
+
+		if header := l.Header; header != nil {
+			if line != 1 || header.Format != "authen" {
+				return total, fmt.Errorf("Import (line %d) - unexpected header", line)
+			}
+			if header.Version > ARCHIVE_VERSION {
+				return total, fmt.Errorf("Import - archive version %d is newer than the supported version %d", header.Version, ARCHIVE_VERSION)
+			}
+			version = header.Version
+			continue
+		}
+
+		if l.Footer != nil {
+			footer = l.Footer
+			continue
+		}
+
+		counts[l.Kind()] += 1
+		batch = append(batch, l.DumpRecord)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return total, fmt.Errorf("Import - %w", err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return total, fmt.Errorf("Import (read) - %w", err)
+	}
+
+	// A missing footer, or counts which don't match, means the archive was
+	// truncated or damaged. Earlier batches are already loaded, but since
+	// Load replaces rows, importing a good archive afterwards is safe.
+	if version > 0 {
+		if footer == nil {
+			return total, errors.New("Import - archive has no footer (truncated?)")
+		}
+		if diff := diffCounts(footer.Counts, counts, false); diff != "" {
+			return total, fmt.Errorf("Import - archive counts don't match its records (%s)", diff)
+		}
+	}
+
+	if err := flush(); err != nil {
+		return total, fmt.Errorf("Import - %w", err)
+	}
+
+	stored, err := loader.Counts()
+	if err != nil {
+		return total, fmt.Errorf("Import (verify) - %w", err)
+	}
+	if diff := diffCounts(counts, stored, true); diff != "" {
+		return total, fmt.Errorf("Import (verify) - storage is missing rows (%s)", diff)
+	}
+	return total, nil
+}
+
+// "kind: expected X, got Y" for every kind which doesn't match (or, when
+// atLeast, for every kind with fewer than expected)
+func diffCounts(expected map[string]int, actual map[string]int, atLeast bool) string {
+	kinds := make([]string, 0, len(expected)+len(actual))
+	for kind := range expected {
+		kinds = append(kinds, kind)
+	}
+	for kind := range actual {
+		if _, ok := expected[kind]; !ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+
+	var diffs []string
+	for _, kind := range kinds {
+		e, a := expected[kind], actual[kind]
+		if a == e || (atLeast && a > e) {
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("%s: expected %d, got %d", kind, e, a))
+	}
+	return strings.Join(diffs, ", ")
+}
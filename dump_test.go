@@ -0,0 +1,162 @@
+package authen
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/bolt"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/authen/storage/memory"
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_Export_Import(t *testing.T) {
+	defer func(db storage.Storage) { storage.DB = db }(storage.DB)
+
+	from := testBoltDB(t)
+	uses := 2
+	from.PutProject(data.Project{Id: "p1", TicketMax: 9})
+	from.TOTPCreate(context.Background(), data.TOTPCreate{ProjectId: "p1", UserId: "u1", Type: "t1", Secret: []byte("encrypted")})
+	from.TicketCreate(context.Background(), data.TicketCreate{ProjectId: "p1", Tickets: []data.TicketCreateTicket{{Ticket: []byte("t1"), Uses: &uses}}})
+	from.TicketDeny(context.Background(), data.TicketDeny{ProjectId: "p1", Ticket: []byte("t2"), Expires: time.Now().Add(time.Minute)})
+	from.LoginLogCreate(context.Background(), data.LoginLogCreate{Id: "l1", ProjectId: "p1", UserId: "u1", Status: 3, Payload: []byte("pl1")})
+	from.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u1"})
+
+	var buf bytes.Buffer
+	storage.DB = from
+	n, err := Export(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, n, 6)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, len(lines), 8)
+	assert.StringContains(t, lines[0], `"header":{"format":"authen","version":1,`)
+	assert.Equal(t, lines[7], `{"footer":{"counts":{"denied":1,"login_log":1,"project":1,"ticket":1,"totp":1,"user_lock":1}}}`)
+
+	// batches smaller than the export
+	to := testBoltDB(t)
+	storage.DB = to
+	n, err = Import(&buf, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, n, 6)
+
+	p, _ := to.GetProject(context.Background(), "p1")
+	assert.Equal(t, p.TicketMax, 9)
+
+	totp, _ := to.TOTPGet(context.Background(), data.TOTPGet{ProjectId: "p1", UserId: "u1", Type: "t1"})
+	assert.Equal(t, string(totp.Secret), "encrypted")
+
+	ticket, _ := to.TicketUse(context.Background(), data.TicketUse{ProjectId: "p1", Ticket: []byte("t1")})
+	assert.Equal(t, *ticket.Uses, 1)
+
+	denied, _ := to.TicketDeny(context.Background(), data.TicketDeny{ProjectId: "p1", Ticket: []byte("t2"), Expires: time.Now()})
+	assert.Equal(t, denied.Status, data.TICKET_USE_NOT_FOUND)
+
+	logs, _ := to.LoginLogGet(context.Background(), data.LoginLogGet{ProjectId: "p1", UserId: "u1", Limit: 10})
+	assert.Equal(t, len(logs.Records), 1)
+	assert.Equal(t, string(logs.Records[0].RawPayload), "pl1")
+}
+
+func Test_Export_Unsupported(t *testing.T) {
+	defer func(db storage.Storage) { storage.DB = db }(storage.DB)
+
+	// only has the storage.Storage methods
+	storage.DB = struct{ storage.Storage }{}
+	_, err := Export(&bytes.Buffer{})
+	assert.Equal(t, err.Error(), "Export - storage does not support exporting")
+
+	_, err = Import(strings.NewReader(""), 10)
+	assert.Equal(t, err.Error(), "Import - storage does not support importing")
+}
+
+func Test_Import_Invalid(t *testing.T) {
+	defer func(db storage.Storage) { storage.DB = db }(storage.DB)
+
+	storage.DB = testBoltDB(t)
+	n, err := Import(strings.NewReader("{\"denied\": {\"project_id\": \"p1\"}}\nnope\n"), 10)
+	assert.Equal(t, n, 0)
+	assert.True(t, strings.HasPrefix(err.Error(), "Import (line 2) - "))
+}
+
+func Test_Import_MemoryToBolt(t *testing.T) {
+	defer func(db storage.Storage) { storage.DB = db }(storage.DB)
+
+	from, _ := memory.New(memory.Config{})
+	from.PutProject(data.Project{Id: "p1"})
+	from.TOTPCreate(context.Background(), data.TOTPCreate{ProjectId: "p1", UserId: "u1", Secret: []byte("encrypted")})
+
+	var buf bytes.Buffer
+	storage.DB = from
+	_, err := Export(&buf)
+	assert.Nil(t, err)
+
+	storage.DB = testBoltDB(t)
+	n, err := Import(&buf, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, n, 2)
+}
+
+// what -export wrote before archives had a header and footer
+func Test_Import_Unversioned(t *testing.T) {
+	defer func(db storage.Storage) { storage.DB = db }(storage.DB)
+
+	storage.DB = testBoltDB(t)
+	n, err := Import(strings.NewReader(`{"project": {"id": "p1"}}`+"\n"), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, n, 1)
+}
+
+func Test_Import_Invalid_Archive(t *testing.T) {
+	defer func(db storage.Storage) { storage.DB = db }(storage.DB)
+	storage.DB = testBoltDB(t)
+
+	header := `{"header": {"format": "authen", "version": 1}}` + "\n"
+	project := `{"project": {"id": "p1"}}` + "\n"
+	footer := `{"footer": {"counts": {"project": 1}}}` + "\n"
+
+	for input, expected := range map[string]string{
+		`{"header": {"format": "authen", "version": 2}}`: "Import - archive version 2 is newer than the supported version 1",
+		header + project:                    "Import - archive has no footer (truncated?)",
+		header + project + project + footer: "Import - archive counts don't match its records (project: expected 1, got 2)",
+		header + project + footer + project: "Import (line 4) - data after the footer",
+		project + header:                    "Import (line 2) - unexpected header",
+	} {
+		_, err := Import(strings.NewReader(input), 10)
+		assert.Equal(t, err.Error(), expected)
+	}
+
+	n, err := Import(strings.NewReader(header+project+footer), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, n, 1)
+}
+
+// Loads nothing, so that verifying the import fails
+type droppingStorage struct {
+	bolt.DB
+}
+
+func (s droppingStorage) Load(records []data.DumpRecord) error {
+	return nil
+}
+
+func Test_Import_Verify(t *testing.T) {
+	defer func(db storage.Storage) { storage.DB = db }(storage.DB)
+
+	storage.DB = droppingStorage{testBoltDB(t)}
+	_, err := Import(strings.NewReader(`{"project": {"id": "p1"}}`+"\n"+`{"totp": {"project_id": "p1"}}`+"\n"), 10)
+	assert.Equal(t, err.Error(), "Import (verify) - storage is missing rows (project: expected 1, got 0, totp: expected 1, got 0)")
+}
+
+func testBoltDB(t *testing.T) bolt.DB {
+	db, err := bolt.New(bolt.Config{Path: filepath.Join(t.TempDir(), "authen.db")})
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
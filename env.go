@@ -6,6 +6,9 @@ Loaded via the EnvHandler middleware.
 */
 
 import (
+	"context"
+	"time"
+
 	"src.goblgobl.com/utils/log"
 	"src.goblgobl.com/utils/validation"
 )
@@ -28,6 +31,12 @@ type Env struct {
 
 	// records validation errors
 	Validator *validation.Result
+
+	// Bounds every storage call made for this request (see Context).
+	// fasthttp doesn't tell us when a client goes away, so the deadline
+	// is what stops a slow storage from holding on to a worker.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewEnv(p *Project) *Env {
@@ -37,7 +46,11 @@ func NewEnv(p *Project) *Env {
 		String("rid", requestId).
 		MultiUse()
 
+	ctx, cancel := RequestContext()
+
 	return &Env{
+		ctx:       ctx,
+		cancel:    cancel,
 		Project:   p,
 		Logger:    logger,
 		requestId: requestId,
@@ -45,10 +58,29 @@ func NewEnv(p *Project) *Env {
 	}
 }
 
+// A context which expires after Config.HTTP.StorageTimeout. Used by
+// NewEnv, and directly by handlers which don't have an env (ping, info).
+func RequestContext() (context.Context, context.CancelFunc) {
+	timeout := Config.HTTP.StorageTimeout
+	if timeout == nil || *timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(*timeout)*time.Millisecond)
+}
+
 func (e *Env) RequestId() string {
 	return e.requestId
 }
 
+// The context to pass to storage. Envs which weren't created by NewEnv
+// (i.e. in tests) have no deadline.
+func (e *Env) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
 func (e *Env) Info(ctx string) log.Logger {
 	return e.Logger.Info(ctx)
 }
@@ -75,6 +107,9 @@ func (e *Env) Request(route string) log.Logger {
 }
 
 func (e *Env) Release() {
+	if e.cancel != nil {
+		e.cancel()
+	}
 	e.Logger.Release()
 	e.Validator.Release()
 }
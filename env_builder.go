@@ -7,6 +7,7 @@ package authen
 import (
 	"time"
 
+	"src.goblgobl.com/authen/storage/data"
 	"src.goblgobl.com/utils/log"
 	"src.goblgobl.com/utils/uuid"
 	"src.goblgobl.com/utils/validation"
@@ -60,6 +61,22 @@ func (eb *EnvBuilder) LoginLogMaxPayloadLength(max int) *EnvBuilder {
 	return eb
 }
 
+func (eb *EnvBuilder) LoginLogRetainCount(count int, onInsert bool) *EnvBuilder {
+	eb.project.LoginLogRetainCount = count
+	eb.project.LoginLogRetainOnInsert = onInsert
+	return eb
+}
+
+func (eb *EnvBuilder) Lockout(rules ...data.LockoutRule) *EnvBuilder {
+	eb.project.LockoutRules = rules
+	return eb
+}
+
+func (eb *EnvBuilder) LoginLogSuccessStatuses(statuses ...int) *EnvBuilder {
+	eb.project.LoginLogSuccessStatuses = statuses
+	return eb
+}
+
 func (eb *EnvBuilder) Env() *Env {
 	project := eb.project
 	if project == nil {
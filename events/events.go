@@ -0,0 +1,299 @@
+// Login events (login logs being created, TOTPs being verified) are
+// broadcast to anyone subscribed to the project. Events are published
+// locally and, when the storage supports it (pg NOTIFY), to every other
+// instance with a subscriber for the project, so a subscriber sees events
+// regardless of which instance handled the request.
+package events
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/utils/log"
+	"src.goblgobl.com/utils/uuid"
+)
+
+const (
+	TYPE_LOGIN_LOG   = "login_log"
+	TYPE_TOTP_VERIFY = "totp_verify"
+
+	// sent between instances to say that one of them has a subscriber
+	// for the project. Never given to subscribers.
+	TYPE_INTEREST = "interest"
+
+	// events buffered per subscriber, past this a slow subscriber
+	// misses events rather than slowing down everyone else
+	SUBSCRIPTION_BUFFER = 64
+
+	// events waiting to be sent to other instances, past this they're
+	// dropped rather than slowing down requests
+	OUTBOX_BUFFER = 1024
+
+	// how long an instance's interest in a project lasts
+	INTEREST_TTL = time.Minute
+)
+
+var (
+	Default = NewBroadcaster()
+
+	// identifies the events we published, so that we can ignore them
+	// when storage hands them back to us
+	origin = uuid.String()
+
+	outbox    = make(chan []byte, OUTBOX_BUFFER)
+	listening atomic.Bool
+	remote    = &interest{projects: make(map[string]time.Time)}
+)
+
+type Event struct {
+	Type      string          `json:"type"`
+	ProjectId string          `json:"project_id"`
+	UserId    string          `json:"user_id"`
+	Data      json.RawMessage `json:"data"`
+	Origin    string          `json:"origin"`
+}
+
+type LoginLog struct {
+	Id        string    `json:"id"`
+	UserId    string    `json:"user_id"`
+	Status    int       `json:"status"`
+	Ip        *string   `json:"ip"`
+	UserAgent *string   `json:"user_agent"`
+	Method    *string   `json:"method"`
+	Country   *string   `json:"country"`
+	NewIp     bool      `json:"new_ip"`
+	NewDevice bool      `json:"new_device"`
+	Created   time.Time `json:"created"`
+}
+
+type TOTPVerify struct {
+	UserId string    `json:"user_id"`
+	Type   string    `json:"type"`
+	Ok     bool      `json:"ok"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+type Broadcaster struct {
+	sync.RWMutex
+	subscribers map[string]map[*Subscription]struct{}
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{
+		subscribers: make(map[string]map[*Subscription]struct{}),
+	}
+}
+
+type Subscription struct {
+	C           chan Event
+	projectId   string
+	broadcaster *Broadcaster
+}
+
+func (b *Broadcaster) Subscribe(projectId string) *Subscription {
+	s := &Subscription{
+		C:           make(chan Event, SUBSCRIPTION_BUFFER),
+		projectId:   projectId,
+		broadcaster: b,
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	subscribers := b.subscribers[projectId]
+	if subscribers == nil {
+		subscribers = make(map[*Subscription]struct{})
+		b.subscribers[projectId] = subscribers
+	}
+	subscribers[s] = struct{}{}
+	return s
+}
+
+// The projects which have at least one subscriber
+func (b *Broadcaster) Projects() []string {
+	b.RLock()
+	defer b.RUnlock()
+	projects := make([]string, 0, len(b.subscribers))
+	for projectId := range b.subscribers {
+		projects = append(projects, projectId)
+	}
+	return projects
+}
+
+// Never blocks.
+func (b *Broadcaster) Broadcast(e Event) {
+	b.RLock()
+	defer b.RUnlock()
+	for s := range b.subscribers[e.ProjectId] {
+		select {
+		case s.C <- e:
+		default:
+		}
+	}
+}
+
+// Unsubscribes and closes C. Safe to call more than once.
+func (s *Subscription) Close() {
+	b := s.broadcaster
+	b.Lock()
+	defer b.Unlock()
+
+	projectId := s.projectId
+	subscribers := b.subscribers[projectId]
+	if _, exists := subscribers[s]; !exists {
+		return
+	}
+
+	delete(subscribers, s)
+	if len(subscribers) == 0 {
+		delete(b.subscribers, projectId)
+	}
+	// Broadcast holds the read lock while sending, so this can't
+	// happen mid-send
+	close(s.C)
+}
+
+// Events are best-effort: failing to publish one is logged, but doesn't
+// fail whatever generated the event. Subscribers on this instance get the
+// event right away. Other instances only get it if one of them has said
+// it has a subscriber for the project (see announce), and then through
+// the outbox, so that the caller never waits on storage.
+func Publish(projectId string, userId string, tpe string, data any) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Error("event_publish_data").String("type", tpe).Err(err).Log()
+		return
+	}
+
+	e := Event{
+		Type:      tpe,
+		ProjectId: projectId,
+		UserId:    userId,
+		Data:      encoded,
+		Origin:    origin,
+	}
+	Default.Broadcast(e)
+
+	if !remote.has(projectId) {
+		return
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Error("event_publish_encode").String("type", tpe).Err(err).Log()
+		return
+	}
+	enqueue(payload)
+}
+
+// Opens a subscription on Default and tells the other instances that
+// this one wants the project's events.
+func Subscribe(projectId string) *Subscription {
+	s := Default.Subscribe(projectId)
+	announce(projectId)
+	return s
+}
+
+// Feeds events published by other instances into Default. Also starts
+// sending the outbox and announcing, every INTEREST_TTL / 3, the projects
+// which have a subscriber on this instance.
+func Listen() error {
+	if err := storage.DB.EventListen(receive); err != nil {
+		return err
+	}
+	listening.Store(true)
+
+	go send()
+	go func() {
+		for range time.Tick(INTEREST_TTL / 3) {
+			for _, projectId := range Default.Projects() {
+				announce(projectId)
+			}
+		}
+	}()
+	return nil
+}
+
+func receive(payload []byte) {
+	var e Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		log.Error("event_receive").Err(err).Log()
+		return
+	}
+	// already broadcast when we published it
+	if e.Origin == origin {
+		return
+	}
+	if e.Type == TYPE_INTEREST {
+		remote.add(e.ProjectId, time.Now().Add(INTEREST_TTL))
+		return
+	}
+	Default.Broadcast(e)
+}
+
+func announce(projectId string) {
+	payload, err := json.Marshal(Event{
+		Type:      TYPE_INTEREST,
+		ProjectId: projectId,
+		Origin:    origin,
+	})
+	if err != nil {
+		log.Error("event_announce").Err(err).Log()
+		return
+	}
+	enqueue(payload)
+}
+
+// Never blocks. Without Listen, nothing sends the outbox (and no other
+// instance can be interested in our events).
+func enqueue(payload []byte) {
+	if !listening.Load() {
+		return
+	}
+	select {
+	case outbox <- payload:
+	default:
+		log.Warn("event_outbox_full").Log()
+	}
+}
+
+func send() {
+	for payload := range outbox {
+		ctx, cancel := storage.Context()
+		err := storage.DB.EventPublish(ctx, payload)
+		cancel()
+		if err != nil {
+			log.Error("event_publish").Err(err).Log()
+		}
+	}
+}
+
+// The projects which other instances have a subscriber for, and until
+// when (unless they announce it again).
+type interest struct {
+	sync.Mutex
+	projects map[string]time.Time
+}
+
+func (i *interest) add(projectId string, until time.Time) {
+	i.Lock()
+	defer i.Unlock()
+	i.projects[projectId] = until
+}
+
+func (i *interest) has(projectId string) bool {
+	i.Lock()
+	defer i.Unlock()
+	until, ok := i.projects[projectId]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(i.projects, projectId)
+		return false
+	}
+	return true
+}
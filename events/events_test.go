@@ -0,0 +1,140 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/tests/assert"
+
+	"src.goblgobl.com/authen/tests"
+)
+
+func Test_Broadcaster_ProjectSubscribers(t *testing.T) {
+	b := NewBroadcaster()
+	s1 := b.Subscribe("p1")
+	s2 := b.Subscribe("p1")
+	s3 := b.Subscribe("p2")
+	defer s1.Close()
+	defer s2.Close()
+	defer s3.Close()
+
+	b.Broadcast(Event{ProjectId: "p1", Type: "t1"})
+	assert.Equal(t, (<-s1.C).Type, "t1")
+	assert.Equal(t, (<-s2.C).Type, "t1")
+	assert.Equal(t, len(s3.C), 0)
+
+	b.Broadcast(Event{ProjectId: "p3", Type: "t2"})
+	assert.Equal(t, len(s1.C), 0)
+	assert.Equal(t, len(s3.C), 0)
+}
+
+func Test_Broadcaster_Close(t *testing.T) {
+	b := NewBroadcaster()
+	s1 := b.Subscribe("p1")
+	s2 := b.Subscribe("p1")
+	s1.Close()
+	s1.Close()
+
+	_, ok := <-s1.C
+	assert.False(t, ok)
+
+	b.Broadcast(Event{ProjectId: "p1", Type: "t1"})
+	assert.Equal(t, (<-s2.C).Type, "t1")
+
+	s2.Close()
+	assert.Equal(t, len(b.subscribers), 0)
+}
+
+func Test_Broadcaster_SlowSubscriber(t *testing.T) {
+	b := NewBroadcaster()
+	s := b.Subscribe("p1")
+	defer s.Close()
+
+	for i := 0; i < SUBSCRIPTION_BUFFER+10; i++ {
+		b.Broadcast(Event{ProjectId: "p1"})
+	}
+	assert.Equal(t, len(s.C), SUBSCRIPTION_BUFFER)
+}
+
+func Test_Publish(t *testing.T) {
+	projectId := tests.UUID()
+	s := Default.Subscribe(projectId)
+	defer s.Close()
+
+	Publish(projectId, "u1", TYPE_LOGIN_LOG, LoginLog{Id: "l1", Status: 3})
+	e := <-s.C
+	assert.Equal(t, e.Type, TYPE_LOGIN_LOG)
+	assert.Equal(t, e.UserId, "u1")
+	assert.Equal(t, e.ProjectId, projectId)
+	assert.Equal(t, e.Origin, origin)
+
+	var data LoginLog
+	assert.Nil(t, json.Unmarshal(e.Data, &data))
+	assert.Equal(t, data.Id, "l1")
+	assert.Equal(t, data.Status, 3)
+}
+
+func Test_Receive(t *testing.T) {
+	projectId := tests.UUID()
+	s := Default.Subscribe(projectId)
+	defer s.Close()
+
+	// our own events were already broadcast when published
+	payload, _ := json.Marshal(Event{ProjectId: projectId, Type: "t1", Origin: origin})
+	receive(payload)
+	assert.Equal(t, len(s.C), 0)
+
+	payload, _ = json.Marshal(Event{ProjectId: projectId, Type: "t2", Origin: "other", Data: json.RawMessage(`{"over":9000}`)})
+	receive(payload)
+	e := <-s.C
+	assert.Equal(t, e.Type, "t2")
+	assert.Equal(t, string(e.Data), `{"over":9000}`)
+
+	// invalid payloads are logged and ignored
+	receive([]byte("nope"))
+	assert.Equal(t, len(s.C), 0)
+}
+
+func Test_Receive_Interest(t *testing.T) {
+	projectId := tests.UUID()
+	s := Default.Subscribe(projectId)
+	defer s.Close()
+
+	// ours
+	payload, _ := json.Marshal(Event{ProjectId: projectId, Type: TYPE_INTEREST, Origin: origin})
+	receive(payload)
+	assert.False(t, remote.has(projectId))
+
+	payload, _ = json.Marshal(Event{ProjectId: projectId, Type: TYPE_INTEREST, Origin: "other"})
+	receive(payload)
+	assert.True(t, remote.has(projectId))
+	assert.False(t, remote.has(tests.UUID()))
+
+	// never given to subscribers
+	assert.Equal(t, len(s.C), 0)
+}
+
+func Test_Interest_Expires(t *testing.T) {
+	i := &interest{projects: make(map[string]time.Time)}
+	i.add("p1", time.Now().Add(time.Minute))
+	i.add("p2", time.Now().Add(-time.Second))
+	assert.True(t, i.has("p1"))
+	assert.False(t, i.has("p2"))
+	assert.Equal(t, len(i.projects), 1)
+}
+
+func Test_Broadcaster_Projects(t *testing.T) {
+	b := NewBroadcaster()
+	assert.Equal(t, len(b.Projects()), 0)
+
+	s1 := b.Subscribe("p1")
+	s2 := b.Subscribe("p1")
+	defer s2.Close()
+	projects := b.Projects()
+	assert.Equal(t, len(projects), 1)
+	assert.Equal(t, projects[0], "p1")
+
+	s1.Close()
+	assert.Equal(t, len(b.Projects()), 1)
+}
@@ -10,10 +10,12 @@ go 1.19
 
 require (
 	github.com/fasthttp/router v1.4.12
+	github.com/go-sql-driver/mysql v1.7.0
 	github.com/jackc/pgx/v5 v5.1.1
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/valyala/fasthttp v1.43.0
 	github.com/xlzd/gotp v0.0.0-20220915034741-1546cf172da8
+	go.etcd.io/bbolt v1.3.6
 	src.goblgobl.com/tests v0.0.6
 	src.goblgobl.com/utils v0.0.6
 )
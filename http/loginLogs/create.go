@@ -2,10 +2,12 @@ package loginLogs
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/valyala/fasthttp"
 	"src.goblgobl.com/authen"
 	"src.goblgobl.com/authen/codes"
+	"src.goblgobl.com/authen/events"
 	"src.goblgobl.com/authen/storage"
 	"src.goblgobl.com/authen/storage/data"
 	"src.goblgobl.com/utils/http"
@@ -20,7 +22,11 @@ import (
 var (
 	createValidation = validation.Object().
 				Field("user_id", userIdValidation).
-				Field("status", statusValidation)
+				Field("status", statusValidation).
+				Field("ip", ipValidation).
+				Field("user_agent", userAgentValidation).
+				Field("method", methodValidation).
+				Field("country", countryValidation)
 
 	resMax              = http.StaticError(400, codes.RES_LOGIN_LOG_MAX, "maximum number of login logs reached")
 	resMaxPayloadLength = http.StaticError(400, codes.RES_LOGIN_LOG_MAX_META_LENGTH, "payload length is exceeds maximum allowed size")
@@ -40,30 +46,60 @@ func Create(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 
 	project := env.Project
 	var payload []byte
+	var payloadKey int
 	if p, ok := input["payload"]; ok {
 		mb, err := json.Marshal(p)
 		if err != nil {
-			// since this unmarshal'd, it should marshal, this is weird
-			// body could have sensitive information...but we do currently store the
-			// payload in plain text. Still not great, but this shouldnt' happen and
-			// if it does, I really want to understand what's goin gon.
+			// since this unmarshal'd, it should marshal, this is weird.
+			// body could have sensitive information, which we otherwise
+			// never store in plain text (when keys are configured). Still
+			// not great, but this shouldn't happen and, if it does, we
+			// really want to understand what's going on.
 			log.Error("login_log_create_payload").Err(err).String("body", string(body)).Log()
 			return nil, err
 		}
 		if m := project.LoginLogMaxPayloadLength; m > 0 && len(mb) > m {
 			return resMaxPayloadLength, nil
 		}
-		payload = mb
+		payloadKey, payload, err = authen.Keys.Encrypt(authen.KEY_LOGIN_LOG_PAYLOAD, mb)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	retainCount := 0
+	if project.LoginLogRetainOnInsert {
+		retainCount = project.LoginLogRetainCount
+	}
+
+	// with retention, old login logs make room for new ones (on insert or
+	// when cleaned), so the max would only ever stop a project from logging
+	max := project.LoginLogMax
+	if project.LoginLogRetainCount > 0 || project.LoginLogRetainDays > 0 {
+		max = 0
 	}
 
 	id := uuid.String()
-	result, err := storage.DB.LoginLogCreate(data.LoginLogCreate{
-		Id:        id,
-		Payload:   payload,
-		ProjectId: project.Id,
-		Status:    input.Int("status"),
-		UserId:    input.String("user_id"),
-		Max:       project.LoginLogMax,
+	ip := optionalString(input, "ip")
+	userAgent := optionalString(input, "user_agent")
+	result, err := storage.DB.LoginLogCreate(env.Context(), data.LoginLogCreate{
+		Id:          id,
+		Payload:     payload,
+		PayloadKey:  payloadKey,
+		ProjectId:   project.Id,
+		Status:      input.Int("status"),
+		UserId:      input.String("user_id"),
+		Max:         max,
+		Ip:          ip,
+		UserAgent:   userAgent,
+		Method:      optionalString(input, "method"),
+		Country:     optionalString(input, "country"),
+		IpPrefix:    ipPrefix(ip),
+		Device:      deviceFingerprint(userAgent),
+		RetainCount: retainCount,
+		Lockout:     project.LockoutRules,
+
+		SuccessStatuses: project.LoginLogSuccessStatuses,
 	})
 	if err != nil {
 		return nil, err
@@ -73,9 +109,34 @@ func Create(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 		return resMax, nil
 	}
 
+	userId := input.String("user_id")
+	events.Publish(project.Id, userId, events.TYPE_LOGIN_LOG, events.LoginLog{
+		Id:        id,
+		UserId:    userId,
+		Status:    input.Int("status"),
+		Ip:        ip,
+		UserAgent: userAgent,
+		Method:    optionalString(input, "method"),
+		Country:   optionalString(input, "country"),
+		NewIp:     result.NewIp,
+		NewDevice: result.NewDevice,
+		Created:   time.Now(),
+	})
+
+	// new_ip and new_device are only ever true when an ip / user_agent
+	// was given and the project has login log success statuses. locked is
+	// only ever true when the project has lockout rules
 	return http.Ok(struct {
-		Id string `json:"id"`
+		Id          string     `json:"id"`
+		NewIp       bool       `json:"new_ip"`
+		NewDevice   bool       `json:"new_device"`
+		Locked      bool       `json:"locked"`
+		LockedUntil *time.Time `json:"locked_until,omitempty"`
 	}{
-		Id: id,
+		Id:          id,
+		NewIp:       result.NewIp,
+		NewDevice:   result.NewDevice,
+		Locked:      result.LockedUntil != nil,
+		LockedUntil: result.LockedUntil,
 	}), nil
 }
@@ -3,11 +3,15 @@ package loginLogs
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/config"
+	"src.goblgobl.com/authen/storage/data"
 	"src.goblgobl.com/authen/tests"
 	"src.goblgobl.com/tests/assert"
 	"src.goblgobl.com/tests/request"
+	"src.goblgobl.com/utils/typed"
 )
 
 func Test_Create_InvalidBody(t *testing.T) {
@@ -32,6 +36,16 @@ func Test_Create_InvalidData(t *testing.T) {
 		}).
 		Post(Create).
 		ExpectValidation("user_id", 1003)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{
+			"ip":         "1.2.3",
+			"country":    "C1",
+			"method":     strings.Repeat("a", 51),
+			"user_agent": strings.Repeat("a", 501),
+		}).
+		Post(Create).
+		ExpectValidation("ip", 101_007, "country", 101_008, "method", 1003, "user_agent", 1003)
 }
 
 func Test_Create_Max(t *testing.T) {
@@ -48,6 +62,63 @@ func Test_Create_Max(t *testing.T) {
 		Post(Create).ExpectInvalid(102012)
 }
 
+func Test_Create_Max_WithRetention(t *testing.T) {
+	projectId := tests.UUID()
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1")
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1")
+
+	// the max is ignored once retention is configured
+	env := authen.BuildEnv().ProjectId(projectId).LoginLogMax(2).LoginLogRetainCount(5, false).Env()
+	request.ReqT(t, env).Body(map[string]any{"status": 1, "user_id": "u1"}).Post(Create).OK()
+
+	env = authen.BuildEnv().ProjectId(projectId).LoginLogMax(2).LoginLogRetainCount(2, true).Env()
+	request.ReqT(t, env).Body(map[string]any{"status": 1, "user_id": "u1"}).Post(Create).OK()
+	assert.Equal(t, tests.Row("select count(*) as n from authen_login_logs where project_id = $1", projectId).Int("n"), 2)
+}
+
+func Test_Create_RetainOnInsert(t *testing.T) {
+	projectId := tests.UUID()
+	now := time.Now()
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 1, "created", now.Add(-time.Hour))
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 2, "created", now.Add(-time.Minute))
+
+	// retention is only enforced on insert when asked
+	env := authen.BuildEnv().ProjectId(projectId).LoginLogRetainCount(2, false).Env()
+	request.ReqT(t, env).Body(map[string]any{"status": 3, "user_id": "u1"}).Post(Create).OK()
+	assert.Equal(t, tests.Row("select count(*) as n from authen_login_logs where project_id = $1", projectId).Int("n"), 3)
+
+	env = authen.BuildEnv().ProjectId(projectId).LoginLogRetainCount(2, true).Env()
+	request.ReqT(t, env).Body(map[string]any{"status": 4, "user_id": "u1"}).Post(Create).OK()
+	rows := tests.Rows("select status from authen_login_logs where project_id = $1 order by status", projectId)
+	assert.Equal(t, len(rows), 2)
+	assert.Equal(t, rows[0].Int("status"), 3)
+	assert.Equal(t, rows[1].Int("status"), 4)
+}
+
+func Test_Create_Lockout(t *testing.T) {
+	projectId := tests.UUID()
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 2, "created", time.Now().Add(-10*time.Second))
+
+	env := authen.BuildEnv().ProjectId(projectId).Lockout(data.LockoutRule{
+		Statuses: []int{2},
+		Failures: 2,
+		Window:   60,
+		Duration: 300,
+	}).Env()
+
+	res := request.ReqT(t, env).Body(map[string]any{"status": 1, "user_id": "u1"}).Post(Create).OK().Json
+	assert.False(t, res.Bool("locked"))
+	assert.Nil(t, res["locked_until"])
+
+	res = request.ReqT(t, env).Body(map[string]any{"status": 2, "user_id": "u1"}).Post(Create).OK().Json
+	assert.True(t, res.Bool("locked"))
+	assert.Timeish(t, res.Time("locked_until"), time.Now().Add(300*time.Second))
+
+	// other users aren't affected
+	res = request.ReqT(t, env).Body(map[string]any{"status": 2, "user_id": "u2"}).Post(Create).OK().Json
+	assert.False(t, res.Bool("locked"))
+}
+
 func Test_Create_Payload_Length(t *testing.T) {
 	env := authen.BuildEnv().LoginLogMaxPayloadLength(10).Env()
 
@@ -89,3 +160,105 @@ func Test_Create_NoPayload(t *testing.T) {
 	assert.Equal(t, row.String("user_id"), "user_id_1")
 	assert.Equal(t, row.String("project_id"), env.Project.Id)
 }
+
+func Test_Create_EncryptedPayload(t *testing.T) {
+	defer func(k authen.KeyRing) { authen.Keys = k }(authen.Keys)
+	authen.Keys = authen.NewKeyRing([]config.Key{{Id: 2, Value: [32]byte{9}}})
+
+	env := authen.BuildEnv().Env()
+	res := request.ReqT(t, env).
+		Body(map[string]any{
+			"status":  1,
+			"user_id": "user_id_1",
+			"payload": map[string]int{"over": 9000},
+		}).
+		Post(Create).OK().Json
+
+	row := tests.Row("select * from authen_login_logs where id = $1", res.String("id"))
+	assert.Equal(t, row.Int("payload_key"), 2)
+
+	payload, err := authen.Keys.Decrypt(authen.KEY_LOGIN_LOG_PAYLOAD, 2, row.Bytes("payload"))
+	assert.Nil(t, err)
+	assert.Bytes(t, payload, []byte(`{"over":9000}`))
+}
+
+func Test_Create_Fields(t *testing.T) {
+	res := request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{
+			"status":     1,
+			"user_id":    "user_id_1",
+			"ip":         "::ffff:1.2.3.4",
+			"user_agent": "curl/7.0",
+			"method":     "password",
+			"country":    "ca",
+		}).
+		Post(Create).OK().Json
+
+	row := tests.Row("select * from authen_login_logs where id = $1", res.String("id"))
+	assert.Equal(t, row.String("ip"), "1.2.3.4")
+	assert.Equal(t, row.String("user_agent"), "curl/7.0")
+	assert.Equal(t, row.String("method"), "password")
+	assert.Equal(t, row.String("country"), "CA")
+}
+
+func Test_Create_NewIpAndDevice(t *testing.T) {
+	env := authen.BuildEnv().LoginLogSuccessStatuses(1).Env()
+	create := func(userId string, ip string, userAgent string) typed.Typed {
+		t.Helper()
+		body := map[string]any{"status": 1, "user_id": userId}
+		if ip != "" {
+			body["ip"] = ip
+		}
+		if userAgent != "" {
+			body["user_agent"] = userAgent
+		}
+		return request.ReqT(t, env).Body(body).Post(Create).OK().Json
+	}
+
+	res := create("u1", "", "")
+	assert.False(t, res.Bool("new_ip"))
+	assert.False(t, res.Bool("new_device"))
+
+	res = create("u1", "1.2.3.4", "Mozilla/5.0 Chrome/118.0")
+	assert.True(t, res.Bool("new_ip"))
+	assert.True(t, res.Bool("new_device"))
+
+	// same /24, upgraded browser
+	res = create("u1", "1.2.3.99", "Mozilla/5.0 Chrome/119.0")
+	assert.False(t, res.Bool("new_ip"))
+	assert.False(t, res.Bool("new_device"))
+
+	res = create("u1", "1.2.4.4", "Mozilla/5.0 Firefox/119.0")
+	assert.True(t, res.Bool("new_ip"))
+	assert.True(t, res.Bool("new_device"))
+
+	// history is per user
+	res = create("u2", "1.2.3.4", "Mozilla/5.0 Chrome/118.0")
+	assert.True(t, res.Bool("new_ip"))
+	assert.True(t, res.Bool("new_device"))
+
+	res = create("u1", "2001:db8:1:2::1", "")
+	assert.True(t, res.Bool("new_ip"))
+	assert.False(t, res.Bool("new_device"))
+
+	res = create("u1", "2001:db8:1:ffff::2", "")
+	assert.False(t, res.Bool("new_ip"))
+}
+
+func Test_IpPrefix(t *testing.T) {
+	assert.Nil(t, ipPrefix(nil))
+	for ip, expected := range map[string]string{
+		"1.2.3.4":         "1.2.3.0/24",
+		"10.0.0.255":      "10.0.0.0/24",
+		"2001:db8:1:2::1": "2001:db8:1::/48",
+	} {
+		assert.Equal(t, *ipPrefix(&ip), expected)
+	}
+}
+
+func Test_DeviceFingerprint(t *testing.T) {
+	assert.Nil(t, deviceFingerprint(nil))
+	ua1, ua2, ua3 := "Mozilla/5.0 Chrome/118.0", "mozilla/5.0 chrome/119.1", "Mozilla/5.0 Firefox/118.0"
+	assert.Equal(t, *deviceFingerprint(&ua1), *deviceFingerprint(&ua2))
+	assert.NotEqual(t, *deviceFingerprint(&ua1), *deviceFingerprint(&ua3))
+}
@@ -0,0 +1,73 @@
+package loginLogs
+
+import (
+	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/codes"
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/http"
+	"src.goblgobl.com/utils/typed"
+	"src.goblgobl.com/utils/validation"
+)
+
+const MAX_DELETE_IDS = 100
+
+var (
+	deleteValidation = validation.Object().
+				Field("user_id", validation.String().Length(1, 100))
+
+	resInvalidIds  = http.StaticError(400, codes.VAL_LOGIN_LOG_IDS, "ids must be an array of 1 to 100 login log ids")
+	resDeleteEmpty = http.StaticError(400, codes.RES_LOGIN_LOG_DELETE_EMPTY, "user_id or ids is required")
+)
+
+// Deletes all of a user's login logs (user_id), specific login logs (ids)
+// or specific login logs of a user (both).
+func Delete(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+	input, err := typed.Json(conn.PostBody())
+	if err != nil {
+		return http.InvalidJSON, nil
+	}
+
+	validator := env.Validator
+	if !deleteValidation.Validate(input, validator) {
+		return http.Validation(validator), nil
+	}
+
+	var ids []string
+	if value, exists := input["ids"]; exists {
+		items, ok := value.([]any)
+		if !ok || len(items) == 0 || len(items) > MAX_DELETE_IDS {
+			return resInvalidIds, nil
+		}
+		ids = make([]string, len(items))
+		for i, item := range items {
+			id, ok := item.(string)
+			if !ok || !isUUID(id) {
+				return resInvalidIds, nil
+			}
+			ids[i] = id
+		}
+	}
+
+	userId := input.String("user_id")
+	if userId == "" && ids == nil {
+		return resDeleteEmpty, nil
+	}
+
+	deleted, err := storage.DB.LoginLogDelete(env.Context(), data.LoginLogDelete{
+		Ids:       ids,
+		UserId:    userId,
+		ProjectId: env.Project.Id,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return http.Ok(struct {
+		Deleted int `json:"deleted"`
+	}{
+		Deleted: deleted,
+	}), nil
+}
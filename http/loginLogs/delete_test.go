@@ -0,0 +1,80 @@
+package loginLogs
+
+import (
+	"strings"
+	"testing"
+
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/tests"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/tests/request"
+)
+
+func Test_Delete_InvalidBody(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body("nope").
+		Post(Delete).
+		ExpectInvalid(2003)
+}
+
+func Test_Delete_InvalidData(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"user_id": strings.Repeat("a", 101)}).
+		Post(Delete).
+		ExpectValidation("user_id", 1003)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{}).
+		Post(Delete).
+		ExpectInvalid(102_019)
+
+	for _, ids := range []any{"nope", []string{}, []any{1}, []string{"not-a-uuid"}, make([]string, 101)} {
+		request.ReqT(t, authen.BuildEnv().Env()).
+			Body(map[string]any{"ids": ids}).
+			Post(Delete).
+			ExpectInvalid(101_011)
+	}
+}
+
+func Test_Delete_UserId(t *testing.T) {
+	projectId := tests.UUID()
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1")
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1")
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u2")
+	tests.Factory.LoginLog.Insert("user_id", "u1")
+
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+	res := request.ReqT(t, env).
+		Body(map[string]any{"user_id": "u1"}).
+		Post(Delete).OK().Json
+	assert.Equal(t, res.Int("deleted"), 2)
+
+	rows := tests.Rows("select user_id from authen_login_logs where project_id = $1", projectId)
+	assert.Equal(t, len(rows), 1)
+	assert.Equal(t, rows[0].String("user_id"), "u2")
+}
+
+func Test_Delete_Ids(t *testing.T) {
+	projectId := tests.UUID()
+	id1, id2, id3 := tests.UUID(), tests.UUID(), tests.UUID()
+	tests.Factory.LoginLog.Insert("id", id1, "project_id", projectId, "user_id", "u1")
+	tests.Factory.LoginLog.Insert("id", id2, "project_id", projectId, "user_id", "u2")
+	tests.Factory.LoginLog.Insert("id", id3, "user_id", "u1")
+
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+
+	// both given, id2 isn't u1's
+	res := request.ReqT(t, env).
+		Body(map[string]any{"user_id": "u1", "ids": []string{id2}}).
+		Post(Delete).OK().Json
+	assert.Equal(t, res.Int("deleted"), 0)
+
+	// id3 belongs to another project
+	res = request.ReqT(t, env).
+		Body(map[string]any{"ids": []string{id1, id2, id3}}).
+		Post(Delete).OK().Json
+	assert.Equal(t, res.Int("deleted"), 2)
+
+	rows := tests.Rows("select id from authen_login_logs where id in ($1, $2, $3)", id1, id2, id3)
+	assert.Equal(t, len(rows), 1)
+}
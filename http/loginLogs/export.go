@@ -0,0 +1,166 @@
+package loginLogs
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/codes"
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/http"
+	"src.goblgobl.com/utils/log"
+	"src.goblgobl.com/utils/typed"
+	"src.goblgobl.com/utils/validation"
+)
+
+var (
+	exportValidation = validation.Object().
+				Field("user_id", validation.String().Length(1, 100)).
+				Field("since", validation.Int().Min(0)).
+				Field("until", validation.Int().Min(0)).
+				Field("format", validation.String().Convert(parseFormat))
+
+	csvHeader = []string{"id", "user_id", "status", "created", "ip", "user_agent", "method", "country", "payload"}
+)
+
+func parseFormat(field validation.Field, value string, _object typed.Typed, _input typed.Typed, res *validation.Result) any {
+	if value == "ndjson" || value == "csv" {
+		return value
+	}
+	res.AddInvalidField(field, validation.Invalid{
+		Code:  codes.VAL_LOGIN_LOG_FORMAT,
+		Error: "format must be 'ndjson' or 'csv'",
+	})
+	return nil
+}
+
+func Export(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+	validator := env.Validator
+	input, ok := exportValidation.ValidateArgs(conn.QueryArgs(), validator)
+	if !ok {
+		return http.Validation(validator), nil
+	}
+
+	opts := data.LoginLogExport{
+		ProjectId: env.Project.Id,
+		UserId:    input.String("user_id"),
+	}
+	if timeout := authen.Config.HTTP.StorageTimeout; timeout != nil {
+		opts.BatchTimeout = time.Duration(*timeout) * time.Millisecond
+	}
+	if n, ok := input.IntIf("since"); ok {
+		since := time.Unix(int64(n), 0)
+		opts.Since = &since
+	}
+	if n, ok := input.IntIf("until"); ok {
+		until := time.Unix(int64(n), 0)
+		opts.Until = &until
+	}
+
+	format, _ := input["format"].(string)
+	return exportResponse{opts: opts, csv: format == "csv"}, nil
+}
+
+// Rows are written as they're read from storage. By the time we're
+// writing the body the status has been sent, so an error part way
+// through can only be logged and the body cut short.
+type exportResponse struct {
+	csv  bool
+	opts data.LoginLogExport
+}
+
+func (r exportResponse) Write(conn *fasthttp.RequestCtx, logger log.Logger) log.Logger {
+	conn.SetStatusCode(200)
+	if r.csv {
+		conn.SetContentType("text/csv")
+	} else {
+		conn.SetContentType("application/x-ndjson")
+	}
+
+	opts := r.opts
+	asCSV := r.csv
+	conn.SetBodyStreamWriter(func(w *bufio.Writer) {
+		var err error
+		if asCSV {
+			err = exportCSV(w, opts)
+		} else {
+			err = exportNDJSON(w, opts)
+		}
+		if err != nil {
+			log.Error("login_logs_export").String("pid", opts.ProjectId).Err(err).Log()
+		}
+		w.Flush()
+	})
+
+	return logger.Int("status", 200)
+}
+
+// The export is streamed after the handler has returned (and released
+// its env), and can legitimately take much longer than any request, so
+// only each batch read from storage is bound by http.storage_timeout. A
+// client which goes away stops it with a failed write.
+func export(opts data.LoginLogExport, fn func(data.LoginLogRecord) error) error {
+	return storage.DB.LoginLogExport(context.Background(), opts, func(record data.LoginLogRecord) error {
+		if err := decodePayload(&record); err != nil {
+			return err
+		}
+		return fn(record)
+	})
+}
+
+func exportNDJSON(w *bufio.Writer, opts data.LoginLogExport) error {
+	encoder := json.NewEncoder(w)
+	return export(opts, func(record data.LoginLogRecord) error {
+		// Encode adds the trailing newline
+		return encoder.Encode(record)
+	})
+}
+
+func exportCSV(w *bufio.Writer, opts data.LoginLogExport) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+
+	row := make([]string, len(csvHeader))
+	err := export(opts, func(record data.LoginLogRecord) error {
+		payload := ""
+		if record.Payload != nil {
+			b, err := json.Marshal(record.Payload)
+			if err != nil {
+				return err
+			}
+			payload = string(b)
+		}
+
+		row[0] = record.Id
+		row[1] = record.UserId
+		row[2] = strconv.Itoa(record.Status)
+		row[3] = record.Created.UTC().Format(time.RFC3339Nano)
+		row[4] = stringOrEmpty(record.Ip)
+		row[5] = stringOrEmpty(record.UserAgent)
+		row[6] = stringOrEmpty(record.Method)
+		row[7] = stringOrEmpty(record.Country)
+		row[8] = payload
+		return writer.Write(row)
+	})
+
+	writer.Flush()
+	if err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,76 @@
+package loginLogs
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/tests"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/tests/request"
+)
+
+func Test_Export_InvalidData(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		QueryMap(map[string]string{
+			"since":  "-1",
+			"format": "xml",
+		}).
+		Get(Export).
+		ExpectValidation("since", 1006, "format", 101_010)
+}
+
+func Test_Export_NDJSON(t *testing.T) {
+	now := time.Now()
+	projectId := tests.UUID()
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 1, "created", now.Add(-time.Minute), "payload", map[string]int{"over": 9000}, "ip", "1.2.3.4")
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u2", "status", 2, "created", now)
+	tests.Factory.LoginLog.Insert("user_id", "u1", "status", 3)
+
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+	body := request.ReqT(t, env).Get(Export).OK().Body
+
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	assert.Equal(t, len(lines), 2)
+
+	var record map[string]any
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, record["user_id"].(string), "u1")
+	assert.Equal(t, record["status"].(float64), 1)
+	assert.Equal(t, record["ip"].(string), "1.2.3.4")
+	assert.Equal(t, record["payload"].(map[string]any)["over"].(float64), 9000)
+
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, record["user_id"].(string), "u2")
+	assert.Equal(t, record["status"].(float64), 2)
+
+	// filtered by user
+	body = request.ReqT(t, env).
+		QueryMap(map[string]string{"user_id": "u2"}).
+		Get(Export).OK().Body
+	assert.Equal(t, strings.Count(body, "\n"), 1)
+}
+
+func Test_Export_CSV(t *testing.T) {
+	created := time.Date(2022, 3, 10, 1, 2, 3, 0, time.UTC)
+	projectId := tests.UUID()
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 1, "created", created, "payload", map[string]int{"over": 9000}, "country", "CA")
+
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+	body := request.ReqT(t, env).
+		QueryMap(map[string]string{"format": "csv"}).
+		Get(Export).OK().Body
+
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	assert.Equal(t, len(lines), 2)
+	assert.Equal(t, lines[0], "id,user_id,status,created,ip,user_agent,method,country,payload")
+	assert.True(t, strings.HasSuffix(lines[1], `,u1,1,2022-03-10T01:02:03Z,,,,CA,"{""over"":9000}"`))
+
+	// header only
+	body = request.ReqT(t, authen.BuildEnv().Env()).
+		QueryMap(map[string]string{"format": "csv"}).
+		Get(Export).OK().Body
+	assert.Equal(t, body, "id,user_id,status,created,ip,user_agent,method,country,payload\n")
+}
@@ -1,6 +1,8 @@
 package loginLogs
 
 import (
+	"time"
+
 	"github.com/valyala/fasthttp"
 	"src.goblgobl.com/authen"
 	"src.goblgobl.com/utils"
@@ -15,6 +17,14 @@ import (
 var (
 	listValidation = validation.Object().
 		Field("user_id", userIdValidation).
+		Field("status", statusesValidation).
+		Field("since", validation.Int().Min(0)).
+		Field("until", validation.Int().Min(0)).
+		Field("cursor", cursorValidation).
+		Field("ip", ipValidation).
+		Field("user_agent", userAgentValidation).
+		Field("method", methodValidation).
+		Field("country", countryValidation).
 		Field("page", validation.Int().Min(1).Default(1)).
 		Field("perpage", validation.Int().Min(1).Max(100).Default(10))
 )
@@ -28,19 +38,58 @@ func List(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 
 	limit, offset := utils.Paging(input.Int("perpage"), input.Int("page"), 10)
 
-	res, err := storage.DB.LoginLogGet(data.LoginLogGet{
+	opts := data.LoginLogGet{
 		Limit:     limit,
 		Offset:    offset,
 		ProjectId: env.Project.Id,
 		UserId:    input.String("user_id"),
-	})
+		Ip:        input.String("ip"),
+		UserAgent: input.String("user_agent"),
+		Method:    input.String("method"),
+		Country:   input.String("country"),
+	}
+
+	if statuses, ok := input["status"].([]int); ok {
+		opts.Statuses = statuses
+	}
+	if n, ok := input.IntIf("since"); ok {
+		since := time.Unix(int64(n), 0)
+		opts.Since = &since
+	}
+	if n, ok := input.IntIf("until"); ok {
+		until := time.Unix(int64(n), 0)
+		opts.Until = &until
+	}
+	// page is still supported, but the cursor (returned as "next") is
+	// stable when new logs are added between pages.
+	if cursor, ok := input["cursor"].(*data.LoginLogCursor); ok {
+		opts.Cursor = cursor
+	}
+
+	res, err := storage.DB.LoginLogGet(env.Context(), opts)
 	if err != nil {
 		return nil, err
 	}
 
+	records := res.Records
+	for i := range records {
+		if err := decodePayload(&records[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	// a full page means there might be more
+	var next *string
+	if l := len(records); l > 0 && l == limit {
+		cursor := encodeCursor(records[l-1])
+		next = &cursor
+	}
+
 	return http.Ok(struct {
 		Results []data.LoginLogRecord `json:"results"`
+		Next    *string               `json:"next"`
 	}{
-		Results: res.Records,
+		Results: records,
+		Next:    next,
 	}), nil
 }
@@ -7,9 +7,11 @@ import (
 	"time"
 
 	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/config"
 	"src.goblgobl.com/authen/tests"
 	"src.goblgobl.com/tests/assert"
 	"src.goblgobl.com/tests/request"
+	"src.goblgobl.com/utils/typed"
 )
 
 func Test_List_InvalidData(t *testing.T) {
@@ -29,6 +31,19 @@ func Test_List_InvalidData(t *testing.T) {
 		}).
 		Get(List).
 		ExpectValidation("user_id", 1003, "page", 1006, "perpage", 1006)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		QueryMap(map[string]string{
+			"user_id": "u1",
+			"status":  "1,nope",
+			"since":   "-1",
+			"until":   "x",
+			"cursor":  "!nope",
+			"ip":      "nope",
+			"country": "USA",
+		}).
+		Get(List).
+		ExpectValidation("status", 101_005, "since", 1006, "until", 1005, "cursor", 101_006, "ip", 101_007, "country", 1003)
 }
 
 func Test_List_EmptyResult(t *testing.T) {
@@ -94,3 +109,139 @@ func Test_List_Result(t *testing.T) {
 	assertPage(1, 3, 1, 2, 3)
 	assertPage(2, 3, 4)
 }
+
+func Test_List_EncryptedPayload(t *testing.T) {
+	defer func(k authen.KeyRing) { authen.Keys = k }(authen.Keys)
+	authen.Keys = authen.NewKeyRing([]config.Key{{Id: 2, Value: [32]byte{9}}})
+
+	now := time.Now()
+	env := authen.BuildEnv().Env()
+	request.ReqT(t, env).
+		Body(map[string]any{
+			"status":  1,
+			"user_id": "u1",
+			"payload": map[string]int{"over": 9000},
+		}).
+		Post(Create).OK()
+
+	// existing plain text payloads are still readable
+	tests.Factory.LoginLog.Insert("project_id", env.Project.Id, "user_id", "u1", "status", 2, "created", now.Add(-time.Minute), "payload", "plain")
+
+	json := request.ReqT(t, env).
+		QueryMap(map[string]string{"user_id": "u1"}).
+		Get(List).OK().Json
+
+	rows := json.Objects("results")
+	assert.Equal(t, len(rows), 2)
+	assert.Equal(t, rows[0].Object("payload").Int("over"), 9000)
+	assert.Equal(t, rows[1].String("payload"), "plain")
+}
+
+func Test_List_Filters(t *testing.T) {
+	now := time.Now()
+	projectId := tests.UUID()
+
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 1, "created", now.Add(-time.Minute))
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 2, "created", now.Add(-time.Hour))
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 3, "created", now.Add(-2*time.Hour))
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 2, "created", now.Add(-48*time.Hour))
+
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+	assertStatuses := func(query map[string]string, statuses ...int) {
+		t.Helper()
+		query["user_id"] = "u1"
+		rows := request.ReqT(t, env).
+			QueryMap(query).
+			Get(List).OK().Json.Objects("results")
+
+		assert.Equal(t, len(rows), len(statuses))
+		for i, status := range statuses {
+			assert.Equal(t, rows[i].Int("status"), status)
+		}
+	}
+
+	dayAgo := strconv.FormatInt(now.Add(-24*time.Hour).Unix(), 10)
+	halfHourAgo := strconv.FormatInt(now.Add(-30*time.Minute).Unix(), 10)
+
+	assertStatuses(map[string]string{"status": "2"}, 2, 2)
+	assertStatuses(map[string]string{"status": "1, 3"}, 1, 3)
+	assertStatuses(map[string]string{"since": dayAgo}, 1, 2, 3)
+	assertStatuses(map[string]string{"until": halfHourAgo}, 2, 3, 2)
+	assertStatuses(map[string]string{"status": "2,3", "since": dayAgo, "until": halfHourAgo}, 2, 3)
+}
+
+func Test_List_Fields(t *testing.T) {
+	projectId := tests.UUID()
+	now := time.Now()
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 1, "created", now, "ip", "1.2.3.4", "user_agent", "ua1", "method", "password", "country", "CA")
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 2, "created", now.Add(-time.Minute), "ip", "1.2.3.4", "method", "totp")
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 3, "created", now.Add(-2*time.Minute))
+
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+	rows := request.ReqT(t, env).
+		QueryMap(map[string]string{"user_id": "u1"}).
+		Get(List).OK().Json.Objects("results")
+
+	assert.Equal(t, len(rows), 3)
+	assert.Equal(t, rows[0].String("ip"), "1.2.3.4")
+	assert.Equal(t, rows[0].String("user_agent"), "ua1")
+	assert.Equal(t, rows[0].String("method"), "password")
+	assert.Equal(t, rows[0].String("country"), "CA")
+	assert.Equal(t, rows[2].String("ip"), "")
+	assert.Equal(t, rows[2].String("country"), "")
+
+	assertStatuses := func(query map[string]string, statuses ...int) {
+		t.Helper()
+		query["user_id"] = "u1"
+		rows := request.ReqT(t, env).
+			QueryMap(query).
+			Get(List).OK().Json.Objects("results")
+
+		assert.Equal(t, len(rows), len(statuses))
+		for i, status := range statuses {
+			assert.Equal(t, rows[i].Int("status"), status)
+		}
+	}
+
+	assertStatuses(map[string]string{"ip": "::ffff:1.2.3.4"}, 1, 2)
+	assertStatuses(map[string]string{"method": "totp"}, 2)
+	assertStatuses(map[string]string{"country": "ca"}, 1)
+	assertStatuses(map[string]string{"ip": "1.2.3.4", "user_agent": "ua1"}, 1)
+}
+
+func Test_List_Cursor(t *testing.T) {
+	now := time.Now()
+	projectId := tests.UUID()
+	for i := 1; i <= 5; i++ {
+		tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", i, "created", now.Add(time.Duration(-i)*time.Minute))
+	}
+
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+	page := func(cursor string) ([]typed.Typed, string) {
+		t.Helper()
+		query := map[string]string{"user_id": "u1", "perpage": "2"}
+		if cursor != "" {
+			query["cursor"] = cursor
+		}
+		json := request.ReqT(t, env).QueryMap(query).Get(List).OK().Json
+		return json.Objects("results"), json.String("next")
+	}
+
+	rows, next := page("")
+	assert.Equal(t, len(rows), 2)
+	assert.Equal(t, rows[0].Int("status"), 1)
+	assert.Equal(t, rows[1].Int("status"), 2)
+
+	// a newer log shouldn't shift the next page
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 9, "created", now)
+
+	rows, next = page(next)
+	assert.Equal(t, len(rows), 2)
+	assert.Equal(t, rows[0].Int("status"), 3)
+	assert.Equal(t, rows[1].Int("status"), 4)
+
+	rows, next = page(next)
+	assert.Equal(t, len(rows), 1)
+	assert.Equal(t, rows[0].Int("status"), 5)
+	assert.Equal(t, next, "")
+}
@@ -1,8 +1,196 @@
 package loginLogs
 
-import "src.goblgobl.com/utils/validation"
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/codes"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/log"
+	"src.goblgobl.com/utils/typed"
+	"src.goblgobl.com/utils/validation"
+)
 
 var (
 	userIdValidation = validation.String().Required().Length(1, 100)
 	statusValidation = validation.Int()
+
+	// a comma separated list of statuses, e.g. status=2,3
+	statusesValidation = validation.String().Length(1, 200).Convert(parseStatuses)
+
+	cursorValidation = validation.String().Length(1, 200).Convert(decodeCursor)
+
+	ipValidation        = validation.String().Length(1, 45).Convert(normalizeIp)
+	userAgentValidation = validation.String().Length(1, 500)
+	methodValidation    = validation.String().Length(1, 50)
+	countryValidation   = validation.String().Length(2, 2).Convert(normalizeCountry)
 )
+
+func parseStatuses(field validation.Field, value string, _object typed.Typed, _input typed.Typed, res *validation.Result) any {
+	parts := strings.Split(value, ",")
+	statuses := make([]int, len(parts))
+	for i, part := range parts {
+		status, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			res.AddInvalidField(field, validation.Invalid{
+				Code:  codes.VAL_LOGIN_LOG_STATUS,
+				Error: "status must be a comma separated list of integers",
+			})
+			return nil
+		}
+		statuses[i] = status
+	}
+	return statuses
+}
+
+// Turns the stored (possibly encrypted) payload into record.Payload.
+// A payload that can't be decrypted is an error, one that isn't valid
+// json is logged and skipped.
+func decodePayload(record *data.LoginLogRecord) error {
+	raw := record.RawPayload
+	if raw == nil {
+		return nil
+	}
+
+	raw, err := authen.Keys.Decrypt(authen.KEY_LOGIN_LOG_PAYLOAD, record.PayloadKey, raw)
+	if err != nil {
+		return err
+	}
+
+	var payload any
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		log.Error("login_record_payload").String("id", record.Id).Err(err).Log()
+		return nil
+	}
+	record.Payload = payload
+	return nil
+}
+
+// Cursors are opaque to the client, but are just the created (in
+// microseconds) and id of the last record of the previous page.
+func encodeCursor(record data.LoginLogRecord) string {
+	value := strconv.FormatInt(record.Created.UnixMicro(), 10) + "." + record.Id
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func decodeCursor(field validation.Field, value string, _object typed.Typed, _input typed.Typed, res *validation.Result) any {
+	if decoded, err := base64.RawURLEncoding.DecodeString(value); err == nil {
+		if micro, id, ok := strings.Cut(string(decoded), "."); ok && id != "" {
+			if n, err := strconv.ParseInt(micro, 10, 64); err == nil {
+				return &data.LoginLogCursor{Id: id, Created: time.UnixMicro(n)}
+			}
+		}
+	}
+
+	res.AddInvalidField(field, validation.Invalid{
+		Code:  codes.VAL_LOGIN_LOG_CURSOR,
+		Error: "cursor is not valid",
+	})
+	return nil
+}
+
+// So that the same address is always stored (and filtered) the same way
+// (e.g. "::FFFF:1.2.3.4" is "1.2.3.4").
+func normalizeIp(field validation.Field, value string, _object typed.Typed, _input typed.Typed, res *validation.Result) any {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		res.AddInvalidField(field, validation.Invalid{
+			Code:  codes.VAL_IP,
+			Error: "must be a valid IPv4 or IPv6 address",
+		})
+		return value
+	}
+	return ip.String()
+}
+
+// ISO 3166-1 alpha-2
+func normalizeCountry(field validation.Field, value string, _object typed.Typed, _input typed.Typed, res *validation.Result) any {
+	country := strings.ToUpper(value)
+	for _, c := range country {
+		if c < 'A' || c > 'Z' {
+			res.AddInvalidField(field, validation.Invalid{
+				Code:  codes.VAL_COUNTRY,
+				Error: "must be a 2 letter country code",
+			})
+			return value
+		}
+	}
+	return country
+}
+
+// Optional string fields are stored as null when they aren't given
+func optionalString(input typed.Typed, field string) *string {
+	if value, ok := input.StringIf(field); ok {
+		return &value
+	}
+	return nil
+}
+
+// Logins from the same network are considered to be from the same
+// place: the /24 for IPv4 and the /48 for IPv6. ip is expected to have
+// been normalized.
+func ipPrefix(ip *string) *string {
+	if ip == nil {
+		return nil
+	}
+	parsed := net.ParseIP(*ip)
+	if parsed == nil {
+		return nil
+	}
+
+	var prefix string
+	if v4 := parsed.To4(); v4 != nil {
+		prefix = v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	} else {
+		prefix = parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	}
+	return &prefix
+}
+
+// A fingerprint of the user agent which ignores version numbers, so that
+// a browser upgrade isn't considered a new device.
+func deviceFingerprint(userAgent *string) *string {
+	if userAgent == nil {
+		return nil
+	}
+
+	normalized := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(*userAgent))
+
+	hash := sha256.Sum256([]byte(normalized))
+	device := hex.EncodeToString(hash[:16])
+	return &device
+}
+
+// Login log ids are generated by us (uuid.String()), but ids given to
+// us are checked since the pg column is a uuid and anything else would
+// be a db error rather than a validation error.
+func isUUID(value string) bool {
+	if len(value) != 36 {
+		return false
+	}
+	for i, c := range value {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') && !(c >= 'A' && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package loginLogs
+
+import (
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/codes"
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/http"
+	"src.goblgobl.com/utils/typed"
+	"src.goblgobl.com/utils/validation"
+)
+
+const (
+	// limits the number of buckets a single request can generate
+	MAX_STATS_DAYS  = 366
+	MAX_STATS_HOURS = 31 * 24
+)
+
+var (
+	statsValidation = validation.Object().
+			Field("since", validation.Int().Required().Min(0)).
+			Field("until", validation.Int().Min(0)).
+			Field("group", validation.String().Convert(parseGroup)).
+			Field("status", statusesValidation).
+			Field("failed", statusesValidation).
+			Field("top", validation.Int().Min(0).Max(100).Default(10))
+
+	resStatsRange = http.StaticError(400, codes.RES_LOGIN_LOG_STATS_RANGE, "until must be after since, and the range can be at most 366 days (31 days when grouped by hour)")
+)
+
+// Returns true when grouping by hour
+func parseGroup(field validation.Field, value string, _object typed.Typed, _input typed.Typed, res *validation.Result) any {
+	switch value {
+	case "day":
+		return false
+	case "hour":
+		return true
+	}
+	res.AddInvalidField(field, validation.Invalid{
+		Code:  codes.VAL_LOGIN_LOG_GROUP,
+		Error: "group must be 'day' or 'hour'",
+	})
+	return nil
+}
+
+func Stats(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+	validator := env.Validator
+	input, ok := statsValidation.ValidateArgs(conn.QueryArgs(), validator)
+	if !ok {
+		return http.Validation(validator), nil
+	}
+
+	until := time.Now()
+	if n, ok := input.IntIf("until"); ok {
+		until = time.Unix(int64(n), 0)
+	}
+	since := time.Unix(int64(input.Int("since")), 0)
+
+	hourly, _ := input["group"].(bool)
+	max := MAX_STATS_DAYS * 24 * time.Hour
+	if hourly {
+		max = MAX_STATS_HOURS * time.Hour
+	}
+	if r := until.Sub(since); r <= 0 || r > max {
+		return resStatsRange, nil
+	}
+
+	opts := data.LoginLogStats{
+		ProjectId: env.Project.Id,
+		Since:     since,
+		Until:     until,
+		Hourly:    hourly,
+		Top:       input.Int("top"),
+	}
+	if statuses, ok := input["status"].([]int); ok {
+		opts.Statuses = statuses
+	}
+	if failed, ok := input["failed"].([]int); ok {
+		opts.FailedStatuses = failed
+	}
+
+	res, err := storage.DB.LoginLogStats(env.Context(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	topFailing := res.TopFailing
+	if topFailing == nil {
+		topFailing = []data.LoginLogStatsUser{}
+	}
+
+	return http.Ok(struct {
+		Buckets       []data.LoginLogStatsBucket `json:"buckets"`
+		DistinctUsers int                        `json:"distinct_users"`
+		TopFailing    []data.LoginLogStatsUser   `json:"top_failing_users"`
+	}{
+		Buckets:       res.Buckets,
+		DistinctUsers: res.DistinctUsers,
+		TopFailing:    topFailing,
+	}), nil
+}
@@ -0,0 +1,97 @@
+package loginLogs
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/tests"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/tests/request"
+)
+
+func Test_Stats_InvalidData(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		QueryMap(map[string]string{
+			"group":  "week",
+			"failed": "a",
+			"top":    "101",
+		}).
+		Get(Stats).
+		ExpectValidation("since", 1001, "group", 101_009, "failed", 101_005, "top", 1006)
+}
+
+func Test_Stats_InvalidRange(t *testing.T) {
+	now := time.Now()
+	assertRange := func(since time.Time, until time.Time, group string) {
+		t.Helper()
+		request.ReqT(t, authen.BuildEnv().Env()).
+			QueryMap(map[string]string{
+				"since": strconv.FormatInt(since.Unix(), 10),
+				"until": strconv.FormatInt(until.Unix(), 10),
+				"group": group,
+			}).
+			Get(Stats).
+			ExpectInvalid(102_018)
+	}
+
+	assertRange(now, now.Add(-time.Hour), "day")
+	assertRange(now.Add(-367*24*time.Hour), now, "day")
+	assertRange(now.Add(-32*24*time.Hour), now, "hour")
+}
+
+func Test_Stats(t *testing.T) {
+	projectId := tests.UUID()
+	day := time.Date(2022, 3, 10, 0, 0, 0, 0, time.UTC)
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 1, "created", day.Add(time.Hour))
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u1", "status", 2, "created", day.Add(2*time.Hour))
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u2", "status", 2, "created", day.Add(25*time.Hour))
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u2", "status", 2, "created", day.Add(26*time.Hour))
+	tests.Factory.LoginLog.Insert("project_id", projectId, "user_id", "u3", "status", 1, "created", day.Add(72*time.Hour))
+
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+	res := request.ReqT(t, env).
+		QueryMap(map[string]string{
+			"since":  strconv.FormatInt(day.Unix(), 10),
+			"until":  strconv.FormatInt(day.Add(48*time.Hour).Unix(), 10),
+			"failed": "2",
+		}).
+		Get(Stats).OK().Json
+
+	assert.Equal(t, res.Int("distinct_users"), 2)
+
+	buckets := res.Objects("buckets")
+	assert.Equal(t, len(buckets), 3)
+	assert.Timeish(t, buckets[0].Time("time"), day)
+	assert.Equal(t, buckets[0].Int("status"), 1)
+	assert.Equal(t, buckets[0].Int("count"), 1)
+	assert.Timeish(t, buckets[1].Time("time"), day)
+	assert.Equal(t, buckets[1].Int("status"), 2)
+	assert.Equal(t, buckets[1].Int("count"), 1)
+	assert.Timeish(t, buckets[2].Time("time"), day.Add(24*time.Hour))
+	assert.Equal(t, buckets[2].Int("status"), 2)
+	assert.Equal(t, buckets[2].Int("count"), 2)
+
+	failing := res.Objects("top_failing_users")
+	assert.Equal(t, len(failing), 2)
+	assert.Equal(t, failing[0].String("user_id"), "u2")
+	assert.Equal(t, failing[0].Int("count"), 2)
+	assert.Equal(t, failing[1].String("user_id"), "u1")
+	assert.Equal(t, failing[1].Int("count"), 1)
+
+	// hourly, without failed statuses
+	res = request.ReqT(t, env).
+		QueryMap(map[string]string{
+			"since": strconv.FormatInt(day.Unix(), 10),
+			"until": strconv.FormatInt(day.Add(24*time.Hour).Unix(), 10),
+			"group": "hour",
+		}).
+		Get(Stats).OK().Json
+
+	buckets = res.Objects("buckets")
+	assert.Equal(t, len(buckets), 2)
+	assert.Timeish(t, buckets[0].Time("time"), day.Add(time.Hour))
+	assert.Timeish(t, buckets[1].Time("time"), day.Add(2*time.Hour))
+	assert.Equal(t, len(res.Objects("top_failing_users")), 0)
+}
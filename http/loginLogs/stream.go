@@ -0,0 +1,95 @@
+package loginLogs
+
+import (
+	"bufio"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/events"
+	"src.goblgobl.com/utils/http"
+	"src.goblgobl.com/utils/log"
+	"src.goblgobl.com/utils/validation"
+)
+
+// Also how we notice that the client has gone away
+const STREAM_HEARTBEAT = 15 * time.Second
+
+var (
+	streamValidation = validation.Object().
+		Field("user_id", validation.String().Length(1, 100))
+)
+
+// A Server-Sent Events stream of the project's login events (login logs
+// being created and TOTPs being verified), optionally for a single user.
+// Only events which happen while connected are sent.
+func Stream(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+	validator := env.Validator
+	input, ok := streamValidation.ValidateArgs(conn.QueryArgs(), validator)
+	if !ok {
+		return http.Validation(validator), nil
+	}
+
+	return streamResponse{
+		projectId: env.Project.Id,
+		userId:    input.String("user_id"),
+	}, nil
+}
+
+type streamResponse struct {
+	userId    string
+	projectId string
+}
+
+func (r streamResponse) Write(conn *fasthttp.RequestCtx, logger log.Logger) log.Logger {
+	conn.SetStatusCode(200)
+	conn.SetContentType("text/event-stream")
+	conn.Response.Header.Set("Cache-Control", "no-cache")
+
+	userId := r.userId
+	projectId := r.projectId
+	conn.SetBodyStreamWriter(func(w *bufio.Writer) {
+		subscription := events.Subscribe(projectId)
+		defer subscription.Close()
+		writeEvents(w, subscription, userId, STREAM_HEARTBEAT)
+	})
+
+	return logger.Int("status", 200)
+}
+
+// Returns when the subscription is closed or when writing fails (which
+// is generally the client disconnecting).
+func writeEvents(w *bufio.Writer, subscription *events.Subscription, userId string, heartbeat time.Duration) {
+	// lets the client know the stream is established
+	w.WriteString(": connected\n\n")
+	if w.Flush() != nil {
+		return
+	}
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-subscription.C:
+			if !ok {
+				return
+			}
+			if userId != "" && e.UserId != userId {
+				continue
+			}
+			w.WriteString("event: ")
+			w.WriteString(e.Type)
+			w.WriteString("\ndata: ")
+			// json.Marshal never emits a newline, so this is a single data line
+			w.Write(e.Data)
+			w.WriteString("\n\n")
+		case <-ticker.C:
+			w.WriteString(": ping\n\n")
+		}
+
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package loginLogs
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/events"
+	"src.goblgobl.com/authen/tests"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/tests/request"
+)
+
+func Test_Stream_InvalidData(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		QueryMap(map[string]string{"user_id": strings.Repeat("a", 101)}).
+		Get(Stream).
+		ExpectValidation("user_id", 1003)
+}
+
+func Test_WriteEvents(t *testing.T) {
+	projectId := tests.UUID()
+	subscription := events.Default.Subscribe(projectId)
+
+	events.Publish(projectId, "u1", "t1", map[string]int{"a": 1})
+	events.Publish(projectId, "u2", "t2", map[string]int{"b": 2})
+	events.Publish(projectId, "u1", "t3", map[string]int{"c": 3})
+	subscription.Close()
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeEvents(w, subscription, "u1", time.Minute)
+	assert.Equal(t, buf.String(), ": connected\n\nevent: t1\ndata: {\"a\":1}\n\nevent: t3\ndata: {\"c\":3}\n\n")
+}
+
+func Test_WriteEvents_Heartbeat(t *testing.T) {
+	subscription := events.Default.Subscribe(tests.UUID())
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		subscription.Close()
+	}()
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeEvents(w, subscription, "", 10*time.Millisecond)
+	assert.StringContains(t, buf.String(), ": ping\n\n")
+}
+
+func Test_Create_PublishesEvent(t *testing.T) {
+	env := authen.BuildEnv().LoginLogSuccessStatuses(4).Env()
+	subscription := events.Default.Subscribe(env.Project.Id)
+	defer subscription.Close()
+
+	request.ReqT(t, env).
+		Body(map[string]any{"status": 4, "user_id": "u1", "ip": "1.2.3.4"}).
+		Post(Create).OK()
+
+	e := <-subscription.C
+	assert.Equal(t, e.Type, events.TYPE_LOGIN_LOG)
+	assert.Equal(t, e.UserId, "u1")
+	assert.StringContains(t, string(e.Data), `"status":4`)
+	assert.StringContains(t, string(e.Data), `"ip":"1.2.3.4"`)
+	assert.StringContains(t, string(e.Data), `"new_ip":true`)
+}
@@ -6,6 +6,7 @@ import (
 	"runtime"
 
 	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/authen"
 	"src.goblgobl.com/authen/storage"
 	"src.goblgobl.com/utils/http"
 )
@@ -15,18 +16,23 @@ import (
 var commit string
 
 func Info(conn *fasthttp.RequestCtx) (http.Response, error) {
-	storageInfo, err := storage.DB.Info()
+	ctx, cancel := authen.RequestContext()
+	defer cancel()
+
+	storageInfo, err := storage.DB.Info(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("storage info - %w", err)
 	}
 
 	return http.Ok(struct {
-		Go      string `json:"go"`
-		Commit  string `json:"commit"`
-		Storage any    `json:"storage"`
+		Go      string            `json:"go"`
+		Commit  string            `json:"commit"`
+		Storage any               `json:"storage"`
+		Cleaner authen.CleanStats `json:"cleaner"`
 	}{
 		Commit:  commit,
 		Go:      runtime.Version(),
 		Storage: storageInfo,
+		Cleaner: authen.CleanerStats(),
 	}), nil
 }
@@ -21,4 +21,5 @@ func Test_Info_Ok(t *testing.T) {
 	assert.Equal(t, body.String("commit"), commit)
 	assert.Equal(t, body.String("go"), runtime.Version())
 	assert.Equal(t, body.Object("storage").String("type"), tests.StorageType())
+	assert.Equal(t, body.Object("cleaner").Object("removed").Int("tickets"), 0)
 }
@@ -4,12 +4,16 @@ import (
 	"fmt"
 
 	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/authen"
 	"src.goblgobl.com/authen/storage"
 	"src.goblgobl.com/utils/http"
 )
 
 func Ping(conn *fasthttp.RequestCtx) (http.Response, error) {
-	if err := storage.DB.Ping(); err != nil {
+	ctx, cancel := authen.RequestContext()
+	defer cancel()
+
+	if err := storage.DB.Ping(ctx); err != nil {
 		return nil, fmt.Errorf("ping store - %w", err)
 	}
 
@@ -1,6 +1,9 @@
 package http
 
 import (
+	"context"
+	"errors"
+
 	"src.goblgobl.com/authen"
 	"src.goblgobl.com/authen/codes"
 	"src.goblgobl.com/authen/config"
@@ -8,6 +11,7 @@ import (
 	"src.goblgobl.com/authen/http/misc"
 	"src.goblgobl.com/authen/http/tickets"
 	"src.goblgobl.com/authen/http/totps"
+	"src.goblgobl.com/authen/http/users"
 	"src.goblgobl.com/authen/storage/data"
 	"src.goblgobl.com/utils"
 	"src.goblgobl.com/utils/http"
@@ -21,6 +25,7 @@ var (
 	resNotFoundPath         = http.StaticNotFound(codes.RES_UNKNOWN_ROUTE)
 	resMissingProjectHeader = http.StaticError(400, codes.RES_MISSING_PROJECT_HEADER, "Gobl-Project header required")
 	resProjectNotFound      = http.StaticError(400, codes.RES_PROJECT_NOT_FOUND, "unknown project id")
+	resStorageTimeout       = http.StaticError(503, codes.RES_STORAGE_TIMEOUT, "storage timeout")
 )
 
 func Listen() {
@@ -45,8 +50,8 @@ func Listen() {
 func handler() func(ctx *fasthttp.RequestCtx) {
 	r := router.New()
 	// misc routes
-	r.GET("/v1/ping", http.NoEnvHandler("ping", misc.Ping))
-	r.GET("/v1/info", http.NoEnvHandler("info", misc.Info))
+	r.GET("/v1/ping", http.NoEnvHandler("ping", noEnvTimeouts(misc.Ping)))
+	r.GET("/v1/info", http.NoEnvHandler("info", noEnvTimeouts(misc.Info)))
 
 	envLoader := loadMultiTenancyEnv
 	if !authen.Config.MultiTenancy {
@@ -54,18 +59,28 @@ func handler() func(ctx *fasthttp.RequestCtx) {
 	}
 
 	// TOTP routes
-	r.POST("/v1/totps", http.Handler("totp_create", envLoader, totps.Create))
-	r.POST("/v1/totps/verify", http.Handler("totp_verify", envLoader, totps.Verify))
-	r.POST("/v1/totps/delete", http.Handler("totp_delete", envLoader, totps.Delete))
-	r.POST("/v1/totps/change_key", http.Handler("totp_change_key", envLoader, totps.ChangeKey))
+	r.POST("/v1/totps", http.Handler("totp_create", envLoader, timeouts(totps.Create)))
+	r.POST("/v1/totps/verify", http.Handler("totp_verify", envLoader, timeouts(totps.Verify)))
+	r.POST("/v1/totps/delete", http.Handler("totp_delete", envLoader, timeouts(totps.Delete)))
+	r.POST("/v1/totps/change_key", http.Handler("totp_change_key", envLoader, timeouts(totps.ChangeKey)))
 
 	// Tickets routes
-	r.POST("/v1/tickets", http.Handler("tickets_create", envLoader, tickets.Create))
-	r.POST("/v1/tickets/use", http.Handler("tickets_use", envLoader, tickets.Use))
-	r.POST("/v1/tickets/delete", http.Handler("tickets_delete", envLoader, tickets.Delete))
-
-	r.GET("/v1/login_logs", http.Handler("login_logs_list", envLoader, loginLogs.List))
-	r.POST("/v1/login_logs", http.Handler("login_logs_create", envLoader, loginLogs.Create))
+	r.POST("/v1/tickets", http.Handler("tickets_create", envLoader, timeouts(tickets.Create)))
+	r.POST("/v1/tickets/batch", http.Handler("tickets_create_batch", envLoader, timeouts(tickets.CreateBatch)))
+	r.POST("/v1/tickets/use", http.Handler("tickets_use", envLoader, timeouts(tickets.Use)))
+	r.POST("/v1/tickets/delete", http.Handler("tickets_delete", envLoader, timeouts(tickets.Delete)))
+	r.POST("/v1/tickets/extend", http.Handler("tickets_extend", envLoader, timeouts(tickets.Extend)))
+
+	r.GET("/v1/login_logs", http.Handler("login_logs_list", envLoader, timeouts(loginLogs.List)))
+	r.GET("/v1/login_logs/stats", http.Handler("login_logs_stats", envLoader, timeouts(loginLogs.Stats)))
+	r.GET("/v1/login_logs/export", http.Handler("login_logs_export", envLoader, timeouts(loginLogs.Export)))
+	r.GET("/v1/login_logs/stream", http.Handler("login_logs_stream", envLoader, timeouts(loginLogs.Stream)))
+	r.POST("/v1/login_logs", http.Handler("login_logs_create", envLoader, timeouts(loginLogs.Create)))
+	r.POST("/v1/login_logs/delete", http.Handler("login_logs_delete", envLoader, timeouts(loginLogs.Delete)))
+
+	// User routes
+	r.GET("/v1/users/lock_status", http.Handler("users_lock_status", envLoader, timeouts(users.LockStatus)))
+	r.POST("/v1/users/unlock", http.Handler("users_unlock", envLoader, timeouts(users.Unlock)))
 
 	// catch all
 	r.NotFound = func(ctx *fasthttp.RequestCtx) {
@@ -84,6 +99,10 @@ func loadMultiTenancyEnv(conn *fasthttp.RequestCtx) (*authen.Env, http.Response,
 	project, err := authen.Projects.Get(projectIdString)
 
 	if err != nil {
+		if isTimeout(err) {
+			log.Warn("storage_timeout").String("pid", projectIdString).Err(err).Log()
+			return nil, resStorageTimeout, nil
+		}
 		return nil, nil, err
 	}
 
@@ -107,9 +126,42 @@ func createSingleTenancyLoader(config config.Config) func(conn *fasthttp.Request
 		TicketMaxPayloadLength:   ticket.MaxPayloadLength,
 		LoginLogMax:              loginLog.Max,
 		LoginLogMaxPayloadLength: loginLog.MaxPayloadLength,
+		LoginLogRetainCount:      loginLog.RetainCount,
+		LoginLogRetainDays:       loginLog.RetainDays,
+		LoginLogRetainOnInsert:   loginLog.RetainOnInsert,
+		LockoutRules:             loginLog.Lockout,
+		LoginLogSuccessStatuses:  loginLog.SuccessStatuses,
 	}, false)
 
 	return func(conn *fasthttp.RequestCtx) (*authen.Env, http.Response, error) {
 		return authen.NewEnv(project), nil, nil
 	}
 }
+
+// A storage call which ran out of time is a 503 rather than a 500, so
+// that callers know it's worth retrying.
+func timeouts(next func(*fasthttp.RequestCtx, *authen.Env) (http.Response, error)) func(*fasthttp.RequestCtx, *authen.Env) (http.Response, error) {
+	return func(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+		res, err := next(conn, env)
+		if err != nil && isTimeout(err) {
+			env.Warn("storage_timeout").Err(err).Log()
+			return resStorageTimeout, nil
+		}
+		return res, err
+	}
+}
+
+func noEnvTimeouts(next func(*fasthttp.RequestCtx) (http.Response, error)) func(*fasthttp.RequestCtx) (http.Response, error) {
+	return func(conn *fasthttp.RequestCtx) (http.Response, error) {
+		res, err := next(conn)
+		if err != nil && isTimeout(err) {
+			log.Warn("storage_timeout").Err(err).Log()
+			return resStorageTimeout, nil
+		}
+		return res, err
+	}
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
@@ -1,7 +1,9 @@
 package http
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -120,6 +122,45 @@ func Test_Server_MultiTenancy_LogsError(t *testing.T) {
 	assert.Equal(t, reqLog["err"], `"Not Over 9000!"`)
 }
 
+func Test_Server_StorageTimeout(t *testing.T) {
+	conn := request.Req(t).ProjectId(projectId).Conn()
+	http.Handler("", loadMultiTenancyEnv, timeouts(func(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+		return nil, fmt.Errorf("PG.TOTPGet - %w", context.DeadlineExceeded)
+	}))(conn)
+
+	res := request.Res(t, conn).ExpectCode(102020)
+	assert.Equal(t, res.Status, 503)
+}
+
+func Test_Server_StorageCanceled(t *testing.T) {
+	// a canceled call isn't a timeout
+	conn := request.Req(t).ProjectId(projectId).Conn()
+	http.Handler("", loadMultiTenancyEnv, timeouts(func(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+		return nil, fmt.Errorf("PG.TOTPGet - %w", context.Canceled)
+	}))(conn)
+
+	res := request.Res(t, conn).ExpectCode(2001)
+	assert.Equal(t, res.Status, 500)
+}
+
+func Test_Server_Env_StorageDeadline(t *testing.T) {
+	defer func(original *uint32) {
+		authen.Config.HTTP.StorageTimeout = original
+	}(authen.Config.HTTP.StorageTimeout)
+
+	timeout := uint32(2000)
+	authen.Config.HTTP.StorageTimeout = &timeout
+
+	conn := request.Req(t).ProjectId(projectId).Conn()
+	http.Handler("", loadMultiTenancyEnv, func(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+		deadline, ok := env.Context().Deadline()
+		assert.True(t, ok)
+		assert.Timeish(t, deadline, time.Now().Add(2*time.Second))
+		return http.Ok(nil), nil
+	})(conn)
+	request.Res(t, conn).OK()
+}
+
 func Test_Server_SingleTenancy_CallsHandlerWithProject(t *testing.T) {
 	loader := createSingleTenancyLoader(config.Config{
 		TOTP: &config.TOTP{
@@ -0,0 +1,123 @@
+package tickets
+
+import (
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/codes"
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/http"
+	"src.goblgobl.com/utils/json"
+	"src.goblgobl.com/utils/log"
+	"src.goblgobl.com/utils/typed"
+	"src.goblgobl.com/utils/validation"
+)
+
+const MAX_BATCH_SIZE = 100
+
+var (
+	batchTicketValidation = validation.Object().
+				Field("ttl", ttlValidation).
+				Field("uses", usesValidation)
+
+	resInvalidBatch = http.StaticError(400, codes.VAL_TICKET_BATCH, "tickets must be an array of 1 to 100 objects")
+)
+
+// Creates normal (token) tickets in bulk. Returns the tickets in the
+// same order as they were given. TicketMax applies to the batch as a
+// whole: either every ticket is created, or none are.
+func CreateBatch(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+	body := conn.PostBody()
+	input, err := typed.Json(body)
+	if err != nil {
+		return http.InvalidJSON, nil
+	}
+
+	items, ok := input["tickets"].([]any)
+	if !ok || len(items) == 0 || len(items) > MAX_BATCH_SIZE {
+		return resInvalidBatch, nil
+	}
+
+	project := env.Project
+	validator := env.Validator
+	maxPayloadLength := project.TicketMaxPayloadLength
+
+	now := time.Now()
+	raws := make([][]byte, len(items))
+	tickets := make([]data.TicketCreateTicket, len(items))
+
+	for i, item := range items {
+		var input typed.Typed
+		switch m := item.(type) {
+		case map[string]any:
+			input = typed.Typed(m)
+		case typed.Typed:
+			input = m
+		default:
+			return resInvalidBatch, nil
+		}
+
+		// validation errors don't say which ticket was invalid, so we stop
+		// at the first one
+		if !batchTicketValidation.Validate(input, validator) {
+			return http.Validation(validator), nil
+		}
+
+		t := &tickets[i]
+		uses := input.Int("uses")
+		t.Uses = &uses
+
+		expires := now.Add(time.Duration(input.Int("ttl")) * time.Second)
+		t.Expires = &expires
+
+		if p, ok := input["payload"]; ok {
+			pb, err := json.Marshal(p)
+			if err != nil {
+				// see the comment in Create
+				log.Error("ticket_batch_payload").Err(err).String("body", string(body)).Log()
+				return nil, err
+			}
+			if maxPayloadLength > 0 && len(pb) > maxPayloadLength {
+				return resMaxPayloadLength, nil
+			}
+			t.Payload = pb
+		}
+
+		if raws[i], err = newToken(t); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := storage.DB.TicketCreate(env.Context(), data.TicketCreate{
+		Tickets:   tickets,
+		ProjectId: project.Id,
+		Max:       project.TicketMax,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch result.Status {
+	case data.TICKET_CREATE_MAX:
+		return resMax, nil
+	case data.TICKET_CREATE_DUPLICATE:
+		// 20 random bytes shouldn't ever collide. If they do, none of the
+		// batch was stored.
+		return nil, errors.New("tickets.Batch - duplicate ticket")
+	}
+
+	encoded := make([]string, len(raws))
+	for i, raw := range raws {
+		encoded[i] = base64.RawStdEncoding.EncodeToString(raw)
+	}
+
+	return http.Ok(struct {
+		Tickets []string `json:"tickets"`
+	}{
+		Tickets: encoded,
+	}), nil
+}
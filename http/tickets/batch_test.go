@@ -0,0 +1,105 @@
+package tickets
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/tests"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/tests/request"
+)
+
+func Test_CreateBatch_InvalidBody(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body("nope").
+		Post(CreateBatch).
+		ExpectInvalid(2003)
+}
+
+func Test_CreateBatch_InvalidData(t *testing.T) {
+	for _, body := range []map[string]any{
+		{},
+		{"tickets": "nope"},
+		{"tickets": []any{}},
+		{"tickets": []any{1}},
+		{"tickets": make([]map[string]any, 101)},
+	} {
+		request.ReqT(t, authen.BuildEnv().Env()).
+			Body(body).
+			Post(CreateBatch).
+			ExpectInvalid(101_004)
+	}
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"tickets": []map[string]any{
+			{"ttl": 10},
+			{"ttl": -1, "uses": "two"},
+		}}).
+		Post(CreateBatch).
+		ExpectValidation("ttl", 1006, "uses", 1005)
+}
+
+func Test_CreateBatch_Max(t *testing.T) {
+	projectId := tests.UUID()
+	env := authen.BuildEnv().ProjectId(projectId).TicketMax(3).Env()
+	tests.Factory.Ticket.Insert("project_id", projectId)
+	tests.Factory.Ticket.Insert("project_id", projectId)
+
+	request.ReqT(t, env).
+		Body(map[string]any{"tickets": []map[string]any{
+			{},
+			{},
+		}}).
+		Post(CreateBatch).
+		ExpectInvalid(102_009)
+
+	row := tests.Row("select count(*) as count from authen_tickets where project_id = $1", projectId)
+	assert.Equal(t, row.Int("count"), 2)
+}
+
+func Test_CreateBatch_Payload_Length(t *testing.T) {
+	env := authen.BuildEnv().TicketMaxPayloadLength(10).Env()
+
+	request.ReqT(t, env).
+		Body(map[string]any{"tickets": []map[string]any{
+			{"payload": map[string]int{"over": 9}},
+			{"payload": map[string]int{"over": 9000}},
+		}}).
+		Post(CreateBatch).
+		ExpectInvalid(102_010)
+}
+
+func Test_CreateBatch(t *testing.T) {
+	env := authen.BuildEnv().Env()
+
+	res := request.ReqT(t, env).
+		Body(map[string]any{"tickets": []map[string]any{
+			{},
+			{"ttl": 120, "uses": 3, "payload": "over 9000"},
+		}}).
+		Post(CreateBatch).
+		OK().Json
+
+	encoded := res.Strings("tickets")
+	assert.Equal(t, len(encoded), 2)
+
+	ticket, _ := base64.RawStdEncoding.DecodeString(encoded[0])
+	row := tests.Row("select * from authen_tickets where project_id = $1 and ticket = $2", env.Project.Id, hashTicket(ticket))
+	assert.Nil(t, row["payload"])
+	assert.Equal(t, row.Int("uses"), 1)
+	assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Minute))
+
+	ticket, _ = base64.RawStdEncoding.DecodeString(encoded[1])
+	row = tests.Row("select * from authen_tickets where project_id = $1 and ticket = $2", env.Project.Id, hashTicket(ticket))
+	assert.Equal(t, row.Int("uses"), 3)
+	assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Minute*2))
+
+	json := request.ReqT(t, env).
+		Body(map[string]any{"ticket": encoded[1]}).
+		Post(Use).
+		OK().Json
+	assert.Equal(t, json.String("payload"), "over 9000")
+	assert.Equal(t, json.Int("uses"), 2)
+}
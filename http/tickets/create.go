@@ -1,9 +1,10 @@
 package tickets
 
 import (
+	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"io"
 	"time"
 
@@ -24,10 +25,19 @@ import (
 var (
 	createValidation = validation.Object().
 				Field("ttl", ttlValidation).
-				Field("uses", usesValidation)
+				Field("uses", usesValidation).
+				Field("unlimited", validation.Bool()).
+				Field("format", formatValidation).
+				Field("length", lengthValidation).
+				Field("scope", scopeValidation).
+				Field("attempts", attemptsValidation).
+				Field("sliding_ttl", slidingTTLValidation)
 
 	resMax              = http.StaticError(400, codes.RES_TICKET_MAX, "maximum number of tickets reached")
 	resMaxPayloadLength = http.StaticError(400, codes.RES_TICKET_MAX_PAYLOAD_LENGTH, "payload length is exceeds maximum allowed size")
+	resCodeCollision    = http.StaticError(409, codes.RES_TICKET_CODE_COLLISION, "could not generate a unique code, consider using a longer code")
+	resCodeScope        = http.StaticError(400, codes.VAL_TICKET_SCOPE, "scope is required for numeric and base32 tickets")
+	resUnlimitedUses    = http.StaticError(400, codes.VAL_TICKET_UNLIMITED, "uses cannot be given for an unlimited ticket")
 )
 
 func Create(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
@@ -37,6 +47,11 @@ func Create(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 		return http.InvalidJSON, nil
 	}
 
+	// ttl and uses have defaults, so we need to know if they were
+	// explicitly given before validation fills them in
+	_, hasTTL := input["ttl"]
+	_, hasUses := input["uses"]
+
 	validator := env.Validator
 	if !createValidation.Validate(input, validator) {
 		return http.Validation(validator), nil
@@ -49,8 +64,8 @@ func Create(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 		pb, err := json.Marshal(p)
 		if err != nil {
 			// since this unmarshal'd, it should marshal, this is weird
-			// body could have sensitive information...but we do currently store the
-			// payload in plain text. Still not great, but this shouldnt' happen and
+			// body could have sensitive information...which we otherwise never
+			// store in plain text. Still not great, but this shouldnt' happen and
 			// if it does, I really want to understand what's goin gon.
 			log.Error("ticket_create_payload").Err(err).String("body", string(body)).Log()
 			return nil, err
@@ -61,43 +76,171 @@ func Create(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 		payload = pb
 	}
 
+	// unlimited is the only way to get a ticket without a uses (which
+	// otherwise defaults to 1), for both stored and signed tickets
+	unlimited := input.Bool("unlimited")
+	if unlimited && hasUses {
+		return resUnlimitedUses, nil
+	}
+
 	var uses *int
-	if n, ok := input.IntIf("uses"); ok {
+	if n, ok := input.IntIf("uses"); ok && !unlimited {
 		uses = &n
 	}
 
+	var slidingTTL *int
+	if n, ok := input.IntIf("sliding_ttl"); ok {
+		slidingTTL = &n
+		// without an explicit ttl, a sliding ticket starts with its sliding window
+		if !hasTTL {
+			input["ttl"] = n
+		}
+	}
+
 	var expires *time.Time
 	if n, ok := input.IntIf("ttl"); ok {
 		e := time.Now().Add(time.Duration(n) * time.Second)
 		expires = &e
 	}
 
-	var ticket [20]byte
-	ticketSlice := ticket[:]
-	if _, err := io.ReadFull(rand.Reader, ticketSlice); err != nil {
-		return nil, err
+	format := input.String("format")
+	if format == FORMAT_SIGNED {
+		// signed tickets can't track uses, other than to deny a single-use
+		// ticket once it's been used. Like every other ticket, they're
+		// single-use unless unlimited.
+		if slidingTTL != nil || (uses != nil && *uses != 1) {
+			return resSignedUnsupported, nil
+		}
+		return createSigned(project.Id, *expires, !unlimited, payload)
 	}
-	ticketHash := sha256.Sum256(ticketSlice)
 
-	result, err := storage.DB.TicketCreate(data.TicketCreate{
-		Uses:      uses,
-		Payload:   payload,
-		Expires:   expires,
+	opts := data.TicketCreate{
 		ProjectId: project.Id,
-		Ticket:    ticketHash[:],
 		Max:       project.TicketMax,
+	}
+
+	if format == "" || format == FORMAT_TOKEN {
+		return createToken(env.Context(), opts, data.TicketCreateTicket{
+			Uses:       uses,
+			Payload:    payload,
+			Expires:    expires,
+			SlidingTTL: slidingTTL,
+		})
+	}
+
+	// A miss burns an attempt from every code in the scope (we can't know
+	// which code was being guessed), so codes can't share one project-wide
+	// pool of attempts.
+	scope := input.String("scope")
+	if scope == "" {
+		return resCodeScope, nil
+	}
+
+	length, ok := input.IntIf("length")
+	if !ok {
+		length = 6
+		if format == FORMAT_BASE32 {
+			length = 8
+		}
+	}
+
+	attempts, ok := input.IntIf("attempts")
+	if !ok {
+		attempts = 5
+	}
+
+	return createCode(env.Context(), format, length, opts, data.TicketCreateTicket{
+		Uses:       uses,
+		Payload:    payload,
+		Expires:    expires,
+		SlidingTTL: slidingTTL,
+		Attempts:   &attempts,
+		Scope:      hashScope(scope),
 	})
+}
+
+// Generates a random ticket, sets its hash on t and encrypts t's
+// payload. Returns the raw ticket.
+func newToken(t *data.TicketCreateTicket) ([]byte, error) {
+	ticket := make([]byte, 20)
+	if _, err := io.ReadFull(rand.Reader, ticket); err != nil {
+		return nil, err
+	}
+	t.Ticket = hashTicket(ticket)
+
+	payload, err := encryptPayload(ticket, t.Payload)
 	if err != nil {
 		return nil, err
 	}
+	t.Payload = payload
+	t.PayloadEncrypted = true
+	return ticket, nil
+}
 
-	if result.Status == data.TICKET_CREATE_MAX {
+func createToken(ctx context.Context, opts data.TicketCreate, t data.TicketCreateTicket) (http.Response, error) {
+	ticket, err := newToken(&t)
+	if err != nil {
+		return nil, err
+	}
+	opts.Tickets = []data.TicketCreateTicket{t}
+
+	result, err := storage.DB.TicketCreate(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch result.Status {
+	case data.TICKET_CREATE_MAX:
 		return resMax, nil
+	case data.TICKET_CREATE_DUPLICATE:
+		// see Batch
+		return nil, errors.New("tickets.Create - duplicate ticket")
 	}
 
 	return http.Ok(struct {
 		Ticket string `json:"ticket"`
 	}{
-		Ticket: base64.RawStdEncoding.EncodeToString(ticketSlice),
+		Ticket: base64.RawStdEncoding.EncodeToString(ticket),
 	}), nil
 }
+
+func createCode(ctx context.Context, format string, length int, opts data.TicketCreate, t data.TicketCreateTicket) (http.Response, error) {
+	payload := t.Payload
+	t.PayloadEncrypted = true
+
+	// Short codes can collide with an existing code in the same scope. When
+	// that happens, we just try again with a new code. If we keep colliding,
+	// the scope is (very) crowded and more tries won't help much.
+	for i := 0; i < 5; i++ {
+		code, err := generateCode(format, length)
+		if err != nil {
+			return nil, err
+		}
+		raw := rawCode(t.Scope, code)
+		t.Ticket = hashRawCode(raw)
+
+		t.Payload, err = encryptPayload(raw, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		opts.Tickets = []data.TicketCreateTicket{t}
+		result, err := storage.DB.TicketCreate(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		switch result.Status {
+		case data.TICKET_CREATE_MAX:
+			return resMax, nil
+		case data.TICKET_CREATE_OK:
+			return http.Ok(struct {
+				Code string `json:"code"`
+			}{
+				Code: code,
+			}), nil
+		}
+	}
+
+	return resCodeCollision, nil
+}
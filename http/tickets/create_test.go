@@ -3,10 +3,13 @@ package tickets
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/config"
 	"src.goblgobl.com/authen/tests"
 	"src.goblgobl.com/tests/assert"
 	"src.goblgobl.com/tests/request"
@@ -30,11 +33,41 @@ func Test_Create_InvalidData(t *testing.T) {
 
 	request.ReqT(t, authen.BuildEnv().Env()).
 		Body(map[string]any{
-			"ttl":  -1,
-			"uses": -2,
+			"ttl":         -1,
+			"uses":        -2,
+			"sliding_ttl": 0,
 		}).
 		Post(Create).
-		ExpectValidation("ttl", 1006, "uses", 1006)
+		ExpectValidation("ttl", 1006, "uses", 1006, "sliding_ttl", 1006)
+
+	// a ticket that can never be used
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"uses": 0}).
+		Post(Create).
+		ExpectValidation("uses", 1006)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"uses": 2, "unlimited": true}).
+		Post(Create).
+		ExpectInvalid(101_013)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{
+			"format":   "hex",
+			"length":   3,
+			"attempts": 0,
+		}).
+		Post(Create).
+		ExpectValidation("format", 101_003, "length", 1006, "attempts", 1006)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{
+			"length":   33,
+			"attempts": 101,
+			"scope":    strings.Repeat("a", 201),
+		}).
+		Post(Create).
+		ExpectValidation("length", 1007, "attempts", 1007, "scope", 1003)
 }
 
 func Test_Create_Minimal(t *testing.T) {
@@ -73,12 +106,56 @@ func Test_Create_Everything(t *testing.T) {
 	ticketHash := sha256.Sum256(ticket)
 
 	row := tests.Row("select * from authen_tickets where project_id = $1 and ticket = $2", env.Project.Id, ticketHash[:])
-	assert.Bytes(t, row.Bytes("payload"), []byte(`{"over":9000}`))
+	assert.True(t, row.Bool("payload_encrypted"))
+	payload, err := decryptPayload(ticket, row.Bytes("payload"))
+	assert.Nil(t, err)
+	assert.Bytes(t, payload, []byte(`{"over":9000}`))
 	assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Minute*2))
 	assert.Equal(t, row.Int("uses"), 4)
 	assert.Nowish(t, row.Time("created"))
 }
 
+func Test_Create_Unlimited(t *testing.T) {
+	env := authen.BuildEnv().Env()
+
+	res := request.ReqT(t, env).
+		Body(map[string]any{"unlimited": true}).
+		Post(Create).
+		OK().Json
+
+	ticket, err := base64.RawStdEncoding.DecodeString(res.String("ticket"))
+	assert.Nil(t, err)
+	ticketHash := sha256.Sum256(ticket)
+
+	row := tests.Row("select * from authen_tickets where project_id = $1 and ticket = $2", env.Project.Id, ticketHash[:])
+	assert.Nil(t, row["uses"])
+}
+
+func Test_Create_SlidingTTL(t *testing.T) {
+	env := authen.BuildEnv().Env()
+
+	// without a ttl, the sliding ttl is used for the initial expiry
+	res := request.ReqT(t, env).
+		Body(map[string]any{"sliding_ttl": 600}).
+		Post(Create).
+		OK().Json
+
+	ticket, _ := base64.RawStdEncoding.DecodeString(res.String("ticket"))
+	row := tests.Row("select * from authen_tickets where project_id = $1 and ticket = $2", env.Project.Id, hashTicket(ticket))
+	assert.Equal(t, row.Int("sliding_ttl"), 600)
+	assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Minute*10))
+
+	res = request.ReqT(t, env).
+		Body(map[string]any{"sliding_ttl": 600, "ttl": 30}).
+		Post(Create).
+		OK().Json
+
+	ticket, _ = base64.RawStdEncoding.DecodeString(res.String("ticket"))
+	row = tests.Row("select * from authen_tickets where project_id = $1 and ticket = $2", env.Project.Id, hashTicket(ticket))
+	assert.Equal(t, row.Int("sliding_ttl"), 600)
+	assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Second*30))
+}
+
 func Test_Create_Max(t *testing.T) {
 	projectId := tests.UUID()
 	env := authen.BuildEnv().ProjectId(projectId).TicketMax(2).Env()
@@ -109,3 +186,148 @@ func Test_Create_Payload_Length(t *testing.T) {
 		}).
 		Post(Create).OK()
 }
+
+func Test_Create_Code_Numeric(t *testing.T) {
+	env := authen.BuildEnv().Env()
+	res := request.ReqT(t, env).
+		Body(map[string]any{"format": "numeric", "scope": "s1"}).
+		Post(Create).
+		OK().Json
+
+	code := res.String("code")
+	assert.Nil(t, res["ticket"])
+	assert.True(t, regexp.MustCompile("^[0-9]{6}$").MatchString(code))
+
+	row := tests.Row("select * from authen_tickets where project_id = $1 and ticket = $2", env.Project.Id, hashCode(hashScope("s1"), code))
+	assert.Equal(t, row.Int("uses"), 1)
+	assert.Equal(t, row.Int("attempts"), 5)
+	assert.Bytes(t, row.Bytes("scope"), hashScope("s1"))
+	assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Minute))
+}
+
+func Test_Create_Code_RequiresScope(t *testing.T) {
+	for _, format := range []string{"numeric", "base32"} {
+		request.ReqT(t, authen.BuildEnv().Env()).
+			Body(map[string]any{"format": format}).
+			Post(Create).
+			ExpectInvalid(101_012)
+
+		request.ReqT(t, authen.BuildEnv().Env()).
+			Body(map[string]any{"format": format, "scope": ""}).
+			Post(Create).
+			ExpectInvalid(101_012)
+	}
+}
+
+func Test_Create_Code_Base32(t *testing.T) {
+	env := authen.BuildEnv().Env()
+	res := request.ReqT(t, env).
+		Body(map[string]any{
+			"format":   "base32",
+			"length":   10,
+			"attempts": 3,
+			"scope":    "leto@goblgobl.com",
+			"payload":  "over 9000",
+		}).
+		Post(Create).
+		OK().Json
+
+	code := res.String("code")
+	assert.True(t, regexp.MustCompile("^[0-9A-HJKMNP-TV-Z]{10}$").MatchString(code))
+
+	scope := hashScope("leto@goblgobl.com")
+	row := tests.Row("select * from authen_tickets where project_id = $1 and ticket = $2", env.Project.Id, hashCode(scope, code))
+	assert.Equal(t, row.Int("attempts"), 3)
+	assert.Bytes(t, row.Bytes("scope"), scope)
+	assert.True(t, row.Bool("payload_encrypted"))
+	payload, err := decryptPayload(rawCode(scope, code), row.Bytes("payload"))
+	assert.Nil(t, err)
+	assert.Bytes(t, payload, []byte(`"over 9000"`))
+}
+
+func Test_Create_Signed_NoKeys(t *testing.T) {
+	defer func(k authen.KeyRing) { authen.Keys = k }(authen.Keys)
+	authen.Keys = authen.NewKeyRing(nil)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"format": "signed"}).
+		Post(Create).
+		ExpectInvalid(102_016)
+}
+
+func Test_Create_Signed_Unsupported(t *testing.T) {
+	defer func(k authen.KeyRing) { authen.Keys = k }(authen.Keys)
+	authen.Keys = authen.NewKeyRing([]config.Key{{Id: 1, Value: [32]byte{1}}})
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"format": "signed", "uses": 2}).
+		Post(Create).
+		ExpectInvalid(102_017)
+
+	// a uses of 0 is invalid for every ticket
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"format": "signed", "uses": 0}).
+		Post(Create).
+		ExpectValidation("uses", 1006)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"format": "signed", "sliding_ttl": 10}).
+		Post(Create).
+		ExpectInvalid(102_017)
+}
+
+func Test_Create_Signed(t *testing.T) {
+	defer func(k authen.KeyRing) { authen.Keys = k }(authen.Keys)
+	authen.Keys = authen.NewKeyRing([]config.Key{{Id: 3, Value: [32]byte{1}}})
+
+	env := authen.BuildEnv().Env()
+	res := request.ReqT(t, env).
+		Body(map[string]any{"format": "signed", "ttl": 120, "payload": "over 9000"}).
+		Post(Create).
+		OK().Json
+
+	ticket := res.String("ticket")
+	assert.True(t, isSigned(ticket))
+
+	// nothing is stored
+	row := tests.Row("select count(*) as count from authen_tickets where project_id = $1", env.Project.Id)
+	assert.Equal(t, row.Int("count"), 0)
+
+	// single-use by default
+	signed := parseSigned(env.Project.Id, ticket)
+	assert.True(t, signed.singleUse)
+	assert.Bytes(t, signed.payload, []byte(`"over 9000"`))
+	assert.Timeish(t, signed.expires, time.Now().Add(time.Minute*2))
+
+	// signed for a specific project
+	assert.Nil(t, parseSigned(tests.UUID(), ticket))
+
+	// tampered
+	assert.Nil(t, parseSigned(env.Project.Id, ticket[:len(ticket)-2]+"AA"))
+
+	res = request.ReqT(t, env).
+		Body(map[string]any{"format": "signed", "uses": 1}).
+		Post(Create).
+		OK().Json
+
+	signed = parseSigned(env.Project.Id, res.String("ticket"))
+	assert.True(t, signed.singleUse)
+	assert.Nil(t, signed.payload)
+
+	// unlimited only when explicitly asked for
+	res = request.ReqT(t, env).
+		Body(map[string]any{"format": "signed", "unlimited": true}).
+		Post(Create).
+		OK().Json
+
+	signed = parseSigned(env.Project.Id, res.String("ticket"))
+	assert.False(t, signed.singleUse)
+}
+
+func Test_NormalizeCode(t *testing.T) {
+	assert.Equal(t, normalizeCode("123456"), "123456")
+	assert.Equal(t, normalizeCode("123-456"), "123456")
+	assert.Equal(t, normalizeCode(" 12 34 56 "), "123456")
+	assert.Equal(t, normalizeCode("abcd-efgh"), "ABCDEFGH")
+	assert.Equal(t, normalizeCode("oil0"), "0110")
+}
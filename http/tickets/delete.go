@@ -26,8 +26,8 @@ func Delete(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 	}
 
 	project := env.Project
-	res, err := storage.DB.TicketDelete(data.TicketUse{
-		Ticket:    input.Bytes("ticket"),
+	res, err := storage.DB.TicketDelete(env.Context(), data.TicketUse{
+		Ticket:    hashTicket(input.Bytes("ticket")),
 		ProjectId: project.Id,
 	})
 
@@ -0,0 +1,72 @@
+package tickets
+
+import (
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/codes"
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/http"
+	"src.goblgobl.com/utils/typed"
+	"src.goblgobl.com/utils/validation"
+)
+
+var (
+	extendValidation = validation.Object().
+				Field("ticket", ticketValidation).
+				Field("ttl", validation.Int().Min(1)).
+				Field("uses", validation.Int().Min(1))
+
+	resExtendEmpty = http.StaticError(400, codes.RES_TICKET_EXTEND_EMPTY, "ttl or uses must be provided")
+)
+
+// ttl sets a new expiry (relative to now), uses is added to the
+// ticket's remaining uses.
+func Extend(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+	input, err := typed.Json(conn.PostBody())
+	if err != nil {
+		return http.InvalidJSON, nil
+	}
+
+	validator := env.Validator
+	if !extendValidation.Validate(input, validator) {
+		return http.Validation(validator), nil
+	}
+
+	var uses *int
+	if n, ok := input.IntIf("uses"); ok {
+		uses = &n
+	}
+
+	var expires *time.Time
+	if n, ok := input.IntIf("ttl"); ok {
+		e := time.Now().Add(time.Duration(n) * time.Second)
+		expires = &e
+	}
+
+	if uses == nil && expires == nil {
+		return resExtendEmpty, nil
+	}
+
+	res, err := storage.DB.TicketExtend(env.Context(), data.TicketExtend{
+		Uses:      uses,
+		Expires:   expires,
+		Ticket:    hashTicket(input.Bytes("ticket")),
+		ProjectId: env.Project.Id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Status == data.TICKET_USE_NOT_FOUND {
+		return resNotFound, nil
+	}
+
+	return http.Ok(struct {
+		Uses *int `json:"uses"`
+	}{
+		Uses: res.Uses,
+	}), nil
+}
@@ -0,0 +1,74 @@
+package tickets
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/tests"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/tests/request"
+)
+
+func Test_Extend_InvalidBody(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body("nope").
+		Post(Extend).
+		ExpectInvalid(2003)
+}
+
+func Test_Extend_InvalidData(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Post(Extend).
+		ExpectValidation("ticket", 1001)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"ticket": "x", "ttl": 0, "uses": "two"}).
+		Post(Extend).
+		ExpectValidation("ticket", 101_002, "ttl", 1006, "uses", 1005)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"ticket": "dDE"}).
+		Post(Extend).
+		ExpectInvalid(102_015)
+}
+
+func Test_Extend_NotFound(t *testing.T) {
+	projectId := tests.UUID()
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+
+	tests.Factory.Ticket.Insert("project_id", projectId, "ticket", "t1", "uses", 0)
+	tests.Factory.Ticket.Insert("project_id", projectId, "ticket", "t2", "expires", time.Now().Add(-time.Second))
+	tests.Factory.Ticket.Insert("ticket", "t3")
+
+	for _, ticket := range []string{"t1", "t2", "t3"} {
+		request.ReqT(t, env).
+			Body(map[string]any{"ticket": base64.RawStdEncoding.EncodeToString([]byte(ticket)), "uses": 2}).
+			Post(Extend).
+			ExpectNotFound(102_011)
+	}
+}
+
+func Test_Extend(t *testing.T) {
+	projectId := tests.UUID()
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+	tests.Factory.Ticket.Insert("project_id", projectId, "ticket", "t1", "uses", 1, "expires", time.Now().Add(time.Minute))
+	ticket := base64.RawStdEncoding.EncodeToString([]byte("t1"))
+
+	json := request.ReqT(t, env).
+		Body(map[string]any{"ticket": ticket, "uses": 3}).
+		Post(Extend).
+		OK().Json
+	assert.Equal(t, json.Int("uses"), 4)
+
+	json = request.ReqT(t, env).
+		Body(map[string]any{"ticket": ticket, "ttl": 3600, "uses": 1}).
+		Post(Extend).
+		OK().Json
+	assert.Equal(t, json.Int("uses"), 5)
+
+	row := tests.Row("select * from authen_tickets where project_id = $1 and ticket = $2", projectId, hashTicket([]byte("t1")))
+	assert.Equal(t, row.Int("uses"), 5)
+	assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Hour))
+}
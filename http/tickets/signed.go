@@ -0,0 +1,146 @@
+package tickets
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/codes"
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/http"
+	"src.goblgobl.com/utils/validation"
+)
+
+/*
+Signed tickets are never written to the database (except for single-use
+tickets, which are added to a denylist when used). Everything we need is
+in the ticket itself:
+
+	keyId:4 | expires:8 | flags:1 | nonce:8 | payload:n | mac:32
+
+The mac is an HMAC-SHA256 of everything between the keyId and the mac,
+using a per-project key derived from the server's key ring. The keyId
+itself isn't signed: changing it only changes which key is used to
+verify the mac, which will then fail. The whole thing is base64 (url)
+encoded and prefixed with signedPrefix, which also lets us tell signed
+tickets apart from normal ones (normal tickets can't contain a '.').
+
+The payload is signed, not encrypted: whoever holds the ticket can read it.
+*/
+
+const (
+	signedPrefix     = "s1."
+	signedHeaderLen  = 4 + 8 + 1 + 8
+	signedMacLen     = sha256.Size
+	signedSingleUse  = byte(1)
+	signedMaxEncoded = 8192
+)
+
+var (
+	signedTicketValidation = validation.String().Required().Length(1, signedMaxEncoded)
+	useSignedValidation    = validation.Object().Field("ticket", signedTicketValidation)
+
+	resSigningNoKeys     = http.StaticError(400, codes.RES_TICKET_SIGNING_NO_KEYS, "signed tickets require keys to be configured")
+	resSignedUnsupported = http.StaticError(400, codes.RES_TICKET_SIGNED_UNSUPPORTED, "signed tickets only support a ttl, a payload and either a uses of 1 (the default) or unlimited")
+)
+
+type signedTicket struct {
+	mac       []byte
+	payload   []byte
+	expires   time.Time
+	singleUse bool
+}
+
+func isSigned(ticket string) bool {
+	return strings.HasPrefix(ticket, signedPrefix)
+}
+
+func createSigned(projectId string, expires time.Time, singleUse bool, payload []byte) (http.Response, error) {
+	keys := authen.Keys
+	if keys.Empty() {
+		return resSigningNoKeys, nil
+	}
+
+	body := make([]byte, signedHeaderLen, signedHeaderLen+len(payload)+signedMacLen)
+	binary.BigEndian.PutUint64(body[4:], uint64(expires.Unix()))
+	if singleUse {
+		body[12] = signedSingleUse
+	}
+	// two single-use tickets with the same expiry and payload must not
+	// share a denylist entry
+	if _, err := io.ReadFull(rand.Reader, body[13:21]); err != nil {
+		return nil, err
+	}
+	body = append(body, payload...)
+
+	keyId, mac := keys.Sign(authen.KEY_TICKET_SIGNING+projectId, body[4:])
+	binary.BigEndian.PutUint32(body, uint32(keyId))
+	body = append(body, mac...)
+
+	return http.Ok(struct {
+		Ticket string `json:"ticket"`
+	}{
+		Ticket: signedPrefix + base64.RawURLEncoding.EncodeToString(body),
+	}), nil
+}
+
+// Returns nil if the ticket isn't valid (malformed, bad signature,
+// unknown key or expired).
+func parseSigned(projectId string, ticket string) *signedTicket {
+	body, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(ticket, signedPrefix))
+	if err != nil || len(body) < signedHeaderLen+signedMacLen {
+		return nil
+	}
+
+	split := len(body) - signedMacLen
+	signed, mac := body[:split], body[split:]
+	keyId := int(binary.BigEndian.Uint32(signed))
+	if !authen.Keys.Verify(authen.KEY_TICKET_SIGNING+projectId, keyId, signed[4:], mac) {
+		return nil
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(signed[4:])), 0)
+	if !expires.After(time.Now()) {
+		return nil
+	}
+
+	var payload []byte
+	if len(signed) > signedHeaderLen {
+		payload = signed[signedHeaderLen:]
+	}
+
+	return &signedTicket{
+		mac:       mac,
+		payload:   payload,
+		expires:   expires,
+		singleUse: signed[12] == signedSingleUse,
+	}
+}
+
+// Returns false if the ticket isn't valid or has already been used.
+func useSigned(ctx context.Context, projectId string, ticket *signedTicket) (bool, error) {
+	if ticket == nil {
+		return false, nil
+	}
+	if !ticket.singleUse {
+		return true, nil
+	}
+
+	// the mac is unique per ticket (thanks to the nonce)
+	res, err := storage.DB.TicketDeny(ctx, data.TicketDeny{
+		Ticket:    hashTicket(ticket.mac),
+		ProjectId: projectId,
+		Expires:   ticket.expires,
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.Status == data.TICKET_USE_OK, nil
+}
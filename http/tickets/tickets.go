@@ -1,22 +1,53 @@
 package tickets
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
 
 	"src.goblgobl.com/authen/codes"
+	"src.goblgobl.com/utils"
+	"src.goblgobl.com/utils/encryption"
 	"src.goblgobl.com/utils/typed"
 	"src.goblgobl.com/utils/validation"
 )
 
+const (
+	FORMAT_TOKEN   = "token"
+	FORMAT_NUMERIC = "numeric"
+	FORMAT_BASE32  = "base32"
+	FORMAT_SIGNED  = "signed"
+
+	// Crockford's base32: no I, L, O or U
+	base32Alphabet  = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	numericAlphabet = "0123456789"
+
+	// the start of every raw code (see rawCode)
+	codePrefix = "authen:code:"
+)
+
 var (
 	ticketValidation = validation.String().
 				Required().Length(1, 200).Convert(decodeTicket)
 
 	ttlValidation  = validation.Int().Min(0).Default(60)
-	usesValidation = validation.Int().Min(0).Default(1)
+	usesValidation = validation.Int().Min(1).Default(1)
+
+	slidingTTLValidation = validation.Int().Min(1)
+
+	formatValidation   = validation.String().Length(0, 10).Convert(validateFormat)
+	lengthValidation   = validation.Int().Min(4).Max(32)
+	scopeValidation    = validation.String().Length(0, 200)
+	attemptsValidation = validation.Int().Min(1).Max(100)
+	codeValidation     = validation.String().Required().Length(1, 100)
 )
 
+// Returns the raw ticket. We store a hash of the ticket, but the raw
+// ticket is also needed to derive the payload's encryption key.
 func decodeTicket(field validation.Field, value string, _object typed.Typed, _input typed.Typed, res *validation.Result) any {
 	ticket, err := base64.RawStdEncoding.DecodeString(value)
 	if err != nil {
@@ -25,6 +56,115 @@ func decodeTicket(field validation.Field, value string, _object typed.Typed, _in
 			Error: "Ticket must be a base64 encoded value",
 		})
 	}
+	return ticket
+}
+
+func hashTicket(ticket []byte) []byte {
 	ticketHash := sha256.Sum256(ticket)
 	return ticketHash[:]
 }
+
+// Payloads are encrypted with a key derived from the ticket (or code)
+// so that someone with access to the DB, but not the ticket, can't read
+// them. For codes, this is only as strong as the code itself, which,
+// being short, can be brute forced offline.
+func payloadKey(ticket []byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte("authen:ticket:payload:"))
+	h.Write(ticket)
+	return *(*[32]byte)(h.Sum(nil))
+}
+
+func encryptPayload(ticket []byte, payload []byte) ([]byte, error) {
+	if payload == nil {
+		return nil, nil
+	}
+	return encryption.Encrypt(payloadKey(ticket), utils.B2S(payload))
+}
+
+func decryptPayload(ticket []byte, payload []byte) ([]byte, error) {
+	decrypted, ok := encryption.Decrypt(payloadKey(ticket), payload)
+	if !ok {
+		return nil, errors.New("ticket payload decryption failed")
+	}
+	return decrypted, nil
+}
+
+func validateFormat(field validation.Field, value string, _object typed.Typed, _input typed.Typed, res *validation.Result) any {
+	switch value {
+	case "", FORMAT_TOKEN, FORMAT_NUMERIC, FORMAT_BASE32, FORMAT_SIGNED:
+		return value
+	}
+	res.AddInvalidField(field, validation.Invalid{
+		Code:  codes.VAL_TICKET_FORMAT,
+		Error: "format must be one of: token, numeric, base32 or signed",
+	})
+	return value
+}
+
+// Codes are short, so we can't rely on them being unique within the
+// project. Instead, they're hashed along with their (hashed) scope.
+// This is the code's equivalent of a raw ticket.
+func rawCode(scope []byte, code string) []byte {
+	raw := make([]byte, 0, len(codePrefix)+len(scope)+len(code))
+	raw = append(raw, codePrefix...)
+	raw = append(raw, scope...)
+	return append(raw, normalizeCode(code)...)
+}
+
+// A code's hash is stored alongside tickets' hashes. If it were hashed
+// like a ticket, anyone could use (or delete, or extend) the code as a
+// ticket by sending its raw code (which, the scope being known, is easy
+// to build for every guess) without using up any of its attempts. A
+// different hash function means no ticket can match a code.
+func hashRawCode(raw []byte) []byte {
+	codeHash := sha512.Sum512_256(raw)
+	return codeHash[:]
+}
+
+func hashCode(scope []byte, code string) []byte {
+	return hashRawCode(rawCode(scope, code))
+}
+
+func hashScope(scope string) []byte {
+	scopeHash := sha256.Sum256([]byte(scope))
+	return scopeHash[:]
+}
+
+// Be forgiving with whatever the user typed. Separators are ignored and
+// the characters Crockford's base32 deliberately avoids are mapped
+// to the ones they're likely to have been confused with.
+func normalizeCode(code string) string {
+	var sb strings.Builder
+	sb.Grow(len(code))
+	for _, c := range strings.ToUpper(code) {
+		switch c {
+		case '-', ' ':
+			continue
+		case 'O':
+			c = '0'
+		case 'I', 'L':
+			c = '1'
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+func generateCode(format string, length int) (string, error) {
+	alphabet := numericAlphabet
+	if format == FORMAT_BASE32 {
+		alphabet = base32Alphabet
+	}
+
+	max := big.NewInt(int64(len(alphabet)))
+	code := make([]byte, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
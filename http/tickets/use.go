@@ -1,6 +1,7 @@
 package tickets
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/valyala/fasthttp"
@@ -17,8 +18,9 @@ import (
 )
 
 var (
-	useValidation = validation.Object().Field("ticket", ticketValidation)
-	resNotFound   = http.StaticError(404, codes.RES_TICKET_NOT_FOUND, "ticket not found")
+	useValidation     = validation.Object().Field("ticket", ticketValidation)
+	useCodeValidation = validation.Object().Field("code", codeValidation).Field("scope", scopeValidation)
+	resNotFound       = http.StaticError(404, codes.RES_TICKET_NOT_FOUND, "ticket not found")
 )
 
 func Use(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
@@ -28,16 +30,35 @@ func Use(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 		return http.InvalidJSON, nil
 	}
 
+	project := env.Project
 	validator := env.Validator
-	if !useValidation.Validate(input, validator) {
-		return http.Validation(validator), nil
+	opts := data.TicketUse{ProjectId: project.Id}
+
+	if ticket, ok := input["ticket"].(string); ok && isSigned(ticket) {
+		if !useSignedValidation.Validate(input, validator) {
+			return http.Validation(validator), nil
+		}
+		return signedUse(env.Context(), project.Id, parseSigned(project.Id, ticket), body)
 	}
 
-	project := env.Project
-	res, err := storage.DB.TicketUse(data.TicketUse{
-		Ticket:    input.Bytes("ticket"),
-		ProjectId: project.Id,
-	})
+	// the raw ticket (or code), needed to decrypt the payload
+	var raw []byte
+	if _, isCode := input["code"]; isCode {
+		if !useCodeValidation.Validate(input, validator) {
+			return http.Validation(validator), nil
+		}
+		opts.Scope = hashScope(input.String("scope"))
+		raw = rawCode(opts.Scope, input.String("code"))
+		opts.Ticket = hashRawCode(raw)
+	} else {
+		if !useValidation.Validate(input, validator) {
+			return http.Validation(validator), nil
+		}
+		raw = input.Bytes("ticket")
+		opts.Ticket = hashTicket(raw)
+	}
+
+	res, err := storage.DB.TicketUse(env.Context(), opts)
 	if err != nil {
 		return nil, err
 	}
@@ -46,9 +67,41 @@ func Use(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 		return resNotFound, nil
 	}
 
-	var payload any
+	var pb []byte
 	if p := res.Payload; p != nil {
-		if err := json.Unmarshal(*p, &payload); err != nil {
+		pb = *p
+		if res.PayloadEncrypted {
+			if pb, err = decryptPayload(raw, pb); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return useResponse(res.Uses, pb, body)
+}
+
+func signedUse(ctx context.Context, projectId string, ticket *signedTicket, body []byte) (http.Response, error) {
+	ok, err := useSigned(ctx, projectId, ticket)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return resNotFound, nil
+	}
+
+	// unlimited uses (within the ttl) is represented by a nil uses, same
+	// as a normal ticket
+	var uses *int
+	if ticket.singleUse {
+		zero := 0
+		uses = &zero
+	}
+	return useResponse(uses, ticket.payload, body)
+}
+
+func useResponse(uses *int, pb []byte, body []byte) (http.Response, error) {
+	var payload any
+	if pb != nil {
+		if err := json.Unmarshal(pb, &payload); err != nil {
 			// very weird, as we've been able to deal with this as json so far
 			log.Error("ticket_use_payload").Err(err).String("body", string(body)).Log()
 			return nil, err
@@ -59,7 +112,7 @@ func Use(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 		Uses    *int `json:"uses"`
 		Payload any  `json:"payload"`
 	}{
-		Uses:    res.Uses,
+		Uses:    uses,
 		Payload: payload,
 	}), nil
 }
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/config"
 	"src.goblgobl.com/authen/tests"
 	"src.goblgobl.com/tests/assert"
 	"src.goblgobl.com/tests/request"
@@ -144,3 +145,207 @@ func Test_Use_Payload(t *testing.T) {
 	}
 
 }
+
+func Test_Use_EncryptedPayload(t *testing.T) {
+	env := authen.BuildEnv().Env()
+
+	ticket := request.ReqT(t, env).
+		Body(map[string]any{"uses": 2, "payload": map[string]int{"over": 9000}}).
+		Post(Create).
+		OK().Json.String("ticket")
+
+	json := request.ReqT(t, env).
+		Body(map[string]any{"ticket": ticket}).
+		Post(Use).
+		OK().Json
+	assert.Equal(t, json.Object("payload").Int("over"), 9000)
+
+	code := request.ReqT(t, env).
+		Body(map[string]any{"format": "numeric", "scope": "s1", "payload": "over 9000!"}).
+		Post(Create).
+		OK().Json.String("code")
+
+	json = request.ReqT(t, env).
+		Body(map[string]any{"code": code, "scope": "s1"}).
+		Post(Use).
+		OK().Json
+	assert.Equal(t, json.String("payload"), "over 9000!")
+}
+
+func Test_Use_Code_InvalidData(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"code": ""}).
+		Post(Use).
+		ExpectValidation("code", 1003)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"code": "123", "scope": 3}).
+		Post(Use).
+		ExpectValidation("scope", 1002)
+}
+
+func Test_Use_Code(t *testing.T) {
+	projectId := tests.UUID()
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+
+	tests.Factory.Ticket.Insert("project_id", projectId, "code", "123456", "attempts", 5, "uses", 1)
+	tests.Factory.Ticket.Insert("project_id", projectId, "code", "ABCD1234", "scope", "s1", "attempts", 5, "payload", "p2")
+
+	// needs the right scope
+	request.ReqT(t, env).
+		Body(map[string]any{"code": "ABCD1234"}).
+		Post(Use).
+		ExpectNotFound(102_011)
+
+	json := request.ReqT(t, env).
+		Body(map[string]any{"code": "abcd-i234", "scope": "s1"}).
+		Post(Use).
+		OK().Json
+	assert.Equal(t, json.String("payload"), "p2")
+
+	json = request.ReqT(t, env).
+		Body(map[string]any{"code": "123 456"}).
+		Post(Use).
+		OK().Json
+	assert.Equal(t, json.Int("uses"), 0)
+
+	// no more uses
+	request.ReqT(t, env).
+		Body(map[string]any{"code": "123456"}).
+		Post(Use).
+		ExpectNotFound(102_011)
+}
+
+func Test_Use_Code_Attempts(t *testing.T) {
+	projectId := tests.UUID()
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+
+	tests.Factory.Ticket.Insert("project_id", projectId, "code", "111111", "scope", "s1", "attempts", 2)
+	tests.Factory.Ticket.Insert("project_id", projectId, "code", "222222", "scope", "s2", "attempts", 2)
+
+	for _, code := range []string{"000000", "999999"} {
+		request.ReqT(t, env).
+			Body(map[string]any{"code": code, "scope": "s1"}).
+			Post(Use).
+			ExpectNotFound(102_011)
+	}
+
+	// out of attempts, even the right code no longer works
+	request.ReqT(t, env).
+		Body(map[string]any{"code": "111111", "scope": "s1"}).
+		Post(Use).
+		ExpectNotFound(102_011)
+
+	// other scopes are unaffected
+	request.ReqT(t, env).
+		Body(map[string]any{"code": "222222", "scope": "s2"}).
+		Post(Use).
+		OK()
+}
+
+// a code can't be used as a ticket, which would get around its attempts
+func Test_Use_Code_AsTicket(t *testing.T) {
+	projectId := tests.UUID()
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+	tests.Factory.Ticket.Insert("project_id", projectId, "code", "123456", "scope", "s1", "attempts", 1)
+
+	scope := hashScope("s1")
+	forged := [][]byte{
+		rawCode(scope, "123456"),
+		append(append([]byte{}, scope...), "123456"...),
+		hashCode(scope, "123456"),
+	}
+	for _, raw := range forged {
+		request.ReqT(t, env).
+			Body(map[string]any{"ticket": base64.RawStdEncoding.EncodeToString(raw)}).
+			Post(Use).
+			ExpectNotFound(102_011)
+	}
+
+	// and none of those used up its one attempt
+	request.ReqT(t, env).
+		Body(map[string]any{"code": "123456", "scope": "s1"}).
+		Post(Use).
+		OK()
+}
+
+func Test_Use_SlidingTTL(t *testing.T) {
+	projectId := tests.UUID()
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+	tests.Factory.Ticket.Insert("project_id", projectId, "ticket", "t1", "uses", 3, "sliding_ttl", 7200, "expires", time.Now().Add(time.Minute))
+
+	request.ReqT(t, env).
+		Body(map[string]any{"ticket": base64.RawStdEncoding.EncodeToString([]byte("t1"))}).
+		Post(Use).
+		OK()
+
+	row := tests.Row("select * from authen_tickets where project_id = $1 and ticket = $2", projectId, hashTicket([]byte("t1")))
+	assert.Equal(t, row.Int("uses"), 2)
+	assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Hour*2))
+}
+
+func Test_Use_Signed(t *testing.T) {
+	defer func(k authen.KeyRing) { authen.Keys = k }(authen.Keys)
+	authen.Keys = authen.NewKeyRing([]config.Key{{Id: 1, Value: [32]byte{1}}})
+
+	env := authen.BuildEnv().Env()
+	multi := request.ReqT(t, env).
+		Body(map[string]any{"format": "signed", "unlimited": true, "payload": map[string]int{"over": 9000}}).
+		Post(Create).
+		OK().Json.String("ticket")
+
+	single := request.ReqT(t, env).
+		Body(map[string]any{"format": "signed", "payload": "single"}).
+		Post(Create).
+		OK().Json.String("ticket")
+
+	for i := 0; i < 2; i++ {
+		json := request.ReqT(t, env).
+			Body(map[string]any{"ticket": multi}).
+			Post(Use).
+			OK().Json
+		assert.Nil(t, json["uses"])
+		assert.Equal(t, json.Object("payload").Int("over"), 9000)
+	}
+
+	json := request.ReqT(t, env).
+		Body(map[string]any{"ticket": single}).
+		Post(Use).
+		OK().Json
+	assert.Equal(t, json.Int("uses"), 0)
+	assert.Equal(t, json.String("payload"), "single")
+
+	request.ReqT(t, env).
+		Body(map[string]any{"ticket": single}).
+		Post(Use).
+		ExpectNotFound(102_011)
+
+	// wrong project
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{"ticket": multi}).
+		Post(Use).
+		ExpectNotFound(102_011)
+
+	// key was rotated out
+	authen.Keys = authen.NewKeyRing([]config.Key{{Id: 2, Value: [32]byte{2}}})
+	request.ReqT(t, env).
+		Body(map[string]any{"ticket": multi}).
+		Post(Use).
+		ExpectNotFound(102_011)
+}
+
+func Test_Use_Signed_Expired(t *testing.T) {
+	defer func(k authen.KeyRing) { authen.Keys = k }(authen.Keys)
+	authen.Keys = authen.NewKeyRing([]config.Key{{Id: 1, Value: [32]byte{1}}})
+
+	env := authen.BuildEnv().Env()
+	ticket := request.ReqT(t, env).
+		Body(map[string]any{"format": "signed", "ttl": 0}).
+		Post(Create).
+		OK().Json.String("ticket")
+
+	request.ReqT(t, env).
+		Body(map[string]any{"ticket": ticket}).
+		Post(Use).
+		ExpectNotFound(102_011)
+}
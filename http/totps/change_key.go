@@ -34,7 +34,7 @@ func ChangeKey(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error
 	tpe := input.String("type")
 	userId := input.String("user_id")
 	projectId := env.Project.Id
-	result, err := storage.DB.TOTPGet(data.TOTPGet{
+	result, err := storage.DB.TOTPGet(env.Context(), data.TOTPGet{
 		Type:      tpe,
 		UserId:    userId,
 		Pending:   false,
@@ -60,7 +60,7 @@ func ChangeKey(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error
 		return nil, err
 	}
 
-	_, err = storage.DB.TOTPCreate(data.TOTPCreate{
+	_, err = storage.DB.TOTPCreate(env.Context(), data.TOTPCreate{
 		UserId:    userId,
 		Type:      tpe,
 		ProjectId: projectId,
@@ -63,7 +63,7 @@ func Create(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 	}
 
 	expires := time.Now().Add(project.TOTPSetupTTL)
-	result, err := storage.DB.TOTPCreate(data.TOTPCreate{
+	result, err := storage.DB.TOTPCreate(env.Context(), data.TOTPCreate{
 		Secret:    encrypted,
 		Type:      input.String("type"),
 		UserId:    input.String("user_id"),
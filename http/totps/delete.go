@@ -28,7 +28,7 @@ func Delete(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 		return http.Validation(validator), nil
 	}
 
-	deleted, err := storage.DB.TOTPDelete(data.TOTPGet{
+	deleted, err := storage.DB.TOTPDelete(env.Context(), data.TOTPGet{
 		ProjectId: env.Project.Id,
 		Type:      input.String("type"),
 		UserId:    input.String("user_id"),
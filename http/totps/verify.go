@@ -6,6 +6,7 @@ import (
 	"github.com/valyala/fasthttp"
 	"github.com/xlzd/gotp"
 	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/events"
 	"src.goblgobl.com/authen/storage"
 	"src.goblgobl.com/authen/storage/data"
 	"src.goblgobl.com/utils"
@@ -40,7 +41,7 @@ func Verify(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 	pending := input.Bool("pending")
 	userId := input.String("user_id")
 
-	result, err := storage.DB.TOTPGet(data.TOTPGet{
+	result, err := storage.DB.TOTPGet(env.Context(), data.TOTPGet{
 		Type:      tpe,
 		UserId:    userId,
 		Pending:   pending,
@@ -50,6 +51,7 @@ func Verify(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 		return nil, err
 	}
 	if result.Status == data.TOTP_GET_NOT_FOUND {
+		publishVerify(projectId, userId, tpe, "not_found")
 		return resNotFound, nil
 	}
 
@@ -57,21 +59,37 @@ func Verify(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
 	key := *(*[32]byte)(input.Bytes("key"))
 	secret, ok := encryption.Decrypt(key, encrypted)
 	if !ok {
+		publishVerify(projectId, userId, tpe, "incorrect_key")
 		return resIncorrectKey, nil
 	}
 
 	totp := gotp.NewDefaultTOTP(utils.B2S(secret))
 	if !totp.VerifyTime(input.String("code"), time.Now()) {
+		publishVerify(projectId, userId, tpe, "incorrect_code")
 		return resIncorrectCode, nil
 	}
 
 	if pending {
-		_, err = storage.DB.TOTPCreate(data.TOTPCreate{
+		_, err = storage.DB.TOTPCreate(env.Context(), data.TOTPCreate{
 			UserId:    userId,
 			Type:      tpe,
 			ProjectId: projectId,
 			Secret:    encrypted,
 		})
 	}
+	if err == nil {
+		publishVerify(projectId, userId, tpe, "")
+	}
 	return resOK, err
 }
+
+// reason is empty on success
+func publishVerify(projectId string, userId string, tpe string, reason string) {
+	events.Publish(projectId, userId, events.TYPE_TOTP_VERIFY, events.TOTPVerify{
+		UserId: userId,
+		Type:   tpe,
+		Ok:     reason == "",
+		Reason: reason,
+		Time:   time.Now(),
+	})
+}
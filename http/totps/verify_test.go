@@ -1,12 +1,14 @@
 package totps
 
 import (
+	"encoding/json"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/xlzd/gotp"
 	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/events"
 	"src.goblgobl.com/authen/tests"
 	"src.goblgobl.com/tests/assert"
 	"src.goblgobl.com/tests/request"
@@ -311,3 +313,36 @@ func Test_Verify_Pending_With_Type(t *testing.T) {
 		assert.Equal(t, string(dbSecret), secret)
 	}
 }
+
+func Test_Verify_PublishesEvents(t *testing.T) {
+	env := authen.BuildEnv().Env()
+	subscription := events.Default.Subscribe(env.Project.Id)
+	defer subscription.Close()
+
+	key, hexKey := tests.Key()
+	secret := gotp.RandomSecret(16)
+	totp := gotp.NewDefaultTOTP(secret)
+	tests.Factory.TOTP.Insert("project_id", env.Project.Id, "user_id", "u1", "secret", secret, "key", key)
+
+	assertEvent := func(ok bool, reason string) {
+		t.Helper()
+		e := <-subscription.C
+		assert.Equal(t, e.Type, events.TYPE_TOTP_VERIFY)
+		assert.Equal(t, e.UserId, "u1")
+
+		var data events.TOTPVerify
+		assert.Nil(t, json.Unmarshal(e.Data, &data))
+		assert.Equal(t, data.Ok, ok)
+		assert.Equal(t, data.Reason, reason)
+	}
+
+	request.ReqT(t, env).
+		Body(map[string]any{"user_id": "u1", "key": hexKey, "code": "123456"}).
+		Post(Verify).ExpectInvalid(102_008)
+	assertEvent(false, "incorrect_code")
+
+	request.ReqT(t, env).
+		Body(map[string]any{"user_id": "u1", "key": hexKey, "code": totp.Now()}).
+		Post(Verify).OK()
+	assertEvent(true, "")
+}
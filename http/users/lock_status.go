@@ -0,0 +1,41 @@
+package users
+
+import (
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/http"
+	"src.goblgobl.com/utils/validation"
+)
+
+var (
+	lockStatusValidation = validation.Object().
+		Field("user_id", userIdValidation)
+)
+
+func LockStatus(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+	validator := env.Validator
+	input, ok := lockStatusValidation.ValidateArgs(conn.QueryArgs(), validator)
+	if !ok {
+		return http.Validation(validator), nil
+	}
+
+	lock, err := storage.DB.UserLockGet(env.Context(), data.UserLockGet{
+		ProjectId: env.Project.Id,
+		UserId:    input.String("user_id"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return http.Ok(struct {
+		Locked      bool       `json:"locked"`
+		LockedUntil *time.Time `json:"locked_until"`
+	}{
+		Locked:      lock.LockedUntil != nil,
+		LockedUntil: lock.LockedUntil,
+	}), nil
+}
@@ -0,0 +1,50 @@
+package users
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/tests"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/tests/request"
+)
+
+func Test_LockStatus_InvalidData(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Get(LockStatus).
+		ExpectValidation("user_id", 1001)
+
+	request.ReqT(t, authen.BuildEnv().Env()).
+		QueryMap(map[string]string{"user_id": strings.Repeat("a", 101)}).
+		Get(LockStatus).
+		ExpectValidation("user_id", 1003)
+}
+
+func Test_LockStatus_NotLocked(t *testing.T) {
+	projectId := tests.UUID()
+	tests.Factory.UserLock.Insert("project_id", projectId, "user_id", "u1", "locked_until", time.Now().Add(-time.Second))
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+
+	for _, userId := range []string{"u1", "u2"} {
+		res := request.ReqT(t, env).
+			QueryMap(map[string]string{"user_id": userId}).
+			Get(LockStatus).OK().Json
+		assert.False(t, res.Bool("locked"))
+		assert.Nil(t, res["locked_until"])
+	}
+}
+
+func Test_LockStatus_Locked(t *testing.T) {
+	projectId := tests.UUID()
+	lockedUntil := time.Now().Add(time.Minute)
+	tests.Factory.UserLock.Insert("project_id", projectId, "user_id", "u1", "locked_until", lockedUntil)
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+
+	res := request.ReqT(t, env).
+		QueryMap(map[string]string{"user_id": "u1"}).
+		Get(LockStatus).OK().Json
+	assert.True(t, res.Bool("locked"))
+	assert.Timeish(t, res.Time("locked_until"), lockedUntil)
+}
@@ -0,0 +1,44 @@
+package users
+
+import (
+	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/http"
+	"src.goblgobl.com/utils/typed"
+	"src.goblgobl.com/utils/validation"
+)
+
+var (
+	unlockValidation = validation.Object().
+		Field("user_id", userIdValidation)
+)
+
+// Removes the user's lock, if any. Failed login logs up to now no
+// longer count towards a new lock.
+func Unlock(conn *fasthttp.RequestCtx, env *authen.Env) (http.Response, error) {
+	input, err := typed.Json(conn.PostBody())
+	if err != nil {
+		return http.InvalidJSON, nil
+	}
+
+	validator := env.Validator
+	if !unlockValidation.Validate(input, validator) {
+		return http.Validation(validator), nil
+	}
+
+	unlocked, err := storage.DB.UserUnlock(env.Context(), data.UserLockGet{
+		ProjectId: env.Project.Id,
+		UserId:    input.String("user_id"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return http.Ok(struct {
+		Unlocked bool `json:"unlocked"`
+	}{
+		Unlocked: unlocked,
+	}), nil
+}
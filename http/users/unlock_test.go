@@ -0,0 +1,44 @@
+package users
+
+import (
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen"
+	"src.goblgobl.com/authen/tests"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/tests/request"
+)
+
+func Test_Unlock_InvalidBody(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body("nope").
+		Post(Unlock).
+		ExpectInvalid(2003)
+}
+
+func Test_Unlock_InvalidData(t *testing.T) {
+	request.ReqT(t, authen.BuildEnv().Env()).
+		Body(map[string]any{}).
+		Post(Unlock).
+		ExpectValidation("user_id", 1001)
+}
+
+func Test_Unlock(t *testing.T) {
+	projectId := tests.UUID()
+	tests.Factory.UserLock.Insert("project_id", projectId, "user_id", "u1", "locked_until", time.Now().Add(time.Minute))
+	env := authen.BuildEnv().ProjectId(projectId).Env()
+
+	res := request.ReqT(t, env).
+		Body(map[string]any{"user_id": "u1"}).
+		Post(Unlock).OK().Json
+	assert.True(t, res.Bool("unlocked"))
+
+	row := tests.Row("select locked_until from authen_user_locks where project_id = $1 and user_id = 'u1'", projectId)
+	assert.Nil(t, row["locked_until"])
+
+	res = request.ReqT(t, env).
+		Body(map[string]any{"user_id": "u1"}).
+		Post(Unlock).OK().Json
+	assert.False(t, res.Bool("unlocked"))
+}
@@ -0,0 +1,9 @@
+package users
+
+import (
+	"src.goblgobl.com/utils/validation"
+)
+
+var (
+	userIdValidation = validation.String().Required().Length(1, 100)
+)
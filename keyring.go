@@ -0,0 +1,156 @@
+package authen
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"src.goblgobl.com/authen/config"
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils"
+	"src.goblgobl.com/utils/encryption"
+)
+
+// What a key is being used for. The same server key is never used
+// directly, rather a purpose-specific key is derived from it.
+const (
+	KEY_LOGIN_LOG_PAYLOAD = "login_log_payload"
+
+	// suffixed with the project id, so that each project has its own key
+	KEY_TICKET_SIGNING = "ticket_signing:"
+)
+
+var Keys KeyRing
+
+type KeyRing struct {
+	// id of the key used for new values, 0 when there are no keys
+	current int
+	keys    map[int][32]byte
+}
+
+func NewKeyRing(keys []config.Key) KeyRing {
+	current := 0
+	lookup := make(map[int][32]byte, len(keys))
+	for _, key := range keys {
+		lookup[key.Id] = key.Value
+		if key.Id > current {
+			current = key.Id
+		}
+	}
+	return KeyRing{current: current, keys: lookup}
+}
+
+func (k KeyRing) Empty() bool {
+	return k.current == 0
+}
+
+// Returns the id of the key that was used. Encryption is opt-in (it
+// requires keys to be configured), without any keys, the value is
+// returned as-is with a key id of 0.
+func (k KeyRing) Encrypt(purpose string, value []byte) (int, []byte, error) {
+	id := k.current
+	if id == 0 {
+		return 0, value, nil
+	}
+
+	encrypted, err := encryption.Encrypt(k.derive(id, purpose), utils.B2S(value))
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, encrypted, nil
+}
+
+// The inverse of Encrypt. A key id of 0 means the value was never
+// encrypted (either there were no keys, or it predates encryption).
+func (k KeyRing) Decrypt(purpose string, id int, value []byte) ([]byte, error) {
+	if id == 0 {
+		return value, nil
+	}
+	if _, ok := k.keys[id]; !ok {
+		return nil, fmt.Errorf("KeyRing.Decrypt - unknown key %d", id)
+	}
+
+	decrypted, ok := encryption.Decrypt(k.derive(id, purpose), value)
+	if !ok {
+		return nil, fmt.Errorf("KeyRing.Decrypt - failed with key %d", id)
+	}
+	return decrypted, nil
+}
+
+// Returns the id of the key used and the HMAC-SHA256 of value. Returns
+// a key id of 0 (and no mac) when there are no keys.
+func (k KeyRing) Sign(purpose string, value []byte) (int, []byte) {
+	id := k.current
+	if id == 0 {
+		return 0, nil
+	}
+	return id, k.sign(id, purpose, value)
+}
+
+// Keys are rotated by adding a new key: new values are signed with it
+// while values signed with older keys remain valid for as long as the
+// older key is configured.
+func (k KeyRing) Verify(purpose string, id int, value []byte, mac []byte) bool {
+	if _, ok := k.keys[id]; !ok {
+		return false
+	}
+	return hmac.Equal(mac, k.sign(id, purpose, value))
+}
+
+func (k KeyRing) sign(id int, purpose string, value []byte) []byte {
+	key := k.derive(id, purpose)
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+func (k KeyRing) derive(id int, purpose string) [32]byte {
+	key := k.keys[id]
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(purpose))
+	return *(*[32]byte)(mac.Sum(nil))
+}
+
+// Encrypts any login log payloads that were stored in plain text, either
+// because they predate encryption or because no keys were configured at the
+// time. Processes batchSize rows at a time and returns the number of rows
+// that were encrypted.
+func EncryptLoginLogPayloads(batchSize int) (int, error) {
+	if Keys.Empty() {
+		return 0, errors.New("EncryptLoginLogPayloads - no keys configured")
+	}
+
+	total := 0
+	for {
+		ctx, cancel := storage.Context()
+		records, err := storage.DB.LoginLogGetUnencrypted(ctx, batchSize)
+		cancel()
+		if err != nil {
+			return total, err
+		}
+
+		for _, record := range records {
+			id, payload, err := Keys.Encrypt(KEY_LOGIN_LOG_PAYLOAD, record.RawPayload)
+			if err != nil {
+				return total, err
+			}
+			ctx, cancel := storage.Context()
+			err = storage.DB.LoginLogUpdatePayload(ctx, data.LoginLogUpdatePayload{
+				Id:         record.Id,
+				Payload:    payload,
+				PayloadKey: id,
+			})
+			cancel()
+			if err != nil {
+				return total, err
+			}
+		}
+
+		total += len(records)
+		if len(records) < batchSize {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package authen
+
+import (
+	"testing"
+
+	"src.goblgobl.com/authen/config"
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_KeyRing_Empty(t *testing.T) {
+	keys := NewKeyRing(nil)
+	assert.True(t, keys.Empty())
+
+	id, value, err := keys.Encrypt(KEY_LOGIN_LOG_PAYLOAD, []byte("over 9000"))
+	assert.Nil(t, err)
+	assert.Equal(t, id, 0)
+	assert.Equal(t, string(value), "over 9000")
+
+	value, err = keys.Decrypt(KEY_LOGIN_LOG_PAYLOAD, 0, []byte("plain"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(value), "plain")
+
+	_, err = keys.Decrypt(KEY_LOGIN_LOG_PAYLOAD, 1, []byte("nope"))
+	assert.Equal(t, err.Error(), "KeyRing.Decrypt - unknown key 1")
+}
+
+func Test_KeyRing_EncryptDecrypt(t *testing.T) {
+	keys := testKeyRing(2, 5)
+	assert.False(t, keys.Empty())
+
+	id, encrypted, err := keys.Encrypt(KEY_LOGIN_LOG_PAYLOAD, []byte("over 9000"))
+	assert.Nil(t, err)
+	assert.Equal(t, id, 5)
+	assert.NotEqual(t, string(encrypted), "over 9000")
+
+	value, err := keys.Decrypt(KEY_LOGIN_LOG_PAYLOAD, id, encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, string(value), "over 9000")
+
+	// different purpose, different key
+	_, err = keys.Decrypt("other", id, encrypted)
+	assert.Equal(t, err.Error(), "KeyRing.Decrypt - failed with key 5")
+
+	// older keys can still decrypt
+	older := NewKeyRing([]config.Key{{Id: 2, Value: [32]byte{2}}})
+	id, encrypted, _ = older.Encrypt(KEY_LOGIN_LOG_PAYLOAD, []byte("ghanima"))
+	value, err = keys.Decrypt(KEY_LOGIN_LOG_PAYLOAD, id, encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, string(value), "ghanima")
+}
+
+func Test_KeyRing_SignVerify(t *testing.T) {
+	id, mac := NewKeyRing(nil).Sign(KEY_TICKET_SIGNING, []byte("over 9000"))
+	assert.Equal(t, id, 0)
+	assert.Nil(t, mac)
+
+	keys := testKeyRing(2, 5)
+	id, mac = keys.Sign(KEY_TICKET_SIGNING+"p1", []byte("over 9000"))
+	assert.Equal(t, id, 5)
+	assert.Equal(t, len(mac), 32)
+
+	assert.True(t, keys.Verify(KEY_TICKET_SIGNING+"p1", 5, []byte("over 9000"), mac))
+	assert.False(t, keys.Verify(KEY_TICKET_SIGNING+"p2", 5, []byte("over 9000"), mac))
+	assert.False(t, keys.Verify(KEY_TICKET_SIGNING+"p1", 5, []byte("over 9001"), mac))
+	assert.False(t, keys.Verify(KEY_TICKET_SIGNING+"p1", 2, []byte("over 9000"), mac))
+	assert.False(t, keys.Verify(KEY_TICKET_SIGNING+"p1", 9, []byte("over 9000"), mac))
+
+	// rotated out
+	assert.False(t, testKeyRing(2).Verify(KEY_TICKET_SIGNING+"p1", 5, []byte("over 9000"), mac))
+}
+
+func Test_EncryptLoginLogPayloads_NoKeys(t *testing.T) {
+	defer func(k KeyRing) { Keys = k }(Keys)
+
+	Keys = NewKeyRing(nil)
+	_, err := EncryptLoginLogPayloads(10)
+	assert.Equal(t, err.Error(), "EncryptLoginLogPayloads - no keys configured")
+}
+
+func testKeyRing(ids ...int) KeyRing {
+	keys := make([]config.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = config.Key{Id: id, Value: [32]byte{byte(id)}}
+	}
+	return NewKeyRing(keys)
+}
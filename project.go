@@ -28,14 +28,19 @@ type Project struct {
 	logField log.Field
 
 	Id                       string
-	TOTPMax                  int           `json:"totp_max"`
-	TOTPIssuer               string        `json:"totp_issuer"`
-	TOTPSetupTTL             time.Duration `json:"totp_setup_ttl"`
-	TOTPSecretLength         int           `json:"totp_secret_length"`
-	TicketMax                int           `json:"ticket_max"`
-	TicketMaxPayloadLength   int           `json:"ticket_max_payload_length"`
-	LoginLogMax              int           `json:"login_log_max"`
-	LoginLogMaxPayloadLength int           `json:"login_log_max_payload_length"`
+	TOTPMax                  int                `json:"totp_max"`
+	TOTPIssuer               string             `json:"totp_issuer"`
+	TOTPSetupTTL             time.Duration      `json:"totp_setup_ttl"`
+	TOTPSecretLength         int                `json:"totp_secret_length"`
+	TicketMax                int                `json:"ticket_max"`
+	TicketMaxPayloadLength   int                `json:"ticket_max_payload_length"`
+	LoginLogMax              int                `json:"login_log_max"`
+	LoginLogMaxPayloadLength int                `json:"login_log_max_payload_length"`
+	LoginLogRetainCount      int                `json:"login_log_retain_count"`
+	LoginLogRetainDays       int                `json:"login_log_retain_days"`
+	LoginLogRetainOnInsert   bool               `json:"login_log_retain_on_insert"`
+	LockoutRules             []data.LockoutRule `json:"lockout_rules"`
+	LoginLogSuccessStatuses  []int              `json:"login_log_success_statuses"`
 }
 
 func (p *Project) NextRequestId() string {
@@ -44,7 +49,11 @@ func (p *Project) NextRequestId() string {
 }
 
 func loadProject(id string) (*Project, error) {
-	projectData, err := storage.DB.GetProject(id)
+	// only called when a request needs a project that isn't cached
+	ctx, cancel := RequestContext()
+	defer cancel()
+
+	projectData, err := storage.DB.GetProject(ctx, id)
 	if projectData == nil || err != nil {
 		return nil, err
 	}
@@ -71,6 +80,11 @@ func NewProject(projectData *data.Project, logProjectId bool) *Project {
 		TicketMaxPayloadLength:   projectData.TicketMaxPayloadLength,
 		LoginLogMax:              projectData.LoginLogMax,
 		LoginLogMaxPayloadLength: projectData.LoginLogMaxPayloadLength,
+		LoginLogRetainCount:      projectData.LoginLogRetainCount,
+		LoginLogRetainDays:       projectData.LoginLogRetainDays,
+		LoginLogRetainOnInsert:   projectData.LoginLogRetainOnInsert,
+		LockoutRules:             lockoutRules(id, projectData.LockoutRules),
+		LoginLogSuccessStatuses:  projectData.LoginLogSuccessStatuses,
 
 		// If we let this start at 0, then restarts are likely to produce duplicates.
 		// While we make no guarantees about the uniqueness of the requestId, there's
@@ -78,3 +92,19 @@ func NewProject(projectData *data.Project, logProjectId bool) *Project {
 		requestId: uint32(time.Now().Unix()),
 	}
 }
+
+// The config's rules are validated on startup, but a project's come
+// straight from storage. An invalid rule is dropped rather than failing
+// every request for the project (a window beyond MAX_LOCKOUT_WINDOW
+// couldn't be honoured: the cleaner deletes the locks it relies on).
+func lockoutRules(projectId string, rules []data.LockoutRule) []data.LockoutRule {
+	var valid []data.LockoutRule
+	for i, rule := range rules {
+		if reason := rule.Invalid(); reason != "" {
+			log.Error("project_lockout_rule").String("pid", projectId).Int("index", i).String("reason", reason).Log()
+			continue
+		}
+		valid = append(valid, rule)
+	}
+	return valid
+}
@@ -44,6 +44,8 @@ func Test_Projects_Get_Known(t *testing.T) {
 		"totp_secret_length", 19,
 		"ticket_max", 49,
 		"ticket_max_payload_length", 149,
+		"lockout_rules", []map[string]any{{"statuses": []int{4}, "failures": 3, "window": 60, "duration": 120}},
+		"login_log_success_statuses", []int{1, 2},
 	)
 	id := row.String("id")
 
@@ -58,4 +60,27 @@ func Test_Projects_Get_Known(t *testing.T) {
 	assert.Equal(t, p.TOTPIssuer, "testing.goblgobl.com")
 	assert.Equal(t, p.TicketMax, 49)
 	assert.Equal(t, p.TicketMaxPayloadLength, 149)
+	assert.Equal(t, len(p.LockoutRules), 1)
+	assert.Equal(t, p.LockoutRules[0].Statuses[0], 4)
+	assert.Equal(t, p.LockoutRules[0].Failures, 3)
+	assert.Equal(t, p.LockoutRules[0].Window, 60)
+	assert.Equal(t, p.LockoutRules[0].Duration, 120)
+	assert.Equal(t, len(p.LoginLogSuccessStatuses), 2)
+	assert.Equal(t, p.LoginLogSuccessStatuses[0], 1)
+	assert.Equal(t, p.LoginLogSuccessStatuses[1], 2)
+}
+
+func Test_Projects_Get_InvalidLockoutRules(t *testing.T) {
+	row := tests.Factory.Project.Insert(
+		"lockout_rules", []map[string]any{
+			{"statuses": []int{4}, "failures": 3, "window": 86401, "duration": 120},
+			{"statuses": []int{5}, "failures": 3, "window": 60, "duration": 120},
+			{"statuses": []int{}, "failures": 3, "window": 60, "duration": 120},
+		},
+	)
+
+	p, err := Projects.Get(row.String("id"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(p.LockoutRules), 1)
+	assert.Equal(t, p.LockoutRules[0].Statuses[0], 5)
 }
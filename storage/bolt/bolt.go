@@ -0,0 +1,1610 @@
+package bolt
+
+// An embedded, pure Go, key-value storage (bbolt) for single instance
+// deployments which don't want sqlite's cgo. Every "table" is a bucket
+// of json encoded values. Keys are built so that the rows we look up
+// together sit next to each other, and the extra buckets (the *_by_*
+// ones) are secondary indexes whose values are the primary key.
+//
+// Keys are made of length-prefixed parts (see key), so that a user id
+// or ticket can't bleed into the next part, with times as 8 byte big
+// endian nanoseconds so that they sort chronologically.
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	bbolt "go.etcd.io/bbolt"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/json"
+)
+
+// rows read per transaction by LoginLogExport (a var so tests can lower it)
+var loginLogExportBatch = 1000
+
+var (
+	// id => project
+	projectsBucket = []byte("projects")
+
+	// project_id, user_id, type, pending => totp
+	totpsBucket = []byte("totps")
+
+	// project_id, ticket => ticket
+	ticketsBucket = []byte("tickets")
+
+	// project_id, scope, ticket => tickets key
+	ticketsByScopeBucket = []byte("tickets_by_scope")
+
+	// project_id, ticket => denied
+	denylistBucket = []byte("ticket_denylist")
+
+	// project_id, created, id => login log
+	loginLogsBucket = []byte("login_logs")
+
+	// project_id, user_id, created, id => login_logs key
+	loginLogsByUserBucket = []byte("login_logs_by_user")
+
+	// id => login_logs key
+	loginLogsByIdBucket = []byte("login_logs_by_id")
+
+	// project_id, user_id => user lock
+	userLocksBucket = []byte("user_locks")
+
+	buckets = [][]byte{
+		projectsBucket, totpsBucket, ticketsBucket, ticketsByScopeBucket, denylistBucket,
+		loginLogsBucket, loginLogsByUserBucket, loginLogsByIdBucket, userLocksBucket,
+	}
+
+	// returned from an each/eachReverse callback to stop iterating
+	errStop = errors.New("stop")
+
+	// returned from TicketCreate's transaction to roll back the batch
+	errTicketDuplicate = errors.New("duplicate ticket")
+)
+
+type Config struct {
+	Path string `json:"path"`
+}
+
+type DB struct {
+	*bbolt.DB
+}
+
+func New(config Config) (DB, error) {
+	// bbolt holds an exclusive lock on the file. Without a timeout, a
+	// second instance pointed at the same file would hang forever.
+	db, err := bbolt.Open(config.Path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return DB{}, fmt.Errorf("Bolt.New - %w", err)
+	}
+
+	// There's no schema to migrate, only buckets to create. This happens
+	// here, rather than in EnsureMigrations, because nothing works
+	// without them.
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return DB{}, fmt.Errorf("Bolt.New (buckets) - %w", err)
+	}
+	return DB{db}, nil
+}
+
+func (db DB) Ping(ctx context.Context) error {
+	return db.View(func(tx *bbolt.Tx) error {
+		return nil
+	})
+}
+
+// New creates the buckets, there's nothing else to migrate
+func (db DB) EnsureMigrations() error {
+	return nil
+}
+
+func (db DB) Info(ctx context.Context) (any, error) {
+	return struct {
+		Type string `json:"type"`
+		Path string `json:"path"`
+	}{
+		Type: "bolt",
+		Path: db.Path(),
+	}, nil
+}
+
+// bolt is a single process, there are no other instances to tell
+func (db DB) EventPublish(ctx context.Context, payload []byte) error {
+	return nil
+}
+
+func (db DB) EventListen(fn func(payload []byte)) error {
+	return nil
+}
+
+// Like the memory storage, there's no authen_projects table to insert
+// into, so projects (for multi tenancy) are added, or replaced, with this.
+func (db DB) PutProject(p data.Project) error {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		return put(tx.Bucket(projectsBucket), []byte(p.Id), data.DumpProject{Project: p, Updated: time.Now()})
+	})
+	if err != nil {
+		return fmt.Errorf("Bolt.PutProject - %w", err)
+	}
+	return nil
+}
+
+func (db DB) Clean(ctx context.Context, opts data.Clean) (data.CleanResult, error) {
+	var result data.CleanResult
+	now := time.Now()
+
+	err := db.Update(func(tx *bbolt.Tx) (err error) {
+		result.TOTPs, err = deleteWhere(tx.Bucket(totpsBucket), nil, func(t *data.DumpTOTP) bool {
+			return t.Expires != nil && t.Expires.Before(now)
+		})
+		return err
+	})
+	if err != nil {
+		return result, fmt.Errorf("Bolt.clean (totp) - %w", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		var dead []*data.DumpTicket
+		err := each(tx.Bucket(ticketsBucket), nil, func(k []byte, v []byte) error {
+			t, err := decode[data.DumpTicket](v)
+			if err != nil {
+				return err
+			}
+			if isZero(t.Uses) || isZero(t.Attempts) || (t.Expires != nil && t.Expires.Before(now)) {
+				dead = append(dead, t)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, t := range dead {
+			if err := deleteTicket(tx, t); err != nil {
+				return err
+			}
+		}
+		result.Tickets = len(dead)
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("Bolt.clean (tickets) - %w", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) (err error) {
+		result.TicketDenylist, err = deleteWhere(tx.Bucket(denylistBucket), nil, func(d *data.DumpDenied) bool {
+			return d.Expires.Before(now)
+		})
+		return err
+	})
+	if err != nil {
+		return result, fmt.Errorf("Bolt.clean (ticket denylist) - %w", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) (err error) {
+		result.LoginLogs, err = cleanLoginLogs(tx, opts.LoginLogRetention, now)
+		return err
+	})
+	if err != nil {
+		return result, fmt.Errorf("Bolt.clean (login logs) - %w", err)
+	}
+
+	// Expired and unlocked locks are only kept so that older login logs
+	// don't count towards a new lock, which they can't once they're older
+	// than data.MAX_LOCKOUT_WINDOW.
+	cutoff := now.Add(-data.MAX_LOCKOUT_WINDOW * time.Second)
+	err = db.Update(func(tx *bbolt.Tx) (err error) {
+		result.UserLocks, err = deleteWhere(tx.Bucket(userLocksBucket), nil, func(l *data.DumpUserLock) bool {
+			return (l.LockedUntil == nil || l.LockedUntil.Before(now)) && l.Reset.Before(cutoff)
+		})
+		return err
+	})
+	if err != nil {
+		return result, fmt.Errorf("Bolt.clean (user locks) - %w", err)
+	}
+
+	return result, nil
+}
+
+func (db DB) GetProject(ctx context.Context, id string) (*data.Project, error) {
+	var project *data.Project
+	err := db.View(func(tx *bbolt.Tx) error {
+		p, err := get[data.DumpProject](tx.Bucket(projectsBucket), []byte(id))
+		if p != nil {
+			project = &p.Project
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Bolt.GetProject - %w", err)
+	}
+	return project, nil
+}
+
+func (db DB) GetUpdatedProjects(ctx context.Context, timestamp time.Time) ([]*data.Project, error) {
+	var projects []*data.Project
+	err := db.View(func(tx *bbolt.Tx) error {
+		return each(tx.Bucket(projectsBucket), nil, func(k []byte, v []byte) error {
+			p, err := decode[data.DumpProject](v)
+			if err != nil {
+				return err
+			}
+			if p.Updated.After(timestamp) {
+				projects = append(projects, &p.Project)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Bolt.GetUpdatedProjects - %w", err)
+	}
+	return projects, nil
+}
+
+func (db DB) TOTPCreate(ctx context.Context, opts data.TOTPCreate) (data.TOTPCreateResult, error) {
+	var result data.TOTPCreateResult
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(totpsBucket)
+		pending := opts.Expires != nil
+
+		// An update doesn't increase the count, so a project+user+type which
+		// already exists (pending or not) can always be "added".
+		if max := opts.Max; max > 0 {
+			typePrefix := key(opts.ProjectId, opts.UserId, opts.Type)
+			count := 0
+			exists := false
+			err := each(b, key(opts.ProjectId), func(k []byte, v []byte) error {
+				if bytes.HasPrefix(k, typePrefix) {
+					exists = true
+					return errStop
+				}
+				count += 1
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if !exists && count >= max {
+				result.Status = data.TOTP_CREATE_MAX
+				return nil
+			}
+		}
+
+		err := put(b, totpKey(opts.ProjectId, opts.UserId, opts.Type, pending), data.DumpTOTP{
+			ProjectId: opts.ProjectId,
+			UserId:    opts.UserId,
+			Type:      opts.Type,
+			Pending:   pending,
+			Secret:    opts.Secret,
+			Expires:   opts.Expires,
+			Created:   time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		// a confirmed TOTP replaces the pending one
+		if !pending {
+			if err := b.Delete(totpKey(opts.ProjectId, opts.UserId, opts.Type, true)); err != nil {
+				return err
+			}
+		}
+		result.Status = data.TOTP_CREATE_OK
+		return nil
+	})
+
+	if err != nil {
+		return result, fmt.Errorf("Bolt.TOTPCreate - %w", err)
+	}
+	return result, nil
+}
+
+func (db DB) TOTPGet(ctx context.Context, opts data.TOTPGet) (data.TOTPGetResult, error) {
+	var result data.TOTPGetResult
+
+	err := db.View(func(tx *bbolt.Tx) error {
+		t, err := get[data.DumpTOTP](tx.Bucket(totpsBucket), totpKey(opts.ProjectId, opts.UserId, opts.Type, opts.Pending))
+		if err != nil {
+			return err
+		}
+		if t == nil || (t.Pending && (t.Expires == nil || !t.Expires.After(time.Now()))) {
+			result.Status = data.TOTP_GET_NOT_FOUND
+			return nil
+		}
+		result.Status = data.TOTP_GET_OK
+		result.Secret = t.Secret
+		return nil
+	})
+
+	if err != nil {
+		return result, fmt.Errorf("Bolt.TOTPGet - %w", err)
+	}
+	return result, nil
+}
+
+func (db DB) TOTPDelete(ctx context.Context, opts data.TOTPGet) (int, error) {
+	prefix := key(opts.ProjectId, opts.UserId)
+	if !opts.AllTypes {
+		prefix = key(opts.ProjectId, opts.UserId, opts.Type)
+	}
+
+	deleted := 0
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(totpsBucket)
+		keys, err := keysWithPrefix(b, prefix)
+		if err != nil {
+			return err
+		}
+		deleted = len(keys)
+		return deleteKeys(b, keys)
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("Bolt.TOTPDelete - %w", err)
+	}
+	return deleted, nil
+}
+
+func (db DB) TicketCreate(ctx context.Context, opts data.TicketCreate) (data.TicketCreateResult, error) {
+	var result data.TicketCreateResult
+
+	projectId := opts.ProjectId
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(ticketsBucket)
+		if max := opts.Max; max > 0 {
+			count, err := countWithPrefix(b, key(projectId))
+			if err != nil {
+				return err
+			}
+			if count+len(opts.Tickets) > max {
+				result.Status = data.TICKET_CREATE_MAX
+				return nil
+			}
+		}
+
+		// like the sql storages, a duplicate (with an existing ticket or
+		// within the batch) means none of the batch is created. Tickets are
+		// put as we go, so the second of a pair within the batch is found.
+		result.Status = data.TICKET_CREATE_OK
+		now := time.Now()
+		for _, t := range opts.Tickets {
+			if b.Get(ticketKey(projectId, t.Ticket)) != nil {
+				result.Status = data.TICKET_CREATE_DUPLICATE
+				return errTicketDuplicate
+			}
+			err := putTicket(tx, &data.DumpTicket{
+				ProjectId:        projectId,
+				Ticket:           t.Ticket,
+				Payload:          t.Payload,
+				PayloadEncrypted: t.PayloadEncrypted,
+				Uses:             t.Uses,
+				Expires:          t.Expires,
+				SlidingTTL:       t.SlidingTTL,
+				Scope:            t.Scope,
+				Attempts:         t.Attempts,
+				Created:          now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err == errTicketDuplicate {
+		// returned to roll back whatever of the batch was put
+		return result, nil
+	}
+	if err != nil {
+		return result, fmt.Errorf("Bolt.TicketCreate - %w", err)
+	}
+	return result, nil
+}
+
+func (db DB) TicketUse(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error) {
+	var result data.TicketUseResult
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		now := time.Now()
+		t, err := liveTicket(tx, opts.ProjectId, opts.Ticket, now)
+		if err != nil {
+			return err
+		}
+
+		if t == nil {
+			result.Status = data.TICKET_USE_NOT_FOUND
+			if scope := opts.Scope; scope != nil {
+				return ticketFailedAttempt(tx, opts.ProjectId, scope)
+			}
+			return nil
+		}
+
+		if t.Uses != nil {
+			*t.Uses -= 1
+		}
+		if ttl := t.SlidingTTL; ttl != nil {
+			expires := now.Add(time.Duration(*ttl) * time.Second)
+			t.Expires = &expires
+		}
+		if err := putTicket(tx, t); err != nil {
+			return err
+		}
+
+		result.Status = data.TICKET_USE_OK
+		result.Uses = t.Uses
+		result.PayloadEncrypted = t.PayloadEncrypted
+		if t.Payload != nil {
+			result.Payload = &t.Payload
+		}
+		return nil
+	})
+
+	if err != nil {
+		return result, fmt.Errorf("Bolt.TicketUse - %w", err)
+	}
+	return result, nil
+}
+
+func (db DB) TicketDelete(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error) {
+	var result data.TicketUseResult
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		t, err := liveTicket(tx, opts.ProjectId, opts.Ticket, time.Now())
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			result.Status = data.TICKET_USE_NOT_FOUND
+			return nil
+		}
+		result.Status = data.TICKET_USE_OK
+		result.Uses = t.Uses
+		return deleteTicket(tx, t)
+	})
+
+	if err != nil {
+		return result, fmt.Errorf("Bolt.TicketDelete - %w", err)
+	}
+	return result, nil
+}
+
+func (db DB) TicketExtend(ctx context.Context, opts data.TicketExtend) (data.TicketUseResult, error) {
+	var result data.TicketUseResult
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		t, err := liveTicket(tx, opts.ProjectId, opts.Ticket, time.Now())
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			result.Status = data.TICKET_USE_NOT_FOUND
+			return nil
+		}
+
+		if expires := opts.Expires; expires != nil {
+			t.Expires = expires
+		}
+		if uses := opts.Uses; uses != nil && t.Uses != nil {
+			*t.Uses += *uses
+		}
+		result.Status = data.TICKET_USE_OK
+		result.Uses = t.Uses
+		return putTicket(tx, t)
+	})
+
+	if err != nil {
+		return result, fmt.Errorf("Bolt.TicketExtend - %w", err)
+	}
+	return result, nil
+}
+
+// Returns TICKET_USE_OK the first time a ticket is denied and
+// TICKET_USE_NOT_FOUND if it already was (i.e. it's already been used).
+func (db DB) TicketDeny(ctx context.Context, opts data.TicketDeny) (data.TicketUseResult, error) {
+	var result data.TicketUseResult
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(denylistBucket)
+		k := ticketKey(opts.ProjectId, opts.Ticket)
+		if b.Get(k) != nil {
+			result.Status = data.TICKET_USE_NOT_FOUND
+			return nil
+		}
+		result.Status = data.TICKET_USE_OK
+		return put(b, k, data.DumpDenied{
+			ProjectId: opts.ProjectId,
+			Ticket:    opts.Ticket,
+			Expires:   opts.Expires,
+		})
+	})
+
+	if err != nil {
+		return result, fmt.Errorf("Bolt.TicketDeny - %w", err)
+	}
+	return result, nil
+}
+
+func (db DB) LoginLogCreate(ctx context.Context, opts data.LoginLogCreate) (data.LoginLogCreateResult, error) {
+	var result data.LoginLogCreateResult
+
+	projectId := opts.ProjectId
+	userId := opts.UserId
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		if max := opts.Max; max > 0 {
+			count, err := countWithPrefix(tx.Bucket(loginLogsBucket), key(projectId))
+			if err != nil {
+				return err
+			}
+			if count >= max {
+				result.Status = data.LOGIN_LOG_CREATE_MAX
+				return nil
+			}
+		}
+
+		// must happen before the insert, else we'd always find ourselves
+		if opts.TracksHistory() {
+			var ip, device data.LoginHistory
+			err := eachUserLoginLog(tx, projectId, userId, nil, func(l *data.DumpLoginLog) error {
+				if !opts.Succeeded(l.Status) {
+					return nil
+				}
+				ip.Add(l.IpPrefix, l.Ip, opts.IpPrefix)
+				device.Add(l.Device, l.UserAgent, opts.Device)
+				if (ip.Known || opts.IpPrefix == nil) && (device.Known || opts.Device == nil) {
+					return errStop
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			result.NewIp = ip.IsNew(opts.IpPrefix)
+			result.NewDevice = device.IsNew(opts.Device)
+		}
+
+		err := putLoginLog(tx, &data.DumpLoginLog{
+			Id:         opts.Id,
+			ProjectId:  projectId,
+			UserId:     userId,
+			Status:     opts.Status,
+			Payload:    opts.Payload,
+			PayloadKey: opts.PayloadKey,
+			Created:    time.Now(),
+			Ip:         opts.Ip,
+			UserAgent:  opts.UserAgent,
+			Method:     opts.Method,
+			Country:    opts.Country,
+			IpPrefix:   opts.IpPrefix,
+			Device:     opts.Device,
+		})
+		if err != nil {
+			return err
+		}
+
+		if retain := opts.RetainCount; retain > 0 {
+			var old [][]byte
+			n := 0
+			err := eachReverse(tx.Bucket(loginLogsByUserBucket), key(projectId, userId), nil, func(k []byte, v []byte) error {
+				n += 1
+				if n > retain {
+					old = append(old, copyBytes(v))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, primary := range old {
+				if err := deleteLoginLog(tx, primary); err != nil {
+					return err
+				}
+			}
+		}
+
+		if rules := opts.Lockout; len(rules) > 0 {
+			lockedUntil, err := userLockEvaluate(tx, projectId, userId, opts.Status, rules)
+			if err != nil {
+				return err
+			}
+			result.LockedUntil = lockedUntil
+		}
+
+		result.Status = data.LOGIN_LOG_CREATE_OK
+		return nil
+	})
+
+	if err != nil {
+		return result, fmt.Errorf("Bolt.LoginLogCreate - %w", err)
+	}
+	return result, nil
+}
+
+func (db DB) LoginLogGet(ctx context.Context, opts data.LoginLogGet) (data.LoginLogGetResult, error) {
+	var result data.LoginLogGetResult
+
+	prefix := key(opts.ProjectId, opts.UserId)
+
+	// newest first, starting before the cursor or until
+	var end []byte
+	offset := opts.Offset
+	if cursor := opts.Cursor; cursor != nil {
+		offset = 0
+		end = append(appendTime(prefix, cursor.Created), cursor.Id...)
+	} else if until := opts.Until; until != nil {
+		end = appendTime(prefix, *until)
+	}
+
+	records := make([]data.LoginLogRecord, 0, opts.Limit)
+	err := db.View(func(tx *bbolt.Tx) error {
+		logs := tx.Bucket(loginLogsBucket)
+		return eachReverse(tx.Bucket(loginLogsByUserBucket), prefix, end, func(k []byte, v []byte) error {
+			if len(records) == opts.Limit {
+				return errStop
+			}
+
+			l, err := get[data.DumpLoginLog](logs, v)
+			if err != nil || l == nil {
+				return err
+			}
+			if since := opts.Since; since != nil && l.Created.Before(*since) {
+				return errStop
+			}
+			if !loginLogMatches(l, opts) {
+				return nil
+			}
+			if offset > 0 {
+				offset -= 1
+				return nil
+			}
+
+			record := loginLogRecord(l)
+			record.UserId = ""
+			records = append(records, record)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return result, fmt.Errorf("Bolt.LoginLogGet - %w", err)
+	}
+	result.Records = records
+	result.Status = data.LOGIN_LOG_GET_OK
+	return result, nil
+}
+
+func (db DB) LoginLogStats(ctx context.Context, opts data.LoginLogStats) (data.LoginLogStatsResult, error) {
+	var result data.LoginLogStatsResult
+
+	unit := 24 * time.Hour
+	if opts.Hourly {
+		unit = time.Hour
+	}
+
+	type bucketKey struct {
+		time   int64
+		status int
+	}
+	counts := make(map[bucketKey]int)
+	users := make(map[string]struct{})
+	failures := make(map[string]int)
+
+	prefix := key(opts.ProjectId)
+	err := db.View(func(tx *bbolt.Tx) error {
+		return eachFrom(tx.Bucket(loginLogsBucket), prefix, appendTime(prefix, opts.Since), func(k []byte, v []byte) error {
+			l, err := decode[data.DumpLoginLog](v)
+			if err != nil {
+				return err
+			}
+			if !l.Created.Before(opts.Until) {
+				return errStop
+			}
+			if len(opts.Statuses) > 0 && !contains(opts.Statuses, l.Status) {
+				return nil
+			}
+			// the zero time is midnight UTC, so this truncates to a UTC day/hour
+			counts[bucketKey{l.Created.Truncate(unit).Unix(), l.Status}] += 1
+			users[l.UserId] = struct{}{}
+			if contains(opts.FailedStatuses, l.Status) {
+				failures[l.UserId] += 1
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return result, fmt.Errorf("Bolt.LoginLogStats - %w", err)
+	}
+
+	buckets := make([]data.LoginLogStatsBucket, 0, len(counts))
+	for key, count := range counts {
+		buckets = append(buckets, data.LoginLogStatsBucket{
+			Time:   time.Unix(key.time, 0).UTC(),
+			Status: key.status,
+			Count:  count,
+		})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		a, b := buckets[i], buckets[j]
+		if !a.Time.Equal(b.Time) {
+			return a.Time.Before(b.Time)
+		}
+		return a.Status < b.Status
+	})
+	result.Buckets = buckets
+	result.DistinctUsers = len(users)
+
+	if len(opts.FailedStatuses) == 0 || opts.Top == 0 {
+		return result, nil
+	}
+
+	failing := make([]data.LoginLogStatsUser, 0, len(failures))
+	for userId, count := range failures {
+		failing = append(failing, data.LoginLogStatsUser{UserId: userId, Count: count})
+	}
+	sort.Slice(failing, func(i, j int) bool {
+		a, b := failing[i], failing[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.UserId < b.UserId
+	})
+	if len(failing) > opts.Top {
+		failing = failing[:opts.Top]
+	}
+	result.TopFailing = failing
+
+	return result, nil
+}
+
+func (db DB) LoginLogDelete(ctx context.Context, opts data.LoginLogDelete) (int, error) {
+	// without either, we'd delete all of the project's logs
+	if opts.UserId == "" && len(opts.Ids) == 0 {
+		return 0, nil
+	}
+
+	deleted := 0
+	err := db.Update(func(tx *bbolt.Tx) error {
+		var primaries [][]byte
+		if len(opts.Ids) == 0 {
+			err := each(tx.Bucket(loginLogsByUserBucket), key(opts.ProjectId, opts.UserId), func(k []byte, v []byte) error {
+				primaries = append(primaries, copyBytes(v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		} else {
+			logs := tx.Bucket(loginLogsBucket)
+			byId := tx.Bucket(loginLogsByIdBucket)
+			for _, id := range opts.Ids {
+				primary := byId.Get([]byte(id))
+				if primary == nil || !bytes.HasPrefix(primary, key(opts.ProjectId)) {
+					continue
+				}
+				if opts.UserId != "" {
+					l, err := get[data.DumpLoginLog](logs, primary)
+					if err != nil {
+						return err
+					}
+					if l == nil || l.UserId != opts.UserId {
+						continue
+					}
+				}
+				primaries = append(primaries, copyBytes(primary))
+			}
+		}
+
+		for _, primary := range primaries {
+			if err := deleteLoginLog(tx, primary); err != nil {
+				return err
+			}
+		}
+		deleted = len(primaries)
+		return nil
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("Bolt.LoginLogDelete - %w", err)
+	}
+	return deleted, nil
+}
+
+// Reads loginLogExportBatch logs per (read) transaction and calls fn
+// outside of it, so that a slow fn doesn't keep a transaction open.
+func (db DB) LoginLogExport(ctx context.Context, opts data.LoginLogExport, fn func(data.LoginLogRecord) error) error {
+	bucket := loginLogsBucket
+	prefix := key(opts.ProjectId)
+	if opts.UserId != "" {
+		bucket = loginLogsByUserBucket
+		prefix = key(opts.ProjectId, opts.UserId)
+	}
+
+	start := prefix
+	if since := opts.Since; since != nil {
+		start = appendTime(prefix, *since)
+	}
+
+	batch := make([]data.LoginLogRecord, 0, loginLogExportBatch)
+	for {
+		// set when there's at least one more log after this batch
+		more := false
+		batch = batch[:0]
+		err := db.View(func(tx *bbolt.Tx) error {
+			logs := tx.Bucket(loginLogsBucket)
+			return eachFrom(tx.Bucket(bucket), prefix, start, func(k []byte, v []byte) error {
+				if len(batch) == loginLogExportBatch {
+					// the next batch starts here
+					start = copyBytes(k)
+					more = true
+					return errStop
+				}
+
+				primary := k
+				if opts.UserId != "" {
+					primary = v
+				}
+				l, err := get[data.DumpLoginLog](logs, primary)
+				if err != nil || l == nil {
+					return err
+				}
+				if until := opts.Until; until != nil && !l.Created.Before(*until) {
+					return errStop
+				}
+				batch = append(batch, loginLogRecord(l))
+				return nil
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("Bolt.LoginLogExport - %w", err)
+		}
+
+		for _, record := range batch {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+
+		if !more {
+			return nil
+		}
+	}
+}
+
+// Used to encrypt payloads created before payload encryption existed
+func (db DB) LoginLogGetUnencrypted(ctx context.Context, limit int) ([]data.LoginLogRecord, error) {
+	records := make([]data.LoginLogRecord, 0, limit)
+	err := db.View(func(tx *bbolt.Tx) error {
+		return each(tx.Bucket(loginLogsBucket), nil, func(k []byte, v []byte) error {
+			if len(records) == limit {
+				return errStop
+			}
+			l, err := decode[data.DumpLoginLog](v)
+			if err != nil {
+				return err
+			}
+			if l.Payload != nil && l.PayloadKey == 0 {
+				records = append(records, data.LoginLogRecord{Id: l.Id, RawPayload: l.Payload})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Bolt.LoginLogGetUnencrypted - %w", err)
+	}
+	return records, nil
+}
+
+func (db DB) LoginLogUpdatePayload(ctx context.Context, opts data.LoginLogUpdatePayload) error {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		primary := tx.Bucket(loginLogsByIdBucket).Get([]byte(opts.Id))
+		if primary == nil {
+			return nil
+		}
+		logs := tx.Bucket(loginLogsBucket)
+		l, err := get[data.DumpLoginLog](logs, primary)
+		if err != nil || l == nil {
+			return err
+		}
+		l.Payload = opts.Payload
+		l.PayloadKey = opts.PayloadKey
+		return put(logs, primary, l)
+	})
+	if err != nil {
+		return fmt.Errorf("Bolt.LoginLogUpdatePayload - %w", err)
+	}
+	return nil
+}
+
+func (db DB) UserLockGet(ctx context.Context, opts data.UserLockGet) (data.UserLock, error) {
+	var result data.UserLock
+	err := db.View(func(tx *bbolt.Tx) error {
+		l, err := get[data.DumpUserLock](tx.Bucket(userLocksBucket), key(opts.ProjectId, opts.UserId))
+		if l != nil {
+			result.LockedUntil = activeLock(l, time.Now())
+		}
+		return err
+	})
+	if err != nil {
+		return result, fmt.Errorf("Bolt.UserLockGet - %w", err)
+	}
+	return result, nil
+}
+
+// Returns true if the user was locked. Whether or not they were, login
+// logs up to now no longer count towards a new lock.
+func (db DB) UserUnlock(ctx context.Context, opts data.UserLockGet) (bool, error) {
+	locked := false
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(userLocksBucket)
+		k := key(opts.ProjectId, opts.UserId)
+
+		now := time.Now()
+		l, err := get[data.DumpUserLock](b, k)
+		if err != nil {
+			return err
+		}
+		locked = l != nil && activeLock(l, now) != nil
+
+		return put(b, k, data.DumpUserLock{
+			ProjectId: opts.ProjectId,
+			UserId:    opts.UserId,
+			Reset:     now,
+		})
+	})
+	if err != nil {
+		return false, fmt.Errorf("Bolt.UserUnlock - %w", err)
+	}
+	return locked, nil
+}
+
+// Mirrors the sql storages: only login logs newer than the user's last
+// lock (or unlock) are counted.
+func userLockEvaluate(tx *bbolt.Tx, projectId string, userId string, status int, rules []data.LockoutRule) (*time.Time, error) {
+	now := time.Now()
+	locks := tx.Bucket(userLocksBucket)
+	k := key(projectId, userId)
+
+	existing, err := get[data.DumpUserLock](locks, k)
+	if err != nil {
+		return nil, err
+	}
+
+	var reset *time.Time
+	var lockedUntil *time.Time
+	if existing != nil {
+		reset = &existing.Reset
+		lockedUntil = activeLock(existing, now)
+	}
+
+	duration := 0
+	for _, rule := range rules {
+		// a rule can only matter if it would lock for longer
+		if rule.Duration <= duration || !rule.Matches(status) {
+			continue
+		}
+
+		since := now.Add(-time.Duration(rule.Window) * time.Second)
+		failures := 0
+		err := eachUserLoginLog(tx, projectId, userId, &since, func(l *data.DumpLoginLog) error {
+			if l.Created.After(since) && (reset == nil || l.Created.After(*reset)) && contains(rule.Statuses, l.Status) {
+				failures += 1
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if failures >= rule.Failures {
+			duration = rule.Duration
+		}
+	}
+
+	if duration == 0 {
+		return lockedUntil, nil
+	}
+
+	until := now.Add(time.Duration(duration) * time.Second)
+	if existing != nil && existing.LockedUntil != nil && existing.LockedUntil.After(until) {
+		until = *existing.LockedUntil
+	}
+
+	err = put(locks, k, data.DumpUserLock{
+		ProjectId:   projectId,
+		UserId:      userId,
+		LockedUntil: &until,
+		Reset:       now,
+	})
+	return &until, err
+}
+
+// Applies both retentions in a single pass over login_logs_by_user,
+// where each project+user's logs sit together, oldest first.
+func cleanLoginLogs(tx *bbolt.Tx, defaultRetention data.LoginLogRetention, now time.Time) (int, error) {
+	projects := tx.Bucket(projectsBucket)
+
+	// login logs of a project which we don't know (single tenancy)
+	// use the retention passed in
+	retentions := make(map[string]data.LoginLogRetention)
+	retentionFor := func(projectId string) (data.LoginLogRetention, error) {
+		if retention, ok := retentions[projectId]; ok {
+			return retention, nil
+		}
+		retention := defaultRetention
+		p, err := get[data.DumpProject](projects, []byte(projectId))
+		if err != nil {
+			return retention, err
+		}
+		if p != nil {
+			retention = data.LoginLogRetention{
+				Count: p.LoginLogRetainCount,
+				Days:  p.LoginLogRetainDays,
+			}
+		}
+		retentions[projectId] = retention
+		return retention, nil
+	}
+
+	var old [][]byte
+	var group []byte
+	var primaries [][]byte
+	var created []time.Time
+
+	flush := func() error {
+		if len(primaries) == 0 {
+			return nil
+		}
+		projectId, _ := part(group)
+		retention, err := retentionFor(string(projectId))
+		if err != nil {
+			return err
+		}
+
+		keep := len(primaries)
+		if count := retention.Count; count > 0 && keep > count {
+			keep = count
+		}
+		for i, primary := range primaries {
+			expired := retention.Days > 0 && created[i].Before(now.Add(-time.Duration(retention.Days)*24*time.Hour))
+			if expired || i < len(primaries)-keep {
+				old = append(old, primary)
+			}
+		}
+		primaries = primaries[:0]
+		created = created[:0]
+		return nil
+	}
+
+	err := each(tx.Bucket(loginLogsByUserBucket), nil, func(k []byte, v []byte) error {
+		n := partsLength(k, 2)
+		if group == nil || !bytes.Equal(k[:n], group) {
+			if err := flush(); err != nil {
+				return err
+			}
+			group = copyBytes(k[:n])
+		}
+		primaries = append(primaries, copyBytes(v))
+		created = append(created, readTime(k[n:]))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+
+	for _, primary := range old {
+		if err := deleteLoginLog(tx, primary); err != nil {
+			return 0, err
+		}
+	}
+	return len(old), nil
+}
+
+// A ticket with no uses or attempts left, or which has expired, is
+// dead (and will be removed by Clean).
+func liveTicket(tx *bbolt.Tx, projectId string, value []byte, now time.Time) (*data.DumpTicket, error) {
+	t, err := get[data.DumpTicket](tx.Bucket(ticketsBucket), ticketKey(projectId, value))
+	if err != nil || t == nil {
+		return nil, err
+	}
+	if (t.Uses != nil && *t.Uses <= 0) || (t.Attempts != nil && *t.Attempts <= 0) {
+		return nil, nil
+	}
+	if t.Expires != nil && !t.Expires.After(now) {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// A code wasn't found. Codes are short enough to be guessed, so every
+// miss burns an attempt from all the live codes within the scope.
+func ticketFailedAttempt(tx *bbolt.Tx, projectId string, scope []byte) error {
+	tickets := tx.Bucket(ticketsBucket)
+
+	var attempted []*data.DumpTicket
+	err := each(tx.Bucket(ticketsByScopeBucket), key(projectId, string(scope)), func(k []byte, v []byte) error {
+		t, err := get[data.DumpTicket](tickets, v)
+		if err != nil {
+			return err
+		}
+		if t != nil && t.Attempts != nil && *t.Attempts > 0 {
+			*t.Attempts -= 1
+			attempted = append(attempted, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, t := range attempted {
+		if err := put(tickets, ticketKey(t.ProjectId, t.Ticket), t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Inserts or updates the ticket (and its scope index)
+func putTicket(tx *bbolt.Tx, t *data.DumpTicket) error {
+	k := ticketKey(t.ProjectId, t.Ticket)
+	if err := put(tx.Bucket(ticketsBucket), k, t); err != nil {
+		return err
+	}
+	if t.Scope == nil {
+		return nil
+	}
+	return tx.Bucket(ticketsByScopeBucket).Put(ticketScopeKey(t), k)
+}
+
+func deleteTicket(tx *bbolt.Tx, t *data.DumpTicket) error {
+	if err := tx.Bucket(ticketsBucket).Delete(ticketKey(t.ProjectId, t.Ticket)); err != nil {
+		return err
+	}
+	if t.Scope == nil {
+		return nil
+	}
+	return tx.Bucket(ticketsByScopeBucket).Delete(ticketScopeKey(t))
+}
+
+// Inserts the login log and its indexes
+func putLoginLog(tx *bbolt.Tx, l *data.DumpLoginLog) error {
+	primary := append(appendTime(key(l.ProjectId), l.Created), l.Id...)
+	if err := put(tx.Bucket(loginLogsBucket), primary, l); err != nil {
+		return err
+	}
+
+	byUser := append(appendTime(key(l.ProjectId, l.UserId), l.Created), l.Id...)
+	if err := tx.Bucket(loginLogsByUserBucket).Put(byUser, primary); err != nil {
+		return err
+	}
+	return tx.Bucket(loginLogsByIdBucket).Put([]byte(l.Id), primary)
+}
+
+// Deletes the login log (by its login_logs key) and its indexes
+func deleteLoginLog(tx *bbolt.Tx, primary []byte) error {
+	logs := tx.Bucket(loginLogsBucket)
+	l, err := get[data.DumpLoginLog](logs, primary)
+	if err != nil || l == nil {
+		return err
+	}
+	if err := logs.Delete(primary); err != nil {
+		return err
+	}
+
+	byUser := append(appendTime(key(l.ProjectId, l.UserId), l.Created), l.Id...)
+	if err := tx.Bucket(loginLogsByUserBucket).Delete(byUser); err != nil {
+		return err
+	}
+	return tx.Bucket(loginLogsByIdBucket).Delete([]byte(l.Id))
+}
+
+// Calls fn for each of the user's login logs, oldest first, optionally
+// starting at since.
+func eachUserLoginLog(tx *bbolt.Tx, projectId string, userId string, since *time.Time, fn func(*data.DumpLoginLog) error) error {
+	logs := tx.Bucket(loginLogsBucket)
+	prefix := key(projectId, userId)
+	start := prefix
+	if since != nil {
+		start = appendTime(prefix, *since)
+	}
+	return eachFrom(tx.Bucket(loginLogsByUserBucket), prefix, start, func(k []byte, v []byte) error {
+		l, err := get[data.DumpLoginLog](logs, v)
+		if err != nil || l == nil {
+			return err
+		}
+		return fn(l)
+	})
+}
+
+func loginLogRecord(l *data.DumpLoginLog) data.LoginLogRecord {
+	return data.LoginLogRecord{
+		Id:         l.Id,
+		UserId:     l.UserId,
+		Status:     l.Status,
+		Created:    l.Created,
+		Ip:         l.Ip,
+		UserAgent:  l.UserAgent,
+		Method:     l.Method,
+		Country:    l.Country,
+		RawPayload: l.Payload,
+		PayloadKey: l.PayloadKey,
+	}
+}
+
+// The user, until and cursor are handled by the range being scanned
+// (and since by where the scan stops).
+func loginLogMatches(l *data.DumpLoginLog, opts data.LoginLogGet) bool {
+	if len(opts.Statuses) > 0 && !contains(opts.Statuses, l.Status) {
+		return false
+	}
+	if opts.Until != nil && !l.Created.Before(*opts.Until) {
+		return false
+	}
+	for _, f := range [...]struct {
+		actual *string
+		value  string
+	}{
+		{l.Ip, opts.Ip},
+		{l.UserAgent, opts.UserAgent},
+		{l.Method, opts.Method},
+		{l.Country, opts.Country},
+	} {
+		if f.value != "" && (f.actual == nil || *f.actual != f.value) {
+			return false
+		}
+	}
+	return true
+}
+
+func activeLock(l *data.DumpUserLock, now time.Time) *time.Time {
+	if l.LockedUntil == nil || !l.LockedUntil.After(now) {
+		return nil
+	}
+	until := *l.LockedUntil
+	return &until
+}
+
+func totpKey(projectId string, userId string, tpe string, pending bool) []byte {
+	k := key(projectId, userId, tpe)
+	if pending {
+		return append(k, 1)
+	}
+	return append(k, 0)
+}
+
+// the ticket is last, so it doesn't need a length
+func ticketKey(projectId string, ticket []byte) []byte {
+	return append(key(projectId), ticket...)
+}
+
+func ticketScopeKey(t *data.DumpTicket) []byte {
+	return append(key(t.ProjectId, string(t.Scope)), t.Ticket...)
+}
+
+// Each part is prefixed with its (uvarint) length
+func key(parts ...string) []byte {
+	n := 0
+	for _, p := range parts {
+		n += len(p) + binary.MaxVarintLen64
+	}
+	k := make([]byte, 0, n+8)
+	for _, p := range parts {
+		k = binary.AppendUvarint(k, uint64(len(p)))
+		k = append(k, p...)
+	}
+	return k
+}
+
+// Returns the first part of k (without its length) and the rest of k
+func part(k []byte) ([]byte, []byte) {
+	length, n := binary.Uvarint(k)
+	end := n + int(length)
+	return k[n:end], k[end:]
+}
+
+// The number of bytes taken up by the first count parts of k
+func partsLength(k []byte, count int) int {
+	rest := k
+	for i := 0; i < count; i++ {
+		_, rest = part(rest)
+	}
+	return len(k) - len(rest)
+}
+
+// Appends to a copy of k, so that a shared prefix isn't modified
+func appendTime(k []byte, t time.Time) []byte {
+	appended := make([]byte, len(k), len(k)+8+36)
+	copy(appended, k)
+	return binary.BigEndian.AppendUint64(appended, uint64(t.UnixNano()))
+}
+
+func readTime(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+}
+
+func get[T any](b *bbolt.Bucket, k []byte) (*T, error) {
+	v := b.Get(k)
+	if v == nil {
+		return nil, nil
+	}
+	return decode[T](v)
+}
+
+func decode[T any](v []byte) (*T, error) {
+	var value T
+	if err := json.Unmarshal(v, &value); err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func put(b *bbolt.Bucket, k []byte, value any) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put(k, encoded)
+}
+
+// Calls fn for each key starting with prefix (every key when prefix is
+// nil), in order. fn can return errStop to stop early. Keys and values
+// are only valid until the transaction ends, and the bucket must not be
+// changed until each returns.
+func each(b *bbolt.Bucket, prefix []byte, fn func(k []byte, v []byte) error) error {
+	return eachFrom(b, prefix, prefix, fn)
+}
+
+// Like each, but starting at the first key >= start.
+func eachFrom(b *bbolt.Bucket, prefix []byte, start []byte, fn func(k []byte, v []byte) error) error {
+	c := b.Cursor()
+	var k, v []byte
+	if start == nil {
+		k, v = c.First()
+	} else {
+		k, v = c.Seek(start)
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			if err == errStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Like each, but in reverse, starting at the last key < end (or the last
+// key with prefix when end is nil).
+func eachReverse(b *bbolt.Bucket, prefix []byte, end []byte, fn func(k []byte, v []byte) error) error {
+	if end == nil {
+		end = prefixEnd(prefix)
+	}
+
+	c := b.Cursor()
+	var k, v []byte
+	if end == nil {
+		k, v = c.Last()
+	} else if k, _ = c.Seek(end); k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Prev() {
+		if err := fn(k, v); err != nil {
+			if err == errStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// The first key which sorts after every key starting with prefix, or
+// nil if there isn't one.
+func prefixEnd(prefix []byte) []byte {
+	end := copyBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i] += 1
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func keysWithPrefix(b *bbolt.Bucket, prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	err := each(b, prefix, func(k []byte, v []byte) error {
+		keys = append(keys, copyBytes(k))
+		return nil
+	})
+	return keys, err
+}
+
+func countWithPrefix(b *bbolt.Bucket, prefix []byte) (int, error) {
+	count := 0
+	err := each(b, prefix, func(k []byte, v []byte) error {
+		count += 1
+		return nil
+	})
+	return count, err
+}
+
+func deleteKeys(b *bbolt.Bucket, keys [][]byte) error {
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// For buckets without indexes. Returns the number of deleted values.
+func deleteWhere[T any](b *bbolt.Bucket, prefix []byte, match func(*T) bool) (int, error) {
+	var keys [][]byte
+	err := each(b, prefix, func(k []byte, v []byte) error {
+		value, err := decode[T](v)
+		if err != nil {
+			return err
+		}
+		if match(value) {
+			keys = append(keys, copyBytes(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := deleteKeys(b, keys); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// bbolt's keys and values can't be used after their transaction, or
+// after the bucket changes
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+func contains[T comparable](values []T, value T) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func isZero(value *int) bool {
+	return value != nil && *value == 0
+}
+
+// Calls fn for every row. Everything is read in a single (read)
+// transaction, so this is a consistent copy.
+func (db DB) Dump(fn func(data.DumpRecord) error) error {
+	err := db.View(func(tx *bbolt.Tx) error {
+		if err := dumpBucket(tx, projectsBucket, fn, func(p *data.DumpProject) data.DumpRecord {
+			return data.DumpRecord{Project: p}
+		}); err != nil {
+			return err
+		}
+		if err := dumpBucket(tx, totpsBucket, fn, func(t *data.DumpTOTP) data.DumpRecord {
+			return data.DumpRecord{TOTP: t}
+		}); err != nil {
+			return err
+		}
+		if err := dumpBucket(tx, ticketsBucket, fn, func(t *data.DumpTicket) data.DumpRecord {
+			return data.DumpRecord{Ticket: t}
+		}); err != nil {
+			return err
+		}
+		if err := dumpBucket(tx, denylistBucket, fn, func(d *data.DumpDenied) data.DumpRecord {
+			return data.DumpRecord{Denied: d}
+		}); err != nil {
+			return err
+		}
+		if err := dumpBucket(tx, loginLogsBucket, fn, func(l *data.DumpLoginLog) data.DumpRecord {
+			return data.DumpRecord{LoginLog: l}
+		}); err != nil {
+			return err
+		}
+		return dumpBucket(tx, userLocksBucket, fn, func(l *data.DumpUserLock) data.DumpRecord {
+			return data.DumpRecord{UserLock: l}
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("Bolt.Dump - %w", err)
+	}
+	return nil
+}
+
+// Inserts (or replaces) the rows, in a single transaction.
+func (db DB) Load(records []data.DumpRecord) error {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for _, record := range records {
+			var err error
+			switch {
+			case record.Project != nil:
+				p := record.Project
+				err = put(tx.Bucket(projectsBucket), []byte(p.Id), p)
+			case record.TOTP != nil:
+				t := record.TOTP
+				err = put(tx.Bucket(totpsBucket), totpKey(t.ProjectId, t.UserId, t.Type, t.Pending), t)
+			case record.Ticket != nil:
+				err = putTicket(tx, record.Ticket)
+			case record.Denied != nil:
+				d := record.Denied
+				err = put(tx.Bucket(denylistBucket), ticketKey(d.ProjectId, d.Ticket), d)
+			case record.LoginLog != nil:
+				// replacing a login log has to remove its old index entries
+				// (its created or user could be different)
+				if primary := tx.Bucket(loginLogsByIdBucket).Get([]byte(record.LoginLog.Id)); primary != nil {
+					if err := deleteLoginLog(tx, copyBytes(primary)); err != nil {
+						return err
+					}
+				}
+				err = putLoginLog(tx, record.LoginLog)
+			case record.UserLock != nil:
+				l := record.UserLock
+				err = put(tx.Bucket(userLocksBucket), key(l.ProjectId, l.UserId), l)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Bolt.Load - %w", err)
+	}
+	return nil
+}
+
+// The number of rows of each kind (keyed by data.DumpRecord.Kind), so
+// that an import can be checked without reading everything back.
+func (db DB) Counts() (map[string]int, error) {
+	var counts map[string]int
+	err := db.View(func(tx *bbolt.Tx) error {
+		n := func(name []byte) int {
+			return tx.Bucket(name).Stats().KeyN
+		}
+		counts = data.DumpCounts(n(projectsBucket), n(totpsBucket), n(ticketsBucket), n(denylistBucket), n(loginLogsBucket), n(userLocksBucket))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Bolt.Counts - %w", err)
+	}
+	return counts, nil
+}
+
+func dumpBucket[T any](tx *bbolt.Tx, name []byte, fn func(data.DumpRecord) error, record func(*T) data.DumpRecord) error {
+	return each(tx.Bucket(name), nil, func(k []byte, v []byte) error {
+		value, err := decode[T](v)
+		if err != nil {
+			return err
+		}
+		return fn(record(value))
+	})
+}
@@ -0,0 +1,466 @@
+package bolt
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bbolt "go.etcd.io/bbolt"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/utils/uuid"
+)
+
+func Test_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authen.db")
+
+	db, err := New(Config{Path: path})
+	assert.Nil(t, err)
+	uses := 3
+	db.PutProject(data.Project{Id: "p1", TOTPMax: 9})
+	db.TicketCreate(context.Background(), data.TicketCreate{ProjectId: "p1", Tickets: []data.TicketCreateTicket{{Ticket: []byte("t1"), Uses: &uses}}})
+	db.LoginLogCreate(context.Background(), data.LoginLogCreate{Id: "l1", ProjectId: "p1", UserId: "u1", Status: 2, Payload: []byte("pl1")})
+	assert.Nil(t, db.Close())
+
+	db, err = New(Config{Path: path})
+	assert.Nil(t, err)
+	defer db.Close()
+
+	p, _ := db.GetProject(context.Background(), "p1")
+	assert.Equal(t, p.TOTPMax, 9)
+
+	ticket, _ := db.TicketUse(context.Background(), data.TicketUse{ProjectId: "p1", Ticket: []byte("t1")})
+	assert.Equal(t, *ticket.Uses, 2)
+
+	logs, _ := db.LoginLogGet(context.Background(), data.LoginLogGet{ProjectId: "p1", UserId: "u1", Limit: 10})
+	assert.Equal(t, len(logs.Records), 1)
+	assert.Equal(t, string(logs.Records[0].RawPayload), "pl1")
+}
+
+func Test_Clean_Totps(t *testing.T) {
+	withTestDB(t, func(db DB) {
+		projectId := uuid.String()
+		load(db,
+			data.DumpRecord{TOTP: &data.DumpTOTP{ProjectId: projectId, UserId: "uid1", Expires: at(-1)}},
+			data.DumpRecord{TOTP: &data.DumpTOTP{ProjectId: projectId, UserId: "uid2", Expires: at(-999)}},
+			data.DumpRecord{TOTP: &data.DumpTOTP{ProjectId: projectId, UserId: "uid3", Expires: at(5)}},
+			data.DumpRecord{TOTP: &data.DumpTOTP{ProjectId: projectId, UserId: "uid4"}},
+		)
+
+		result, err := db.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.TOTPs, 2)
+		records := dump(db)
+		assert.Equal(t, len(records), 2)
+		for _, record := range records {
+			assert.True(t, record.TOTP.UserId == "uid3" || record.TOTP.UserId == "uid4")
+		}
+	})
+}
+
+func Test_Clean_Tickets(t *testing.T) {
+	withTestDB(t, func(db DB) {
+		projectId := uuid.String()
+		zero, one := 0, 1
+		load(db,
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t1"), Expires: at(-1)}},
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t2"), Expires: at(-999), Scope: []byte("s1"), Attempts: &one}},
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t3"), Uses: &zero}},
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t4"), Expires: at(5), Uses: &one, Attempts: &one, Scope: []byte("s1")}},
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t5")}},
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t6"), Attempts: &zero}},
+		)
+
+		result, err := db.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.Tickets, 4)
+		records := dump(db)
+		assert.Equal(t, len(records), 2)
+		assert.Equal(t, string(records[0].Ticket.Ticket), "t4")
+		assert.Equal(t, string(records[1].Ticket.Ticket), "t5")
+
+		// the dead ticket's scope index entry is gone too
+		assert.Equal(t, bucketLen(db, ticketsByScopeBucket), 1)
+	})
+}
+
+func Test_Clean_TicketDenylist(t *testing.T) {
+	withTestDB(t, func(db DB) {
+		projectId := uuid.String()
+		db.TicketDeny(context.Background(), data.TicketDeny{ProjectId: projectId, Ticket: []byte("t1"), Expires: *at(-1)})
+		db.TicketDeny(context.Background(), data.TicketDeny{ProjectId: projectId, Ticket: []byte("t2"), Expires: *at(5)})
+
+		result, err := db.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.TicketDenylist, 1)
+		records := dump(db)
+		assert.Equal(t, len(records), 1)
+		assert.Equal(t, string(records[0].Denied.Ticket), "t2")
+	})
+}
+
+func Test_Clean_LoginLogs(t *testing.T) {
+	withTestDB(t, func(db DB) {
+		db.PutProject(data.Project{Id: "p1", LoginLogRetainCount: 2})
+		db.PutProject(data.Project{Id: "p2", LoginLogRetainDays: 1})
+		db.PutProject(data.Project{Id: "p3"})
+
+		load(db,
+			loginLog("l1", "p1", "u1", 1, 0),
+			loginLog("l2", "p1", "u1", 2, -60),
+			loginLog("l3", "p1", "u1", 3, -120),
+			loginLog("l4", "p1", "u2", 4, -120),
+			loginLog("l5", "p2", "u1", 5, -82800),
+			loginLog("l6", "p2", "u1", 6, -90000),
+			loginLog("l7", "p3", "u1", 7, -86400000),
+			loginLog("l8", "st", "u1", 8, 0),
+			loginLog("l9", "st", "u1", 9, -60),
+			loginLog("l10", "st", "u2", 10, -172800),
+		)
+
+		assertStatuses := func(statuses ...int) {
+			t.Helper()
+			actual := make(map[int]bool)
+			for _, record := range dump(db) {
+				if l := record.LoginLog; l != nil {
+					actual[l.Status] = true
+				}
+			}
+			assert.Equal(t, len(actual), len(statuses))
+			for _, status := range statuses {
+				assert.True(t, actual[status])
+			}
+			// the indexes are kept in sync
+			assert.Equal(t, bucketLen(db, loginLogsByUserBucket), len(statuses))
+			assert.Equal(t, bucketLen(db, loginLogsByIdBucket), len(statuses))
+		}
+
+		// no default retention, logs without a project are kept
+		result, err := db.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.LoginLogs, 2)
+		assertStatuses(1, 2, 4, 5, 7, 8, 9, 10)
+
+		result, err = db.Clean(context.Background(), data.Clean{LoginLogRetention: data.LoginLogRetention{Days: 1}})
+		assert.Nil(t, err)
+		assert.Equal(t, result.LoginLogs, 1)
+		assertStatuses(1, 2, 4, 5, 7, 8, 9)
+
+		result, err = db.Clean(context.Background(), data.Clean{LoginLogRetention: data.LoginLogRetention{Count: 1}})
+		assert.Nil(t, err)
+		assert.Equal(t, result.LoginLogs, 1)
+		assertStatuses(1, 2, 4, 5, 7, 8)
+	})
+}
+
+func Test_Clean_UserLocks(t *testing.T) {
+	withTestDB(t, func(db DB) {
+		load(db,
+			data.DumpRecord{UserLock: &data.DumpUserLock{ProjectId: "p1", UserId: "u1", LockedUntil: at(60), Reset: *at(-172800)}},
+			data.DumpRecord{UserLock: &data.DumpUserLock{ProjectId: "p1", UserId: "u2", LockedUntil: at(-60), Reset: *at(-172800)}},
+			data.DumpRecord{UserLock: &data.DumpUserLock{ProjectId: "p1", UserId: "u3", Reset: *at(-172800)}},
+			data.DumpRecord{UserLock: &data.DumpUserLock{ProjectId: "p1", UserId: "u4", Reset: *at(-3600)}},
+		)
+
+		result, err := db.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.UserLocks, 2)
+		records := dump(db)
+		assert.Equal(t, len(records), 2)
+		assert.Equal(t, records[0].UserLock.UserId, "u1")
+		assert.Equal(t, records[1].UserLock.UserId, "u4")
+	})
+}
+
+func Test_TicketUse_SlidingTTL(t *testing.T) {
+	withTestDB(t, func(db DB) {
+		projectId := uuid.String()
+		five, ttl := 5, 3600
+		load(db,
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t1"), Uses: &five, Expires: at(10), SlidingTTL: &ttl}},
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t2"), Uses: &five, Expires: at(10)}},
+		)
+
+		for _, value := range []string{"t1", "t2"} {
+			res, err := db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId, Ticket: []byte(value)})
+			assert.Nil(t, err)
+			assert.Equal(t, res.Status, data.TICKET_USE_OK)
+			assert.Equal(t, *res.Uses, 4)
+		}
+
+		records := dump(db)
+		assert.Timeish(t, *records[0].Ticket.Expires, time.Now().Add(time.Hour))
+		assert.Timeish(t, *records[1].Ticket.Expires, time.Now().Add(time.Second*10))
+	})
+}
+
+func Test_TicketExtend(t *testing.T) {
+	withTestDB(t, func(db DB) {
+		projectId := uuid.String()
+		two, zero := 2, 0
+		load(db,
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t1"), Uses: &two, Expires: at(10)}},
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t2")}},
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t3"), Uses: &zero}},
+			data.DumpRecord{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t4"), Uses: &two, Expires: at(-1)}},
+		)
+
+		extend := func(value string, expires *time.Time, uses *int) data.TicketUseResult {
+			t.Helper()
+			res, err := db.TicketExtend(context.Background(), data.TicketExtend{
+				Uses:      uses,
+				Expires:   expires,
+				Ticket:    []byte(value),
+				ProjectId: projectId,
+			})
+			assert.Nil(t, err)
+			return res
+		}
+		expiresOf := func(value string) *time.Time {
+			for _, record := range dump(db) {
+				if string(record.Ticket.Ticket) == value {
+					return record.Ticket.Expires
+				}
+			}
+			return nil
+		}
+
+		uses := 3
+		expires := time.Now().Add(time.Hour)
+
+		// dead tickets can't be extended
+		assert.Equal(t, extend("t3", nil, &uses).Status, data.TICKET_USE_NOT_FOUND)
+		assert.Equal(t, extend("t4", &expires, nil).Status, data.TICKET_USE_NOT_FOUND)
+		assert.Equal(t, extend("t9", &expires, nil).Status, data.TICKET_USE_NOT_FOUND)
+
+		// only uses
+		res := extend("t1", nil, &uses)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+		assert.Equal(t, *res.Uses, 5)
+		assert.Timeish(t, *expiresOf("t1"), time.Now().Add(time.Second*10))
+
+		// only expires
+		res = extend("t1", &expires, nil)
+		assert.Equal(t, *res.Uses, 5)
+		assert.Timeish(t, *expiresOf("t1"), expires)
+
+		// unlimited uses stay unlimited
+		res = extend("t2", &expires, &uses)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+		assert.True(t, res.Uses == nil)
+		assert.Timeish(t, *expiresOf("t2"), expires)
+	})
+}
+
+func Test_TicketDeny(t *testing.T) {
+	withTestDB(t, func(db DB) {
+		opts := data.TicketDeny{
+			ProjectId: "p1",
+			Ticket:    []byte("t1"),
+			Expires:   time.Now().Add(time.Minute),
+		}
+
+		res, err := db.TicketDeny(context.Background(), opts)
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+
+		res, err = db.TicketDeny(context.Background(), opts)
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.TICKET_USE_NOT_FOUND)
+
+		// different project
+		opts.ProjectId = "p2"
+		res, err = db.TicketDeny(context.Background(), opts)
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+
+		assert.Timeish(t, dump(db)[0].Denied.Expires, opts.Expires)
+	})
+}
+
+func Test_LoginLogExport(t *testing.T) {
+	defer func(n int) { loginLogExportBatch = n }(loginLogExportBatch)
+	loginLogExportBatch = 2
+
+	withTestDB(t, func(db DB) {
+		load(db,
+			loginLog("l1", "p1", "u1", 1, -300),
+			loginLog("l2", "p1", "u2", 2, -240),
+			loginLog("l3", "p1", "u1", 3, -180),
+			loginLog("l4", "p1", "u1", 4, -120),
+			loginLog("l5", "p1", "u2", 5, -60),
+			loginLog("l6", "p2", "u1", 6, -60),
+		)
+
+		export := func(opts data.LoginLogExport) []int {
+			t.Helper()
+			var statuses []int
+			opts.ProjectId = "p1"
+			err := db.LoginLogExport(context.Background(), opts, func(record data.LoginLogRecord) error {
+				statuses = append(statuses, record.Status)
+				return nil
+			})
+			assert.Nil(t, err)
+			return statuses
+		}
+		assertStatuses := func(actual []int, expected ...int) {
+			t.Helper()
+			assert.Equal(t, len(actual), len(expected))
+			for i, status := range expected {
+				assert.Equal(t, actual[i], status)
+			}
+		}
+
+		// not a multiple of the batch size
+		assertStatuses(export(data.LoginLogExport{}), 1, 2, 3, 4, 5)
+
+		// exact multiple of the batch size, through the user index
+		assertStatuses(export(data.LoginLogExport{UserId: "u2"}), 2, 5)
+
+		since, until := at(-200), at(-90)
+		assertStatuses(export(data.LoginLogExport{Since: since, Until: until}), 3, 4)
+		assertStatuses(export(data.LoginLogExport{UserId: "u1", Since: since, Until: until}), 3, 4)
+
+		// stops at the first error, even mid batch
+		n := 0
+		err := db.LoginLogExport(context.Background(), data.LoginLogExport{ProjectId: "p1"}, func(record data.LoginLogRecord) error {
+			n += 1
+			if n == 3 {
+				return errors.New("stop")
+			}
+			return nil
+		})
+		assert.Equal(t, err.Error(), "stop")
+		assert.Equal(t, n, 3)
+	})
+}
+
+func Test_UserUnlock(t *testing.T) {
+	withTestDB(t, func(db DB) {
+		load(db,
+			data.DumpRecord{UserLock: &data.DumpUserLock{ProjectId: "p1", UserId: "u1", LockedUntil: at(60), Reset: *at(-3600)}},
+			data.DumpRecord{UserLock: &data.DumpUserLock{ProjectId: "p1", UserId: "u2", LockedUntil: at(-1), Reset: *at(-3600)}},
+		)
+
+		unlocked, err := db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u1"})
+		assert.Nil(t, err)
+		assert.True(t, unlocked)
+
+		unlocked, _ = db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u1"})
+		assert.False(t, unlocked)
+
+		lock, _ := db.UserLockGet(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u1"})
+		assert.True(t, lock.LockedUntil == nil)
+
+		unlocked, _ = db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u2"})
+		assert.False(t, unlocked)
+
+		// unlocking a user without a lock resets their failures too
+		unlocked, _ = db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u3"})
+		assert.False(t, unlocked)
+
+		records := dump(db)
+		assert.Equal(t, len(records), 3)
+		for _, record := range records {
+			assert.True(t, record.UserLock.LockedUntil == nil)
+			assert.Nowish(t, record.UserLock.Reset)
+		}
+	})
+}
+
+func Test_Load_ReplacesLoginLog(t *testing.T) {
+	withTestDB(t, func(db DB) {
+		load(db, loginLog("l1", "p1", "u1", 1, -60))
+		load(db, loginLog("l1", "p1", "u2", 2, -30))
+
+		records := dump(db)
+		assert.Equal(t, len(records), 1)
+		assert.Equal(t, records[0].LoginLog.UserId, "u2")
+		assert.Equal(t, bucketLen(db, loginLogsByUserBucket), 1)
+
+		logs, _ := db.LoginLogGet(context.Background(), data.LoginLogGet{ProjectId: "p1", UserId: "u1", Limit: 10})
+		assert.Equal(t, len(logs.Records), 0)
+		logs, _ = db.LoginLogGet(context.Background(), data.LoginLogGet{ProjectId: "p1", UserId: "u2", Limit: 10})
+		assert.Equal(t, len(logs.Records), 1)
+	})
+}
+
+func Test_Key(t *testing.T) {
+	// a part can't bleed into the next one
+	assert.False(t, string(key("a\x01b", "c")) == string(key("a", "\x01bc")))
+
+	k := key("p1", "u1", "")
+	projectId, rest := part(k)
+	assert.Equal(t, string(projectId), "p1")
+	assert.Equal(t, partsLength(k, 2), len(key("p1", "u1")))
+	userId, rest := part(rest)
+	assert.Equal(t, string(userId), "u1")
+	empty, rest := part(rest)
+	assert.Equal(t, len(empty), 0)
+	assert.Equal(t, len(rest), 0)
+
+	now := time.Now()
+	assert.True(t, readTime(appendTime(nil, now)).Equal(now))
+
+	assert.Equal(t, string(prefixEnd([]byte{1, 2})), string([]byte{1, 3}))
+	assert.Equal(t, string(prefixEnd([]byte{1, 0xff})), string([]byte{2}))
+	assert.True(t, prefixEnd([]byte{0xff, 0xff}) == nil)
+}
+
+func withTestDB(t *testing.T, fn func(db DB)) {
+	db, err := New(Config{Path: filepath.Join(t.TempDir(), "authen.db")})
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+	fn(db)
+}
+
+// now + seconds
+func at(seconds int) *time.Time {
+	t := time.Now().Add(time.Duration(seconds) * time.Second)
+	return &t
+}
+
+func loginLog(id string, projectId string, userId string, status int, seconds int) data.DumpRecord {
+	return data.DumpRecord{LoginLog: &data.DumpLoginLog{
+		Id:        id,
+		ProjectId: projectId,
+		UserId:    userId,
+		Status:    status,
+		Created:   *at(seconds),
+	}}
+}
+
+func load(db DB, records ...data.DumpRecord) {
+	if err := db.Load(records); err != nil {
+		panic(err)
+	}
+}
+
+// projects are left out, so that tests can PutProject without having
+// to skip over them
+func dump(db DB) []data.DumpRecord {
+	var records []data.DumpRecord
+	err := db.Dump(func(record data.DumpRecord) error {
+		if record.Project == nil {
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return records
+}
+
+func bucketLen(db DB, name []byte) int {
+	n := 0
+	db.View(func(tx *bbolt.Tx) error {
+		n = tx.Bucket(name).Stats().KeyN
+		return nil
+	})
+	return n
+}
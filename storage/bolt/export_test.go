@@ -0,0 +1,39 @@
+package bolt
+
+import (
+	"time"
+
+	"src.goblgobl.com/authen/storage/data"
+)
+
+// Fixtures for the conformance suite, which has to run from an
+// external test package (storagetest imports storage which imports us)
+
+func (db DB) InsertProject(p data.Project, updated time.Time) {
+	load(db, data.DumpRecord{Project: &data.DumpProject{Project: p, Updated: updated}})
+}
+
+func (db DB) InsertLoginLog(opts data.LoginLogCreate, created time.Time) {
+	load(db, data.DumpRecord{LoginLog: &data.DumpLoginLog{
+		Id:         opts.Id,
+		ProjectId:  opts.ProjectId,
+		UserId:     opts.UserId,
+		Status:     opts.Status,
+		Payload:    opts.Payload,
+		PayloadKey: opts.PayloadKey,
+		Created:    created,
+		Ip:         opts.Ip,
+		UserAgent:  opts.UserAgent,
+		Method:     opts.Method,
+		Country:    opts.Country,
+	}})
+}
+
+func (db DB) InsertUserLock(projectId string, userId string, lockedUntil *time.Time, reset time.Time) {
+	load(db, data.DumpRecord{UserLock: &data.DumpUserLock{
+		ProjectId:   projectId,
+		UserId:      userId,
+		LockedUntil: lockedUntil,
+		Reset:       reset,
+	}})
+}
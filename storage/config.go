@@ -1,6 +1,9 @@
 package storage
 
 import (
+	"src.goblgobl.com/authen/storage/bolt"
+	"src.goblgobl.com/authen/storage/memory"
+	"src.goblgobl.com/authen/storage/mysql"
 	"src.goblgobl.com/authen/storage/pg"
 	"src.goblgobl.com/authen/storage/sqlite"
 )
@@ -10,4 +13,12 @@ type Config struct {
 	Sqlite    sqlite.Config `json:"sqlite"`
 	Postgres  pg.Config     `json:"postgres"`
 	Cockroach pg.Config     `json:"cockroach"`
+	Memory    memory.Config `json:"memory"`
+	MySQL     mysql.Config  `json:"mysql"`
+	Bolt      bolt.Config   `json:"bolt"`
+
+	// milliseconds each background storage call (reloading projects,
+	// each statement of a clean, ...) is given. 0 == no limit. Requests
+	// are bounded by http.storage_timeout instead.
+	Timeout uint32 `json:"timeout"`
 }
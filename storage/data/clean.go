@@ -0,0 +1,95 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+type Clean struct {
+	// Applies to login logs which don't belong to a project in
+	// authen_projects (i.e. the single tenancy project). Projects in
+	// authen_projects have their own retention.
+	LoginLogRetention LoginLogRetention
+
+	// SQL storages delete at most BatchSize rows per statement, sleeping
+	// Pause between statements, so that a big clean doesn't hold locks
+	// on a table for long. 0 == a single statement per table. The memory
+	// and bolt storages ignore both.
+	BatchSize int
+	Pause     time.Duration
+
+	// How long each statement (each batch) is given. 0 == no limit. The
+	// context passed to Clean bounds the whole run, pauses included.
+	BatchTimeout time.Duration
+}
+
+// The context for a single statement of a clean
+func (c Clean) BatchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.BatchTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.BatchTimeout)
+}
+
+// Calls fn, which deletes at most limit rows and returns how many it
+// deleted, until it deletes fewer than limit, waiting Pause between
+// calls. Without a BatchSize, fn is called once with a limit of 0 (no
+// limit). Each call gets its own context (see BatchContext). Returns the
+// total deleted, even on error.
+func (c Clean) Batches(ctx context.Context, fn func(ctx context.Context, limit int) (int, error)) (int, error) {
+	total := 0
+	for {
+		batchCtx, cancel := c.BatchContext(ctx)
+		n, err := fn(batchCtx, c.BatchSize)
+		cancel()
+		total += n
+		if err != nil || c.BatchSize <= 0 || n < c.BatchSize {
+			return total, err
+		}
+		if err := c.Wait(ctx); err != nil {
+			return total, err
+		}
+	}
+}
+
+// Sleeps Pause between two batches, returning early (with the
+// context's error) if ctx is done first.
+func (c Clean) Wait(ctx context.Context) error {
+	if c.Pause <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(c.Pause)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Number of rows a Clean removed, per table.
+type CleanResult struct {
+	TOTPs          int `json:"totps"`
+	Tickets        int `json:"tickets"`
+	TicketDenylist int `json:"ticket_denylist"`
+	LoginLogs      int `json:"login_logs"`
+	UserLocks      int `json:"user_locks"`
+
+	// login log partitions dropped (pg only). Their rows are included
+	// in LoginLogs.
+	Partitions int `json:"partitions"`
+}
+
+func (r *CleanResult) Add(other CleanResult) {
+	r.TOTPs += other.TOTPs
+	r.Tickets += other.Tickets
+	r.TicketDenylist += other.TicketDenylist
+	r.LoginLogs += other.LoginLogs
+	r.UserLocks += other.UserLocks
+	r.Partitions += other.Partitions
+}
+
+func (r CleanResult) Total() int {
+	return r.TOTPs + r.Tickets + r.TicketDenylist + r.LoginLogs + r.UserLocks
+}
@@ -0,0 +1,104 @@
+package data
+
+import "time"
+
+// A copy of a single row, independent of any storage, used to move data
+// from one storage to another. Exactly one of the fields is set.
+type DumpRecord struct {
+	Project  *DumpProject  `json:"project,omitempty"`
+	TOTP     *DumpTOTP     `json:"totp,omitempty"`
+	Ticket   *DumpTicket   `json:"ticket,omitempty"`
+	Denied   *DumpDenied   `json:"denied,omitempty"`
+	LoginLog *DumpLoginLog `json:"login_log,omitempty"`
+	UserLock *DumpUserLock `json:"user_lock,omitempty"`
+}
+
+type DumpProject struct {
+	Project
+	Updated time.Time `json:"updated"`
+}
+
+// Secrets are copied as-is (they're encrypted by the caller, not the
+// storage), so the same keys have to be configured after the move.
+type DumpTOTP struct {
+	ProjectId string     `json:"project_id"`
+	UserId    string     `json:"user_id"`
+	Type      string     `json:"type"`
+	Pending   bool       `json:"pending"`
+	Secret    []byte     `json:"secret"`
+	Expires   *time.Time `json:"expires"`
+	Created   time.Time  `json:"created"`
+}
+
+type DumpTicket struct {
+	ProjectId        string     `json:"project_id"`
+	Ticket           []byte     `json:"ticket"`
+	Payload          []byte     `json:"payload"`
+	PayloadEncrypted bool       `json:"payload_encrypted"`
+	Uses             *int       `json:"uses"`
+	Expires          *time.Time `json:"expires"`
+	SlidingTTL       *int       `json:"sliding_ttl"`
+	Scope            []byte     `json:"scope"`
+	Attempts         *int       `json:"attempts"`
+	Created          time.Time  `json:"created"`
+}
+
+type DumpDenied struct {
+	ProjectId string    `json:"project_id"`
+	Ticket    []byte    `json:"ticket"`
+	Expires   time.Time `json:"expires"`
+}
+
+type DumpLoginLog struct {
+	Id         string    `json:"id"`
+	ProjectId  string    `json:"project_id"`
+	UserId     string    `json:"user_id"`
+	Status     int       `json:"status"`
+	Payload    []byte    `json:"payload"`
+	PayloadKey int       `json:"payload_key"`
+	Created    time.Time `json:"created"`
+	Ip         *string   `json:"ip"`
+	UserAgent  *string   `json:"user_agent"`
+	Method     *string   `json:"method"`
+	Country    *string   `json:"country"`
+	IpPrefix   *string   `json:"ip_prefix"`
+	Device     *string   `json:"device"`
+}
+
+type DumpUserLock struct {
+	ProjectId   string     `json:"project_id"`
+	UserId      string     `json:"user_id"`
+	LockedUntil *time.Time `json:"locked_until"`
+	Reset       time.Time  `json:"reset"`
+}
+
+// The json name of the field which is set, used to count records by kind
+func (r DumpRecord) Kind() string {
+	switch {
+	case r.Project != nil:
+		return "project"
+	case r.TOTP != nil:
+		return "totp"
+	case r.Ticket != nil:
+		return "ticket"
+	case r.Denied != nil:
+		return "denied"
+	case r.LoginLog != nil:
+		return "login_log"
+	case r.UserLock != nil:
+		return "user_lock"
+	}
+	return ""
+}
+
+// The counts a Loader returns, keyed by Kind
+func DumpCounts(projects int, totps int, tickets int, denied int, loginLogs int, userLocks int) map[string]int {
+	return map[string]int{
+		"project":   projects,
+		"totp":      totps,
+		"ticket":    tickets,
+		"denied":    denied,
+		"login_log": loginLogs,
+		"user_lock": userLocks,
+	}
+}
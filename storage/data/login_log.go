@@ -1,6 +1,9 @@
 package data
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type LoginLogGetStatus int
 type LoginLogCreateStatus int
@@ -19,10 +22,85 @@ type LoginLogCreate struct {
 	UserId    string
 	Status    int
 	Payload   []byte
+
+	// id of the server key the payload was encrypted with, 0 == plain text
+	PayloadKey int
+
+	// optional, nil when not known
+	Ip        *string
+	UserAgent *string
+	Method    *string
+	Country   *string
+
+	// optional, derived from Ip and UserAgent. When given, the result
+	// says whether the user has a previous successful login log (one with
+	// a status in SuccessStatuses) with the same value (see LoginHistory).
+	// Without SuccessStatuses, there's no telling a failed login (say, an
+	// attacker's) from a successful one, so nothing is ever new.
+	IpPrefix        *string
+	Device          *string
+	SuccessStatuses []int
+
+	// when > 0, the user's login logs beyond the RetainCount most recent
+	// are deleted as part of the insert
+	RetainCount int
+
+	// the project's lockout rules, those matching Status are evaluated
+	// after the insert. When not empty, the result includes the user's lock.
+	Lockout []LockoutRule
+}
+
+// Whether the new ip / device should be looked for at all
+func (o LoginLogCreate) TracksHistory() bool {
+	return len(o.SuccessStatuses) > 0 && (o.IpPrefix != nil || o.Device != nil)
+}
+
+func (o LoginLogCreate) Succeeded(status int) bool {
+	for _, s := range o.SuccessStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// What a user's successful login logs say about an ip prefix or a
+// device. Login logs from before ip_prefix and device existed have an
+// ip / user_agent but no ip_prefix / device; they're untracked.
+type LoginHistory struct {
+	Known     bool
+	Tracked   bool
+	Untracked bool
+}
+
+// value is the login log's ip_prefix (or device), source its ip (or
+// user_agent) and given what's being looked for.
+func (h *LoginHistory) Add(value *string, source *string, given *string) {
+	h.Known = h.Known || (value != nil && given != nil && *value == *given)
+	h.Tracked = h.Tracked || value != nil
+	h.Untracked = h.Untracked || (value == nil && source != nil)
+}
+
+// A user with nothing but untracked history isn't flagged: we can't
+// tell whether the value is new.
+func (h LoginHistory) IsNew(given *string) bool {
+	return given != nil && !h.Known && (h.Tracked || !h.Untracked)
 }
 
 type LoginLogCreateResult struct {
-	Status LoginLogCreateStatus
+	Status    LoginLogCreateStatus
+	NewIp     bool
+	NewDevice bool
+
+	// nil when the user isn't locked (or Lockout was empty)
+	LockedUntil *time.Time
+}
+
+// Login logs older than Days and those beyond the Count most recent
+// of each user are deleted. 0 disables either.
+type LoginLogRetention struct {
+	Count int
+	Days  int
 }
 
 type LoginLogGet struct {
@@ -30,16 +108,117 @@ type LoginLogGet struct {
 	ProjectId string
 	Limit     int
 	Offset    int
+
+	// Optional filters. Since is inclusive, Until is exclusive.
+	Statuses  []int
+	Since     *time.Time
+	Until     *time.Time
+	Ip        string
+	UserAgent string
+	Method    string
+	Country   string
+
+	// When set, Offset is ignored and records strictly older than the
+	// cursor (by created, then id) are returned.
+	Cursor *LoginLogCursor
+}
+
+// The position of a record within a user's login logs, which are
+// ordered by created desc, id desc.
+type LoginLogCursor struct {
+	Id      string
+	Created time.Time
 }
 
 type LoginLogRecord struct {
-	Id      string    `json:"id"`
-	Status  int       `json:"status"`
-	Payload any       `json:"payload",omitempty`
-	Created time.Time `json:"created"`
+	Id        string    `json:"id"`
+	UserId    string    `json:"user_id,omitempty"`
+	Status    int       `json:"status"`
+	Payload   any       `json:"payload",omitempty`
+	Created   time.Time `json:"created"`
+	Ip        *string   `json:"ip"`
+	UserAgent *string   `json:"user_agent"`
+	Method    *string   `json:"method"`
+	Country   *string   `json:"country"`
+
+	// The payload as stored, possibly encrypted. The storage layer doesn't
+	// know about keys, so it's up to the caller to turn this into Payload.
+	RawPayload []byte `json:"-"`
+	PayloadKey int    `json:"-"`
+}
+
+type LoginLogUpdatePayload struct {
+	Id         string
+	Payload    []byte
+	PayloadKey int
 }
 
 type LoginLogGetResult struct {
 	Status  LoginLogGetStatus
 	Records []LoginLogRecord
 }
+
+// Deletes the user's login logs, the login logs with the given ids, or,
+// when both are given, the user's login logs with the given ids.
+type LoginLogDelete struct {
+	ProjectId string
+	UserId    string
+	Ids       []string
+}
+
+// All of a project's login logs, optionally for a single user and/or
+// time range (Since is inclusive, Until is exclusive).
+type LoginLogExport struct {
+	ProjectId string
+	UserId    string
+	Since     *time.Time
+	Until     *time.Time
+
+	// Logs are read in batches, each with its own query. When > 0, bounds
+	// each of those queries (the export as a whole can take much longer).
+	BatchTimeout time.Duration
+}
+
+// The context for a single batch of an export
+func (o LoginLogExport) BatchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.BatchTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, o.BatchTimeout)
+}
+
+type LoginLogStats struct {
+	ProjectId string
+
+	// Since is inclusive, Until is exclusive
+	Since time.Time
+	Until time.Time
+
+	// group by hour rather than by day (buckets are in UTC)
+	Hourly bool
+
+	// optional, only count these statuses
+	Statuses []int
+
+	// the statuses which are considered failures, for the top failing
+	// users. When empty, or when Top is 0, TopFailing is empty.
+	FailedStatuses []int
+	Top            int
+}
+
+type LoginLogStatsBucket struct {
+	Time   time.Time `json:"time"`
+	Status int       `json:"status"`
+	Count  int       `json:"count"`
+}
+
+type LoginLogStatsUser struct {
+	UserId string `json:"user_id"`
+	Count  int    `json:"count"`
+}
+
+type LoginLogStatsResult struct {
+	Buckets       []LoginLogStatsBucket
+	DistinctUsers int
+	TopFailing    []LoginLogStatsUser
+}
@@ -1,13 +1,20 @@
 package data
 
 type Project struct {
-	Id                       string `json:"id"`
-	TOTPMax                  int    `json:"totp_max"`
-	TOTPIssuer               string `json:"totp_issuer"`
-	TOTPSetupTTL             int    `json:"totp_setup_ttl`
-	TOTPSecretLength         int    `json:"totp_secret_length"`
-	TicketMax                int    `json:"ticket_max"`
-	TicketMaxPayloadLength   int    `json:"ticket_max_payload_length"`
-	LoginLogMax              int    `json:"login_log_max"`
-	LoginLogMaxPayloadLength int    `json:"login_log_max_payload_length"`
+	Id                       string        `json:"id"`
+	TOTPMax                  int           `json:"totp_max"`
+	TOTPIssuer               string        `json:"totp_issuer"`
+	TOTPSetupTTL             int           `json:"totp_setup_ttl`
+	TOTPSecretLength         int           `json:"totp_secret_length"`
+	TicketMax                int           `json:"ticket_max"`
+	TicketMaxPayloadLength   int           `json:"ticket_max_payload_length"`
+	LoginLogMax              int           `json:"login_log_max"`
+	LoginLogMaxPayloadLength int           `json:"login_log_max_payload_length"`
+	LoginLogRetainCount      int           `json:"login_log_retain_count"`
+	LoginLogRetainDays       int           `json:"login_log_retain_days"`
+	LoginLogRetainOnInsert   bool          `json:"login_log_retain_on_insert"`
+	LockoutRules             []LockoutRule `json:"lockout_rules"`
+
+	// the statuses of a successful login, see LoginLogCreate.SuccessStatuses
+	LoginLogSuccessStatuses []int `json:"login_log_success_statuses"`
 }
@@ -8,18 +8,40 @@ type TicketCreateStatus int
 const (
 	TICKET_CREATE_OK TicketCreateStatus = iota
 	TICKET_CREATE_MAX
+	TICKET_CREATE_DUPLICATE
 
 	TICKET_USE_OK TicketUseStatus = iota
 	TICKET_USE_NOT_FOUND
 )
 
+// Tickets are created in batches (of one or more). Max is enforced
+// once for the whole batch: either all tickets fit, or none are created.
+// Likewise, a duplicate ticket (of an existing one, or within the batch)
+// means none are created and the result is TICKET_CREATE_DUPLICATE.
 type TicketCreate struct {
 	Max       int
 	ProjectId string
-	Ticket    []byte
-	Payload   []byte
-	Uses      *int
-	Expires   *time.Time
+	Tickets   []TicketCreateTicket
+}
+
+type TicketCreateTicket struct {
+	Ticket  []byte
+	Payload []byte
+	Uses    *int
+	Expires *time.Time
+
+	// When set, every use pushes the expiry to now + SlidingTTL (seconds)
+	SlidingTTL *int
+
+	// Payloads are encrypted with a key derived from the ticket itself. This
+	// is only false for tickets created before payloads were encrypted.
+	PayloadEncrypted bool
+
+	// Only set for short (human-typeable) codes. Scope is the hash of
+	// whatever the code was issued for (e.g. an email), and Attempts is
+	// the number of failed uses, within that scope, before the code dies
+	Scope    []byte
+	Attempts *int
 }
 
 type TicketCreateResult struct {
@@ -29,10 +51,35 @@ type TicketCreateResult struct {
 type TicketUse struct {
 	Ticket    []byte
 	ProjectId string
+
+	// When set, this is a code lookup. A miss consumes an attempt from
+	// every live code in the scope.
+	Scope []byte
 }
 
 type TicketUseResult struct {
-	Status  TicketUseStatus
-	Payload *[]byte
-	Uses    *int
+	Status           TicketUseStatus
+	Payload          *[]byte
+	Uses             *int
+	PayloadEncrypted bool
+}
+
+type TicketExtend struct {
+	Ticket    []byte
+	ProjectId string
+
+	// When set, replaces the existing expiry
+	Expires *time.Time
+
+	// When set, added to the remaining uses. Has no effect on tickets
+	// with unlimited uses.
+	Uses *int
+}
+
+// A signed ticket being used (see http/tickets/signed.go). Ticket is
+// a hash of the signed ticket, Expires is when it can be forgotten.
+type TicketDeny struct {
+	Ticket    []byte
+	ProjectId string
+	Expires   time.Time
 }
@@ -0,0 +1,55 @@
+package data
+
+import (
+	"strconv"
+	"time"
+)
+
+// in seconds. Cleaning relies on this to know when a user's lock
+// can be deleted.
+const MAX_LOCKOUT_WINDOW = 86400
+
+// Failures login logs, each with one of Statuses, within the last
+// Window seconds lock the user for Duration seconds.
+type LockoutRule struct {
+	Statuses []int `json:"statuses"`
+	Failures int   `json:"failures"`
+	Window   int   `json:"window"`
+	Duration int   `json:"duration"`
+}
+
+// Why the rule is invalid, or "" if it's valid.
+func (r LockoutRule) Invalid() string {
+	if len(r.Statuses) == 0 {
+		return "statuses must have at least 1 status"
+	}
+	if r.Failures < 1 {
+		return "failures must be greater than 0"
+	}
+	if r.Window < 1 || r.Window > MAX_LOCKOUT_WINDOW {
+		return "window must be between 1 and " + strconv.Itoa(MAX_LOCKOUT_WINDOW)
+	}
+	if r.Duration < 1 {
+		return "duration must be greater than 0"
+	}
+	return ""
+}
+
+func (r LockoutRule) Matches(status int) bool {
+	for _, s := range r.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+type UserLockGet struct {
+	ProjectId string
+	UserId    string
+}
+
+type UserLock struct {
+	// nil when the user isn't locked
+	LockedUntil *time.Time
+}
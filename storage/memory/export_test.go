@@ -0,0 +1,39 @@
+package memory
+
+import (
+	"time"
+
+	"src.goblgobl.com/authen/storage/data"
+)
+
+// Fixtures for the conformance suite, which has to run from an
+// external test package (storagetest imports storage which imports us)
+
+func (db *DB) InsertProject(p data.Project, updated time.Time) {
+	db.projects[p.Id] = &project{Project: p, Updated: updated}
+}
+
+func (db *DB) InsertLoginLog(opts data.LoginLogCreate, created time.Time) {
+	addLoginLogs(db, &loginLog{
+		Id:         opts.Id,
+		ProjectId:  opts.ProjectId,
+		UserId:     opts.UserId,
+		Status:     opts.Status,
+		Payload:    opts.Payload,
+		PayloadKey: opts.PayloadKey,
+		Created:    created,
+		Ip:         opts.Ip,
+		UserAgent:  opts.UserAgent,
+		Method:     opts.Method,
+		Country:    opts.Country,
+	})
+}
+
+func (db *DB) InsertUserLock(projectId string, userId string, lockedUntil *time.Time, reset time.Time) {
+	addUserLocks(db, &userLock{
+		ProjectId:   projectId,
+		UserId:      userId,
+		LockedUntil: lockedUntil,
+		Reset:       reset,
+	})
+}
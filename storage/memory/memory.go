@@ -0,0 +1,1232 @@
+package memory
+
+// An in-memory storage, for tests and ephemeral (single instance)
+// environments. Everything sits behind a single mutex; nothing here
+// is meant to be fast, only to behave like the sql storages.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/utils/json"
+)
+
+var loginLogExportBatch = 1000
+
+type Config struct {
+	// Optional. When set, New loads the data from this file (if it
+	// exists) and Close writes the data to it.
+	Snapshot string `json:"snapshot"`
+}
+
+type DB struct {
+	sync.Mutex
+	snapshot  string
+	projects  map[string]*project
+	totps     map[totpKey]*totp
+	tickets   map[string]*ticket
+	denylist  map[string]*denied
+	loginLogs map[string][]*loginLog
+	userLocks map[string]*userLock
+}
+
+type project struct {
+	data.Project
+	Updated time.Time `json:"updated"`
+}
+
+type totpKey struct {
+	ProjectId string
+	UserId    string
+	Type      string
+	Pending   bool
+}
+
+type totp struct {
+	totpKey
+	Secret  []byte     `json:"secret"`
+	Expires *time.Time `json:"expires"`
+	Created time.Time  `json:"created"`
+}
+
+type ticket struct {
+	ProjectId        string     `json:"project_id"`
+	Ticket           []byte     `json:"ticket"`
+	Payload          []byte     `json:"payload"`
+	PayloadEncrypted bool       `json:"payload_encrypted"`
+	Uses             *int       `json:"uses"`
+	Expires          *time.Time `json:"expires"`
+	SlidingTTL       *int       `json:"sliding_ttl"`
+	Scope            []byte     `json:"scope"`
+	Attempts         *int       `json:"attempts"`
+	Created          time.Time  `json:"created"`
+}
+
+type denied struct {
+	ProjectId string    `json:"project_id"`
+	Ticket    []byte    `json:"ticket"`
+	Expires   time.Time `json:"expires"`
+}
+
+type loginLog struct {
+	Id         string    `json:"id"`
+	ProjectId  string    `json:"project_id"`
+	UserId     string    `json:"user_id"`
+	Status     int       `json:"status"`
+	Payload    []byte    `json:"payload"`
+	PayloadKey int       `json:"payload_key"`
+	Created    time.Time `json:"created"`
+	Ip         *string   `json:"ip"`
+	UserAgent  *string   `json:"user_agent"`
+	Method     *string   `json:"method"`
+	Country    *string   `json:"country"`
+	IpPrefix   *string   `json:"ip_prefix"`
+	Device     *string   `json:"device"`
+}
+
+type userLock struct {
+	ProjectId   string     `json:"project_id"`
+	UserId      string     `json:"user_id"`
+	LockedUntil *time.Time `json:"locked_until"`
+	Reset       time.Time  `json:"reset"`
+}
+
+// What's written to, and read from, Config.Snapshot
+type snapshot struct {
+	Projects  []*project  `json:"projects"`
+	TOTPs     []*totp     `json:"totps"`
+	Tickets   []*ticket   `json:"tickets"`
+	Denylist  []*denied   `json:"denylist"`
+	LoginLogs []*loginLog `json:"login_logs"`
+	UserLocks []*userLock `json:"user_locks"`
+}
+
+func New(config Config) (*DB, error) {
+	db := &DB{
+		snapshot:  config.Snapshot,
+		projects:  make(map[string]*project),
+		totps:     make(map[totpKey]*totp),
+		tickets:   make(map[string]*ticket),
+		denylist:  make(map[string]*denied),
+		loginLogs: make(map[string][]*loginLog),
+		userLocks: make(map[string]*userLock),
+	}
+
+	if config.Snapshot == "" {
+		return db, nil
+	}
+
+	if err := db.load(); err != nil {
+		return nil, fmt.Errorf("Memory.New - %w", err)
+	}
+	return db, nil
+}
+
+func (db *DB) Ping(ctx context.Context) error {
+	return nil
+}
+
+// nothing to migrate
+func (db *DB) EnsureMigrations() error {
+	return nil
+}
+
+func (db *DB) Info(ctx context.Context) (any, error) {
+	return struct {
+		Type     string `json:"type"`
+		Snapshot string `json:"snapshot,omitempty"`
+	}{
+		Type:     "memory",
+		Snapshot: db.snapshot,
+	}, nil
+}
+
+// Writes the snapshot, if one is configured. The DB can still be used
+// afterwards, but further changes won't be saved unless Close is
+// called again.
+func (db *DB) Close() error {
+	if db.snapshot == "" {
+		return nil
+	}
+
+	db.Lock()
+	s := snapshot{
+		Projects:  make([]*project, 0, len(db.projects)),
+		TOTPs:     make([]*totp, 0, len(db.totps)),
+		Tickets:   make([]*ticket, 0, len(db.tickets)),
+		Denylist:  make([]*denied, 0, len(db.denylist)),
+		UserLocks: make([]*userLock, 0, len(db.userLocks)),
+	}
+	for _, p := range db.projects {
+		s.Projects = append(s.Projects, p)
+	}
+	for _, t := range db.totps {
+		s.TOTPs = append(s.TOTPs, t)
+	}
+	for _, t := range db.tickets {
+		s.Tickets = append(s.Tickets, t)
+	}
+	for _, d := range db.denylist {
+		s.Denylist = append(s.Denylist, d)
+	}
+	for _, logs := range db.loginLogs {
+		s.LoginLogs = append(s.LoginLogs, logs...)
+	}
+	for _, l := range db.userLocks {
+		s.UserLocks = append(s.UserLocks, l)
+	}
+	encoded, err := json.Marshal(s)
+	db.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("Memory.Close (marshal) - %w", err)
+	}
+
+	// write + rename so that a crash mid-write doesn't lose the
+	// previous snapshot
+	tmp := db.snapshot + ".tmp"
+	if err := os.WriteFile(tmp, encoded, 0600); err != nil {
+		return fmt.Errorf("Memory.Close (write) - %w", err)
+	}
+	if err := os.Rename(tmp, db.snapshot); err != nil {
+		return fmt.Errorf("Memory.Close (rename) - %w", err)
+	}
+	return nil
+}
+
+// Calls fn for every row, holding the lock throughout, so this is a
+// consistent copy.
+func (db *DB) Dump(fn func(data.DumpRecord) error) error {
+	db.Lock()
+	defer db.Unlock()
+
+	for _, p := range db.projects {
+		if err := fn(data.DumpRecord{Project: &data.DumpProject{Project: p.Project, Updated: p.Updated}}); err != nil {
+			return fmt.Errorf("Memory.Dump - %w", err)
+		}
+	}
+	for _, t := range db.totps {
+		if err := fn(data.DumpRecord{TOTP: &data.DumpTOTP{
+			ProjectId: t.ProjectId,
+			UserId:    t.UserId,
+			Type:      t.Type,
+			Pending:   t.Pending,
+			Secret:    t.Secret,
+			Expires:   t.Expires,
+			Created:   t.Created,
+		}}); err != nil {
+			return fmt.Errorf("Memory.Dump - %w", err)
+		}
+	}
+	for _, t := range db.tickets {
+		ticket := data.DumpTicket(*t)
+		if err := fn(data.DumpRecord{Ticket: &ticket}); err != nil {
+			return fmt.Errorf("Memory.Dump - %w", err)
+		}
+	}
+	for _, d := range db.denylist {
+		denied := data.DumpDenied(*d)
+		if err := fn(data.DumpRecord{Denied: &denied}); err != nil {
+			return fmt.Errorf("Memory.Dump - %w", err)
+		}
+	}
+	for _, logs := range db.loginLogs {
+		for _, l := range logs {
+			loginLog := data.DumpLoginLog(*l)
+			if err := fn(data.DumpRecord{LoginLog: &loginLog}); err != nil {
+				return fmt.Errorf("Memory.Dump - %w", err)
+			}
+		}
+	}
+	for _, l := range db.userLocks {
+		userLock := data.DumpUserLock(*l)
+		if err := fn(data.DumpRecord{UserLock: &userLock}); err != nil {
+			return fmt.Errorf("Memory.Dump - %w", err)
+		}
+	}
+	return nil
+}
+
+// Inserts (or replaces) the rows.
+func (db *DB) Load(records []data.DumpRecord) error {
+	db.Lock()
+	defer db.Unlock()
+
+	// login logs being replaced are removed up front (one pass per
+	// project rather than per log)
+	replaced := make(map[string]map[string]bool)
+	for _, record := range records {
+		if l := record.LoginLog; l != nil {
+			if replaced[l.ProjectId] == nil {
+				replaced[l.ProjectId] = make(map[string]bool)
+			}
+			replaced[l.ProjectId][l.Id] = true
+		}
+	}
+	for projectId, ids := range replaced {
+		db.loginLogs[projectId] = filter(db.loginLogs[projectId], func(l *loginLog) bool {
+			return !ids[l.Id]
+		})
+	}
+
+	for _, record := range records {
+		switch {
+		case record.Project != nil:
+			p := record.Project
+			db.projects[p.Id] = &project{Project: p.Project, Updated: p.Updated}
+		case record.TOTP != nil:
+			t := record.TOTP
+			key := totpKey{ProjectId: t.ProjectId, UserId: t.UserId, Type: t.Type, Pending: t.Pending}
+			db.totps[key] = &totp{totpKey: key, Secret: t.Secret, Expires: t.Expires, Created: t.Created}
+		case record.Ticket != nil:
+			t := ticket(*record.Ticket)
+			db.tickets[ticketKey(t.ProjectId, t.Ticket)] = &t
+		case record.Denied != nil:
+			d := denied(*record.Denied)
+			db.denylist[ticketKey(d.ProjectId, d.Ticket)] = &d
+		case record.LoginLog != nil:
+			l := loginLog(*record.LoginLog)
+			db.loginLogs[l.ProjectId] = append(db.loginLogs[l.ProjectId], &l)
+		case record.UserLock != nil:
+			l := userLock(*record.UserLock)
+			db.userLocks[userKey(l.ProjectId, l.UserId)] = &l
+		}
+	}
+	return nil
+}
+
+// The number of rows of each kind (keyed by data.DumpRecord.Kind), so
+// that an import can be checked without reading everything back.
+func (db *DB) Counts() (map[string]int, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	loginLogs := 0
+	for _, logs := range db.loginLogs {
+		loginLogs += len(logs)
+	}
+	return data.DumpCounts(len(db.projects), len(db.totps), len(db.tickets), len(db.denylist), loginLogs, len(db.userLocks)), nil
+}
+
+func (db *DB) load() error {
+	encoded, err := os.ReadFile(db.snapshot)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(encoded, &s); err != nil {
+		return err
+	}
+
+	for _, p := range s.Projects {
+		db.projects[p.Id] = p
+	}
+	for _, t := range s.TOTPs {
+		db.totps[t.totpKey] = t
+	}
+	for _, t := range s.Tickets {
+		db.tickets[ticketKey(t.ProjectId, t.Ticket)] = t
+	}
+	for _, d := range s.Denylist {
+		db.denylist[ticketKey(d.ProjectId, d.Ticket)] = d
+	}
+	for _, l := range s.LoginLogs {
+		db.loginLogs[l.ProjectId] = append(db.loginLogs[l.ProjectId], l)
+	}
+	for _, l := range s.UserLocks {
+		db.userLocks[userKey(l.ProjectId, l.UserId)] = l
+	}
+	return nil
+}
+
+// There's no authen_projects table to insert into, so projects (for
+// multi tenancy) are added, or replaced, with this.
+func (db *DB) PutProject(p data.Project) {
+	db.Lock()
+	defer db.Unlock()
+	db.projects[p.Id] = &project{Project: p, Updated: time.Now()}
+}
+
+func (db *DB) Clean(ctx context.Context, opts data.Clean) (data.CleanResult, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var result data.CleanResult
+
+	now := time.Now()
+	for key, t := range db.totps {
+		if t.Expires != nil && t.Expires.Before(now) {
+			delete(db.totps, key)
+			result.TOTPs += 1
+		}
+	}
+
+	for key, t := range db.tickets {
+		if isZero(t.Uses) || isZero(t.Attempts) || (t.Expires != nil && t.Expires.Before(now)) {
+			delete(db.tickets, key)
+			result.Tickets += 1
+		}
+	}
+
+	for key, d := range db.denylist {
+		if d.Expires.Before(now) {
+			delete(db.denylist, key)
+			result.TicketDenylist += 1
+		}
+	}
+
+	// login logs of a project which we don't know (single tenancy)
+	// use the retention passed in
+	for projectId, logs := range db.loginLogs {
+		retention := opts.LoginLogRetention
+		if p, ok := db.projects[projectId]; ok {
+			retention = data.LoginLogRetention{
+				Count: p.LoginLogRetainCount,
+				Days:  p.LoginLogRetainDays,
+			}
+		}
+
+		if days := retention.Days; days > 0 {
+			cutoff := now.Add(-time.Duration(days) * 24 * time.Hour)
+			logs = filter(logs, func(l *loginLog) bool {
+				return !l.Created.Before(cutoff)
+			})
+		}
+
+		if count := retention.Count; count > 0 {
+			seen := make(map[string]int)
+			sortNewestFirst(logs)
+			logs = filter(logs, func(l *loginLog) bool {
+				seen[l.UserId] += 1
+				return seen[l.UserId] <= count
+			})
+		}
+		result.LoginLogs += len(db.loginLogs[projectId]) - len(logs)
+		db.loginLogs[projectId] = logs
+	}
+
+	// Expired and unlocked locks are only kept so that older login logs
+	// don't count towards a new lock, which they can't once they're older
+	// than data.MAX_LOCKOUT_WINDOW.
+	cutoff := now.Add(-data.MAX_LOCKOUT_WINDOW * time.Second)
+	for key, l := range db.userLocks {
+		if (l.LockedUntil == nil || l.LockedUntil.Before(now)) && l.Reset.Before(cutoff) {
+			delete(db.userLocks, key)
+			result.UserLocks += 1
+		}
+	}
+
+	return result, nil
+}
+
+// memory is a single process, there are no other instances to tell
+func (db *DB) EventPublish(ctx context.Context, payload []byte) error {
+	return nil
+}
+
+func (db *DB) EventListen(fn func(payload []byte)) error {
+	return nil
+}
+
+func (db *DB) GetProject(ctx context.Context, id string) (*data.Project, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	p, ok := db.projects[id]
+	if !ok {
+		return nil, nil
+	}
+	project := p.Project
+	return &project, nil
+}
+
+func (db *DB) GetUpdatedProjects(ctx context.Context, timestamp time.Time) ([]*data.Project, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var projects []*data.Project
+	for _, p := range db.projects {
+		if p.Updated.After(timestamp) {
+			project := p.Project
+			projects = append(projects, &project)
+		}
+	}
+	return projects, nil
+}
+
+func (db *DB) TOTPCreate(ctx context.Context, opts data.TOTPCreate) (data.TOTPCreateResult, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	key := totpKey{
+		ProjectId: opts.ProjectId,
+		UserId:    opts.UserId,
+		Type:      opts.Type,
+		Pending:   opts.Expires != nil,
+	}
+
+	var result data.TOTPCreateResult
+	if !db.totpCanAdd(key, opts.Max) {
+		result.Status = data.TOTP_CREATE_MAX
+		return result, nil
+	}
+
+	db.totps[key] = &totp{
+		totpKey: key,
+		Secret:  opts.Secret,
+		Expires: opts.Expires,
+		Created: time.Now(),
+	}
+
+	// a confirmed TOTP replaces the pending one
+	if !key.Pending {
+		pending := key
+		pending.Pending = true
+		delete(db.totps, pending)
+	}
+
+	result.Status = data.TOTP_CREATE_OK
+	return result, nil
+}
+
+func (db *DB) TOTPGet(ctx context.Context, opts data.TOTPGet) (data.TOTPGetResult, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var result data.TOTPGetResult
+	t, ok := db.totps[totpKey{
+		ProjectId: opts.ProjectId,
+		UserId:    opts.UserId,
+		Type:      opts.Type,
+		Pending:   opts.Pending,
+	}]
+
+	if !ok || (t.Pending && (t.Expires == nil || !t.Expires.After(time.Now()))) {
+		result.Status = data.TOTP_GET_NOT_FOUND
+		return result, nil
+	}
+
+	result.Status = data.TOTP_GET_OK
+	result.Secret = t.Secret
+	return result, nil
+}
+
+func (db *DB) TOTPDelete(ctx context.Context, opts data.TOTPGet) (int, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	deleted := 0
+	for key := range db.totps {
+		if key.ProjectId == opts.ProjectId && key.UserId == opts.UserId && (opts.AllTypes || key.Type == opts.Type) {
+			delete(db.totps, key)
+			deleted += 1
+		}
+	}
+	return deleted, nil
+}
+
+func (db *DB) TicketCreate(ctx context.Context, opts data.TicketCreate) (data.TicketCreateResult, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	projectId := opts.ProjectId
+	tickets := opts.Tickets
+
+	var result data.TicketCreateResult
+	if max := opts.Max; max > 0 && db.ticketCount(projectId)+len(tickets) > max {
+		result.Status = data.TICKET_CREATE_MAX
+		return result, nil
+	}
+
+	// like the sql storages, a duplicate (with an existing ticket or
+	// within the batch) means none of the batch is created
+	seen := make(map[string]struct{}, len(tickets))
+	for _, t := range tickets {
+		key := ticketKey(projectId, t.Ticket)
+		if _, exists := db.tickets[key]; exists {
+			result.Status = data.TICKET_CREATE_DUPLICATE
+			return result, nil
+		}
+		if _, exists := seen[key]; exists {
+			result.Status = data.TICKET_CREATE_DUPLICATE
+			return result, nil
+		}
+		seen[key] = struct{}{}
+	}
+
+	result.Status = data.TICKET_CREATE_OK
+	now := time.Now()
+	for _, t := range tickets {
+		key := ticketKey(projectId, t.Ticket)
+		db.tickets[key] = &ticket{
+			ProjectId:        projectId,
+			Ticket:           t.Ticket,
+			Payload:          t.Payload,
+			PayloadEncrypted: t.PayloadEncrypted,
+			Uses:             copyInt(t.Uses),
+			Expires:          t.Expires,
+			SlidingTTL:       t.SlidingTTL,
+			Scope:            t.Scope,
+			Attempts:         copyInt(t.Attempts),
+			Created:          now,
+		}
+	}
+	return result, nil
+}
+
+func (db *DB) TicketUse(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var result data.TicketUseResult
+
+	now := time.Now()
+	t := db.liveTicket(opts.ProjectId, opts.Ticket, now)
+	if t == nil {
+		if scope := opts.Scope; scope != nil {
+			db.ticketFailedAttempt(opts.ProjectId, scope)
+		}
+		result.Status = data.TICKET_USE_NOT_FOUND
+		return result, nil
+	}
+
+	if t.Uses != nil {
+		*t.Uses -= 1
+	}
+	if ttl := t.SlidingTTL; ttl != nil {
+		expires := now.Add(time.Duration(*ttl) * time.Second)
+		t.Expires = &expires
+	}
+
+	result.Status = data.TICKET_USE_OK
+	result.Uses = copyInt(t.Uses)
+	result.PayloadEncrypted = t.PayloadEncrypted
+	if t.Payload != nil {
+		payload := t.Payload
+		result.Payload = &payload
+	}
+	return result, nil
+}
+
+func (db *DB) TicketDelete(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var result data.TicketUseResult
+
+	t := db.liveTicket(opts.ProjectId, opts.Ticket, time.Now())
+	if t == nil {
+		result.Status = data.TICKET_USE_NOT_FOUND
+		return result, nil
+	}
+
+	delete(db.tickets, ticketKey(opts.ProjectId, opts.Ticket))
+	result.Status = data.TICKET_USE_OK
+	result.Uses = t.Uses
+	return result, nil
+}
+
+func (db *DB) TicketExtend(ctx context.Context, opts data.TicketExtend) (data.TicketUseResult, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var result data.TicketUseResult
+
+	t := db.liveTicket(opts.ProjectId, opts.Ticket, time.Now())
+	if t == nil {
+		result.Status = data.TICKET_USE_NOT_FOUND
+		return result, nil
+	}
+
+	if expires := opts.Expires; expires != nil {
+		t.Expires = expires
+	}
+	if uses := opts.Uses; uses != nil && t.Uses != nil {
+		*t.Uses += *uses
+	}
+
+	result.Status = data.TICKET_USE_OK
+	result.Uses = copyInt(t.Uses)
+	return result, nil
+}
+
+// Returns TICKET_USE_OK the first time a ticket is denied and
+// TICKET_USE_NOT_FOUND if it already was (i.e. it's already been used).
+func (db *DB) TicketDeny(ctx context.Context, opts data.TicketDeny) (data.TicketUseResult, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var result data.TicketUseResult
+
+	key := ticketKey(opts.ProjectId, opts.Ticket)
+	if _, exists := db.denylist[key]; exists {
+		result.Status = data.TICKET_USE_NOT_FOUND
+		return result, nil
+	}
+
+	db.denylist[key] = &denied{
+		ProjectId: opts.ProjectId,
+		Ticket:    opts.Ticket,
+		Expires:   opts.Expires,
+	}
+	result.Status = data.TICKET_USE_OK
+	return result, nil
+}
+
+func (db *DB) LoginLogCreate(ctx context.Context, opts data.LoginLogCreate) (data.LoginLogCreateResult, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	projectId := opts.ProjectId
+	userId := opts.UserId
+	logs := db.loginLogs[projectId]
+
+	var result data.LoginLogCreateResult
+	if max := opts.Max; max > 0 && len(logs) >= max {
+		result.Status = data.LOGIN_LOG_CREATE_MAX
+		return result, nil
+	}
+
+	// must happen before the insert, else we'd always find ourselves
+	if opts.TracksHistory() {
+		var ip, device data.LoginHistory
+		for _, l := range logs {
+			if l.UserId != userId || !opts.Succeeded(l.Status) {
+				continue
+			}
+			ip.Add(l.IpPrefix, l.Ip, opts.IpPrefix)
+			device.Add(l.Device, l.UserAgent, opts.Device)
+		}
+		result.NewIp = ip.IsNew(opts.IpPrefix)
+		result.NewDevice = device.IsNew(opts.Device)
+	}
+
+	logs = append(logs, &loginLog{
+		Id:         opts.Id,
+		ProjectId:  projectId,
+		UserId:     userId,
+		Status:     opts.Status,
+		Payload:    opts.Payload,
+		PayloadKey: opts.PayloadKey,
+		Created:    time.Now(),
+		Ip:         opts.Ip,
+		UserAgent:  opts.UserAgent,
+		Method:     opts.Method,
+		Country:    opts.Country,
+		IpPrefix:   opts.IpPrefix,
+		Device:     opts.Device,
+	})
+
+	if retain := opts.RetainCount; retain > 0 {
+		n := 0
+		sortNewestFirst(logs)
+		logs = filter(logs, func(l *loginLog) bool {
+			if l.UserId != userId {
+				return true
+			}
+			n += 1
+			return n <= retain
+		})
+	}
+	db.loginLogs[projectId] = logs
+
+	if rules := opts.Lockout; len(rules) > 0 {
+		result.LockedUntil = db.userLockEvaluate(projectId, userId, opts.Status, rules)
+	}
+
+	result.Status = data.LOGIN_LOG_CREATE_OK
+	return result, nil
+}
+
+func (db *DB) LoginLogGet(ctx context.Context, opts data.LoginLogGet) (data.LoginLogGetResult, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var result data.LoginLogGetResult
+
+	matches := make([]*loginLog, 0, opts.Limit)
+	for _, l := range db.loginLogs[opts.ProjectId] {
+		if loginLogMatches(l, opts) {
+			matches = append(matches, l)
+		}
+	}
+	sortNewestFirst(matches)
+
+	offset := opts.Offset
+	if opts.Cursor != nil {
+		offset = 0
+	}
+	if offset > len(matches) {
+		offset = len(matches)
+	}
+	matches = matches[offset:]
+	if len(matches) > opts.Limit {
+		matches = matches[:opts.Limit]
+	}
+
+	records := make([]data.LoginLogRecord, len(matches))
+	for i, l := range matches {
+		records[i] = l.record()
+		records[i].UserId = ""
+	}
+
+	result.Records = records
+	result.Status = data.LOGIN_LOG_GET_OK
+	return result, nil
+}
+
+func (db *DB) LoginLogStats(ctx context.Context, opts data.LoginLogStats) (data.LoginLogStatsResult, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var result data.LoginLogStatsResult
+
+	unit := 24 * time.Hour
+	if opts.Hourly {
+		unit = time.Hour
+	}
+
+	type bucketKey struct {
+		time   int64
+		status int
+	}
+	counts := make(map[bucketKey]int)
+	users := make(map[string]struct{})
+	failures := make(map[string]int)
+
+	for _, l := range db.loginLogs[opts.ProjectId] {
+		if l.Created.Before(opts.Since) || !l.Created.Before(opts.Until) {
+			continue
+		}
+		if len(opts.Statuses) > 0 && !contains(opts.Statuses, l.Status) {
+			continue
+		}
+		// the zero time is midnight UTC, so this truncates to a UTC day/hour
+		counts[bucketKey{l.Created.Truncate(unit).Unix(), l.Status}] += 1
+		users[l.UserId] = struct{}{}
+		if contains(opts.FailedStatuses, l.Status) {
+			failures[l.UserId] += 1
+		}
+	}
+
+	buckets := make([]data.LoginLogStatsBucket, 0, len(counts))
+	for key, count := range counts {
+		buckets = append(buckets, data.LoginLogStatsBucket{
+			Time:   time.Unix(key.time, 0).UTC(),
+			Status: key.status,
+			Count:  count,
+		})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		a, b := buckets[i], buckets[j]
+		if !a.Time.Equal(b.Time) {
+			return a.Time.Before(b.Time)
+		}
+		return a.Status < b.Status
+	})
+	result.Buckets = buckets
+	result.DistinctUsers = len(users)
+
+	if len(opts.FailedStatuses) == 0 || opts.Top == 0 {
+		return result, nil
+	}
+
+	failing := make([]data.LoginLogStatsUser, 0, len(failures))
+	for userId, count := range failures {
+		failing = append(failing, data.LoginLogStatsUser{UserId: userId, Count: count})
+	}
+	sort.Slice(failing, func(i, j int) bool {
+		a, b := failing[i], failing[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.UserId < b.UserId
+	})
+	if len(failing) > opts.Top {
+		failing = failing[:opts.Top]
+	}
+	result.TopFailing = failing
+
+	return result, nil
+}
+
+func (db *DB) LoginLogDelete(ctx context.Context, opts data.LoginLogDelete) (int, error) {
+	// without either, we'd delete all of the project's logs
+	if opts.UserId == "" && len(opts.Ids) == 0 {
+		return 0, nil
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	projectId := opts.ProjectId
+	logs := db.loginLogs[projectId]
+	n := len(logs)
+
+	logs = filter(logs, func(l *loginLog) bool {
+		if opts.UserId != "" && l.UserId != opts.UserId {
+			return true
+		}
+		if len(opts.Ids) > 0 && !contains(opts.Ids, l.Id) {
+			return true
+		}
+		return false
+	})
+	db.loginLogs[projectId] = logs
+	return n - len(logs), nil
+}
+
+// The matching records are copied before fn is called, so fn can take
+// as long as it needs without blocking everything else.
+func (db *DB) LoginLogExport(ctx context.Context, opts data.LoginLogExport, fn func(data.LoginLogRecord) error) error {
+	db.Lock()
+	matches := make([]*loginLog, 0)
+	for _, l := range db.loginLogs[opts.ProjectId] {
+		if opts.UserId != "" && l.UserId != opts.UserId {
+			continue
+		}
+		if opts.Since != nil && l.Created.Before(*opts.Since) {
+			continue
+		}
+		if opts.Until != nil && !l.Created.Before(*opts.Until) {
+			continue
+		}
+		matches = append(matches, l)
+	}
+	db.Unlock()
+
+	// oldest first
+	sortNewestFirst(matches)
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+
+	// only loginLogExportBatch records are copied at a time, under the
+	// lock, since the logs can be changed (e.g. their payload re-encrypted)
+	// while fn is being called
+	batch := make([]data.LoginLogRecord, 0, loginLogExportBatch)
+	for len(matches) > 0 {
+		n := loginLogExportBatch
+		if n > len(matches) {
+			n = len(matches)
+		}
+
+		batch = batch[:0]
+		db.Lock()
+		for _, l := range matches[:n] {
+			batch = append(batch, l.record())
+		}
+		db.Unlock()
+		matches = matches[n:]
+
+		for _, record := range batch {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Used to encrypt payloads created before payload encryption existed
+func (db *DB) LoginLogGetUnencrypted(ctx context.Context, limit int) ([]data.LoginLogRecord, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	records := make([]data.LoginLogRecord, 0, limit)
+	for _, logs := range db.loginLogs {
+		for _, l := range logs {
+			if len(records) == limit {
+				return records, nil
+			}
+			if l.Payload != nil && l.PayloadKey == 0 {
+				records = append(records, data.LoginLogRecord{Id: l.Id, RawPayload: l.Payload})
+			}
+		}
+	}
+	return records, nil
+}
+
+func (db *DB) LoginLogUpdatePayload(ctx context.Context, opts data.LoginLogUpdatePayload) error {
+	db.Lock()
+	defer db.Unlock()
+
+	for _, logs := range db.loginLogs {
+		for _, l := range logs {
+			if l.Id == opts.Id {
+				l.Payload = opts.Payload
+				l.PayloadKey = opts.PayloadKey
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (db *DB) UserLockGet(ctx context.Context, opts data.UserLockGet) (data.UserLock, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var result data.UserLock
+	if l, ok := db.userLocks[userKey(opts.ProjectId, opts.UserId)]; ok {
+		result.LockedUntil = activeLock(l, time.Now())
+	}
+	return result, nil
+}
+
+// Returns true if the user was locked. Whether or not they were, login
+// logs up to now no longer count towards a new lock.
+func (db *DB) UserUnlock(ctx context.Context, opts data.UserLockGet) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	now := time.Now()
+	key := userKey(opts.ProjectId, opts.UserId)
+
+	locked := false
+	if l, ok := db.userLocks[key]; ok {
+		locked = activeLock(l, now) != nil
+	}
+
+	db.userLocks[key] = &userLock{
+		ProjectId: opts.ProjectId,
+		UserId:    opts.UserId,
+		Reset:     now,
+	}
+	return locked, nil
+}
+
+// The lock must be held. Mirrors the sql storages: only login logs
+// newer than the user's last lock (or unlock) are counted.
+func (db *DB) userLockEvaluate(projectId string, userId string, status int, rules []data.LockoutRule) *time.Time {
+	now := time.Now()
+	key := userKey(projectId, userId)
+
+	var reset *time.Time
+	var lockedUntil *time.Time
+	existing, ok := db.userLocks[key]
+	if ok {
+		reset = &existing.Reset
+		lockedUntil = activeLock(existing, now)
+	}
+
+	duration := 0
+	for _, rule := range rules {
+		// a rule can only matter if it would lock for longer
+		if rule.Duration <= duration || !rule.Matches(status) {
+			continue
+		}
+
+		since := now.Add(-time.Duration(rule.Window) * time.Second)
+		failures := 0
+		for _, l := range db.loginLogs[projectId] {
+			if l.UserId == userId && l.Created.After(since) && (reset == nil || l.Created.After(*reset)) && contains(rule.Statuses, l.Status) {
+				failures += 1
+			}
+		}
+		if failures >= rule.Failures {
+			duration = rule.Duration
+		}
+	}
+
+	if duration == 0 {
+		return lockedUntil
+	}
+
+	until := now.Add(time.Duration(duration) * time.Second)
+	if ok && existing.LockedUntil != nil && existing.LockedUntil.After(until) {
+		until = *existing.LockedUntil
+	}
+
+	db.userLocks[key] = &userLock{
+		ProjectId:   projectId,
+		UserId:      userId,
+		LockedUntil: &until,
+		Reset:       now,
+	}
+	return &until
+}
+
+// The lock must be held. An update doesn't increase the count, so a
+// project+user+type which already exists (pending or not) can be "added".
+func (db *DB) totpCanAdd(key totpKey, max int) bool {
+	if max == 0 {
+		return true
+	}
+
+	count := 0
+	for k := range db.totps {
+		if k.ProjectId != key.ProjectId {
+			continue
+		}
+		if k.UserId == key.UserId && k.Type == key.Type {
+			return true
+		}
+		count += 1
+	}
+	return count < max
+}
+
+// The lock must be held.
+func (db *DB) ticketCount(projectId string) int {
+	count := 0
+	for _, t := range db.tickets {
+		if t.ProjectId == projectId {
+			count += 1
+		}
+	}
+	return count
+}
+
+// The lock must be held. A ticket with no uses or attempts left, or
+// which has expired, is dead (and will be removed by Clean).
+func (db *DB) liveTicket(projectId string, value []byte, now time.Time) *ticket {
+	t, ok := db.tickets[ticketKey(projectId, value)]
+	if !ok {
+		return nil
+	}
+	if (t.Uses != nil && *t.Uses <= 0) || (t.Attempts != nil && *t.Attempts <= 0) {
+		return nil
+	}
+	if t.Expires != nil && !t.Expires.After(now) {
+		return nil
+	}
+	return t
+}
+
+// The lock must be held. A code wasn't found. Codes are short enough to
+// be guessed, so every miss burns an attempt from all the live codes
+// within the scope.
+func (db *DB) ticketFailedAttempt(projectId string, scope []byte) {
+	for _, t := range db.tickets {
+		if t.ProjectId == projectId && bytes.Equal(t.Scope, scope) && t.Attempts != nil && *t.Attempts > 0 {
+			*t.Attempts -= 1
+		}
+	}
+}
+
+func (l *loginLog) record() data.LoginLogRecord {
+	return data.LoginLogRecord{
+		Id:         l.Id,
+		UserId:     l.UserId,
+		Status:     l.Status,
+		Created:    l.Created,
+		Ip:         l.Ip,
+		UserAgent:  l.UserAgent,
+		Method:     l.Method,
+		Country:    l.Country,
+		RawPayload: l.Payload,
+		PayloadKey: l.PayloadKey,
+	}
+}
+
+func loginLogMatches(l *loginLog, opts data.LoginLogGet) bool {
+	if l.UserId != opts.UserId {
+		return false
+	}
+	if len(opts.Statuses) > 0 && !contains(opts.Statuses, l.Status) {
+		return false
+	}
+	if opts.Since != nil && l.Created.Before(*opts.Since) {
+		return false
+	}
+	if opts.Until != nil && !l.Created.Before(*opts.Until) {
+		return false
+	}
+	for _, f := range [...]struct {
+		actual *string
+		value  string
+	}{
+		{l.Ip, opts.Ip},
+		{l.UserAgent, opts.UserAgent},
+		{l.Method, opts.Method},
+		{l.Country, opts.Country},
+	} {
+		if f.value != "" && (f.actual == nil || *f.actual != f.value) {
+			return false
+		}
+	}
+	if cursor := opts.Cursor; cursor != nil {
+		if l.Created.After(cursor.Created) {
+			return false
+		}
+		if l.Created.Equal(cursor.Created) && l.Id >= cursor.Id {
+			return false
+		}
+	}
+	return true
+}
+
+// created desc, id desc (the order login logs are listed in)
+func sortNewestFirst(logs []*loginLog) {
+	sort.Slice(logs, func(i, j int) bool {
+		a, b := logs[i], logs[j]
+		if !a.Created.Equal(b.Created) {
+			return a.Created.After(b.Created)
+		}
+		return a.Id > b.Id
+	})
+}
+
+// filters in place
+func filter(logs []*loginLog, keep func(*loginLog) bool) []*loginLog {
+	kept := logs[:0]
+	for _, l := range logs {
+		if keep(l) {
+			kept = append(kept, l)
+		}
+	}
+	// don't hold on to the removed logs
+	for i := len(kept); i < len(logs); i++ {
+		logs[i] = nil
+	}
+	return kept
+}
+
+func activeLock(l *userLock, now time.Time) *time.Time {
+	if l.LockedUntil == nil || !l.LockedUntil.After(now) {
+		return nil
+	}
+	until := *l.LockedUntil
+	return &until
+}
+
+func ticketKey(projectId string, ticket []byte) string {
+	return projectId + "\x00" + string(ticket)
+}
+
+func userKey(projectId string, userId string) string {
+	return projectId + "\x00" + userId
+}
+
+func contains[T comparable](values []T, value T) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func isZero(value *int) bool {
+	return value != nil && *value == 0
+}
+
+func copyInt(value *int) *int {
+	if value == nil {
+		return nil
+	}
+	v := *value
+	return &v
+}
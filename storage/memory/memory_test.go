@@ -0,0 +1,385 @@
+package memory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/utils/uuid"
+)
+
+func Test_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authen.json")
+
+	// no file yet, that's fine
+	db, err := New(Config{Snapshot: path})
+	assert.Nil(t, err)
+
+	uses := 3
+	db.PutProject(data.Project{Id: "p1", TOTPMax: 9, LockoutRules: []data.LockoutRule{{Statuses: []int{2}, Failures: 1, Window: 60, Duration: 60}}})
+	db.TOTPCreate(context.Background(), data.TOTPCreate{ProjectId: "p1", UserId: "u1", Type: "t1", Secret: []byte("sec1")})
+	db.TicketCreate(context.Background(), data.TicketCreate{ProjectId: "p1", Tickets: []data.TicketCreateTicket{{Ticket: []byte("t1"), Uses: &uses}}})
+	db.TicketDeny(context.Background(), data.TicketDeny{ProjectId: "p1", Ticket: []byte("t2"), Expires: time.Now().Add(time.Minute)})
+	db.LoginLogCreate(context.Background(), data.LoginLogCreate{Id: "l1", ProjectId: "p1", UserId: "u1", Status: 2, Payload: []byte("pl1"), Lockout: []data.LockoutRule{{Statuses: []int{2}, Failures: 1, Window: 60, Duration: 60}}})
+	assert.Nil(t, db.Close())
+
+	db, err = New(Config{Snapshot: path})
+	assert.Nil(t, err)
+
+	p, _ := db.GetProject(context.Background(), "p1")
+	assert.Equal(t, p.TOTPMax, 9)
+	assert.Equal(t, p.LockoutRules[0].Duration, 60)
+
+	totp, _ := db.TOTPGet(context.Background(), data.TOTPGet{ProjectId: "p1", UserId: "u1", Type: "t1"})
+	assert.Equal(t, totp.Status, data.TOTP_GET_OK)
+	assert.Bytes(t, totp.Secret, []byte("sec1"))
+
+	ticket, _ := db.TicketUse(context.Background(), data.TicketUse{ProjectId: "p1", Ticket: []byte("t1")})
+	assert.Equal(t, ticket.Status, data.TICKET_USE_OK)
+	assert.Equal(t, *ticket.Uses, 2)
+
+	denied, _ := db.TicketDeny(context.Background(), data.TicketDeny{ProjectId: "p1", Ticket: []byte("t2"), Expires: time.Now()})
+	assert.Equal(t, denied.Status, data.TICKET_USE_NOT_FOUND)
+
+	logs, _ := db.LoginLogGet(context.Background(), data.LoginLogGet{ProjectId: "p1", UserId: "u1", Limit: 10})
+	assert.Equal(t, len(logs.Records), 1)
+	assert.Equal(t, logs.Records[0].Id, "l1")
+	assert.Equal(t, string(logs.Records[0].RawPayload), "pl1")
+
+	lock, _ := db.UserLockGet(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u1"})
+	assert.Timeish(t, *lock.LockedUntil, time.Now().Add(time.Minute))
+}
+
+func Test_Snapshot_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authen.json")
+	os.WriteFile(path, []byte("nope"), 0600)
+
+	_, err := New(Config{Snapshot: path})
+	assert.True(t, err != nil)
+}
+
+func Test_Clean_Totps(t *testing.T) {
+	withTestDB(func(db *DB) {
+		projectId := uuid.String()
+		addTOTPs(db,
+			&totp{totpKey: totpKey{ProjectId: projectId, UserId: "uid1"}, Expires: at(-1)},
+			&totp{totpKey: totpKey{ProjectId: projectId, UserId: "uid2"}, Expires: at(-999)},
+			&totp{totpKey: totpKey{ProjectId: projectId, UserId: "uid3"}, Expires: at(5)},
+			&totp{totpKey: totpKey{ProjectId: projectId, UserId: "uid4"}},
+		)
+
+		result, err := db.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.TOTPs, 2)
+		assert.Equal(t, len(db.totps), 2)
+		for key := range db.totps {
+			assert.True(t, key.UserId == "uid3" || key.UserId == "uid4")
+		}
+	})
+}
+
+func Test_Clean_Tickets(t *testing.T) {
+	withTestDB(func(db *DB) {
+		projectId := uuid.String()
+		zero, one := 0, 1
+		addTickets(db,
+			&ticket{ProjectId: projectId, Ticket: []byte("t1"), Expires: at(-1)},
+			&ticket{ProjectId: projectId, Ticket: []byte("t2"), Expires: at(-999)},
+			&ticket{ProjectId: projectId, Ticket: []byte("t3"), Uses: &zero},
+			&ticket{ProjectId: projectId, Ticket: []byte("t4"), Expires: at(5), Uses: &one, Attempts: &one},
+			&ticket{ProjectId: projectId, Ticket: []byte("t5")},
+			&ticket{ProjectId: projectId, Ticket: []byte("t6"), Attempts: &zero},
+		)
+
+		result, err := db.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.Tickets, 4)
+		assert.Equal(t, len(db.tickets), 2)
+		assert.True(t, db.tickets[ticketKey(projectId, []byte("t4"))] != nil)
+		assert.True(t, db.tickets[ticketKey(projectId, []byte("t5"))] != nil)
+	})
+}
+
+func Test_Clean_TicketDenylist(t *testing.T) {
+	withTestDB(func(db *DB) {
+		projectId := uuid.String()
+		db.TicketDeny(context.Background(), data.TicketDeny{ProjectId: projectId, Ticket: []byte("t1"), Expires: *at(-1)})
+		db.TicketDeny(context.Background(), data.TicketDeny{ProjectId: projectId, Ticket: []byte("t2"), Expires: *at(5)})
+
+		result, err := db.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.TicketDenylist, 1)
+		assert.Equal(t, len(db.denylist), 1)
+		assert.True(t, db.denylist[ticketKey(projectId, []byte("t2"))] != nil)
+	})
+}
+
+func Test_Clean_LoginLogs(t *testing.T) {
+	withTestDB(func(db *DB) {
+		db.PutProject(data.Project{Id: "p1", LoginLogRetainCount: 2})
+		db.PutProject(data.Project{Id: "p2", LoginLogRetainDays: 1})
+		db.PutProject(data.Project{Id: "p3"})
+
+		addLoginLogs(db,
+			&loginLog{Id: "l1", ProjectId: "p1", UserId: "u1", Status: 1, Created: *at(0)},
+			&loginLog{Id: "l2", ProjectId: "p1", UserId: "u1", Status: 2, Created: *at(-60)},
+			&loginLog{Id: "l3", ProjectId: "p1", UserId: "u1", Status: 3, Created: *at(-120)},
+			&loginLog{Id: "l4", ProjectId: "p1", UserId: "u2", Status: 4, Created: *at(-120)},
+			&loginLog{Id: "l5", ProjectId: "p2", UserId: "u1", Status: 5, Created: *at(-82800)},
+			&loginLog{Id: "l6", ProjectId: "p2", UserId: "u1", Status: 6, Created: *at(-90000)},
+			&loginLog{Id: "l7", ProjectId: "p3", UserId: "u1", Status: 7, Created: *at(-86400000)},
+			&loginLog{Id: "l8", ProjectId: "st", UserId: "u1", Status: 8, Created: *at(0)},
+			&loginLog{Id: "l9", ProjectId: "st", UserId: "u1", Status: 9, Created: *at(-60)},
+			&loginLog{Id: "l10", ProjectId: "st", UserId: "u2", Status: 10, Created: *at(-172800)},
+		)
+
+		assertStatuses := func(statuses ...int) {
+			t.Helper()
+			actual := make(map[int]bool)
+			for _, logs := range db.loginLogs {
+				for _, l := range logs {
+					actual[l.Status] = true
+				}
+			}
+			assert.Equal(t, len(actual), len(statuses))
+			for _, status := range statuses {
+				assert.True(t, actual[status])
+			}
+		}
+
+		// no default retention, logs without a project are kept
+		result, err := db.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.LoginLogs, 2)
+		assertStatuses(1, 2, 4, 5, 7, 8, 9, 10)
+
+		result, err = db.Clean(context.Background(), data.Clean{LoginLogRetention: data.LoginLogRetention{Days: 1}})
+		assert.Nil(t, err)
+		assert.Equal(t, result.LoginLogs, 1)
+		assertStatuses(1, 2, 4, 5, 7, 8, 9)
+
+		result, err = db.Clean(context.Background(), data.Clean{LoginLogRetention: data.LoginLogRetention{Count: 1}})
+		assert.Nil(t, err)
+		assert.Equal(t, result.LoginLogs, 1)
+		assertStatuses(1, 2, 4, 5, 7, 8)
+	})
+}
+
+func Test_Clean_UserLocks(t *testing.T) {
+	withTestDB(func(db *DB) {
+		addUserLocks(db,
+			&userLock{ProjectId: "p1", UserId: "u1", LockedUntil: at(60), Reset: *at(-172800)},
+			&userLock{ProjectId: "p1", UserId: "u2", LockedUntil: at(-60), Reset: *at(-172800)},
+			&userLock{ProjectId: "p1", UserId: "u3", Reset: *at(-172800)},
+			&userLock{ProjectId: "p1", UserId: "u4", Reset: *at(-3600)},
+		)
+
+		result, err := db.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.UserLocks, 2)
+		assert.Equal(t, len(db.userLocks), 2)
+		assert.True(t, db.userLocks[userKey("p1", "u1")] != nil)
+		assert.True(t, db.userLocks[userKey("p1", "u4")] != nil)
+	})
+}
+
+func Test_TicketUse_SlidingTTL(t *testing.T) {
+	withTestDB(func(db *DB) {
+		projectId := uuid.String()
+		five, fiveAgain, ttl := 5, 5, 3600
+		addTickets(db,
+			&ticket{ProjectId: projectId, Ticket: []byte("t1"), Uses: &five, Expires: at(10), SlidingTTL: &ttl},
+			&ticket{ProjectId: projectId, Ticket: []byte("t2"), Uses: &fiveAgain, Expires: at(10)},
+		)
+
+		for _, value := range []string{"t1", "t2"} {
+			res, err := db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId, Ticket: []byte(value)})
+			assert.Nil(t, err)
+			assert.Equal(t, res.Status, data.TICKET_USE_OK)
+			assert.Equal(t, *res.Uses, 4)
+		}
+
+		assert.Timeish(t, *db.tickets[ticketKey(projectId, []byte("t1"))].Expires, time.Now().Add(time.Hour))
+		assert.Timeish(t, *db.tickets[ticketKey(projectId, []byte("t2"))].Expires, time.Now().Add(time.Second*10))
+	})
+}
+
+func Test_TicketExtend(t *testing.T) {
+	withTestDB(func(db *DB) {
+		projectId := uuid.String()
+		two, zero, twoAgain := 2, 0, 2
+		addTickets(db,
+			&ticket{ProjectId: projectId, Ticket: []byte("t1"), Uses: &two, Expires: at(10)},
+			&ticket{ProjectId: projectId, Ticket: []byte("t2")},
+			&ticket{ProjectId: projectId, Ticket: []byte("t3"), Uses: &zero},
+			&ticket{ProjectId: projectId, Ticket: []byte("t4"), Uses: &twoAgain, Expires: at(-1)},
+		)
+
+		extend := func(value string, expires *time.Time, uses *int) data.TicketUseResult {
+			t.Helper()
+			res, err := db.TicketExtend(context.Background(), data.TicketExtend{
+				Uses:      uses,
+				Expires:   expires,
+				Ticket:    []byte(value),
+				ProjectId: projectId,
+			})
+			assert.Nil(t, err)
+			return res
+		}
+		expiresOf := func(value string) *time.Time {
+			return db.tickets[ticketKey(projectId, []byte(value))].Expires
+		}
+
+		uses := 3
+		expires := time.Now().Add(time.Hour)
+
+		// dead tickets can't be extended
+		assert.Equal(t, extend("t3", nil, &uses).Status, data.TICKET_USE_NOT_FOUND)
+		assert.Equal(t, extend("t4", &expires, nil).Status, data.TICKET_USE_NOT_FOUND)
+		assert.Equal(t, extend("t9", &expires, nil).Status, data.TICKET_USE_NOT_FOUND)
+
+		// only uses
+		res := extend("t1", nil, &uses)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+		assert.Equal(t, *res.Uses, 5)
+		assert.Timeish(t, *expiresOf("t1"), time.Now().Add(time.Second*10))
+
+		// only expires
+		res = extend("t1", &expires, nil)
+		assert.Equal(t, *res.Uses, 5)
+		assert.Timeish(t, *expiresOf("t1"), expires)
+
+		// unlimited uses stay unlimited
+		res = extend("t2", &expires, &uses)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+		assert.True(t, res.Uses == nil)
+		assert.Timeish(t, *expiresOf("t2"), expires)
+	})
+}
+
+// statuses are covered by the shared storagetest suite, this only
+// checks what gets stored
+func Test_TicketDeny(t *testing.T) {
+	withTestDB(func(db *DB) {
+		opts := data.TicketDeny{
+			ProjectId: "p1",
+			Ticket:    []byte("t1"),
+			Expires:   time.Now().Add(time.Minute),
+		}
+
+		res, err := db.TicketDeny(context.Background(), opts)
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+		assert.Equal(t, len(db.denylist), 1)
+		assert.Timeish(t, db.denylist[ticketKey("p1", []byte("t1"))].Expires, opts.Expires)
+	})
+}
+
+func Test_LoginLogExport(t *testing.T) {
+	defer func(n int) { loginLogExportBatch = n }(loginLogExportBatch)
+	loginLogExportBatch = 2
+
+	withTestDB(func(db *DB) {
+		l3 := &loginLog{Id: "l3", ProjectId: "p1", UserId: "u1", Status: 3, Created: *at(-180)}
+		addLoginLogs(db,
+			&loginLog{Id: "l2", ProjectId: "p1", UserId: "u2", Status: 2, Created: *at(-240)},
+			&loginLog{Id: "l1", ProjectId: "p1", UserId: "u1", Status: 1, Created: *at(-300)},
+			l3,
+			&loginLog{Id: "l4", ProjectId: "p2", UserId: "u1", Status: 4, Created: *at(-60)},
+		)
+
+		var statuses []int
+		var payloads []string
+		err := db.LoginLogExport(context.Background(), data.LoginLogExport{ProjectId: "p1"}, func(record data.LoginLogRecord) error {
+			statuses = append(statuses, record.Status)
+			payloads = append(payloads, string(record.RawPayload))
+			// l3 is in the next batch, so it hasn't been copied yet
+			if record.Status == 1 {
+				db.Lock()
+				l3.Payload = []byte("changed")
+				db.Unlock()
+			}
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, len(statuses), 3)
+		assert.Equal(t, statuses[0], 1)
+		assert.Equal(t, statuses[1], 2)
+		assert.Equal(t, statuses[2], 3)
+		assert.Equal(t, payloads[2], "changed")
+	})
+}
+
+func Test_UserUnlock(t *testing.T) {
+	withTestDB(func(db *DB) {
+		addUserLocks(db,
+			&userLock{ProjectId: "p1", UserId: "u1", LockedUntil: at(60), Reset: *at(-3600)},
+			&userLock{ProjectId: "p1", UserId: "u2", LockedUntil: at(-1), Reset: *at(-3600)},
+		)
+
+		unlocked, err := db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u1"})
+		assert.Nil(t, err)
+		assert.True(t, unlocked)
+
+		unlocked, _ = db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u1"})
+		assert.False(t, unlocked)
+
+		lock, _ := db.UserLockGet(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u1"})
+		assert.True(t, lock.LockedUntil == nil)
+
+		unlocked, _ = db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u2"})
+		assert.False(t, unlocked)
+
+		// unlocking a user without a lock resets their failures too
+		unlocked, _ = db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u3"})
+		assert.False(t, unlocked)
+
+		assert.Equal(t, len(db.userLocks), 3)
+		for _, l := range db.userLocks {
+			assert.True(t, l.LockedUntil == nil)
+			assert.Nowish(t, l.Reset)
+		}
+	})
+}
+
+func withTestDB(fn func(db *DB)) {
+	db, err := New(Config{})
+	if err != nil {
+		panic(err)
+	}
+	fn(db)
+}
+
+// now + seconds
+func at(seconds int) *time.Time {
+	t := time.Now().Add(time.Duration(seconds) * time.Second)
+	return &t
+}
+
+func addTOTPs(db *DB, totps ...*totp) {
+	for _, t := range totps {
+		db.totps[t.totpKey] = t
+	}
+}
+
+func addTickets(db *DB, tickets ...*ticket) {
+	for _, t := range tickets {
+		db.tickets[ticketKey(t.ProjectId, t.Ticket)] = t
+	}
+}
+
+func addLoginLogs(db *DB, logs ...*loginLog) {
+	for _, l := range logs {
+		db.loginLogs[l.ProjectId] = append(db.loginLogs[l.ProjectId], l)
+	}
+}
+
+func addUserLocks(db *DB, locks ...*userLock) {
+	for _, l := range locks {
+		db.userLocks[userKey(l.ProjectId, l.UserId)] = l
+	}
+}
@@ -0,0 +1,37 @@
+package memory_test
+
+import (
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/authen/storage/memory"
+	"src.goblgobl.com/authen/storage/storagetest"
+)
+
+func Test_StorageTest(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (storage.Storage, storagetest.Fixtures) {
+		db, err := memory.New(memory.Config{})
+		if err != nil {
+			panic(err)
+		}
+		return db, fixtures{db}
+	})
+}
+
+type fixtures struct {
+	db *memory.DB
+}
+
+func (f fixtures) Project(project data.Project, updated time.Time) {
+	f.db.InsertProject(project, updated)
+}
+
+func (f fixtures) LoginLog(opts data.LoginLogCreate, created time.Time) {
+	f.db.InsertLoginLog(opts, created)
+}
+
+func (f fixtures) UserLock(projectId string, userId string, lockedUntil *time.Time, reset time.Time) {
+	f.db.InsertUserLock(projectId, userId, lockedUntil, reset)
+}
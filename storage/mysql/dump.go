@@ -0,0 +1,287 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"src.goblgobl.com/utils/json"
+
+	"src.goblgobl.com/authen/storage/data"
+)
+
+// Calls fn for every row. Everything is read in a single repeatable read
+// transaction, so this is a consistent copy.
+func (db DB) Dump(fn func(data.DumpRecord) error) error {
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("MySQL.Dump (begin) - %w", err)
+	}
+	defer tx.Rollback()
+
+	err = dumpRows(tx, fn, `
+		select id,
+			totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
+			ticket_max, ticket_max_payload_length,
+			login_log_max, login_log_max_payload_length,
+			login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+			lockout_rules, login_log_success_statuses, updated
+		from authen_projects
+	`, func(rows *sql.Rows) (data.DumpRecord, error) {
+		var updated time.Time
+		project, err := scanProject(withUpdated{rows, &updated})
+		if err != nil {
+			return data.DumpRecord{}, err
+		}
+		return data.DumpRecord{Project: &data.DumpProject{Project: *project, Updated: updated}}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("MySQL.Dump (projects) - %w", err)
+	}
+
+	err = dumpRows(tx, fn, `
+		select project_id, user_id, type, pending, secret, expires, created
+		from authen_totps
+	`, func(rows *sql.Rows) (data.DumpRecord, error) {
+		t := new(data.DumpTOTP)
+		err := rows.Scan(&t.ProjectId, &t.UserId, &t.Type, &t.Pending, &t.Secret, &t.Expires, &t.Created)
+		return data.DumpRecord{TOTP: t}, err
+	})
+	if err != nil {
+		return fmt.Errorf("MySQL.Dump (totps) - %w", err)
+	}
+
+	err = dumpRows(tx, fn, `
+		select project_id, ticket, payload, payload_encrypted, uses, expires, sliding_ttl, scope, attempts, created
+		from authen_tickets
+	`, func(rows *sql.Rows) (data.DumpRecord, error) {
+		t := new(data.DumpTicket)
+		err := rows.Scan(&t.ProjectId, &t.Ticket, &t.Payload, &t.PayloadEncrypted, &t.Uses, &t.Expires, &t.SlidingTTL, &t.Scope, &t.Attempts, &t.Created)
+		return data.DumpRecord{Ticket: t}, err
+	})
+	if err != nil {
+		return fmt.Errorf("MySQL.Dump (tickets) - %w", err)
+	}
+
+	err = dumpRows(tx, fn, `
+		select project_id, ticket, expires
+		from authen_ticket_denylist
+	`, func(rows *sql.Rows) (data.DumpRecord, error) {
+		d := new(data.DumpDenied)
+		err := rows.Scan(&d.ProjectId, &d.Ticket, &d.Expires)
+		return data.DumpRecord{Denied: d}, err
+	})
+	if err != nil {
+		return fmt.Errorf("MySQL.Dump (ticket denylist) - %w", err)
+	}
+
+	err = dumpRows(tx, fn, `
+		select id, project_id, user_id, status, payload, payload_key, created, ip, user_agent, method, country, ip_prefix, device
+		from authen_login_logs
+		order by created, id
+	`, func(rows *sql.Rows) (data.DumpRecord, error) {
+		l := new(data.DumpLoginLog)
+		err := rows.Scan(&l.Id, &l.ProjectId, &l.UserId, &l.Status, &l.Payload, &l.PayloadKey, &l.Created, &l.Ip, &l.UserAgent, &l.Method, &l.Country, &l.IpPrefix, &l.Device)
+		return data.DumpRecord{LoginLog: l}, err
+	})
+	if err != nil {
+		return fmt.Errorf("MySQL.Dump (login logs) - %w", err)
+	}
+
+	err = dumpRows(tx, fn, `
+		select project_id, user_id, locked_until, reset
+		from authen_user_locks
+	`, func(rows *sql.Rows) (data.DumpRecord, error) {
+		l := new(data.DumpUserLock)
+		err := rows.Scan(&l.ProjectId, &l.UserId, &l.LockedUntil, &l.Reset)
+		return data.DumpRecord{UserLock: l}, err
+	})
+	if err != nil {
+		return fmt.Errorf("MySQL.Dump (user locks) - %w", err)
+	}
+
+	return nil
+}
+
+// Inserts (or replaces) the rows, in a single transaction.
+func (db DB) Load(records []data.DumpRecord) error {
+	err := db.transaction(context.Background(), func(tx *sql.Tx) error {
+		for _, record := range records {
+			var err error
+			switch {
+			case record.Project != nil:
+				p := record.Project
+				var lockoutRules, successStatuses *string
+				if lockoutRules, err = encodeList(p.LockoutRules); err != nil {
+					return err
+				}
+				if successStatuses, err = encodeList(p.LoginLogSuccessStatuses); err != nil {
+					return err
+				}
+				_, err = tx.Exec(`
+					insert into authen_projects (id,
+						totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
+						ticket_max, ticket_max_payload_length,
+						login_log_max, login_log_max_payload_length,
+						login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+						lockout_rules, login_log_success_statuses, updated)
+					values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+					on duplicate key update
+						totp_issuer = values(totp_issuer),
+						totp_max = values(totp_max),
+						totp_setup_ttl = values(totp_setup_ttl),
+						totp_secret_length = values(totp_secret_length),
+						ticket_max = values(ticket_max),
+						ticket_max_payload_length = values(ticket_max_payload_length),
+						login_log_max = values(login_log_max),
+						login_log_max_payload_length = values(login_log_max_payload_length),
+						login_log_retain_count = values(login_log_retain_count),
+						login_log_retain_days = values(login_log_retain_days),
+						login_log_retain_on_insert = values(login_log_retain_on_insert),
+						lockout_rules = values(lockout_rules),
+						login_log_success_statuses = values(login_log_success_statuses),
+						updated = values(updated)
+				`, p.Id,
+					p.TOTPIssuer, p.TOTPMax, p.TOTPSetupTTL, p.TOTPSecretLength,
+					p.TicketMax, p.TicketMaxPayloadLength,
+					p.LoginLogMax, p.LoginLogMaxPayloadLength,
+					p.LoginLogRetainCount, p.LoginLogRetainDays, p.LoginLogRetainOnInsert,
+					lockoutRules, successStatuses, p.Updated)
+			case record.TOTP != nil:
+				t := record.TOTP
+				_, err = tx.Exec(`
+					insert into authen_totps (project_id, user_id, type, pending, secret, expires, created)
+					values (?, ?, ?, ?, ?, ?, ?)
+					on duplicate key update
+						secret = values(secret),
+						expires = values(expires),
+						created = values(created)
+				`, t.ProjectId, t.UserId, t.Type, t.Pending, t.Secret, t.Expires, t.Created)
+			case record.Ticket != nil:
+				t := record.Ticket
+				_, err = tx.Exec(`
+					insert into authen_tickets (project_id, ticket, payload, payload_encrypted, uses, expires, sliding_ttl, scope, attempts, created)
+					values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+					on duplicate key update
+						payload = values(payload),
+						payload_encrypted = values(payload_encrypted),
+						uses = values(uses),
+						expires = values(expires),
+						sliding_ttl = values(sliding_ttl),
+						scope = values(scope),
+						attempts = values(attempts),
+						created = values(created)
+				`, t.ProjectId, t.Ticket, t.Payload, t.PayloadEncrypted, t.Uses, t.Expires, t.SlidingTTL, t.Scope, t.Attempts, t.Created)
+			case record.Denied != nil:
+				d := record.Denied
+				_, err = tx.Exec(`
+					insert into authen_ticket_denylist (project_id, ticket, expires)
+					values (?, ?, ?)
+					on duplicate key update expires = values(expires)
+				`, d.ProjectId, d.Ticket, d.Expires)
+			case record.LoginLog != nil:
+				l := record.LoginLog
+				_, err = tx.Exec(`
+					insert into authen_login_logs (id, project_id, user_id, status, payload, payload_key, created, ip, user_agent, method, country, ip_prefix, device)
+					values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+					on duplicate key update
+						project_id = values(project_id),
+						user_id = values(user_id),
+						status = values(status),
+						payload = values(payload),
+						payload_key = values(payload_key),
+						created = values(created),
+						ip = values(ip),
+						user_agent = values(user_agent),
+						method = values(method),
+						country = values(country),
+						ip_prefix = values(ip_prefix),
+						device = values(device)
+				`, l.Id, l.ProjectId, l.UserId, l.Status, l.Payload, l.PayloadKey, l.Created, l.Ip, l.UserAgent, l.Method, l.Country, l.IpPrefix, l.Device)
+			case record.UserLock != nil:
+				l := record.UserLock
+				_, err = tx.Exec(`
+					insert into authen_user_locks (project_id, user_id, locked_until, reset)
+					values (?, ?, ?, ?)
+					on duplicate key update
+						locked_until = values(locked_until),
+						reset = values(reset)
+				`, l.ProjectId, l.UserId, l.LockedUntil, l.Reset)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("MySQL.Load - %w", err)
+	}
+	return nil
+}
+
+// The number of rows of each kind (keyed by data.DumpRecord.Kind), so
+// that an import can be checked without reading everything back.
+func (db DB) Counts() (map[string]int, error) {
+	var projects, totps, tickets, denied, loginLogs, userLocks int
+	err := db.QueryRowContext(context.Background(), `
+		select
+			(select count(*) from authen_projects),
+			(select count(*) from authen_totps),
+			(select count(*) from authen_tickets),
+			(select count(*) from authen_ticket_denylist),
+			(select count(*) from authen_login_logs),
+			(select count(*) from authen_user_locks)
+	`).Scan(&projects, &totps, &tickets, &denied, &loginLogs, &userLocks)
+
+	if err != nil {
+		return nil, fmt.Errorf("MySQL.Counts - %w", err)
+	}
+	return data.DumpCounts(projects, totps, tickets, denied, loginLogs, userLocks), nil
+}
+
+// Closes rows
+func dumpRows(tx *sql.Tx, fn func(data.DumpRecord) error, query string, scan func(*sql.Rows) (data.DumpRecord, error)) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record, err := scan(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// what's stored in authen_projects' json columns, lockout_rules and
+// login_log_success_statuses (the reverse of scanProject)
+func encodeList[T any](values []T) (*string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	text := string(encoded)
+	return &text, nil
+}
+
+// Lets Dump use scanProject, with updated as an extra, last, column
+type withUpdated struct {
+	scanner
+	updated *time.Time
+}
+
+func (s withUpdated) Scan(dest ...any) error {
+	return s.scanner.Scan(append(dest, s.updated)...)
+}
@@ -0,0 +1,7 @@
+package mysql
+
+// The conformance suite runs from an external test package (storagetest
+// imports storage which imports us) and shares our database.
+func SharedDB() DB {
+	return db
+}
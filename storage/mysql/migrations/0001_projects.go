@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Tables are utf8mb4_bin so that ids (and everything else we look up)
+// compare like they do in pg and sqlite, case and accent sensitive.
+func Migrate_0001(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		create table authen_projects (
+			id char(36) not null primary key,
+			totp_max int not null,
+			totp_issuer varchar(255) not null,
+			totp_setup_ttl int not null,
+			totp_secret_length int not null,
+			ticket_max int not null,
+			ticket_max_payload_length int not null,
+			login_log_max int not null,
+			login_log_max_payload_length int not null,
+			created datetime(6) not null default current_timestamp(6),
+			updated datetime(6) not null default current_timestamp(6)
+		) character set utf8mb4 collate utf8mb4_bin`); err != nil {
+		return fmt.Errorf("mysql 0001 migration authen_projects - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		create index authen_projects_updated on authen_projects(updated)
+	`); err != nil {
+		return fmt.Errorf("mysql 0001 migration authen_projects_updated - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func Migrate_0002(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		create table authen_totps (
+			project_id char(36) not null,
+			user_id varchar(255) not null,
+			type varchar(255) not null,
+			pending bool not null,
+			secret varbinary(1024) not null,
+			expires datetime(6) null,
+			created datetime(6) not null default current_timestamp(6),
+			primary key (project_id, user_id, type, pending)
+		) character set utf8mb4 collate utf8mb4_bin`); err != nil {
+		return fmt.Errorf("mysql 0002 migration authen_totps - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		create index authen_totps_expires on authen_totps(expires)
+	`); err != nil {
+		return fmt.Errorf("mysql 0002 migration authen_totps_expires - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func Migrate_0003(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		create table authen_tickets (
+			project_id varchar(255) not null,
+			ticket varbinary(255) not null,
+			expires datetime(6) null,
+			uses int null,
+			payload mediumblob null,
+			created datetime(6) not null default current_timestamp(6),
+			primary key (project_id, ticket)
+		) character set utf8mb4 collate utf8mb4_bin`); err != nil {
+		return fmt.Errorf("mysql 0003 migration authen_tickets - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		create index authen_tickets_expires on authen_tickets(expires)
+	`); err != nil {
+		return fmt.Errorf("mysql 0003 migration authen_tickets_expires - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		create index authen_tickets_uses on authen_tickets(uses)
+	`); err != nil {
+		return fmt.Errorf("mysql 0003 migration authen_tickets_uses - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func Migrate_0004(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		create table authen_login_logs (
+			id char(36) not null primary key,
+			project_id varchar(255) not null,
+			user_id varchar(255) not null,
+			status int not null,
+			payload mediumblob null,
+			created datetime(6) not null default current_timestamp(6)
+		) character set utf8mb4 collate utf8mb4_bin`); err != nil {
+		return fmt.Errorf("mysql 0004 migration authen_login_logs - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		create index authen_login_logs_project_id_user_id on authen_login_logs(project_id, user_id)
+	`); err != nil {
+		return fmt.Errorf("mysql 0004 migration authen_login_logs_project_id_user_id - %w", err)
+	}
+
+	return nil
+}
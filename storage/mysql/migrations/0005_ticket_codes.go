@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func Migrate_0005(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		alter table authen_tickets
+		add column scope varbinary(255) null,
+		add column attempts int null
+	`); err != nil {
+		return fmt.Errorf("mysql 0005 migration authen_tickets - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		create index authen_tickets_scope on authen_tickets(project_id, scope)
+	`); err != nil {
+		return fmt.Errorf("mysql 0005 migration authen_tickets_scope - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// See pg's 0006. Login log payloads can be encrypted with the
+// -encrypt-login-logs command.
+func Migrate_0006(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		alter table authen_tickets
+		add column payload_encrypted bool not null default false
+	`); err != nil {
+		return fmt.Errorf("mysql 0006 migration authen_tickets - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		alter table authen_login_logs
+		add column payload_key int not null default 0
+	`); err != nil {
+		return fmt.Errorf("mysql 0006 migration authen_login_logs - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,17 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func Migrate_0007(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		alter table authen_tickets
+		add column sliding_ttl int null
+	`); err != nil {
+		return fmt.Errorf("mysql 0007 migration authen_tickets - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Signed tickets aren't stored. Single-use signed tickets are added
+// here on use, and removed by Clean once they've expired.
+func Migrate_0008(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		create table authen_ticket_denylist (
+			project_id varchar(255) not null,
+			ticket varbinary(255) not null,
+			expires datetime(6) not null,
+			primary key (project_id, ticket)
+		) character set utf8mb4 collate utf8mb4_bin`); err != nil {
+		return fmt.Errorf("mysql 0008 migration authen_ticket_denylist - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		create index authen_ticket_denylist_expires on authen_ticket_denylist(expires)
+	`); err != nil {
+		return fmt.Errorf("mysql 0008 migration authen_ticket_denylist_expires - %w", err)
+	}
+
+	return nil
+}
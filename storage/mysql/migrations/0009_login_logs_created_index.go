@@ -0,0 +1,25 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Login logs are always listed for a user, newest first, and can be
+// filtered by time. The (project_id, user_id) index is a prefix of the
+// new one, so it can go.
+func Migrate_0009(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		create index authen_login_logs_project_id_user_id_created on authen_login_logs(project_id, user_id, created)
+	`); err != nil {
+		return fmt.Errorf("mysql 0009 migration authen_login_logs_project_id_user_id_created - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		drop index authen_login_logs_project_id_user_id on authen_login_logs
+	`); err != nil {
+		return fmt.Errorf("mysql 0009 migration drop authen_login_logs_project_id_user_id - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ip, method and country are filtered on (along with the project and
+// user), so they're varchar rather than text.
+func Migrate_0010(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		alter table authen_login_logs
+		add column ip varchar(255) null,
+		add column user_agent text null,
+		add column method varchar(255) null,
+		add column country varchar(255) null
+	`); err != nil {
+		return fmt.Errorf("mysql 0010 migration authen_login_logs - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ip_prefix and device are derived from ip and user_agent and are what
+// we look up to decide if a login is from a new ip / device.
+func Migrate_0011(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		alter table authen_login_logs
+		add column ip_prefix varchar(255) null,
+		add column device varchar(255) null
+	`); err != nil {
+		return fmt.Errorf("mysql 0011 migration authen_login_logs - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		create index authen_login_logs_project_id_user_id_ip_prefix on authen_login_logs(project_id, user_id, ip_prefix)
+	`); err != nil {
+		return fmt.Errorf("mysql 0011 migration authen_login_logs_project_id_user_id_ip_prefix - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		create index authen_login_logs_project_id_user_id_device on authen_login_logs(project_id, user_id, device)
+	`); err != nil {
+		return fmt.Errorf("mysql 0011 migration authen_login_logs_project_id_user_id_device - %w", err)
+	}
+
+	return nil
+}
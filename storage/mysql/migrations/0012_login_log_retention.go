@@ -0,0 +1,19 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func Migrate_0012(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		alter table authen_projects
+		add column login_log_retain_count int not null default 0,
+		add column login_log_retain_days int not null default 0,
+		add column login_log_retain_on_insert bool not null default false
+	`); err != nil {
+		return fmt.Errorf("mysql 0012 migration authen_projects - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,18 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Stats are for a project over a time range, across all users, so the
+// (project_id, user_id, created) index doesn't help.
+func Migrate_0013(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		create index authen_login_logs_project_id_created on authen_login_logs(project_id, created)
+	`); err != nil {
+		return fmt.Errorf("mysql 0013 migration authen_login_logs_project_id_created - %w", err)
+	}
+
+	return nil
+}
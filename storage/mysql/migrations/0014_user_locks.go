@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// lockout_rules is a json array of data.LockoutRule. A user's lock is
+// kept after it expires (or is manually unlocked) since login logs
+// older than reset no longer count towards a new lock.
+func Migrate_0014(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		alter table authen_projects
+		add column lockout_rules text null
+	`); err != nil {
+		return fmt.Errorf("mysql 0014 migration authen_projects - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		create table authen_user_locks (
+			project_id varchar(255) not null,
+			user_id varchar(255) not null,
+			locked_until datetime(6) null,
+			reset datetime(6) not null,
+			primary key (project_id, user_id)
+		) character set utf8mb4 collate utf8mb4_bin`); err != nil {
+		return fmt.Errorf("mysql 0014 migration authen_user_locks - %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		create index authen_user_locks_reset on authen_user_locks(reset)
+	`); err != nil {
+		return fmt.Errorf("mysql 0014 migration authen_user_locks_reset - %w", err)
+	}
+
+	return nil
+}
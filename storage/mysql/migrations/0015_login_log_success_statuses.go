@@ -0,0 +1,19 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// login_log_success_statuses is a json array of the statuses of a
+// successful login. Only those make an ip or device known.
+func Migrate_0015(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		alter table authen_projects
+		add column login_log_success_statuses text null
+	`); err != nil {
+		return fmt.Errorf("mysql 0015 migration authen_projects - %w", err)
+	}
+
+	return nil
+}
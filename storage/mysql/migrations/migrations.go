@@ -0,0 +1,113 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+
+	"src.goblgobl.com/utils/log"
+)
+
+// src.goblgobl.com/utils has pg and sqlite migration runners, but nothing
+// for mysql, so this is a small equivalent which records applied versions
+// in the same gobl_migrations table.
+//
+// MySQL implicitly commits DDL statements, so a migration which fails
+// part way through isn't rolled back. Each migration is kept to
+// statements which can safely be re-run by hand after fixing the cause.
+type Migration struct {
+	Version int
+	Fn      func(tx *sql.Tx) error
+}
+
+func Run(db *sql.DB) error {
+	migrations := []Migration{
+		Migration{1, Migrate_0001},
+		Migration{2, Migrate_0002},
+		Migration{3, Migrate_0003},
+		Migration{4, Migrate_0004},
+		Migration{5, Migrate_0005},
+		Migration{6, Migrate_0006},
+		Migration{7, Migrate_0007},
+		Migration{8, Migrate_0008},
+		Migration{9, Migrate_0009},
+		Migration{10, Migrate_0010},
+		Migration{11, Migrate_0011},
+		Migration{12, Migrate_0012},
+		Migration{13, Migrate_0013},
+		Migration{14, Migrate_0014},
+		Migration{15, Migrate_0015},
+	}
+	return MigrateAll(db, "authen", migrations)
+}
+
+func GetCurrent(db *sql.DB) (int, error) {
+	return GetCurrentMigrationVersion(db, "authen")
+}
+
+func MigrateAll(db *sql.DB, app string, migrations []Migration) error {
+	if _, err := db.Exec(`
+		create table if not exists gobl_migrations (
+			app varchar(255) not null,
+			version int not null,
+			created datetime(6) not null default current_timestamp(6),
+			primary key (app, version)
+		)`); err != nil {
+		return fmt.Errorf("mysql migrations gobl_migrations - %w", err)
+	}
+
+	current, err := GetCurrentMigrationVersion(db, app)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		version := migration.Version
+		if version <= current {
+			continue
+		}
+		log.Info("migration").String("app", app).String("type", "mysql").Int("version", version).Log()
+		if err := migrate(db, app, migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetCurrentMigrationVersion(db *sql.DB, app string) (int, error) {
+	var version int
+	err := db.QueryRow(`
+		select coalesce(max(version), 0)
+		from gobl_migrations
+		where app = ?
+	`, app).Scan(&version)
+
+	if err != nil {
+		return 0, fmt.Errorf("mysql migrations version - %w", err)
+	}
+	return version, nil
+}
+
+func migrate(db *sql.DB, app string, migration Migration) error {
+	version := migration.Version
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("mysql migration %d begin - %w", version, err)
+	}
+	defer tx.Rollback()
+
+	if err := migration.Fn(tx); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		insert into gobl_migrations (app, version)
+		values (?, ?)
+	`, app, version); err != nil {
+		return fmt.Errorf("mysql migration %d record - %w", version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("mysql migration %d commit - %w", version, err)
+	}
+	return nil
+}
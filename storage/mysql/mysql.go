@@ -0,0 +1,1358 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"src.goblgobl.com/utils/json"
+
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/authen/storage/mysql/migrations"
+)
+
+// rows read per query by LoginLogExport (a var so tests can lower it)
+var loginLogExportBatch = 1000
+
+// returned when inserting a batch of tickets, so that it's rolled back
+var errTicketDuplicate = errors.New("duplicate ticket")
+
+// URL is a go-sql-driver/mysql DSN, e.g.
+// user:password@tcp(localhost:3306)/gobl
+type Config struct {
+	URL string `json:"url"`
+}
+
+// Works with MySQL 8 and MariaDB 10.5+ (window functions, and large
+// enough index prefixes for our utf8mb4 keys).
+type DB struct {
+	*sql.DB
+}
+
+func New(config Config) (DB, error) {
+	cfg, err := mysql.ParseDSN(config.URL)
+	if err != nil {
+		return DB{}, fmt.Errorf("MySQL.New (dsn) - %w", err)
+	}
+
+	// datetime columns have no timezone. Times are written and read as
+	// UTC and the session's now() is UTC, so everything lines up.
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return DB{}, fmt.Errorf("MySQL.New - %w", err)
+	}
+	return DB{db}, nil
+}
+
+func (db DB) Ping(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, "select 1")
+	if err != nil {
+		return fmt.Errorf("MySQL.Ping - %w", err)
+	}
+	return nil
+}
+
+// Every delete is done opts.BatchSize rows at a time. MySQL can't delete
+// from a table it's selecting from in a subquery, nor limit a multi-table
+// delete, hence the login log deletes joined to a (materialized, limited)
+// derived table.
+func (db DB) Clean(ctx context.Context, opts data.Clean) (data.CleanResult, error) {
+	var err error
+	var result data.CleanResult
+
+	result.TOTPs, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return db.deleted(ctx, `
+			delete from authen_totps
+			where expires < now(6)
+		`+limitClause(limit))
+	})
+	if err != nil {
+		return result, fmt.Errorf("MySQL.clean (totp) - %w", err)
+	}
+
+	result.Tickets, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return db.deleted(ctx, `
+			delete from authen_tickets
+			where uses = 0 or attempts = 0 or expires < now(6)
+		`+limitClause(limit))
+	})
+	if err != nil {
+		return result, fmt.Errorf("MySQL.clean (tickets) - %w", err)
+	}
+
+	result.TicketDenylist, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return db.deleted(ctx, `
+			delete from authen_ticket_denylist
+			where expires < now(6)
+		`+limitClause(limit))
+	})
+	if err != nil {
+		return result, fmt.Errorf("MySQL.clean (ticket denylist) - %w", err)
+	}
+
+	// login logs of a project which isn't in authen_projects (single tenancy)
+	// use the retention passed in
+	retention := opts.LoginLogRetention
+	removed, err := opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return db.deleted(ctx, `
+			delete l
+			from authen_login_logs l
+				join (
+					select l.id
+					from authen_login_logs l
+						left join authen_projects p on p.id = l.project_id
+					where coalesce(p.login_log_retain_days, ?) > 0
+						and l.created < now(6) - interval coalesce(p.login_log_retain_days, ?) day
+					`+limitClause(limit)+`
+				) old on old.id = l.id
+		`, retention.Days, retention.Days)
+	})
+	result.LoginLogs += removed
+	if err != nil {
+		return result, fmt.Errorf("MySQL.clean (login logs days) - %w", err)
+	}
+
+	removed, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return db.deleted(ctx, `
+			delete l
+			from authen_login_logs l
+				join (
+					select id from (
+						select l.id,
+							coalesce(p.login_log_retain_count, ?) as retain,
+							row_number() over (partition by l.project_id, l.user_id order by l.created desc, l.id desc) as n
+						from authen_login_logs l
+							left join authen_projects p on p.id = l.project_id
+					) ranked
+					where retain > 0 and n > retain
+					`+limitClause(limit)+`
+				) old on old.id = l.id
+		`, retention.Count)
+	})
+	result.LoginLogs += removed
+	if err != nil {
+		return result, fmt.Errorf("MySQL.clean (login logs count) - %w", err)
+	}
+
+	// Expired and unlocked locks are only kept so that older login logs
+	// don't count towards a new lock, which they can't once they're older
+	// than data.MAX_LOCKOUT_WINDOW.
+	result.UserLocks, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return db.deleted(ctx, `
+			delete from authen_user_locks
+			where (locked_until is null or locked_until < now(6))
+				and reset < now(6) - interval 1 day
+		`+limitClause(limit))
+	})
+	if err != nil {
+		return result, fmt.Errorf("MySQL.clean (user locks) - %w", err)
+	}
+
+	return result, nil
+}
+
+// Runs a delete and returns the number of rows it deleted
+func (db DB) deleted(ctx context.Context, query string, args ...any) (int, error) {
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return rowsAffected(res)
+}
+
+// " limit N", or nothing when there's no limit (n == 0)
+func limitClause(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return " limit " + strconv.Itoa(n)
+}
+
+func (db DB) EnsureMigrations() error {
+	return migrations.Run(db.DB)
+}
+
+func (db DB) EventPublish(ctx context.Context, payload []byte) error {
+	return nil
+}
+
+func (db DB) EventListen(fn func(payload []byte)) error {
+	return nil
+}
+
+func (db DB) Info(ctx context.Context) (any, error) {
+	migration, err := migrations.GetCurrent(db.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		Type      string `json:"type"`
+		Migration int    `json:"migration"`
+	}{
+		Type:      "mysql",
+		Migration: migration,
+	}, nil
+}
+
+func (db DB) GetProject(ctx context.Context, id string) (*data.Project, error) {
+	row := db.QueryRowContext(ctx, `
+		select id,
+			totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
+			ticket_max, ticket_max_payload_length,
+			login_log_max, login_log_max_payload_length,
+			login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+			lockout_rules, login_log_success_statuses
+		from authen_projects
+		where id = ?
+	`, id)
+
+	project, err := scanProject(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("MySQL.GetProject - %w", err)
+	}
+	return project, nil
+}
+
+func (db DB) GetUpdatedProjects(ctx context.Context, timestamp time.Time) ([]*data.Project, error) {
+	// See pg's GetUpdatedProjects, we expect this to be 0 almost every time.
+	var count int
+	if err := db.QueryRowContext(ctx, "select count(*) from authen_projects where updated > ?", timestamp).Scan(&count); err != nil {
+		return nil, fmt.Errorf("MySQL.GetUpdatedProjects (count) - %w", err)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		select id,
+			totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
+			ticket_max, ticket_max_payload_length,
+			login_log_max, login_log_max_payload_length,
+			login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+			lockout_rules, login_log_success_statuses
+		from authen_projects where updated > ?
+	`, timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("MySQL.GetUpdatedProjects (select) - %w", err)
+	}
+	defer rows.Close()
+
+	projects := make([]*data.Project, 0, count)
+	for rows.Next() {
+		project, err := scanProject(rows)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+
+	return projects, rows.Err()
+}
+
+func (db DB) TOTPCreate(ctx context.Context, opts data.TOTPCreate) (data.TOTPCreateResult, error) {
+	max := opts.Max
+	tpe := opts.Type
+	secret := opts.Secret
+	userId := opts.UserId
+	expires := opts.Expires
+	pending := expires != nil
+	projectId := opts.ProjectId
+
+	var result data.TOTPCreateResult
+
+	// Like pg, concurrent calls might go a little over max.
+	canAdd, err := db.canAddTOTP(ctx, projectId, userId, tpe, max)
+	if err != nil {
+		return result, err
+	}
+
+	if !canAdd {
+		result.Status = data.TOTP_CREATE_MAX
+		return result, nil
+	}
+
+	err = db.transaction(ctx, func(tx *sql.Tx) error {
+		// values() is deprecated in MySQL 8.0.20+, but the alias syntax
+		// which replaces it isn't supported by MariaDB
+		_, err := tx.ExecContext(ctx, `
+			insert into authen_totps (project_id, user_id, type, pending, secret, expires)
+			values (?, ?, ?, ?, ?, ?)
+			on duplicate key update secret = values(secret), expires = values(expires)
+		`, projectId, userId, tpe, pending, secret, expires)
+		if err != nil {
+			return fmt.Errorf("MySQL.TOTPCreate (upsert) - %w", err)
+		}
+
+		if pending {
+			return nil
+		}
+
+		// a confirmed TOTP replaces the pending one (see pg's TOTPCreate)
+		_, err = tx.ExecContext(ctx, `
+			delete from authen_totps
+			where project_id = ? and user_id = ? and type = ? and pending
+		`, projectId, userId, tpe)
+
+		if err != nil {
+			return fmt.Errorf("MySQL.TOTPCreate (delete) - %w", err)
+		}
+
+		return nil
+	})
+
+	return result, err
+}
+
+func (db DB) TOTPGet(ctx context.Context, opts data.TOTPGet) (data.TOTPGetResult, error) {
+	var result data.TOTPGetResult
+
+	row := db.QueryRowContext(ctx, `
+		select secret
+		from authen_totps
+		where project_id = ?
+			and user_id = ?
+			and type = ?
+			and pending = ?
+			and (not pending or expires > now(6))
+	`, opts.ProjectId, opts.UserId, opts.Type, opts.Pending)
+
+	var secret []byte
+	if err := row.Scan(&secret); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			result.Status = data.TOTP_GET_NOT_FOUND
+			return result, nil
+		}
+		return result, fmt.Errorf("MySQL.TOTPGet - %w", err)
+	}
+
+	return data.TOTPGetResult{
+		Secret: secret,
+		Status: data.TOTP_GET_OK,
+	}, nil
+}
+
+func (db DB) TOTPDelete(ctx context.Context, opts data.TOTPGet) (int, error) {
+	res, err := db.ExecContext(ctx, `
+		delete from authen_totps
+		where project_id = ?
+			and user_id = ?
+			and (type = ? or ?)
+	`, opts.ProjectId, opts.UserId, opts.Type, opts.AllTypes)
+
+	if err != nil {
+		return 0, fmt.Errorf("MySQL.TOTPDelete - %w", err)
+	}
+	return rowsAffected(res)
+}
+
+func (db DB) TicketCreate(ctx context.Context, opts data.TicketCreate) (data.TicketCreateResult, error) {
+	max := opts.Max
+	tickets := opts.Tickets
+	projectId := opts.ProjectId
+
+	var result data.TicketCreateResult
+	if len(tickets) == 0 {
+		result.Status = data.TICKET_CREATE_OK
+		return result, nil
+	}
+
+	canAdd, err := db.ticketCanAdd(ctx, projectId, max, len(tickets))
+	if err != nil {
+		return result, err
+	}
+
+	if !canAdd {
+		result.Status = data.TICKET_CREATE_MAX
+		return result, nil
+	}
+
+	// Random 20 byte tickets won't collide, but short codes can, in which
+	// case the caller is expected to generate a new code and try again.
+	// A batch with a duplicate is rolled back.
+	insert := func(exec func(context.Context, string, ...any) (sql.Result, error)) error {
+		query, args := ticketCreateSQL(projectId, tickets)
+		res, err := exec(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("MySQL.TicketCreate - %w", err)
+		}
+
+		inserted, err := rowsAffected(res)
+		if err != nil {
+			return fmt.Errorf("MySQL.TicketCreate - %w", err)
+		}
+
+		if inserted != len(tickets) {
+			return errTicketDuplicate
+		}
+		return nil
+	}
+
+	if len(tickets) == 1 {
+		// a single row, there's nothing else to roll back
+		err = insert(db.ExecContext)
+	} else {
+		err = db.transaction(ctx, func(tx *sql.Tx) error {
+			return insert(tx.ExecContext)
+		})
+	}
+
+	if errors.Is(err, errTicketDuplicate) {
+		result.Status = data.TICKET_CREATE_DUPLICATE
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	result.Status = data.TICKET_CREATE_OK
+	return result, nil
+}
+
+// MySQL has no update ... returning, so the ticket is locked, read and
+// then updated within a transaction.
+func (db DB) TicketUse(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error) {
+	scope := opts.Scope
+	ticket := opts.Ticket
+	projectId := opts.ProjectId
+
+	var result data.TicketUseResult
+
+	var found bool
+	var uses *int
+	var payload *[]byte
+	var encrypted bool
+	err := db.transaction(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `
+			select uses, payload, payload_encrypted
+			from authen_tickets
+			where project_id = ?
+				and ticket = ?
+				and (uses is null or uses > 0)
+				and (attempts is null or attempts > 0)
+				and (expires is null or expires > now(6))
+			for update
+		`, projectId, ticket)
+
+		if err := row.Scan(&uses, &payload, &encrypted); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return fmt.Errorf("MySQL.TicketUse (select) - %w", err)
+		}
+
+		_, err := tx.ExecContext(ctx, `
+			update authen_tickets
+			set uses = uses - 1, expires = coalesce(now(6) + interval sliding_ttl second, expires)
+			where project_id = ? and ticket = ?
+		`, projectId, ticket)
+		if err != nil {
+			return fmt.Errorf("MySQL.TicketUse (update) - %w", err)
+		}
+
+		found = true
+		return nil
+	})
+
+	if err != nil {
+		return result, err
+	}
+
+	if !found {
+		if scope != nil {
+			if err := db.ticketFailedAttempt(ctx, projectId, scope); err != nil {
+				return result, err
+			}
+		}
+		result.Status = data.TICKET_USE_NOT_FOUND
+		return result, nil
+	}
+
+	if uses != nil {
+		*uses -= 1
+	}
+
+	result.Status = data.TICKET_USE_OK
+	result.Payload = payload
+	result.Uses = uses
+	result.PayloadEncrypted = encrypted
+	return result, nil
+}
+
+func (db DB) TicketDelete(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error) {
+	ticket := opts.Ticket
+	projectId := opts.ProjectId
+
+	var result data.TicketUseResult
+	result.Status = data.TICKET_USE_NOT_FOUND
+
+	err := db.transaction(ctx, func(tx *sql.Tx) error {
+		var uses *int
+		row := tx.QueryRowContext(ctx, `
+			select uses
+			from authen_tickets
+			where project_id = ?
+				and ticket = ?
+				and (uses is null or uses > 0)
+				and (attempts is null or attempts > 0)
+				and (expires is null or expires > now(6))
+			for update
+		`, projectId, ticket)
+
+		if err := row.Scan(&uses); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return fmt.Errorf("MySQL.TicketDelete (select) - %w", err)
+		}
+
+		_, err := tx.ExecContext(ctx, `
+			delete from authen_tickets
+			where project_id = ? and ticket = ?
+		`, projectId, ticket)
+		if err != nil {
+			return fmt.Errorf("MySQL.TicketDelete (delete) - %w", err)
+		}
+
+		result.Status = data.TICKET_USE_OK
+		result.Uses = uses
+		return nil
+	})
+
+	return result, err
+}
+
+func (db DB) TicketExtend(ctx context.Context, opts data.TicketExtend) (data.TicketUseResult, error) {
+	uses := opts.Uses
+	ticket := opts.Ticket
+	expires := opts.Expires
+	projectId := opts.ProjectId
+
+	var result data.TicketUseResult
+	result.Status = data.TICKET_USE_NOT_FOUND
+
+	// Only live tickets can be extended. A ticket with no uses left, or
+	// which has expired, is dead (and will be removed by Clean).
+	err := db.transaction(ctx, func(tx *sql.Tx) error {
+		var remaining *int
+		row := tx.QueryRowContext(ctx, `
+			select uses
+			from authen_tickets
+			where project_id = ?
+				and ticket = ?
+				and (uses is null or uses > 0)
+				and (attempts is null or attempts > 0)
+				and (expires is null or expires > now(6))
+			for update
+		`, projectId, ticket)
+
+		if err := row.Scan(&remaining); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return fmt.Errorf("MySQL.TicketExtend (select) - %w", err)
+		}
+
+		_, err := tx.ExecContext(ctx, `
+			update authen_tickets
+			set expires = coalesce(?, expires),
+				uses = uses + coalesce(?, 0)
+			where project_id = ? and ticket = ?
+		`, expires, uses, projectId, ticket)
+		if err != nil {
+			return fmt.Errorf("MySQL.TicketExtend (update) - %w", err)
+		}
+
+		// unlimited uses stay unlimited
+		if remaining != nil && uses != nil {
+			*remaining += *uses
+		}
+
+		result.Status = data.TICKET_USE_OK
+		result.Uses = remaining
+		return nil
+	})
+
+	return result, err
+}
+
+// Returns TICKET_USE_OK the first time a ticket is denied and
+// TICKET_USE_NOT_FOUND if it already was (i.e. it's already been used).
+func (db DB) TicketDeny(ctx context.Context, opts data.TicketDeny) (data.TicketUseResult, error) {
+	var result data.TicketUseResult
+
+	// a no-op update is how MySQL does "on conflict do nothing" without
+	// insert ignore also swallowing other errors (it affects 0 rows)
+	res, err := db.ExecContext(ctx, `
+		insert into authen_ticket_denylist (project_id, ticket, expires)
+		values (?, ?, ?)
+		on duplicate key update project_id = project_id
+	`, opts.ProjectId, opts.Ticket, opts.Expires)
+
+	if err != nil {
+		return result, fmt.Errorf("MySQL.TicketDeny - %w", err)
+	}
+
+	inserted, err := rowsAffected(res)
+	if err != nil {
+		return result, fmt.Errorf("MySQL.TicketDeny - %w", err)
+	}
+
+	if inserted == 0 {
+		result.Status = data.TICKET_USE_NOT_FOUND
+		return result, nil
+	}
+
+	result.Status = data.TICKET_USE_OK
+	return result, nil
+}
+
+// What the user's successful login logs say about given, the ip_prefix
+// or device (column) derived from source. Each probe is an exists, which
+// stops at the first match; the tracked and known ones can use the
+// (project_id, user_id, column) index. Untracked history only matters
+// when nothing is tracked, so it's only looked for then.
+func (db DB) loginHistory(ctx context.Context, opts data.LoginLogCreate, column string, source string, given *string) (data.LoginHistory, error) {
+	var history data.LoginHistory
+	if given == nil {
+		return history, nil
+	}
+
+	probe := func(condition string, args ...any) (bool, error) {
+		var found bool
+		args = append([]any{opts.ProjectId, opts.UserId}, args...)
+		where := "project_id = ? and user_id = ? and " + condition + whereIn("status", opts.SuccessStatuses, &args)
+		err := db.QueryRowContext(ctx, `
+			select exists (
+				select 1 from authen_login_logs
+				where `+where+`
+			)
+		`, args...).Scan(&found)
+
+		if err != nil {
+			return false, fmt.Errorf("MySQL.LoginLogCreate (%s) - %w", column, err)
+		}
+		return found, nil
+	}
+
+	tracked, err := probe(column + " is not null")
+	if err != nil {
+		return history, err
+	}
+	if !tracked {
+		history.Untracked, err = probe(source + " is not null and " + column + " is null")
+		return history, err
+	}
+
+	history.Tracked = true
+	history.Known, err = probe(column+" = ?", *given)
+	return history, err
+}
+
+func (db DB) LoginLogCreate(ctx context.Context, opts data.LoginLogCreate) (data.LoginLogCreateResult, error) {
+	id := opts.Id
+	max := opts.Max
+	payload := opts.Payload
+	userId := opts.UserId
+	status := opts.Status
+	projectId := opts.ProjectId
+	payloadKey := opts.PayloadKey
+
+	var result data.LoginLogCreateResult
+
+	canAdd, err := db.loginLogCanAdd(ctx, projectId, max)
+	if err != nil {
+		return result, err
+	}
+
+	if !canAdd {
+		result.Status = data.LOGIN_LOG_CREATE_MAX
+		return result, nil
+	}
+
+	if opts.TracksHistory() {
+		// must happen before the insert, else we'd always find ourselves
+		ip, err := db.loginHistory(ctx, opts, "ip_prefix", "ip", opts.IpPrefix)
+		if err != nil {
+			return result, err
+		}
+		device, err := db.loginHistory(ctx, opts, "device", "user_agent", opts.Device)
+		if err != nil {
+			return result, err
+		}
+		result.NewIp = ip.IsNew(opts.IpPrefix)
+		result.NewDevice = device.IsNew(opts.Device)
+	}
+
+	_, err = db.ExecContext(ctx, `
+		insert into authen_login_logs (id, project_id, user_id, status, payload, payload_key, ip, user_agent, method, country, ip_prefix, device)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, projectId, userId, status, payload, payloadKey, opts.Ip, opts.UserAgent, opts.Method, opts.Country, opts.IpPrefix, opts.Device)
+
+	if err != nil {
+		return result, fmt.Errorf("MySQL.LoginLogCreate - %w", err)
+	}
+
+	if retain := opts.RetainCount; retain > 0 {
+		// an offset needs a limit, this is the one the MySQL docs suggest
+		_, err = db.ExecContext(ctx, `
+			delete l
+			from authen_login_logs l
+				join (
+					select id from authen_login_logs
+					where project_id = ? and user_id = ?
+					order by created desc, id desc
+					limit ?, 18446744073709551615
+				) old on old.id = l.id
+		`, projectId, userId, retain)
+
+		if err != nil {
+			return result, fmt.Errorf("MySQL.LoginLogCreate (retain) - %w", err)
+		}
+	}
+
+	if rules := opts.Lockout; len(rules) > 0 {
+		lockedUntil, err := db.userLockEvaluate(ctx, projectId, userId, status, rules)
+		if err != nil {
+			return result, err
+		}
+		result.LockedUntil = lockedUntil
+	}
+
+	result.Status = data.LOGIN_LOG_CREATE_OK
+	return result, nil
+}
+
+func (db DB) LoginLogGet(ctx context.Context, opts data.LoginLogGet) (data.LoginLogGetResult, error) {
+	limit := opts.Limit
+	offset := opts.Offset
+	if opts.Cursor != nil {
+		offset = 0
+	}
+
+	var result data.LoginLogGetResult
+
+	where, args := loginLogWhere(opts)
+	args = append(args, limit, offset)
+
+	rows, err := db.QueryContext(ctx, `
+		select id, status, payload, payload_key, created, ip, user_agent, method, country
+		from authen_login_logs
+		where `+where+`
+		order by created desc, id desc
+		limit ? offset ?`, args...)
+
+	if err != nil {
+		return result, fmt.Errorf("MySQL.LoginLogGet (select) - %w", err)
+	}
+	defer rows.Close()
+
+	records := make([]data.LoginLogRecord, 0, limit)
+	for rows.Next() {
+		var record data.LoginLogRecord
+		if err := rows.Scan(&record.Id, &record.Status, &record.RawPayload, &record.PayloadKey, &record.Created, &record.Ip, &record.UserAgent, &record.Method, &record.Country); err != nil {
+			return result, fmt.Errorf("MySQL.LoginLogGet (scan) - %w", err)
+		}
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("MySQL.LoginLogGet (rows) - %w", err)
+	}
+
+	result.Records = records
+	result.Status = data.LOGIN_LOG_GET_OK
+	return result, nil
+}
+
+// Aggregated in the database: a range can cover far more logs than we'd
+// want to pull through LoginLogGet.
+func (db DB) LoginLogStats(ctx context.Context, opts data.LoginLogStats) (data.LoginLogStatsResult, error) {
+	var result data.LoginLogStatsResult
+
+	args := []any{opts.ProjectId, opts.Since, opts.Until}
+	where := "project_id = ? and created >= ? and created < ?"
+	where += whereIn("status", opts.Statuses, &args)
+
+	// created is UTC, so this truncates to a UTC day/hour
+	format := "%Y-%m-%d 00:00:00"
+	if opts.Hourly {
+		format = "%Y-%m-%d %H:00:00"
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		select cast(date_format(created, '`+format+`') as datetime) as bucket, status, count(*)
+		from authen_login_logs
+		where `+where+`
+		group by bucket, status
+		order by bucket, status
+	`, args...)
+	if err != nil {
+		return result, fmt.Errorf("MySQL.LoginLogStats (buckets) - %w", err)
+	}
+	defer rows.Close()
+
+	buckets := make([]data.LoginLogStatsBucket, 0, 32)
+	for rows.Next() {
+		var bucket data.LoginLogStatsBucket
+		if err := rows.Scan(&bucket.Time, &bucket.Status, &bucket.Count); err != nil {
+			return result, fmt.Errorf("MySQL.LoginLogStats (buckets scan) - %w", err)
+		}
+		buckets = append(buckets, bucket)
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("MySQL.LoginLogStats (buckets rows) - %w", err)
+	}
+	result.Buckets = buckets
+
+	var distinct int
+	if err := db.QueryRowContext(ctx, `
+		select count(distinct user_id)
+		from authen_login_logs
+		where `+where, args...).Scan(&distinct); err != nil {
+		return result, fmt.Errorf("MySQL.LoginLogStats (distinct) - %w", err)
+	}
+	result.DistinctUsers = distinct
+
+	failed := opts.FailedStatuses
+	if len(failed) == 0 || opts.Top == 0 {
+		return result, nil
+	}
+
+	where += whereIn("status", failed, &args)
+	args = append(args, opts.Top)
+	rows, err = db.QueryContext(ctx, `
+		select user_id, count(*) as failures
+		from authen_login_logs
+		where `+where+`
+		group by user_id
+		order by failures desc, user_id
+		limit ?`, args...)
+	if err != nil {
+		return result, fmt.Errorf("MySQL.LoginLogStats (failing) - %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]data.LoginLogStatsUser, 0, opts.Top)
+	for rows.Next() {
+		var user data.LoginLogStatsUser
+		if err := rows.Scan(&user.UserId, &user.Count); err != nil {
+			return result, fmt.Errorf("MySQL.LoginLogStats (failing scan) - %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("MySQL.LoginLogStats (failing rows) - %w", err)
+	}
+	result.TopFailing = users
+
+	return result, nil
+}
+
+func (db DB) LoginLogDelete(ctx context.Context, opts data.LoginLogDelete) (int, error) {
+	// without either, we'd delete all of the project's logs
+	if opts.UserId == "" && len(opts.Ids) == 0 {
+		return 0, nil
+	}
+
+	args := []any{opts.ProjectId}
+	where := "project_id = ?"
+	if userId := opts.UserId; userId != "" {
+		args = append(args, userId)
+		where += " and user_id = ?"
+	}
+	where += whereIn("id", opts.Ids, &args)
+
+	res, err := db.ExecContext(ctx, `
+		delete from authen_login_logs
+		where `+where, args...)
+
+	if err != nil {
+		return 0, fmt.Errorf("MySQL.LoginLogDelete - %w", err)
+	}
+	return rowsAffected(res)
+}
+
+func (db DB) UserLockGet(ctx context.Context, opts data.UserLockGet) (data.UserLock, error) {
+	var result data.UserLock
+
+	var lockedUntil *time.Time
+	err := db.QueryRowContext(ctx, `
+		select locked_until
+		from authen_user_locks
+		where project_id = ? and user_id = ? and locked_until > now(6)
+	`, opts.ProjectId, opts.UserId).Scan(&lockedUntil)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return result, nil
+		}
+		return result, fmt.Errorf("MySQL.UserLockGet - %w", err)
+	}
+
+	result.LockedUntil = lockedUntil
+	return result, nil
+}
+
+// Returns true if the user was locked. Whether or not they were, login
+// logs up to now no longer count towards a new lock.
+func (db DB) UserUnlock(ctx context.Context, opts data.UserLockGet) (bool, error) {
+	projectId := opts.ProjectId
+	userId := opts.UserId
+
+	var locked bool
+	err := db.transaction(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `
+			select coalesce(locked_until > now(6), false)
+			from authen_user_locks
+			where project_id = ? and user_id = ?
+			for update
+		`, projectId, userId).Scan(&locked)
+
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("MySQL.UserUnlock (select) - %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			insert into authen_user_locks (project_id, user_id, locked_until, reset)
+			values (?, ?, null, now(6))
+			on duplicate key update locked_until = null, reset = values(reset)
+		`, projectId, userId)
+
+		if err != nil {
+			return fmt.Errorf("MySQL.UserUnlock (upsert) - %w", err)
+		}
+		return nil
+	})
+
+	return locked, err
+}
+
+// Keyset pagination (like sqlite's) so that only loginLogExportBatch rows
+// are in memory at a time, regardless of how many logs the project has.
+func (db DB) LoginLogExport(ctx context.Context, opts data.LoginLogExport, fn func(data.LoginLogRecord) error) error {
+	args := []any{opts.ProjectId}
+	where := "project_id = ?"
+	if userId := opts.UserId; userId != "" {
+		args = append(args, userId)
+		where += " and user_id = ?"
+	}
+	if since := opts.Since; since != nil {
+		args = append(args, *since)
+		where += " and created >= ?"
+	}
+	if until := opts.Until; until != nil {
+		args = append(args, *until)
+		where += " and created < ?"
+	}
+
+	sql := `
+		select id, user_id, status, payload, payload_key, created, ip, user_agent, method, country
+		from authen_login_logs
+		where ` + where + `
+			and (? is null or created > ? or (created = ? and id > ?))
+		order by created, id
+		limit ` + strconv.Itoa(loginLogExportBatch)
+
+	// nil for the first batch
+	var lastCreated, lastId any
+
+	batch := make([]data.LoginLogRecord, 0, loginLogExportBatch)
+	for {
+		var err error
+		batch, err = db.loginLogExportBatch(ctx, opts, batch[:0], sql, append(args, lastCreated, lastCreated, lastCreated, lastId)...)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range batch {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+
+		if len(batch) < loginLogExportBatch {
+			return nil
+		}
+		last := batch[len(batch)-1]
+		lastCreated, lastId = last.Created, last.Id
+	}
+}
+
+func (db DB) loginLogExportBatch(ctx context.Context, opts data.LoginLogExport, batch []data.LoginLogRecord, sql string, args ...any) ([]data.LoginLogRecord, error) {
+	ctx, cancel := opts.BatchContext(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("MySQL.LoginLogExport - %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record data.LoginLogRecord
+		if err := rows.Scan(&record.Id, &record.UserId, &record.Status, &record.RawPayload, &record.PayloadKey, &record.Created, &record.Ip, &record.UserAgent, &record.Method, &record.Country); err != nil {
+			return nil, fmt.Errorf("MySQL.LoginLogExport (scan) - %w", err)
+		}
+		batch = append(batch, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("MySQL.LoginLogExport (rows) - %w", err)
+	}
+	return batch, nil
+}
+
+// Used to encrypt payloads created before payload encryption existed
+func (db DB) LoginLogGetUnencrypted(ctx context.Context, limit int) ([]data.LoginLogRecord, error) {
+	rows, err := db.QueryContext(ctx, `
+		select id, payload
+		from authen_login_logs
+		where payload is not null and payload_key = 0
+		limit ?
+	`, limit)
+
+	if err != nil {
+		return nil, fmt.Errorf("MySQL.LoginLogGetUnencrypted (select) - %w", err)
+	}
+	defer rows.Close()
+
+	records := make([]data.LoginLogRecord, 0, limit)
+	for rows.Next() {
+		var record data.LoginLogRecord
+		if err := rows.Scan(&record.Id, &record.RawPayload); err != nil {
+			return nil, fmt.Errorf("MySQL.LoginLogGetUnencrypted (scan) - %w", err)
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func (db DB) LoginLogUpdatePayload(ctx context.Context, opts data.LoginLogUpdatePayload) error {
+	_, err := db.ExecContext(ctx, `
+		update authen_login_logs
+		set payload = ?, payload_key = ?
+		where id = ?
+	`, opts.Payload, opts.PayloadKey, opts.Id)
+
+	if err != nil {
+		return fmt.Errorf("MySQL.LoginLogUpdatePayload - %w", err)
+	}
+	return nil
+}
+
+func (db DB) canAddTOTP(ctx context.Context, projectId string, userId string, tpe string, max int) (bool, error) {
+	// no limit
+	if max == 0 {
+		return true, nil
+	}
+
+	// if the user already exists, then we aren't adding a user
+	// and thus cannot be over any limit
+	var exists bool
+	if err := db.QueryRowContext(ctx, `
+		select exists (
+			select 1
+			from authen_totps
+			where project_id = ? and user_id = ? and type = ?
+		)`, projectId, userId, tpe).Scan(&exists); err != nil {
+		return false, fmt.Errorf("MySQL.canAddTOTP (exists) - %w", err)
+	}
+	if exists {
+		return exists, nil
+	}
+
+	var count int
+	if err := db.QueryRowContext(ctx, `
+		select count(*)
+		from authen_totps
+		where project_id = ?
+	`, projectId).Scan(&count); err != nil {
+		return false, fmt.Errorf("MySQL.canAddTOTP (count) - %w", err)
+	}
+	return count < max, nil
+}
+
+func (db DB) ticketCanAdd(ctx context.Context, projectId string, max int, n int) (bool, error) {
+	// no limit
+	if max == 0 {
+		return true, nil
+	}
+
+	var count int
+	if err := db.QueryRowContext(ctx, `
+		select count(*)
+		from authen_tickets
+		where project_id = ?
+	`, projectId).Scan(&count); err != nil {
+		return false, fmt.Errorf("MySQL.ticketCanAdd (count) - %w", err)
+	}
+	return count+n <= max, nil
+}
+
+// A code wasn't found. Codes are short enough to be guessed, so every
+// miss burns an attempt from all the live codes within the scope.
+func (db DB) ticketFailedAttempt(ctx context.Context, projectId string, scope []byte) error {
+	_, err := db.ExecContext(ctx, `
+		update authen_tickets
+		set attempts = attempts - 1
+		where project_id = ? and scope = ? and attempts > 0
+	`, projectId, scope)
+
+	if err != nil {
+		return fmt.Errorf("MySQL.ticketFailedAttempt - %w", err)
+	}
+	return nil
+}
+
+func (db DB) loginLogCanAdd(ctx context.Context, projectId string, max int) (bool, error) {
+	// no limit
+	if max == 0 {
+		return true, nil
+	}
+
+	var count int
+	if err := db.QueryRowContext(ctx, `
+		select count(*)
+		from authen_login_logs
+		where project_id = ?
+	`, projectId).Scan(&count); err != nil {
+		return false, fmt.Errorf("MySQL.loginLogCanAdd (count) - %w", err)
+	}
+	return count < max, nil
+}
+
+// Evaluates the rules which match the new login log's status and
+// returns the user's lock, which might predate this login log. Only
+// login logs newer than the user's last lock (or unlock) are counted.
+func (db DB) userLockEvaluate(ctx context.Context, projectId string, userId string, status int, rules []data.LockoutRule) (*time.Time, error) {
+	var reset, lockedUntil *time.Time
+	row := db.QueryRowContext(ctx, `
+		select reset, case when locked_until > now(6) then locked_until end
+		from authen_user_locks
+		where project_id = ? and user_id = ?
+	`, projectId, userId)
+
+	if err := row.Scan(&reset, &lockedUntil); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("MySQL.userLockEvaluate (get) - %w", err)
+	}
+
+	duration := 0
+	for _, rule := range rules {
+		// a rule can only matter if it would lock for longer
+		if rule.Duration <= duration || !rule.Matches(status) {
+			continue
+		}
+
+		args := []any{projectId, userId, rule.Window, reset, reset}
+		where := whereIn("status", rule.Statuses, &args)
+
+		var failures int
+		err := db.QueryRowContext(ctx, `
+			select count(*)
+			from authen_login_logs
+			where project_id = ? and user_id = ?
+				and created > now(6) - interval ? second
+				and (? is null or created > ?)`+where, args...).Scan(&failures)
+
+		if err != nil {
+			return nil, fmt.Errorf("MySQL.userLockEvaluate (count) - %w", err)
+		}
+		if failures >= rule.Failures {
+			duration = rule.Duration
+		}
+	}
+
+	if duration == 0 {
+		return lockedUntil, nil
+	}
+
+	// greatest() is null if either side is, unlike pg's which ignores nulls
+	_, err := db.ExecContext(ctx, `
+		insert into authen_user_locks (project_id, user_id, locked_until, reset)
+		values (?, ?, now(6) + interval ? second, now(6))
+		on duplicate key update
+			locked_until = greatest(coalesce(locked_until, values(locked_until)), values(locked_until)),
+			reset = values(reset)
+	`, projectId, userId, duration)
+
+	if err != nil {
+		return nil, fmt.Errorf("MySQL.userLockEvaluate (lock) - %w", err)
+	}
+
+	if err := db.QueryRowContext(ctx, `
+		select locked_until
+		from authen_user_locks
+		where project_id = ? and user_id = ?
+	`, projectId, userId).Scan(&lockedUntil); err != nil {
+		return nil, fmt.Errorf("MySQL.userLockEvaluate (locked) - %w", err)
+	}
+	return lockedUntil, nil
+}
+
+func (db DB) transaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("MySQL.transaction (begin) - %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("MySQL.transaction (commit) - %w", err)
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProject(row scanner) (*data.Project, error) {
+	var id, totpIssuer string
+	var totpMax, totpSetupTTL, totpSecretLength int
+	var ticketMax, ticketMaxPayloadLength int
+	var loginLogMax, loginLogMaxPayloadLength int
+	var loginLogRetainCount, loginLogRetainDays int
+	var loginLogRetainOnInsert bool
+	var lockoutRules, successStatuses *string
+
+	err := row.Scan(&id,
+		&totpIssuer, &totpMax, &totpSetupTTL, &totpSecretLength,
+		&ticketMax, &ticketMaxPayloadLength,
+		&loginLogMax, &loginLogMaxPayloadLength,
+		&loginLogRetainCount, &loginLogRetainDays, &loginLogRetainOnInsert,
+		&lockoutRules, &successStatuses)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var lockout []data.LockoutRule
+	if lockoutRules != nil {
+		if err := json.Unmarshal([]byte(*lockoutRules), &lockout); err != nil {
+			return nil, fmt.Errorf("MySQL.scanProject (lockout_rules) - %w", err)
+		}
+	}
+
+	var success []int
+	if successStatuses != nil {
+		if err := json.Unmarshal([]byte(*successStatuses), &success); err != nil {
+			return nil, fmt.Errorf("MySQL.scanProject (login_log_success_statuses) - %w", err)
+		}
+	}
+
+	return &data.Project{
+		Id:                       id,
+		TOTPMax:                  totpMax,
+		TOTPIssuer:               totpIssuer,
+		TOTPSetupTTL:             totpSetupTTL,
+		TOTPSecretLength:         totpSecretLength,
+		TicketMax:                ticketMax,
+		TicketMaxPayloadLength:   ticketMaxPayloadLength,
+		LoginLogMax:              loginLogMax,
+		LoginLogMaxPayloadLength: loginLogMaxPayloadLength,
+		LoginLogRetainCount:      loginLogRetainCount,
+		LoginLogRetainDays:       loginLogRetainDays,
+		LoginLogRetainOnInsert:   loginLogRetainOnInsert,
+		LockoutRules:             lockout,
+		LoginLogSuccessStatuses:  success,
+	}, nil
+}
+
+// A single multi-row insert for the whole batch. Duplicates are a no-op
+// update (0 affected rows), so fewer affected rows than tickets means at
+// least one ticket already existed.
+func ticketCreateSQL(projectId string, tickets []data.TicketCreateTicket) (string, []any) {
+	const columns = 9
+	args := make([]any, 0, len(tickets)*columns)
+
+	var sb strings.Builder
+	sb.WriteString(`
+		insert into authen_tickets (project_id, ticket, expires, uses, payload, scope, attempts, payload_encrypted, sliding_ttl)
+		values `)
+
+	for i, t := range tickets {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, projectId, t.Ticket, t.Expires, t.Uses, t.Payload, t.Scope, t.Attempts, t.PayloadEncrypted, t.SlidingTTL)
+	}
+	sb.WriteString(" on duplicate key update project_id = project_id")
+	return sb.String(), args
+}
+
+func whereIn[T any](column string, values []T, args *[]any) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	where := " and " + column + " in ("
+	for i, value := range values {
+		if i > 0 {
+			where += ", "
+		}
+		*args = append(*args, value)
+		where += "?"
+	}
+	return where + ")"
+}
+
+func loginLogWhere(opts data.LoginLogGet) (string, []any) {
+	args := []any{opts.ProjectId, opts.UserId}
+	where := "project_id = ? and user_id = ?"
+
+	where += whereIn("status", opts.Statuses, &args)
+	if since := opts.Since; since != nil {
+		args = append(args, *since)
+		where += " and created >= ?"
+	}
+	if until := opts.Until; until != nil {
+		args = append(args, *until)
+		where += " and created < ?"
+	}
+	for _, f := range [...]struct {
+		column string
+		value  string
+	}{
+		{"ip", opts.Ip},
+		{"user_agent", opts.UserAgent},
+		{"method", opts.Method},
+		{"country", opts.Country},
+	} {
+		if f.value != "" {
+			args = append(args, f.value)
+			where += " and " + f.column + " = ?"
+		}
+	}
+	if cursor := opts.Cursor; cursor != nil {
+		args = append(args, cursor.Created, cursor.Created, cursor.Id)
+		where += " and (created < ? or (created = ? and id < ?))"
+	}
+	return where, args
+}
+
+func rowsAffected(res sql.Result) (int, error) {
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,329 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/tests"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/utils/log"
+	"src.goblgobl.com/utils/uuid"
+)
+
+var db DB
+
+func shouldRunTests() bool {
+	return tests.StorageType() == "mysql"
+}
+
+// GOBL_TEST_MYSQL is a go-sql-driver/mysql DSN (see GOBL_TEST_PG)
+func testURL() string {
+	if url := os.Getenv("GOBL_TEST_MYSQL"); url != "" {
+		return url
+	}
+	return "root@tcp(localhost:3306)/gobl_test"
+}
+
+func TestMain(m *testing.M) {
+	if !shouldRunTests() {
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func init() {
+	if !shouldRunTests() {
+		return
+	}
+
+	err := log.Configure(log.Config{
+		Level: "WARN",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	db, err = New(Config{URL: testURL()})
+	if err != nil {
+		panic(err)
+	}
+	if err := db.EnsureMigrations(); err != nil {
+		panic(err)
+	}
+}
+
+func Test_Info(t *testing.T) {
+	info, err := db.Info(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, info.(struct {
+		Type      string `json:"type"`
+		Migration int    `json:"migration"`
+	}).Migration, 14)
+}
+
+func Test_Clean_Totps(t *testing.T) {
+	mustExec("truncate table authen_totps")
+	mustExec(`
+		insert into authen_totps (expires, project_id, user_id, type, pending, secret) values
+		(now(6) - interval 1 second, ?, 'uid1', '', false, ''),
+		(now(6) - interval 999 second, ?, 'uid2', '', false, ''),
+		(now(6) + interval 5 second, ?, 'uid3', '', false, ''),
+		(null, ?, 'uid4', '', false, '')
+	`, repeat(uuid.String(), 4)...)
+
+	result, err := db.Clean(context.Background(), data.Clean{})
+	assert.Nil(t, err)
+	assert.Equal(t, result.TOTPs, 2)
+	assertStrings(t, "select user_id from authen_totps order by user_id", nil, "uid3", "uid4")
+}
+
+func Test_Clean_Tickets(t *testing.T) {
+	mustExec("truncate table authen_tickets")
+	mustExec(`
+		insert into authen_tickets (expires, uses, project_id, ticket, attempts) values
+		(now(6) - interval 1 second, null, ?, 't1', null),
+		(now(6) - interval 999 second, null, ?, 't2', null),
+		(null, 0, ?, 't3', null),
+		(now(6) + interval 5 second, 1, ?, 't4', 1),
+		(null, null, ?, 't5', null),
+		(null, null, ?, 't6', 0)
+	`, repeat(uuid.String(), 6)...)
+
+	result, err := db.Clean(context.Background(), data.Clean{})
+	assert.Nil(t, err)
+	assert.Equal(t, result.Tickets, 4)
+	assertStrings(t, "select ticket from authen_tickets order by ticket", nil, "t4", "t5")
+}
+
+func Test_Clean_TicketDenylist(t *testing.T) {
+	mustExec("truncate table authen_ticket_denylist")
+	mustExec(`
+		insert into authen_ticket_denylist (expires, project_id, ticket) values
+		(now(6) - interval 1 second, ?, 't1'),
+		(now(6) + interval 5 second, ?, 't2')
+	`, repeat(uuid.String(), 2)...)
+
+	result, err := db.Clean(context.Background(), data.Clean{})
+	assert.Nil(t, err)
+	assert.Equal(t, result.TicketDenylist, 1)
+	assertStrings(t, "select ticket from authen_ticket_denylist order by ticket", nil, "t2")
+}
+
+func Test_Clean_LoginLogs(t *testing.T) {
+	// other tests insert login logs without a project in authen_projects,
+	// so the default retention isn't tested here (it would delete their rows)
+	p1, p2, p3 := uuid.String(), uuid.String(), uuid.String()
+	mustExec(`
+		insert into authen_projects (id, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length, login_log_retain_count, login_log_retain_days)
+		values
+			(?, '', 0, 0, 0, 0, 0, 0, 0, 2, 0),
+			(?, '', 0, 0, 0, 0, 0, 0, 0, 0, 1),
+			(?, '', 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	`, p1, p2, p3)
+
+	mustExec(`
+		insert into authen_login_logs (id, project_id, user_id, status, created) values
+		(uuid(), ?, 'u1', 1, now(6)),
+		(uuid(), ?, 'u1', 2, now(6) - interval 1 minute),
+		(uuid(), ?, 'u1', 3, now(6) - interval 2 minute),
+		(uuid(), ?, 'u2', 4, now(6) - interval 2 minute),
+		(uuid(), ?, 'u1', 5, now(6) - interval 23 hour),
+		(uuid(), ?, 'u1', 6, now(6) - interval 25 hour),
+		(uuid(), ?, 'u1', 7, now(6) - interval 1000 day)
+	`, p1, p1, p1, p1, p2, p2, p3)
+
+	result, err := db.Clean(context.Background(), data.Clean{})
+	assert.Nil(t, err)
+	assert.True(t, result.LoginLogs >= 2)
+	assertStrings(t, "select status from authen_login_logs where project_id in (?, ?, ?) order by status", []any{p1, p2, p3}, "1", "2", "4", "5", "7")
+}
+
+func Test_Clean_UserLocks(t *testing.T) {
+	projectId := uuid.String()
+	mustExec(`
+		insert into authen_user_locks (project_id, user_id, locked_until, reset) values
+		(?, 'u1', now(6) + interval 1 minute, now(6) - interval 2 day),
+		(?, 'u2', now(6) - interval 1 minute, now(6) - interval 2 day),
+		(?, 'u3', null, now(6) - interval 2 day),
+		(?, 'u4', null, now(6) - interval 1 hour)
+	`, repeat(projectId, 4)...)
+
+	result, err := db.Clean(context.Background(), data.Clean{})
+	assert.Nil(t, err)
+	assert.True(t, result.UserLocks >= 2)
+	assertStrings(t, "select user_id from authen_user_locks where project_id = ? order by user_id", []any{projectId}, "u1", "u4")
+}
+
+func Test_TicketUse_SlidingTTL(t *testing.T) {
+	projectId := uuid.String()
+	mustExec(`
+		insert into authen_tickets (project_id, ticket, uses, expires, sliding_ttl) values
+		(?, 't1', 5, now(6) + interval 10 second, 3600),
+		(?, 't2', 5, now(6) + interval 10 second, null)
+	`, projectId, projectId)
+
+	for _, ticket := range []string{"t1", "t2"} {
+		res, err := db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId, Ticket: []byte(ticket)})
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+		assert.Equal(t, *res.Uses, 4)
+	}
+
+	assert.Timeish(t, ticketExpires(projectId, "t1"), time.Now().Add(time.Hour))
+	assert.Timeish(t, ticketExpires(projectId, "t2"), time.Now().Add(time.Second*10))
+}
+
+func Test_TicketExtend(t *testing.T) {
+	projectId := uuid.String()
+	mustExec(`
+		insert into authen_tickets (project_id, ticket, uses, expires) values
+		(?, 't1', 2, now(6) + interval 10 second),
+		(?, 't2', null, null)
+	`, projectId, projectId)
+
+	uses := 3
+	expires := time.Now().Add(time.Hour)
+
+	// only uses
+	res, err := db.TicketExtend(context.Background(), data.TicketExtend{ProjectId: projectId, Ticket: []byte("t1"), Uses: &uses})
+	assert.Nil(t, err)
+	assert.Equal(t, *res.Uses, 5)
+	assert.Timeish(t, ticketExpires(projectId, "t1"), time.Now().Add(time.Second*10))
+
+	// only expires
+	res, _ = db.TicketExtend(context.Background(), data.TicketExtend{ProjectId: projectId, Ticket: []byte("t1"), Expires: &expires})
+	assert.Equal(t, *res.Uses, 5)
+	assert.Timeish(t, ticketExpires(projectId, "t1"), expires)
+
+	res, _ = db.TicketExtend(context.Background(), data.TicketExtend{ProjectId: projectId, Ticket: []byte("t2"), Expires: &expires, Uses: &uses})
+	assert.True(t, res.Uses == nil)
+	assert.Timeish(t, ticketExpires(projectId, "t2"), expires)
+}
+
+func Test_TicketDeny(t *testing.T) {
+	opts := data.TicketDeny{
+		ProjectId: uuid.String(),
+		Ticket:    []byte("t1"),
+		Expires:   time.Now().Add(time.Minute),
+	}
+
+	res, err := db.TicketDeny(context.Background(), opts)
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+
+	var expires time.Time
+	err = db.QueryRow("select expires from authen_ticket_denylist where project_id = ? and ticket = ?", opts.ProjectId, opts.Ticket).Scan(&expires)
+	assert.Nil(t, err)
+	assert.Timeish(t, expires, opts.Expires)
+}
+
+func Test_LoginLogExport(t *testing.T) {
+	defer func(n int) { loginLogExportBatch = n }(loginLogExportBatch)
+	loginLogExportBatch = 2
+
+	projectId := uuid.String()
+	mustExec(`
+		insert into authen_login_logs (id, project_id, user_id, status, created) values
+		(uuid(), ?, 'u1', 1, now(6) - interval 5 minute),
+		(uuid(), ?, 'u2', 2, now(6) - interval 4 minute),
+		(uuid(), ?, 'u1', 3, now(6) - interval 3 minute),
+		(uuid(), ?, 'u1', 4, now(6) - interval 2 minute),
+		(uuid(), ?, 'u2', 5, now(6) - interval 1 minute)
+	`, repeat(projectId, 5)...)
+
+	export := func(opts data.LoginLogExport) []int {
+		t.Helper()
+		var statuses []int
+		opts.ProjectId = projectId
+		err := db.LoginLogExport(context.Background(), opts, func(record data.LoginLogRecord) error {
+			statuses = append(statuses, record.Status)
+			return nil
+		})
+		assert.Nil(t, err)
+		return statuses
+	}
+
+	// not a multiple of the batch size
+	statuses := export(data.LoginLogExport{})
+	assert.Equal(t, len(statuses), 5)
+	for i, status := range []int{1, 2, 3, 4, 5} {
+		assert.Equal(t, statuses[i], status)
+	}
+
+	// exact multiple of the batch size
+	statuses = export(data.LoginLogExport{UserId: "u2"})
+	assert.Equal(t, len(statuses), 2)
+
+	// stops at the first error, even mid batch
+	n := 0
+	err := db.LoginLogExport(context.Background(), data.LoginLogExport{ProjectId: projectId}, func(record data.LoginLogRecord) error {
+		n += 1
+		if n == 3 {
+			return errors.New("stop")
+		}
+		return nil
+	})
+	assert.Equal(t, err.Error(), "stop")
+	assert.Equal(t, n, 3)
+}
+
+func Test_UserUnlock_NotLocked(t *testing.T) {
+	projectId := uuid.String()
+
+	// unlocking a user without a lock resets their failures too
+	unlocked, err := db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u1"})
+	assert.Nil(t, err)
+	assert.False(t, unlocked)
+
+	var lockedUntil *time.Time
+	var reset time.Time
+	err = db.QueryRow("select locked_until, reset from authen_user_locks where project_id = ? and user_id = 'u1'", projectId).Scan(&lockedUntil, &reset)
+	assert.Nil(t, err)
+	assert.True(t, lockedUntil == nil)
+	assert.Nowish(t, reset)
+}
+
+func mustExec(sql string, args ...any) {
+	if _, err := db.Exec(sql, args...); err != nil {
+		panic(err)
+	}
+}
+
+func repeat(value any, n int) []any {
+	values := make([]any, n)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+func assertStrings(t *testing.T, sql string, args []any, expected ...string) {
+	t.Helper()
+	rows, err := db.Query(sql, args...)
+	assert.Nil(t, err)
+	defer rows.Close()
+
+	var actual []string
+	for rows.Next() {
+		var value string
+		assert.Nil(t, rows.Scan(&value))
+		actual = append(actual, value)
+	}
+	assert.Nil(t, rows.Err())
+	assert.Equal(t, len(actual), len(expected))
+	for i, value := range expected {
+		assert.Equal(t, actual[i], value)
+	}
+}
+
+func ticketExpires(projectId string, ticket string) time.Time {
+	var expires time.Time
+	if err := db.QueryRow("select expires from authen_tickets where project_id = ? and ticket = ?", projectId, []byte(ticket)).Scan(&expires); err != nil {
+		panic(err)
+	}
+	return expires
+}
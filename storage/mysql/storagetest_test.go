@@ -0,0 +1,65 @@
+package mysql_test
+
+import (
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/authen/storage/mysql"
+	"src.goblgobl.com/authen/storage/storagetest"
+	"src.goblgobl.com/utils/json"
+)
+
+// TestMain (in mysql_test.go) skips this when we aren't testing mysql
+func Test_StorageTest(t *testing.T) {
+	db := mysql.SharedDB()
+	storagetest.Run(t, func(t *testing.T) (storage.Storage, storagetest.Fixtures) {
+		return db, fixtures{db}
+	})
+}
+
+type fixtures struct {
+	db mysql.DB
+}
+
+func (f fixtures) Project(p data.Project, updated time.Time) {
+	rules := jsonColumn(p.LockoutRules)
+	success := jsonColumn(p.LoginLogSuccessStatuses)
+	f.mustExec(`
+		replace into authen_projects (id, updated, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length, login_log_retain_count, login_log_retain_days, login_log_retain_on_insert, lockout_rules, login_log_success_statuses)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, p.Id, updated, p.TOTPIssuer, p.TOTPMax, p.TOTPSetupTTL, p.TOTPSecretLength, p.TicketMax, p.TicketMaxPayloadLength, p.LoginLogMax, p.LoginLogMaxPayloadLength, p.LoginLogRetainCount, p.LoginLogRetainDays, p.LoginLogRetainOnInsert, rules, success)
+}
+
+func jsonColumn[T any](values []T) *string {
+	if len(values) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		panic(err)
+	}
+	s := string(encoded)
+	return &s
+}
+
+func (f fixtures) LoginLog(opts data.LoginLogCreate, created time.Time) {
+	f.mustExec(`
+		insert into authen_login_logs (id, project_id, user_id, status, payload, payload_key, ip, user_agent, method, country, created)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, opts.Id, opts.ProjectId, opts.UserId, opts.Status, opts.Payload, opts.PayloadKey, opts.Ip, opts.UserAgent, opts.Method, opts.Country, created)
+}
+
+func (f fixtures) UserLock(projectId string, userId string, lockedUntil *time.Time, reset time.Time) {
+	f.mustExec(`
+		replace into authen_user_locks (project_id, user_id, locked_until, reset)
+		values (?, ?, ?, ?)
+	`, projectId, userId, lockedUntil, reset)
+}
+
+func (f fixtures) mustExec(sql string, args ...any) {
+	if _, err := f.db.Exec(sql, args...); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,308 @@
+package pg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"src.goblgobl.com/utils/json"
+	"src.goblgobl.com/utils/pg"
+
+	"src.goblgobl.com/authen/storage/data"
+)
+
+// Calls fn for every row. Everything is read in a single repeatable read
+// transaction, so this is a consistent copy.
+func (db DB) Dump(fn func(data.DumpRecord) error) error {
+	bg := context.Background()
+	opts := pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}
+
+	err := pgx.BeginTxFunc(bg, db, opts, func(tx pgx.Tx) error {
+		err := dumpRows(tx, fn, `
+			select id,
+				totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
+				ticket_max, ticket_max_payload_length,
+				login_log_max, login_log_max_payload_length,
+				login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+				lockout_rules, login_log_success_statuses, updated
+			from authen_projects
+		`, func(rows pgx.Rows) (data.DumpRecord, error) {
+			var updated time.Time
+			project, err := scanProject(withUpdated{rows, &updated})
+			if err != nil {
+				return data.DumpRecord{}, err
+			}
+			return data.DumpRecord{Project: &data.DumpProject{Project: *project, Updated: updated}}, nil
+		})
+		if err != nil {
+			return fmt.Errorf("projects - %w", err)
+		}
+
+		err = dumpRows(tx, fn, `
+			select project_id, user_id, type, pending, secret, expires, created
+			from authen_totps
+		`, func(rows pgx.Rows) (data.DumpRecord, error) {
+			t := new(data.DumpTOTP)
+			err := rows.Scan(&t.ProjectId, &t.UserId, &t.Type, &t.Pending, &t.Secret, &t.Expires, &t.Created)
+			return data.DumpRecord{TOTP: t}, err
+		})
+		if err != nil {
+			return fmt.Errorf("totps - %w", err)
+		}
+
+		err = dumpRows(tx, fn, `
+			select project_id, ticket, payload, payload_encrypted, uses, expires, sliding_ttl, scope, attempts, created
+			from authen_tickets
+		`, func(rows pgx.Rows) (data.DumpRecord, error) {
+			t := new(data.DumpTicket)
+			err := rows.Scan(&t.ProjectId, &t.Ticket, &t.Payload, &t.PayloadEncrypted, &t.Uses, &t.Expires, &t.SlidingTTL, &t.Scope, &t.Attempts, &t.Created)
+			return data.DumpRecord{Ticket: t}, err
+		})
+		if err != nil {
+			return fmt.Errorf("tickets - %w", err)
+		}
+
+		err = dumpRows(tx, fn, `
+			select project_id, ticket, expires
+			from authen_ticket_denylist
+		`, func(rows pgx.Rows) (data.DumpRecord, error) {
+			d := new(data.DumpDenied)
+			err := rows.Scan(&d.ProjectId, &d.Ticket, &d.Expires)
+			return data.DumpRecord{Denied: d}, err
+		})
+		if err != nil {
+			return fmt.Errorf("ticket denylist - %w", err)
+		}
+
+		err = dumpRows(tx, fn, `
+			select id, project_id, user_id, status, payload, payload_key, created, ip, user_agent, method, country, ip_prefix, device
+			from authen_login_logs
+			order by created, id
+		`, func(rows pgx.Rows) (data.DumpRecord, error) {
+			l := new(data.DumpLoginLog)
+			err := rows.Scan(&l.Id, &l.ProjectId, &l.UserId, &l.Status, &l.Payload, &l.PayloadKey, &l.Created, &l.Ip, &l.UserAgent, &l.Method, &l.Country, &l.IpPrefix, &l.Device)
+			return data.DumpRecord{LoginLog: l}, err
+		})
+		if err != nil {
+			return fmt.Errorf("login logs - %w", err)
+		}
+
+		err = dumpRows(tx, fn, `
+			select project_id, user_id, locked_until, reset
+			from authen_user_locks
+		`, func(rows pgx.Rows) (data.DumpRecord, error) {
+			l := new(data.DumpUserLock)
+			err := rows.Scan(&l.ProjectId, &l.UserId, &l.LockedUntil, &l.Reset)
+			return data.DumpRecord{UserLock: l}, err
+		})
+		if err != nil {
+			return fmt.Errorf("user locks - %w", err)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("PG.Dump - %w", err)
+	}
+	return nil
+}
+
+// Inserts (or replaces) the rows, in a single transaction (and a single
+// round trip). When strict, counts in authen_project_counts for the
+// projects touched are then recounted from the tables (loading isn't
+// expected to run alongside writes to the same projects).
+func (db DB) Load(records []data.DumpRecord) error {
+	bg := context.Background()
+	batch := new(pgx.Batch)
+	projectIds := make([]string, 0, 1)
+	seen := make(map[string]struct{})
+	touch := func(projectId string) {
+		if _, ok := seen[projectId]; !ok {
+			seen[projectId] = struct{}{}
+			projectIds = append(projectIds, projectId)
+		}
+	}
+
+	for _, record := range records {
+		switch {
+		case record.Project != nil:
+			p := record.Project
+			lockoutRules, err := encodeList(p.LockoutRules)
+			if err != nil {
+				return fmt.Errorf("PG.Load (lockout_rules) - %w", err)
+			}
+			successStatuses, err := encodeList(p.LoginLogSuccessStatuses)
+			if err != nil {
+				return fmt.Errorf("PG.Load (login_log_success_statuses) - %w", err)
+			}
+			batch.Queue(`
+				insert into authen_projects (id,
+					totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
+					ticket_max, ticket_max_payload_length,
+					login_log_max, login_log_max_payload_length,
+					login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+					lockout_rules, login_log_success_statuses, updated)
+				values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+				on conflict (id) do update set
+					totp_issuer = excluded.totp_issuer,
+					totp_max = excluded.totp_max,
+					totp_setup_ttl = excluded.totp_setup_ttl,
+					totp_secret_length = excluded.totp_secret_length,
+					ticket_max = excluded.ticket_max,
+					ticket_max_payload_length = excluded.ticket_max_payload_length,
+					login_log_max = excluded.login_log_max,
+					login_log_max_payload_length = excluded.login_log_max_payload_length,
+					login_log_retain_count = excluded.login_log_retain_count,
+					login_log_retain_days = excluded.login_log_retain_days,
+					login_log_retain_on_insert = excluded.login_log_retain_on_insert,
+					lockout_rules = excluded.lockout_rules,
+					login_log_success_statuses = excluded.login_log_success_statuses,
+					updated = excluded.updated
+			`, p.Id,
+				p.TOTPIssuer, p.TOTPMax, p.TOTPSetupTTL, p.TOTPSecretLength,
+				p.TicketMax, p.TicketMaxPayloadLength,
+				p.LoginLogMax, p.LoginLogMaxPayloadLength,
+				p.LoginLogRetainCount, p.LoginLogRetainDays, p.LoginLogRetainOnInsert,
+				lockoutRules, successStatuses, p.Updated)
+		case record.TOTP != nil:
+			t := record.TOTP
+			touch(t.ProjectId)
+			batch.Queue(`
+				insert into authen_totps (project_id, user_id, type, pending, secret, expires, created)
+				values ($1, $2, $3, $4, $5, $6, $7)
+				on conflict (project_id, user_id, type, pending) do update set
+					secret = excluded.secret,
+					expires = excluded.expires,
+					created = excluded.created
+			`, t.ProjectId, t.UserId, t.Type, t.Pending, t.Secret, t.Expires, t.Created)
+		case record.Ticket != nil:
+			t := record.Ticket
+			touch(t.ProjectId)
+			batch.Queue(`
+				insert into authen_tickets (project_id, ticket, payload, payload_encrypted, uses, expires, sliding_ttl, scope, attempts, created)
+				values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+				on conflict (project_id, ticket) do update set
+					payload = excluded.payload,
+					payload_encrypted = excluded.payload_encrypted,
+					uses = excluded.uses,
+					expires = excluded.expires,
+					sliding_ttl = excluded.sliding_ttl,
+					scope = excluded.scope,
+					attempts = excluded.attempts,
+					created = excluded.created
+			`, t.ProjectId, t.Ticket, t.Payload, t.PayloadEncrypted, t.Uses, t.Expires, t.SlidingTTL, t.Scope, t.Attempts, t.Created)
+		case record.Denied != nil:
+			d := record.Denied
+			batch.Queue(`
+				insert into authen_ticket_denylist (project_id, ticket, expires)
+				values ($1, $2, $3)
+				on conflict (project_id, ticket) do update set expires = excluded.expires
+			`, d.ProjectId, d.Ticket, d.Expires)
+		case record.LoginLog != nil:
+			l := record.LoginLog
+			touch(l.ProjectId)
+			// authen_login_logs' primary key is (id, created) when it's
+			// partitioned, so there's no conflict on id alone to upsert on
+			batch.Queue("delete from authen_login_logs where id = $1", l.Id)
+			batch.Queue(`
+				insert into authen_login_logs (id, project_id, user_id, status, payload, payload_key, created, ip, user_agent, method, country, ip_prefix, device)
+				values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			`, l.Id, l.ProjectId, l.UserId, l.Status, l.Payload, l.PayloadKey, l.Created, l.Ip, l.UserAgent, l.Method, l.Country, l.IpPrefix, l.Device)
+		case record.UserLock != nil:
+			l := record.UserLock
+			batch.Queue(`
+				insert into authen_user_locks (project_id, user_id, locked_until, reset)
+				values ($1, $2, $3, $4)
+				on conflict (project_id, user_id) do update set
+					locked_until = excluded.locked_until,
+					reset = excluded.reset
+			`, l.ProjectId, l.UserId, l.LockedUntil, l.Reset)
+		}
+	}
+
+	if db.strict && len(projectIds) > 0 {
+		for resource, table := range countTables {
+			batch.Queue(`
+				insert into authen_project_counts (project_id, resource, count)
+				select project_id, $2, count(*)
+				from `+table+`
+				where project_id = any($1)
+				group by project_id
+				on conflict (project_id, resource) do update set count = excluded.count
+			`, projectIds, resource)
+		}
+	}
+
+	err := pgx.BeginFunc(bg, db, func(tx pgx.Tx) error {
+		return tx.SendBatch(bg, batch).Close()
+	})
+	if err != nil {
+		return fmt.Errorf("PG.Load - %w", err)
+	}
+	return nil
+}
+
+// The number of rows of each kind (keyed by data.DumpRecord.Kind), so
+// that an import can be checked without reading everything back.
+func (db DB) Counts() (map[string]int, error) {
+	var projects, totps, tickets, denied, loginLogs, userLocks int
+	err := db.QueryRow(context.Background(), `
+		select
+			(select count(*) from authen_projects),
+			(select count(*) from authen_totps),
+			(select count(*) from authen_tickets),
+			(select count(*) from authen_ticket_denylist),
+			(select count(*) from authen_login_logs),
+			(select count(*) from authen_user_locks)
+	`).Scan(&projects, &totps, &tickets, &denied, &loginLogs, &userLocks)
+
+	if err != nil {
+		return nil, fmt.Errorf("PG.Counts - %w", err)
+	}
+	return data.DumpCounts(projects, totps, tickets, denied, loginLogs, userLocks), nil
+}
+
+// Closes rows
+func dumpRows(tx pgx.Tx, fn func(data.DumpRecord) error, sql string, scan func(pgx.Rows) (data.DumpRecord, error)) error {
+	rows, err := tx.Query(context.Background(), sql)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record, err := scan(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// what's stored in authen_projects' json columns, lockout_rules and
+// login_log_success_statuses (the reverse of scanProject)
+func encodeList[T any](values []T) (*string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	text := string(encoded)
+	return &text, nil
+}
+
+// Lets Dump use scanProject, with updated as an extra, last, column
+type withUpdated struct {
+	pg.Row
+	updated *time.Time
+}
+
+func (s withUpdated) Scan(dest ...any) error {
+	return s.Row.Scan(append(dest, s.updated)...)
+}
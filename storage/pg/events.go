@@ -0,0 +1,87 @@
+package pg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"src.goblgobl.com/utils/log"
+)
+
+const EVENTS_CHANNEL = "authen_events"
+
+// cockroach doesn't support LISTEN/NOTIFY
+func (db DB) eventsSupported() bool {
+	return db.tpe == "postgres"
+}
+
+func (db DB) EventPublish(ctx context.Context, payload []byte) error {
+	if !db.eventsSupported() {
+		return nil
+	}
+
+	_, err := db.Exec(ctx, "select pg_notify($1, $2)", EVENTS_CHANNEL, string(payload))
+	if err != nil {
+		return fmt.Errorf("PG.EventPublish - %w", err)
+	}
+	return nil
+}
+
+// Listening holds on to a connection for as long as the process runs,
+// so it's a dedicated connection rather than one from the pool. The
+// initial connection is made before returning so that a misconfiguration
+// is reported at startup. After that, a lost connection is re-established
+// (events published in between are missed).
+func (db DB) EventListen(fn func(payload []byte)) error {
+	if !db.eventsSupported() {
+		log.Warn("events_listen").String("details", "cross-instance events are only supported with postgres").Log()
+		return nil
+	}
+
+	conn, err := db.eventConnect()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			err := eventLoop(conn, fn)
+			log.Error("events_listen").Err(err).Log()
+			conn.Close(context.Background())
+
+			for {
+				time.Sleep(5 * time.Second)
+				if conn, err = db.eventConnect(); err == nil {
+					break
+				}
+				log.Error("events_listen_connect").Err(err).Log()
+			}
+		}
+	}()
+	return nil
+}
+
+func (db DB) eventConnect() (*pgx.Conn, error) {
+	bg := context.Background()
+	conn, err := pgx.Connect(bg, db.url)
+	if err != nil {
+		return nil, fmt.Errorf("PG.eventConnect (connect) - %w", err)
+	}
+
+	if _, err := conn.Exec(bg, "listen "+EVENTS_CHANNEL); err != nil {
+		conn.Close(bg)
+		return nil, fmt.Errorf("PG.eventConnect (listen) - %w", err)
+	}
+	return conn, nil
+}
+
+func eventLoop(conn *pgx.Conn, fn func(payload []byte)) error {
+	for {
+		notification, err := conn.WaitForNotification(context.Background())
+		if err != nil {
+			return fmt.Errorf("PG.eventLoop - %w", err)
+		}
+		fn([]byte(notification.Payload))
+	}
+}
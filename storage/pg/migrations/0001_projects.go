@@ -33,3 +33,15 @@ func Migrate_0001(tx pgx.Tx) error {
 	}
 	return nil
 }
+
+func Down_0001(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		drop table authen_projects
+	`); err != nil {
+		return fmt.Errorf("pg 0001 down authen_projects - %w", err)
+	}
+
+	return nil
+}
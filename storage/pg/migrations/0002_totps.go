@@ -32,3 +32,15 @@ func Migrate_0002(tx pgx.Tx) error {
 
 	return nil
 }
+
+func Down_0002(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		drop table authen_totps
+	`); err != nil {
+		return fmt.Errorf("pg 0002 down authen_totps - %w", err)
+	}
+
+	return nil
+}
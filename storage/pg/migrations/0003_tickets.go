@@ -37,3 +37,15 @@ func Migrate_0003(tx pgx.Tx) error {
 
 	return nil
 }
+
+func Down_0003(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		drop table authen_tickets
+	`); err != nil {
+		return fmt.Errorf("pg 0003 down authen_tickets - %w", err)
+	}
+
+	return nil
+}
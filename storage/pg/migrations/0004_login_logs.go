@@ -29,3 +29,15 @@ func Migrate_0004(tx pgx.Tx) error {
 
 	return nil
 }
+
+func Down_0004(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		drop table authen_login_logs
+	`); err != nil {
+		return fmt.Errorf("pg 0004 down authen_login_logs - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func Migrate_0005(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		alter table authen_tickets
+		add column scope bytea null,
+		add column attempts int null
+	`); err != nil {
+		return fmt.Errorf("pg 0005 migration authen_tickets - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create index authen_tickets_scope on authen_tickets(project_id, scope) where scope is not null
+	`); err != nil {
+		return fmt.Errorf("pg 0005 migration authen_tickets_scope - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0005(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		alter table authen_tickets
+		drop column scope,
+		drop column attempts
+	`); err != nil {
+		return fmt.Errorf("pg 0005 down authen_tickets - %w", err)
+	}
+
+	return nil
+}
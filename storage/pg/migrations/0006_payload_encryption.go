@@ -0,0 +1,51 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Existing rows are left as-is (and flagged as not encrypted). Ticket
+// payloads can't be encrypted after the fact, since the key is derived
+// from the ticket, which we don't have. Login log payloads can be
+// encrypted with the -encrypt-login-logs command.
+func Migrate_0006(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		alter table authen_tickets
+		add column payload_encrypted bool not null default false
+	`); err != nil {
+		return fmt.Errorf("pg 0006 migration authen_tickets - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		alter table authen_login_logs
+		add column payload_key int not null default 0
+	`); err != nil {
+		return fmt.Errorf("pg 0006 migration authen_login_logs - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0006(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		alter table authen_tickets
+		drop column payload_encrypted
+	`); err != nil {
+		return fmt.Errorf("pg 0006 down authen_tickets - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		alter table authen_login_logs
+		drop column payload_key
+	`); err != nil {
+		return fmt.Errorf("pg 0006 down authen_login_logs - %w", err)
+	}
+
+	return nil
+}
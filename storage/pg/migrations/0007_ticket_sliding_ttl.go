@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func Migrate_0007(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		alter table authen_tickets
+		add column sliding_ttl int null
+	`); err != nil {
+		return fmt.Errorf("pg 0007 migration authen_tickets - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0007(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		alter table authen_tickets
+		drop column sliding_ttl
+	`); err != nil {
+		return fmt.Errorf("pg 0007 down authen_tickets - %w", err)
+	}
+
+	return nil
+}
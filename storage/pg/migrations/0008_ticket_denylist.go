@@ -0,0 +1,43 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Signed tickets aren't stored. Single-use signed tickets are added
+// here on use, and removed by Clean once they've expired.
+func Migrate_0008(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		create table authen_ticket_denylist (
+			project_id text not null,
+			ticket bytea not null,
+			expires timestamptz not null,
+			primary key (project_id, ticket)
+		)`); err != nil {
+		return fmt.Errorf("pg 0008 migration authen_ticket_denylist - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create index authen_ticket_denylist_expires on authen_ticket_denylist(expires)
+	`); err != nil {
+		return fmt.Errorf("pg 0008 migration authen_ticket_denylist_expires - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0008(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		drop table authen_ticket_denylist
+	`); err != nil {
+		return fmt.Errorf("pg 0008 down authen_ticket_denylist - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Login logs are always listed for a user, newest first, and can be
+// filtered by time. The (project_id, user_id) index is a prefix of the
+// new one, so it can go.
+func Migrate_0009(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		create index authen_login_logs_project_id_user_id_created on authen_login_logs(project_id, user_id, created)
+	`); err != nil {
+		return fmt.Errorf("pg 0009 migration authen_login_logs_project_id_user_id_created - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		drop index authen_login_logs_project_id_user_id
+	`); err != nil {
+		return fmt.Errorf("pg 0009 migration drop authen_login_logs_project_id_user_id - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0009(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		create index authen_login_logs_project_id_user_id on authen_login_logs(project_id, user_id)
+	`); err != nil {
+		return fmt.Errorf("pg 0009 down authen_login_logs_project_id_user_id - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		drop index authen_login_logs_project_id_user_id_created
+	`); err != nil {
+		return fmt.Errorf("pg 0009 down drop authen_login_logs_project_id_user_id_created - %w", err)
+	}
+
+	return nil
+}
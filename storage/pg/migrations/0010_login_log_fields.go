@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func Migrate_0010(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		alter table authen_login_logs
+		add column ip text null,
+		add column user_agent text null,
+		add column method text null,
+		add column country text null
+	`); err != nil {
+		return fmt.Errorf("pg 0010 migration authen_login_logs - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0010(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		alter table authen_login_logs
+		drop column ip,
+		drop column user_agent,
+		drop column method,
+		drop column country
+	`); err != nil {
+		return fmt.Errorf("pg 0010 down authen_login_logs - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ip_prefix and device are derived from ip and user_agent and are what
+// we look up to decide if a login is from a new ip / device. Existing
+// rows are left null; a user with only such rows is never flagged
+// (see data.LoginHistory).
+func Migrate_0011(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		alter table authen_login_logs
+		add column ip_prefix text null,
+		add column device text null
+	`); err != nil {
+		return fmt.Errorf("pg 0011 migration authen_login_logs - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create index authen_login_logs_project_id_user_id_ip_prefix on authen_login_logs(project_id, user_id, ip_prefix)
+		where ip_prefix is not null
+	`); err != nil {
+		return fmt.Errorf("pg 0011 migration authen_login_logs_project_id_user_id_ip_prefix - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create index authen_login_logs_project_id_user_id_device on authen_login_logs(project_id, user_id, device)
+		where device is not null
+	`); err != nil {
+		return fmt.Errorf("pg 0011 migration authen_login_logs_project_id_user_id_device - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0011(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		alter table authen_login_logs
+		drop column ip_prefix,
+		drop column device
+	`); err != nil {
+		return fmt.Errorf("pg 0011 down authen_login_logs - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func Migrate_0012(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		alter table authen_projects
+		add column login_log_retain_count int not null default 0,
+		add column login_log_retain_days int not null default 0,
+		add column login_log_retain_on_insert bool not null default false
+	`); err != nil {
+		return fmt.Errorf("pg 0012 migration authen_projects - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0012(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		alter table authen_projects
+		drop column login_log_retain_count,
+		drop column login_log_retain_days,
+		drop column login_log_retain_on_insert
+	`); err != nil {
+		return fmt.Errorf("pg 0012 down authen_projects - %w", err)
+	}
+
+	return nil
+}
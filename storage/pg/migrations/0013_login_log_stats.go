@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Stats are for a project over a time range, across all users, so the
+// (project_id, user_id, created) index doesn't help.
+func Migrate_0013(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		create index authen_login_logs_project_id_created on authen_login_logs(project_id, created)
+	`); err != nil {
+		return fmt.Errorf("pg 0013 migration authen_login_logs_project_id_created - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0013(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		drop index authen_login_logs_project_id_created
+	`); err != nil {
+		return fmt.Errorf("pg 0013 down drop authen_login_logs_project_id_created - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// lockout_rules is a json array of data.LockoutRule. A user's lock is
+// kept after it expires (or is manually unlocked) since login logs
+// older than reset no longer count towards a new lock.
+func Migrate_0014(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		alter table authen_projects
+		add column lockout_rules text null
+	`); err != nil {
+		return fmt.Errorf("pg 0014 migration authen_projects - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create table authen_user_locks (
+			project_id text not null,
+			user_id text not null,
+			locked_until timestamptz null,
+			reset timestamptz not null,
+			primary key (project_id, user_id)
+		)`); err != nil {
+		return fmt.Errorf("pg 0014 migration authen_user_locks - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create index authen_user_locks_reset on authen_user_locks(reset)
+	`); err != nil {
+		return fmt.Errorf("pg 0014 migration authen_user_locks_reset - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0014(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		drop table authen_user_locks
+	`); err != nil {
+		return fmt.Errorf("pg 0014 down authen_user_locks - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		alter table authen_projects
+		drop column lockout_rules
+	`); err != nil {
+		return fmt.Errorf("pg 0014 down authen_projects - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Per-project row counts of authen_totps, authen_tickets and
+// authen_login_logs, used to enforce max limits atomically (strict_limits).
+// Seeded here from the existing rows. Only inserts and deletes made in
+// strict mode keep it up to date, so a project's count is also recounted
+// the first time strict mode needs it (after starting).
+func Migrate_0015(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		create table authen_project_counts (
+			project_id text not null,
+			resource text not null,
+			count int not null,
+			primary key (project_id, resource)
+		)`); err != nil {
+		return fmt.Errorf("pg 0015 migration authen_project_counts - %w", err)
+	}
+
+	// the resource names match storage/pg's COUNT_* constants
+	for _, c := range [][2]string{{"totp", "authen_totps"}, {"ticket", "authen_tickets"}, {"login_log", "authen_login_logs"}} {
+		if _, err := tx.Exec(bg, `
+			insert into authen_project_counts (project_id, resource, count)
+			select project_id, $1, count(*)
+			from `+c[1]+`
+			group by project_id
+		`, c[0]); err != nil {
+			return fmt.Errorf("pg 0015 migration seed %s - %w", c[0], err)
+		}
+	}
+
+	return nil
+}
+
+func Down_0015(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		drop table authen_project_counts
+	`); err != nil {
+		return fmt.Errorf("pg 0015 down authen_project_counts - %w", err)
+	}
+
+	return nil
+}
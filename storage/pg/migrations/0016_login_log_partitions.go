@@ -0,0 +1,221 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// days, after today, which always have a login log partition
+	LOGIN_LOG_PARTITIONS_AHEAD = 7
+
+	loginLogPartitionPrefix = "authen_login_logs_"
+	loginLogPartitionLayout = "20060102"
+)
+
+// authen_login_logs becomes partitioned by day (UTC), so that expired
+// login logs can be removed by dropping a whole partition rather than
+// deleting rows. Partitions are named authen_login_logs_YYYYMMDD; the
+// next LOGIN_LOG_PARTITIONS_AHEAD days are created here and the cleaner
+// keeps creating them ahead of time. Existing rows go in a partition for
+// their day, created before they're copied, so that
+// authen_login_logs_default starts out empty (creating a partition scans
+// the default one, under a lock). Only a row which doesn't fall in a
+// day's partition ends up there, and it's only ever cleaned row by row.
+//
+// The copy happens in the migration's transaction, with the old table
+// locked, so login logs can't be written (and logins which record one
+// wait) until it's done. On a big table, run it during a maintenance
+// window.
+//
+// The primary key has to include the partition key, so it's now (id,
+// created). Cockroach doesn't have declarative partitioning; its table
+// is left as-is.
+func Migrate_0016(tx pgx.Tx) error {
+	if cockroach(tx) {
+		return nil
+	}
+
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		alter table authen_login_logs rename to authen_login_logs_unpartitioned
+	`); err != nil {
+		return fmt.Errorf("pg 0016 migration rename authen_login_logs - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create table authen_login_logs (like authen_login_logs_unpartitioned including defaults)
+		partition by range (created)
+	`); err != nil {
+		return fmt.Errorf("pg 0016 migration authen_login_logs - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create table authen_login_logs_default partition of authen_login_logs default
+	`); err != nil {
+		return fmt.Errorf("pg 0016 migration authen_login_logs_default - %w", err)
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for i := 0; i <= LOGIN_LOG_PARTITIONS_AHEAD; i++ {
+		day := today.AddDate(0, 0, i)
+		if _, err := tx.Exec(bg, LoginLogPartitionSQL(day)); err != nil {
+			return fmt.Errorf("pg 0016 migration %s - %w", LoginLogPartitionName(day), err)
+		}
+	}
+
+	// A partition for every day with rows, named and bounded like
+	// LoginLogPartitionSQL's. Done in the database (rather than querying
+	// the days) so that it's part of a dry run's SQL.
+	if _, err := tx.Exec(bg, `
+		do $$
+		declare
+			day timestamp;
+		begin
+			for day in
+				select distinct date_trunc('day', created at time zone 'UTC')
+				from authen_login_logs_unpartitioned
+			loop
+				execute format(
+					'create table if not exists %I partition of authen_login_logs for values from (%L) to (%L)',
+					'`+loginLogPartitionPrefix+`' || to_char(day, 'YYYYMMDD'),
+					to_char(day, 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+					to_char(day + interval '1 day', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+				);
+			end loop;
+		end $$
+	`); err != nil {
+		return fmt.Errorf("pg 0016 migration existing days - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		insert into authen_login_logs
+		select * from authen_login_logs_unpartitioned
+	`); err != nil {
+		return fmt.Errorf("pg 0016 migration copy authen_login_logs - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		drop table authen_login_logs_unpartitioned
+	`); err != nil {
+		return fmt.Errorf("pg 0016 migration drop authen_login_logs_unpartitioned - %w", err)
+	}
+
+	// created after the old table (and its indexes) is gone, so that they
+	// keep their names
+	if err := loginLogIndexes(tx, "id, created"); err != nil {
+		return fmt.Errorf("pg 0016 migration %w", err)
+	}
+
+	return nil
+}
+
+func Down_0016(tx pgx.Tx) error {
+	if cockroach(tx) {
+		return nil
+	}
+
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		alter table authen_login_logs rename to authen_login_logs_partitioned
+	`); err != nil {
+		return fmt.Errorf("pg 0016 down rename authen_login_logs - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create table authen_login_logs (like authen_login_logs_partitioned including defaults)
+	`); err != nil {
+		return fmt.Errorf("pg 0016 down authen_login_logs - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		insert into authen_login_logs
+		select * from authen_login_logs_partitioned
+	`); err != nil {
+		return fmt.Errorf("pg 0016 down copy authen_login_logs - %w", err)
+	}
+
+	// drops every partition along with it
+	if _, err := tx.Exec(bg, `
+		drop table authen_login_logs_partitioned
+	`); err != nil {
+		return fmt.Errorf("pg 0016 down drop authen_login_logs_partitioned - %w", err)
+	}
+
+	if err := loginLogIndexes(tx, "id"); err != nil {
+		return fmt.Errorf("pg 0016 down %w", err)
+	}
+
+	return nil
+}
+
+// The primary key and the indexes authen_login_logs had after 0013
+func loginLogIndexes(tx pgx.Tx, primaryKey string) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		alter table authen_login_logs add primary key (`+primaryKey+`)
+	`); err != nil {
+		return fmt.Errorf("authen_login_logs primary key - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create index authen_login_logs_project_id_user_id_created on authen_login_logs(project_id, user_id, created)
+	`); err != nil {
+		return fmt.Errorf("authen_login_logs_project_id_user_id_created - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create index authen_login_logs_project_id_user_id_ip_prefix on authen_login_logs(project_id, user_id, ip_prefix)
+		where ip_prefix is not null
+	`); err != nil {
+		return fmt.Errorf("authen_login_logs_project_id_user_id_ip_prefix - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create index authen_login_logs_project_id_user_id_device on authen_login_logs(project_id, user_id, device)
+		where device is not null
+	`); err != nil {
+		return fmt.Errorf("authen_login_logs_project_id_user_id_device - %w", err)
+	}
+
+	if _, err := tx.Exec(bg, `
+		create index authen_login_logs_project_id_created on authen_login_logs(project_id, created)
+	`); err != nil {
+		return fmt.Errorf("authen_login_logs_project_id_created - %w", err)
+	}
+
+	return nil
+}
+
+// Name of the partition holding the login logs created on day (UTC)
+func LoginLogPartitionName(day time.Time) string {
+	return loginLogPartitionPrefix + day.UTC().Format(loginLogPartitionLayout)
+}
+
+// The day (UTC) of a partition named by LoginLogPartitionName. False
+// for any other table (e.g. authen_login_logs_default).
+func LoginLogPartitionDay(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, loginLogPartitionPrefix) {
+		return time.Time{}, false
+	}
+	day, err := time.Parse(loginLogPartitionLayout, name[len(loginLogPartitionPrefix):])
+	return day, err == nil
+}
+
+func LoginLogPartitionSQL(day time.Time) string {
+	from := day.UTC().Truncate(24 * time.Hour)
+	return fmt.Sprintf(
+		"create table if not exists %s partition of authen_login_logs for values from ('%s') to ('%s')",
+		LoginLogPartitionName(from), from.Format(time.RFC3339), from.AddDate(0, 0, 1).Format(time.RFC3339))
+}
+
+// Cockroach identifies itself with a crdb_version parameter when
+// connecting. A dry run has no connection and gets postgres' SQL.
+func cockroach(tx pgx.Tx) bool {
+	conn := tx.Conn()
+	return conn != nil && conn.PgConn().ParameterStatus("crdb_version") != ""
+}
@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// login_log_success_statuses is a json array of the statuses of a
+// successful login. Only those make an ip or device known.
+func Migrate_0017(tx pgx.Tx) error {
+	bg := context.Background()
+	if _, err := tx.Exec(bg, `
+		alter table authen_projects
+		add column login_log_success_statuses text null
+	`); err != nil {
+		return fmt.Errorf("pg 0017 migration authen_projects - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0017(tx pgx.Tx) error {
+	bg := context.Background()
+
+	if _, err := tx.Exec(bg, `
+		alter table authen_projects
+		drop column login_log_success_statuses
+	`); err != nil {
+		return fmt.Errorf("pg 0017 down authen_projects - %w", err)
+	}
+
+	return nil
+}
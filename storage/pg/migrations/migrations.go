@@ -1,19 +1,148 @@
 package migrations
 
 import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"src.goblgobl.com/utils/log"
 	"src.goblgobl.com/utils/pg"
 )
 
+// pg.Migration only knows how to go up. Every step also has a Down which
+// undoes it (dropping whatever data was in the tables/columns it created).
+type Step struct {
+	Version int
+	Up      func(pgx.Tx) error
+	Down    func(pgx.Tx) error
+}
+
+var steps = []Step{
+	Step{1, Migrate_0001, Down_0001},
+	Step{2, Migrate_0002, Down_0002},
+	Step{3, Migrate_0003, Down_0003},
+	Step{4, Migrate_0004, Down_0004},
+	Step{5, Migrate_0005, Down_0005},
+	Step{6, Migrate_0006, Down_0006},
+	Step{7, Migrate_0007, Down_0007},
+	Step{8, Migrate_0008, Down_0008},
+	Step{9, Migrate_0009, Down_0009},
+	Step{10, Migrate_0010, Down_0010},
+	Step{11, Migrate_0011, Down_0011},
+	Step{12, Migrate_0012, Down_0012},
+	Step{13, Migrate_0013, Down_0013},
+	Step{14, Migrate_0014, Down_0014},
+	Step{15, Migrate_0015, Down_0015},
+	Step{16, Migrate_0016, Down_0016},
+	Step{17, Migrate_0017, Down_0017},
+}
+
 func Run(db pg.DB) error {
-	migrations := []pg.Migration{
-		pg.Migration{1, Migrate_0001},
-		pg.Migration{2, Migrate_0002},
-		pg.Migration{3, Migrate_0003},
-		pg.Migration{4, Migrate_0004},
-	}
-	return pg.MigrateAll(db, "authen", migrations)
+	return Up(db, Latest())
 }
 
 func GetCurrent(db pg.DB) (int, error) {
 	return pg.GetCurrentMigrationVersion(db, "authen")
 }
+
+// The version Run migrates to
+func Latest() int {
+	return steps[len(steps)-1].Version
+}
+
+// Runs every pending migration up to, and including, version.
+func Up(db pg.DB, version int) error {
+	migrations := make([]pg.Migration, 0, len(steps))
+	for _, step := range steps {
+		if step.Version > version {
+			break
+		}
+		migrations = append(migrations, pg.Migration{step.Version, step.Up})
+	}
+	return pg.MigrateAll(db, "authen", migrations)
+}
+
+// Undoes every applied migration newer than version, newest first. Each
+// step runs in its own transaction along with removing its version from
+// gobl_migrations (the table pg.MigrateAll records applied versions in),
+// so a failure leaves the schema at the last step that succeeded.
+func Down(db pg.DB, version int) error {
+	current, err := GetCurrent(db)
+	if err != nil {
+		return err
+	}
+
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if step.Version > current {
+			continue
+		}
+		if step.Version <= version {
+			break
+		}
+
+		log.Info("migration_down").String("app", "authen").String("type", "pg").Int("version", step.Version).Log()
+		err := pgx.BeginFunc(context.Background(), db, func(tx pgx.Tx) error {
+			if err := step.Down(tx); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(context.Background(), `
+				delete from gobl_migrations
+				where app = 'authen' and version = $1
+			`, step.Version); err != nil {
+				return fmt.Errorf("pg %04d down record - %w", step.Version, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The SQL which Up (when from < to) or Down (when from > to) would execute
+// to go from one version to the other. Nothing is executed.
+func SQL(from int, to int) ([]string, error) {
+	tx := &recorder{}
+	if from < to {
+		for _, step := range steps {
+			if step.Version > from && step.Version <= to {
+				tx.sql = append(tx.sql, fmt.Sprintf("-- %04d up", step.Version))
+				if err := step.Up(tx); err != nil {
+					return nil, err
+				}
+			}
+		}
+	} else {
+		for i := len(steps) - 1; i >= 0; i-- {
+			step := steps[i]
+			if step.Version <= from && step.Version > to {
+				tx.sql = append(tx.sql, fmt.Sprintf("-- %04d down", step.Version))
+				if err := step.Down(tx); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return tx.sql, nil
+}
+
+// A pgx.Tx which records, rather than executes, statements. Migrations
+// only ever call Exec (and Conn); anything else panics on the nil
+// embedded Tx.
+type recorder struct {
+	pgx.Tx
+	sql []string
+}
+
+func (r *recorder) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	r.sql = append(r.sql, sql)
+	return pgconn.CommandTag{}, nil
+}
+
+// There's no connection
+func (r *recorder) Conn() *pgx.Conn {
+	return nil
+}
@@ -0,0 +1,171 @@
+package pg
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/authen/storage/pg/migrations"
+)
+
+// The days which authen_login_logs has a partition for (see migration
+// 0016), oldest first, and whether it's partitioned at all.
+func (db DB) loginLogPartitions(ctx context.Context) ([]time.Time, bool, error) {
+	rows, err := db.Query(ctx, `
+		select c.relname
+		from pg_inherits i
+			join pg_class c on c.oid = i.inhrelid
+		where i.inhparent = 'authen_login_logs'::regclass
+	`)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	partitioned := false
+	var days []time.Time
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, false, err
+		}
+		partitioned = true
+		if day, ok := migrations.LoginLogPartitionDay(name); ok {
+			days = append(days, day)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].Before(days[j])
+	})
+	return days, partitioned, nil
+}
+
+// Drops every day partition in which all the login logs are past their
+// project's retention. Returns the number of partitions dropped and of
+// login logs they had.
+func (db DB) dropLoginLogPartitions(ctx context.Context, opts data.Clean) (int, int, error) {
+	listCtx, cancel := opts.BatchContext(ctx)
+	days, _, err := db.loginLogPartitions(listCtx)
+	cancel()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the shortest possible retention is 1 day, anything newer can't be
+	// dropped
+	cutoff := time.Now().Add(-24 * time.Hour)
+
+	dropped, removed := 0, 0
+	for _, day := range days {
+		if day.AddDate(0, 0, 1).After(cutoff) {
+			break
+		}
+		batchCtx, cancel := opts.BatchContext(ctx)
+		ok, n, err := db.dropLoginLogPartition(batchCtx, day, opts.LoginLogRetention.Days)
+		cancel()
+		if err != nil {
+			return dropped, removed, err
+		}
+		if ok {
+			dropped += 1
+			removed += n
+		}
+	}
+	return dropped, removed, nil
+}
+
+// The partition is checked once without locking it, which, for the
+// partitions that have to be kept (most of them), is all that's done.
+// Otherwise, writes to it are blocked while it's checked again, its
+// rows are taken off of their projects' counts and it's dropped.
+func (db DB) dropLoginLogPartition(ctx context.Context, day time.Time, retentionDays int) (bool, int, error) {
+	name := migrations.LoginLogPartitionName(day)
+	keepSQL := `
+		select exists (
+			select 1
+			from ` + name + ` l
+				left join authen_projects p on p.id::text = l.project_id
+			where coalesce(p.login_log_retain_days, $1) = 0
+				or l.created >= now() - coalesce(p.login_log_retain_days, $1) * interval '1 day'
+		)
+	`
+
+	keep, err := scalar[bool](ctx, db, keepSQL, retentionDays)
+	if err != nil || keep {
+		return false, 0, err
+	}
+
+	dropped, removed := false, 0
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "lock table "+name+" in exclusive mode"); err != nil {
+			return err
+		}
+
+		keep, err := scalar[bool](ctx, tx, keepSQL, retentionDays)
+		if err != nil || keep {
+			return err
+		}
+
+		removed, err = scalar[int](ctx, tx, `
+			with deleted as (
+				select project_id, count(*) as n
+				from `+name+`
+				group by project_id
+			)`+db.countedCTE(`
+				update authen_project_counts c
+				set count = c.count - d.n
+				from deleted d
+				where c.project_id = d.project_id and c.resource = '`+COUNT_LOGIN_LOG+`'
+			`)+`
+			select coalesce(sum(n), 0)::int from deleted
+		`)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, "drop table "+name); err != nil {
+			return err
+		}
+		dropped = true
+		return nil
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	return dropped, removed, nil
+}
+
+// Creates any missing partition for the next LOGIN_LOG_PARTITIONS_AHEAD
+// days. Today's is never created here: if it's missing, today's login
+// logs are already in the default partition, which a new partition
+// can't overlap.
+func (db DB) createLoginLogPartitions(ctx context.Context) error {
+	days, partitioned, err := db.loginLogPartitions(ctx)
+	if err != nil || !partitioned {
+		return err
+	}
+
+	existing := make(map[time.Time]struct{}, len(days))
+	for _, day := range days {
+		existing[day] = struct{}{}
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for i := 1; i <= migrations.LOGIN_LOG_PARTITIONS_AHEAD; i++ {
+		day := today.AddDate(0, 0, i)
+		if _, ok := existing[day]; ok {
+			continue
+		}
+		if _, err := db.Exec(ctx, migrations.LoginLogPartitionSQL(day)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,12 +2,16 @@ package pg
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"src.goblgobl.com/utils/json"
 	"src.goblgobl.com/utils/log"
 	"src.goblgobl.com/utils/pg"
 
@@ -15,13 +19,63 @@ import (
 	"src.goblgobl.com/authen/storage/pg/migrations"
 )
 
+// rows fetched per query by LoginLogExport (a var so tests can lower it)
+var loginLogExportBatch = 1000
+
+// times a transaction which fails with a serialization error is tried
+// (cockroach only)
+const txRetries = 5
+
+// authen_project_counts.resource
+const (
+	COUNT_TOTP      = "totp"
+	COUNT_TICKET    = "ticket"
+	COUNT_LOGIN_LOG = "login_log"
+)
+
+// returned by ticketInsert, so that the batch's transaction is rolled back
+var errTicketDuplicate = errors.New("duplicate ticket")
+
+// the table each authen_project_counts.resource counts
+var countTables = map[string]string{
+	COUNT_TOTP:      "authen_totps",
+	COUNT_TICKET:    "authen_tickets",
+	COUNT_LOGIN_LOG: "authen_login_logs",
+}
+
 type Config struct {
 	URL string `json:"url"`
+
+	// When true, the max number of TOTPs, tickets and login logs a project
+	// can have is checked in the same transaction as the insert, against
+	// a locked row of authen_project_counts, so concurrent inserts can't
+	// go over. authen_project_counts is only maintained when true.
+	StrictLimits bool `json:"strict_limits"`
+
+	// Optional read replicas. Reads which don't need to see a write that
+	// was just made (GetProject, LoginLogGet, LoginLogStats and Info) go
+	// to a healthy replica, falling back to the primary.
+	Replicas []string `json:"replicas"`
+
+	// How often, in seconds, replicas are pinged to see if they're up
+	ReplicaCheckFrequency uint16 `json:"replica_check_frequency"`
 }
 
 type DB struct {
 	pg.DB
 	tpe string
+
+	// for connections outside of the pool (e.g. to LISTEN)
+	url string
+
+	strict bool
+
+	// resource:projectId of the counts recounted since we started (only
+	// used when strict)
+	recounted *sync.Map
+
+	// nil when no replicas are configured
+	replicas *replicas
 }
 
 func New(config Config, tpe string) (DB, error) {
@@ -29,67 +83,366 @@ func New(config Config, tpe string) (DB, error) {
 	if err != nil {
 		return DB{}, fmt.Errorf("PG.New - %w", err)
 	}
-	return DB{db, tpe}, nil
+
+	frequency := config.ReplicaCheckFrequency
+	if frequency == 0 {
+		frequency = 5
+	}
+	replicas, err := newReplicas(config.Replicas, time.Duration(frequency)*time.Second)
+	if err != nil {
+		return DB{}, err
+	}
+
+	return DB{
+		DB:        db,
+		tpe:       tpe,
+		url:       config.URL,
+		strict:    config.StrictLimits,
+		recounted: new(sync.Map),
+		replicas:  replicas,
+	}, nil
 }
 
-func (db DB) Ping() error {
-	_, err := db.Exec(context.Background(), "select 1")
+func (db DB) Ping(ctx context.Context) error {
+	_, err := db.Exec(ctx, "select 1")
 	if err != nil {
 		return fmt.Errorf("PG.Ping - %w", err)
 	}
 	return nil
 }
 
-func (db DB) Clean() error {
-	_, err := db.Exec(context.Background(), `
-		delete from authen_totps
-		where expires < now()
-	`)
+// Every delete is done opts.BatchSize rows at a time. The rows to delete
+// are picked by a limited subquery on the table's key, since postgres'
+// delete has no limit.
+func (db DB) Clean(ctx context.Context, opts data.Clean) (data.CleanResult, error) {
+	var err error
+	var result data.CleanResult
+
+	// Future login log partitions come first, and regardless of the deletes
+	// failing, else logs could end up in the default partition (which then
+	// has to be scanned when the missing partition is created). An error is
+	// logged straight away, since a failing delete would return first.
+	var partitionsErr error
+	if db.tpe == "postgres" {
+		batchCtx, cancel := opts.BatchContext(ctx)
+		err := db.createLoginLogPartitions(batchCtx)
+		cancel()
+		if err != nil {
+			partitionsErr = fmt.Errorf("PG.clean (create login log partitions) - %w", err)
+			log.Error("pg_login_log_partitions").Err(err).Log()
+		}
+	}
+
+	result.TOTPs, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return db.countedDelete(ctx, db, COUNT_TOTP, `
+			delete from authen_totps
+			where (project_id, user_id, type, pending) in (
+				select project_id, user_id, type, pending
+				from authen_totps
+				where expires < now()
+				`+limitClause(limit)+`
+			)
+		`)
+	})
 	if err != nil {
-		return fmt.Errorf("PG.clean (totp) - %w", err)
+		return result, fmt.Errorf("PG.clean (totp) - %w", err)
 	}
 
-	_, err = db.Exec(context.Background(), `
-		delete from authen_tickets
-		where uses = 0 or expires < now()
-	`)
+	result.Tickets, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return db.countedDelete(ctx, db, COUNT_TICKET, `
+			delete from authen_tickets
+			where (project_id, ticket) in (
+				select project_id, ticket
+				from authen_tickets
+				where uses = 0 or attempts = 0 or expires < now()
+				`+limitClause(limit)+`
+			)
+		`)
+	})
 	if err != nil {
-		return fmt.Errorf("PG.clean (tickets) - %w", err)
+		return result, fmt.Errorf("PG.clean (tickets) - %w", err)
 	}
 
-	return nil
+	result.TicketDenylist, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		cmd, err := db.Exec(ctx, `
+			delete from authen_ticket_denylist
+			where (project_id, ticket) in (
+				select project_id, ticket
+				from authen_ticket_denylist
+				where expires < now()
+				`+limitClause(limit)+`
+			)
+		`)
+		return int(cmd.RowsAffected()), err
+	})
+	if err != nil {
+		return result, fmt.Errorf("PG.clean (ticket denylist) - %w", err)
+	}
+
+	// login logs of a project which isn't in authen_projects (single tenancy)
+	// use the retention passed in
+	retention := opts.LoginLogRetention
+
+	// whole partitions first, so that their rows don't have to be deleted
+	// one by one
+	if db.tpe == "postgres" {
+		partitions, removed, err := db.dropLoginLogPartitions(ctx, opts)
+		result.Partitions = partitions
+		result.LoginLogs = removed
+		if err != nil {
+			return result, fmt.Errorf("PG.clean (login log partitions) - %w", err)
+		}
+	}
+
+	removed, err := opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return db.countedDelete(ctx, db, COUNT_LOGIN_LOG, `
+			delete from authen_login_logs
+			where id in (
+				select l.id
+				from authen_login_logs l
+					left join authen_projects p on p.id::text = l.project_id
+				where coalesce(p.login_log_retain_days, $1) > 0
+					and l.created < now() - coalesce(p.login_log_retain_days, $1) * interval '1 day'
+				`+limitClause(limit)+`
+			)
+		`, retention.Days)
+	})
+	result.LoginLogs += removed
+	if err != nil {
+		return result, fmt.Errorf("PG.clean (login logs days) - %w", err)
+	}
+
+	removed, err = db.cleanLoginLogsByCount(ctx, opts, retention.Count)
+	result.LoginLogs += removed
+	if err != nil {
+		return result, fmt.Errorf("PG.clean (login logs count) - %w", err)
+	}
+
+	// Expired and unlocked locks are only kept so that older login logs
+	// don't count towards a new lock, which they can't once they're older
+	// than data.MAX_LOCKOUT_WINDOW.
+	result.UserLocks, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		cmd, err := db.Exec(ctx, `
+			delete from authen_user_locks
+			where (project_id, user_id) in (
+				select project_id, user_id
+				from authen_user_locks
+				where (locked_until is null or locked_until < now())
+					and reset < now() - interval '1 day'
+				`+limitClause(limit)+`
+			)
+		`)
+		return int(cmd.RowsAffected()), err
+	})
+	if err != nil {
+		return result, fmt.Errorf("PG.clean (user locks) - %w", err)
+	}
+
+	return result, partitionsErr
+}
+
+// Deletes the login logs beyond each user's retain count. This goes
+// project by project, and then user by user, so that every statement is
+// driven by the (project_id, user_id, created) index rather than ranking
+// the whole table.
+func (db DB) cleanLoginLogsByCount(ctx context.Context, opts data.Clean, retainCount int) (int, error) {
+	type project struct {
+		id     string
+		retain int
+	}
+
+	// authen_projects doesn't have the single tenancy project, so the
+	// project ids come from the login logs themselves, one index lookup
+	// per project.
+	queryCtx, cancel := opts.BatchContext(ctx)
+	defer cancel()
+	rows, err := db.Query(queryCtx, `
+		with recursive projects as (
+			(select project_id from authen_login_logs order by project_id limit 1)
+			union all
+			select (
+				select l.project_id
+				from authen_login_logs l
+				where l.project_id > projects.project_id
+				order by l.project_id
+				limit 1
+			)
+			from projects
+			where projects.project_id is not null
+		)
+		select l.project_id, coalesce(p.login_log_retain_count, $1)
+		from projects l
+			left join authen_projects p on p.id::text = l.project_id
+		where l.project_id is not null
+			and coalesce(p.login_log_retain_count, $1) > 0
+	`, retainCount)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var projects []project
+	for rows.Next() {
+		var p project
+		if err := rows.Scan(&p.id, &p.retain); err != nil {
+			return 0, err
+		}
+		projects = append(projects, p)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, p := range projects {
+		removed, err := db.cleanProjectLoginLogsByCount(ctx, opts, p.id, p.retain)
+		total += removed
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Finding the logs beyond the retain count means ranking every one of the
+// project's users' logs, so it's done once, and the ids are then deleted
+// in batches. A log inserted in the meantime only pushes more logs past
+// the count, which the next clean gets.
+func (db DB) cleanProjectLoginLogsByCount(ctx context.Context, opts data.Clean, projectId string, retain int) (int, error) {
+	ids, err := db.loginLogIdsBeyondCount(ctx, opts, projectId, retain)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for len(ids) > 0 {
+		batch := ids
+		if size := opts.BatchSize; size > 0 && len(batch) > size {
+			batch = batch[:size]
+		}
+		ids = ids[len(batch):]
+
+		batchCtx, cancel := opts.BatchContext(ctx)
+		removed, err := db.countedDelete(batchCtx, db, COUNT_LOGIN_LOG, `
+			delete from authen_login_logs
+			where project_id = $1 and id = any($2::uuid[])
+		`, projectId, batch)
+		cancel()
+		total += removed
+		if err != nil {
+			return total, err
+		}
+
+		if len(ids) > 0 {
+			if err := opts.Wait(ctx); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (db DB) loginLogIdsBeyondCount(ctx context.Context, opts data.Clean, projectId string, retain int) ([]string, error) {
+	ctx, cancel := opts.BatchContext(ctx)
+	defer cancel()
+
+	rows, err := db.Query(ctx, `
+		select d.id::text
+		from (
+			select user_id
+			from authen_login_logs
+			where project_id = $1
+			group by user_id
+			having count(*) > $2
+		) u cross join lateral (
+			select id
+			from authen_login_logs
+			where project_id = $1 and user_id = u.user_id
+			order by created desc, id desc
+			offset $2
+		) d
+	`, projectId, retain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
 
 func (db DB) EnsureMigrations() error {
 	return migrations.Run(db.DB)
 }
 
-func (db DB) Info() (any, error) {
-	migration, err := migrations.GetCurrent(db.DB)
+func (db DB) MigrationVersions() (int, int, error) {
+	current, err := migrations.GetCurrent(db.DB)
+	if err != nil {
+		return 0, 0, fmt.Errorf("PG.MigrationVersions - %w", err)
+	}
+	return current, migrations.Latest(), nil
+}
+
+func (db DB) MigrateTo(version int) error {
+	current, err := migrations.GetCurrent(db.DB)
+	if err != nil {
+		return fmt.Errorf("PG.MigrateTo (current) - %w", err)
+	}
+	if version < current {
+		err = migrations.Down(db.DB, version)
+	} else {
+		err = migrations.Up(db.DB, version)
+	}
+	if err != nil {
+		return fmt.Errorf("PG.MigrateTo - %w", err)
+	}
+	return nil
+}
+
+func (db DB) MigrateToSQL(version int) ([]string, error) {
+	current, err := migrations.GetCurrent(db.DB)
+	if err != nil {
+		return nil, fmt.Errorf("PG.MigrateToSQL (current) - %w", err)
+	}
+	return migrations.SQL(current, version)
+}
+
+func (db DB) Info(ctx context.Context) (any, error) {
+	var migration int
+	pool, err := db.read(ctx, func(r pg.DB) (err error) {
+		migration, err = migrations.GetCurrent(r)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	return struct {
-		Type      string `json:"type"`
-		Migration int    `json:"migration"`
+		Type      string        `json:"type"`
+		Migration int           `json:"migration"`
+		Pool      string        `json:"pool"`
+		Replicas  []replicaInfo `json:"replicas,omitempty"`
 	}{
 		Type:      db.tpe,
 		Migration: migration,
+		Pool:      pool,
+		Replicas:  db.replicas.info(),
 	}, nil
 }
 
-func (db DB) GetProject(id string) (*data.Project, error) {
-	row := db.QueryRow(context.Background(), `
-		select id,
-			totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
-			ticket_max, ticket_max_payload_length,
-			login_log_max, login_log_max_payload_length
-		from authen_projects
-		where id = $1
-	`, id)
-
-	project, err := scanProject(row)
+func (db DB) GetProject(ctx context.Context, id string) (*data.Project, error) {
+	var project *data.Project
+	_, err := db.read(ctx, func(r pg.DB) (err error) {
+		project, err = getProject(ctx, r, id)
+		return err
+	})
 	if err != nil {
 		if errors.Is(err, pg.ErrNoRows) {
 			return nil, nil
@@ -99,12 +452,27 @@ func (db DB) GetProject(id string) (*data.Project, error) {
 	return project, nil
 }
 
-func (db DB) GetUpdatedProjects(timestamp time.Time) ([]*data.Project, error) {
+func getProject(ctx context.Context, q querier, id string) (*data.Project, error) {
+	row := q.QueryRow(ctx, `
+		select id,
+			totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
+			ticket_max, ticket_max_payload_length,
+			login_log_max, login_log_max_payload_length,
+			login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+			lockout_rules, login_log_success_statuses
+		from authen_projects
+		where id = $1
+	`, id)
+
+	return scanProject(row)
+}
+
+func (db DB) GetUpdatedProjects(ctx context.Context, timestamp time.Time) ([]*data.Project, error) {
 	// Not sure fetching the count upfront really makes much sense.
 	// But we do expect this to be 0 almost every time that it's called, so most
 	// of the time we're going to be doing a single DB call (either to get the count
 	// which returns 0, or to get an empty result set).
-	count, err := pg.Scalar[int](db.DB, "select count(*) from authen_projects where updated > $1", timestamp)
+	count, err := scalar[int](ctx, db, "select count(*) from authen_projects where updated > $1", timestamp)
 	if count == 0 {
 		return nil, nil
 	}
@@ -112,11 +480,13 @@ func (db DB) GetUpdatedProjects(timestamp time.Time) ([]*data.Project, error) {
 		return nil, fmt.Errorf("PG.GetUpdatedProjects (count) - %w", err)
 	}
 
-	rows, err := db.Query(context.Background(), `
+	rows, err := db.Query(ctx, `
 		select id,
 			totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
 			ticket_max, ticket_max_payload_length,
-			login_log_max, login_log_max_payload_length
+			login_log_max, login_log_max_payload_length,
+			login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+			lockout_rules, login_log_success_statuses
 		from authen_projects where updated > $1
 	`, timestamp)
 	if err != nil {
@@ -136,7 +506,7 @@ func (db DB) GetUpdatedProjects(timestamp time.Time) ([]*data.Project, error) {
 	return projects, rows.Err()
 }
 
-func (db DB) TOTPCreate(opts data.TOTPCreate) (data.TOTPCreateResult, error) {
+func (db DB) TOTPCreate(ctx context.Context, opts data.TOTPCreate) (data.TOTPCreateResult, error) {
 	max := opts.Max
 	tpe := opts.Type
 	secret := opts.Secret
@@ -147,28 +517,58 @@ func (db DB) TOTPCreate(opts data.TOTPCreate) (data.TOTPCreateResult, error) {
 
 	var result data.TOTPCreateResult
 
-	// Since we check first, then add the user (outside of a transaction)
-	// concurrent calls to this might result in going a little over max
-	// but I'm ok with that in the name of minimizing the DB calls
-	// we need to make inside a transaction.
-	canAdd, err := db.canAddTOTP(projectId, userId, tpe, max)
-	if err != nil {
-		return result, err
-	}
+	// Unless we're strict, we check first, then add the user (outside of
+	// a transaction) so concurrent calls to this might result in going a
+	// little over max but I'm ok with that in the name of minimizing the
+	// DB calls we need to make inside a transaction.
+	if !db.strict {
+		canAdd, err := db.canAddTOTP(ctx, projectId, userId, tpe, max)
+		if err != nil {
+			return result, err
+		}
 
-	if !canAdd {
-		result.Status = data.TOTP_CREATE_MAX
-		return result, nil
+		if !canAdd {
+			result.Status = data.TOTP_CREATE_MAX
+			return result, nil
+		}
+	} else if max > 0 {
+		if err := db.recount(ctx, COUNT_TOTP, projectId); err != nil {
+			return result, err
+		}
 	}
 
-	err = db.Transaction(func(tx pgx.Tx) error {
-		_, err := tx.Exec(context.Background(), `
+	err := db.beginFunc(ctx, func(tx pgx.Tx) error {
+		if db.strict && max > 0 {
+			canAdd, err := db.canAddTOTPStrict(ctx, tx, projectId, userId, tpe, max)
+			if err != nil {
+				return err
+			}
+			if !canAdd {
+				result.Status = data.TOTP_CREATE_MAX
+				return nil
+			}
+		}
+
+		// insert and update are separate so that we know whether a row
+		// was added (and needs to be counted)
+		inserted, err := db.countedInsert(ctx, tx, COUNT_TOTP, projectId, `
 			insert into authen_totps (project_id, user_id, type, pending, secret, expires)
 			values ($1, $2, $3, $4, $5, $6)
-			on conflict (project_id, user_id, type, pending) do update set secret = $5, expires = $6
+			on conflict (project_id, user_id, type, pending) do nothing
 		`, projectId, userId, tpe, pending, secret, expires)
 		if err != nil {
-			return fmt.Errorf("PG.TOTPCreate (upsert) - %w", err)
+			return fmt.Errorf("PG.TOTPCreate (insert) - %w", err)
+		}
+
+		if inserted == 0 {
+			_, err := tx.Exec(ctx, `
+				update authen_totps
+				set secret = $5, expires = $6
+				where project_id = $1 and user_id = $2 and type = $3 and pending = $4
+			`, projectId, userId, tpe, pending, secret, expires)
+			if err != nil {
+				return fmt.Errorf("PG.TOTPCreate (update) - %w", err)
+			}
 		}
 
 		if pending {
@@ -181,7 +581,7 @@ func (db DB) TOTPCreate(opts data.TOTPCreate) (data.TOTPCreateResult, error) {
 		// longer than necessary would allow it to be re-used, which,
 		// at the very least, is not expected.)
 
-		_, err = tx.Exec(context.Background(), `
+		_, err = db.countedDelete(ctx, tx, COUNT_TOTP, `
 			delete from authen_totps
 			where project_id = $1 and user_id = $2 and type = $3 and pending
 		`, projectId, userId, tpe)
@@ -196,14 +596,16 @@ func (db DB) TOTPCreate(opts data.TOTPCreate) (data.TOTPCreateResult, error) {
 	return result, err
 }
 
-func (db DB) TOTPGet(opts data.TOTPGet) (data.TOTPGetResult, error) {
+func (db DB) TOTPGet(ctx context.Context, opts data.TOTPGet) (data.TOTPGetResult, error) {
 	tpe := opts.Type
 	userId := opts.UserId
 	pending := opts.Pending
 	projectId := opts.ProjectId
 	var result data.TOTPGetResult
 
-	row := db.QueryRow(context.Background(), `
+	// Always the primary: a TOTP is typically verified right after being
+	// created (or replaced), and a replica could return the old secret.
+	row := db.QueryRow(ctx, `
 		select secret
 		from authen_totps
 		where project_id = $1
@@ -228,13 +630,13 @@ func (db DB) TOTPGet(opts data.TOTPGet) (data.TOTPGetResult, error) {
 	}, nil
 }
 
-func (db DB) TOTPDelete(opts data.TOTPGet) (int, error) {
+func (db DB) TOTPDelete(ctx context.Context, opts data.TOTPGet) (int, error) {
 	tpe := opts.Type
 	userId := opts.UserId
 	allTypes := opts.AllTypes
 	projectId := opts.ProjectId
 
-	cmd, err := db.Exec(context.Background(), `
+	deleted, err := db.countedDelete(ctx, db, COUNT_TOTP, `
 		delete from authen_totps
 		where project_id = $1
 			and user_id = $2
@@ -244,20 +646,40 @@ func (db DB) TOTPDelete(opts data.TOTPGet) (int, error) {
 	if err != nil {
 		return 0, fmt.Errorf("PG.TOTPDelete - %w", err)
 	}
-	return int(cmd.RowsAffected()), nil
+	return deleted, nil
 }
 
-func (db DB) TicketCreate(opts data.TicketCreate) (data.TicketCreateResult, error) {
+func (db DB) TicketCreate(ctx context.Context, opts data.TicketCreate) (data.TicketCreateResult, error) {
 	max := opts.Max
-	uses := opts.Uses
-	ticket := opts.Ticket
-	expires := opts.Expires
-	payload := opts.Payload
+	tickets := opts.Tickets
 	projectId := opts.ProjectId
 
 	var result data.TicketCreateResult
+	if len(tickets) == 0 {
+		result.Status = data.TICKET_CREATE_OK
+		return result, nil
+	}
 
-	canAdd, err := db.ticketCanAdd(projectId, max)
+	if db.strict && max > 0 {
+		if err := db.recount(ctx, COUNT_TICKET, projectId); err != nil {
+			return result, err
+		}
+		err := db.beginFunc(ctx, func(tx pgx.Tx) error {
+			count, err := db.lockCount(ctx, tx, COUNT_TICKET, projectId)
+			if err != nil {
+				return err
+			}
+			if count+len(tickets) > max {
+				result.Status = data.TICKET_CREATE_MAX
+				return nil
+			}
+			result.Status, err = db.ticketInsert(ctx, tx, projectId, tickets)
+			return err
+		})
+		return ticketCreateResult(result, err)
+	}
+
+	canAdd, err := db.ticketCanAdd(ctx, projectId, max, len(tickets))
 	if err != nil {
 		return result, err
 	}
@@ -267,128 +689,352 @@ func (db DB) TicketCreate(opts data.TicketCreate) (data.TicketCreateResult, erro
 		return result, nil
 	}
 
-	_, err = db.Exec(context.Background(), `
-		insert into authen_tickets (project_id, ticket, expires, uses, payload)
-		values ($1, $2, $3, $4, $5)
-	`, projectId, ticket, expires, uses, payload)
+	if len(tickets) == 1 {
+		// a single row, there's nothing else to roll back
+		result.Status, err = db.ticketInsert(ctx, db, projectId, tickets)
+	} else {
+		err = db.beginFunc(ctx, func(tx pgx.Tx) error {
+			result.Status, err = db.ticketInsert(ctx, tx, projectId, tickets)
+			return err
+		})
+	}
+	return ticketCreateResult(result, err)
+}
 
+// Random 20 byte tickets won't collide, but short codes can, in which
+// case the caller is expected to generate a new code and try again. A
+// duplicate is returned as errTicketDuplicate, so that, in a batch, the
+// tickets which were inserted are rolled back (see ticketCreateResult).
+func (db DB) ticketInsert(ctx context.Context, q querier, projectId string, tickets []data.TicketCreateTicket) (data.TicketCreateStatus, error) {
+	sql, args := ticketCreateSQL(projectId, tickets)
+	inserted, err := db.countedInsert(ctx, q, COUNT_TICKET, projectId, sql, args...)
 	if err != nil {
-		return result, fmt.Errorf("PG.TicketCreate - %w", err)
+		return 0, fmt.Errorf("PG.TicketCreate - %w", err)
 	}
 
-	result.Status = data.TICKET_CREATE_OK
-	return result, nil
+	if inserted != len(tickets) {
+		return data.TICKET_CREATE_DUPLICATE, errTicketDuplicate
+	}
+	return data.TICKET_CREATE_OK, nil
 }
 
-func (db DB) TicketUse(opts data.TicketUse) (data.TicketUseResult, error) {
+func ticketCreateResult(result data.TicketCreateResult, err error) (data.TicketCreateResult, error) {
+	if errors.Is(err, errTicketDuplicate) {
+		return data.TicketCreateResult{Status: data.TICKET_CREATE_DUPLICATE}, nil
+	}
+	return result, err
+}
+
+func (db DB) TicketUse(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error) {
+	scope := opts.Scope
 	ticket := opts.Ticket
 	projectId := opts.ProjectId
 
 	var result data.TicketUseResult
 
-	row := db.QueryRow(context.Background(), `
+	row := db.QueryRow(ctx, `
 		update authen_tickets
-		set uses = uses - 1
+		set uses = uses - 1, expires = coalesce(now() + sliding_ttl * interval '1 second', expires)
 		where project_id = $1
 			and ticket = $2
 			and (uses is null or uses > 0)
+			and (attempts is null or attempts > 0)
 			and (expires is null or expires > now())
-		returning uses, payload
+		returning uses, payload, payload_encrypted
 	`, projectId, ticket)
 
 	var uses *int
 	var payload *[]byte
-	if err := row.Scan(&uses, &payload); err != nil {
+	var encrypted bool
+	if err := row.Scan(&uses, &payload, &encrypted); err != nil {
+		if err != pg.ErrNoRows {
+			return result, fmt.Errorf("PG.TicketUse - %w", err)
+		}
+		if scope != nil {
+			if err := db.ticketFailedAttempt(ctx, projectId, scope); err != nil {
+				return result, err
+			}
+		}
+		result.Status = data.TICKET_USE_NOT_FOUND
+		return result, nil
+	}
+
+	result.Status = data.TICKET_USE_OK
+	result.Payload = payload
+	result.Uses = uses
+	result.PayloadEncrypted = encrypted
+	return result, nil
+}
+
+func (db DB) TicketDelete(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error) {
+	ticket := opts.Ticket
+	projectId := opts.ProjectId
+
+	var result data.TicketUseResult
+
+	row := db.QueryRow(ctx, `
+		with deleted as (
+			delete from authen_tickets
+			where project_id = $1
+				and ticket = $2
+				and (uses is null or uses > 0)
+				and (attempts is null or attempts > 0)
+				and (expires is null or expires > now())
+			returning uses
+		)`+db.countedCTE(`
+			update authen_project_counts
+			set count = count - 1
+			where project_id = $1 and resource = '`+COUNT_TICKET+`'
+				and exists (select 1 from deleted)
+		`)+`
+		select uses from deleted
+	`, projectId, ticket)
+
+	var uses *int
+	if err := row.Scan(&uses); err != nil {
 		if err == pg.ErrNoRows {
 			result.Status = data.TICKET_USE_NOT_FOUND
 			return result, nil
 		}
-		return result, fmt.Errorf("PG.TicketUse - %w", err)
+		return result, fmt.Errorf("PG.TicketDelete - %w", err)
 	}
 
 	result.Status = data.TICKET_USE_OK
-	result.Payload = payload
 	result.Uses = uses
 	return result, nil
 }
 
-func (db DB) TicketDelete(opts data.TicketUse) (data.TicketUseResult, error) {
+func (db DB) TicketExtend(ctx context.Context, opts data.TicketExtend) (data.TicketUseResult, error) {
+	uses := opts.Uses
 	ticket := opts.Ticket
+	expires := opts.Expires
 	projectId := opts.ProjectId
 
 	var result data.TicketUseResult
 
-	row := db.QueryRow(context.Background(), `
-		delete from authen_tickets
+	// Only live tickets can be extended. A ticket with no uses left, or
+	// which has expired, is dead (and will be removed by Clean).
+	row := db.QueryRow(ctx, `
+		update authen_tickets
+		set expires = coalesce($3::timestamptz, expires),
+			uses = uses + coalesce($4::int, 0)
 		where project_id = $1
 			and ticket = $2
 			and (uses is null or uses > 0)
+			and (attempts is null or attempts > 0)
 			and (expires is null or expires > now())
 		returning uses
-	`, projectId, ticket)
+	`, projectId, ticket, expires, uses)
 
-	var uses *int
-	if err := row.Scan(&uses); err != nil {
+	var remaining *int
+	if err := row.Scan(&remaining); err != nil {
 		if err == pg.ErrNoRows {
 			result.Status = data.TICKET_USE_NOT_FOUND
 			return result, nil
 		}
-		return result, fmt.Errorf("PG.TicketDelete - %w", err)
+		return result, fmt.Errorf("PG.TicketExtend - %w", err)
 	}
 
 	result.Status = data.TICKET_USE_OK
-	result.Uses = uses
+	result.Uses = remaining
 	return result, nil
 }
 
-func (db DB) LoginLogCreate(opts data.LoginLogCreate) (data.LoginLogCreateResult, error) {
+// Returns TICKET_USE_OK the first time a ticket is denied and
+// TICKET_USE_NOT_FOUND if it already was (i.e. it's already been used).
+func (db DB) TicketDeny(ctx context.Context, opts data.TicketDeny) (data.TicketUseResult, error) {
+	var result data.TicketUseResult
+
+	cmd, err := db.Exec(ctx, `
+		insert into authen_ticket_denylist (project_id, ticket, expires)
+		values ($1, $2, $3)
+		on conflict do nothing
+	`, opts.ProjectId, opts.Ticket, opts.Expires)
+
+	if err != nil {
+		return result, fmt.Errorf("PG.TicketDeny - %w", err)
+	}
+
+	if cmd.RowsAffected() == 0 {
+		result.Status = data.TICKET_USE_NOT_FOUND
+		return result, nil
+	}
+
+	result.Status = data.TICKET_USE_OK
+	return result, nil
+}
+
+// What the user's successful login logs say about given, the ip_prefix
+// or device (column) derived from source. Each probe is an exists, which
+// stops at the first match; the tracked and known ones can use the
+// (project_id, user_id, column) index. Untracked history only matters
+// when nothing is tracked, so it's only looked for then.
+func (db DB) loginHistory(ctx context.Context, opts data.LoginLogCreate, column string, source string, given *string) (data.LoginHistory, error) {
+	var history data.LoginHistory
+	if given == nil {
+		return history, nil
+	}
+
+	probe := func(condition string, args ...any) (bool, error) {
+		var found bool
+		args = append([]any{opts.ProjectId, opts.UserId, opts.SuccessStatuses}, args...)
+		err := db.QueryRow(ctx, `
+			select exists (
+				select 1 from authen_login_logs
+				where project_id = $1 and user_id = $2 and status = any($3) and `+condition+`
+			)
+		`, args...).Scan(&found)
+
+		if err != nil {
+			return false, fmt.Errorf("PG.LoginLogCreate (%s) - %w", column, err)
+		}
+		return found, nil
+	}
+
+	tracked, err := probe(column + " is not null")
+	if err != nil {
+		return history, err
+	}
+	if !tracked {
+		history.Untracked, err = probe(source + " is not null and " + column + " is null")
+		return history, err
+	}
+
+	history.Tracked = true
+	history.Known, err = probe(column+" = $4", *given)
+	return history, err
+}
+
+func (db DB) LoginLogCreate(ctx context.Context, opts data.LoginLogCreate) (data.LoginLogCreateResult, error) {
 	id := opts.Id
 	max := opts.Max
 	payload := opts.Payload
 	userId := opts.UserId
 	status := opts.Status
 	projectId := opts.ProjectId
+	payloadKey := opts.PayloadKey
 
 	var result data.LoginLogCreateResult
 
-	canAdd, err := db.loginLogCanAdd(projectId, max)
-	if err != nil {
-		return result, err
+	if !db.strict {
+		canAdd, err := db.loginLogCanAdd(ctx, projectId, max)
+		if err != nil {
+			return result, err
+		}
+
+		if !canAdd {
+			result.Status = data.LOGIN_LOG_CREATE_MAX
+			return result, nil
+		}
 	}
 
-	if !canAdd {
-		result.Status = data.LOGIN_LOG_CREATE_MAX
-		return result, nil
+	if opts.TracksHistory() {
+		// must happen before the insert, else we'd always find ourselves
+		ip, err := db.loginHistory(ctx, opts, "ip_prefix", "ip", opts.IpPrefix)
+		if err != nil {
+			return result, err
+		}
+		device, err := db.loginHistory(ctx, opts, "device", "user_agent", opts.Device)
+		if err != nil {
+			return result, err
+		}
+		result.NewIp = ip.IsNew(opts.IpPrefix)
+		result.NewDevice = device.IsNew(opts.Device)
 	}
 
-	_, err = db.Exec(context.Background(), `
-		insert into authen_login_logs (id, project_id, user_id, status, payload)
-		values ($1, $2, $3, $4, $5)
-	`, id, projectId, userId, status, payload)
+	insert := func(q querier) error {
+		_, err := db.countedInsert(ctx, q, COUNT_LOGIN_LOG, projectId, `
+			insert into authen_login_logs (id, project_id, user_id, status, payload, payload_key, ip, user_agent, method, country, ip_prefix, device)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		`, id, projectId, userId, status, payload, payloadKey, opts.Ip, opts.UserAgent, opts.Method, opts.Country, opts.IpPrefix, opts.Device)
+
+		if err != nil {
+			return fmt.Errorf("PG.LoginLogCreate - %w", err)
+		}
+		return nil
+	}
 
+	var err error
+	if db.strict && max > 0 {
+		if err := db.recount(ctx, COUNT_LOGIN_LOG, projectId); err != nil {
+			return result, err
+		}
+		canAdd := true
+		err = db.beginFunc(ctx, func(tx pgx.Tx) error {
+			count, err := db.lockCount(ctx, tx, COUNT_LOGIN_LOG, projectId)
+			if err != nil {
+				return err
+			}
+			if canAdd = count < max; !canAdd {
+				return nil
+			}
+			return insert(tx)
+		})
+		if err == nil && !canAdd {
+			return data.LoginLogCreateResult{Status: data.LOGIN_LOG_CREATE_MAX}, nil
+		}
+	} else {
+		err = insert(db)
+	}
 	if err != nil {
-		return result, fmt.Errorf("PG.LoginLogCreate - %w", err)
+		return result, err
+	}
+
+	if retain := opts.RetainCount; retain > 0 {
+		_, err = db.countedDelete(ctx, db, COUNT_LOGIN_LOG, `
+			delete from authen_login_logs
+			where id in (
+				select id from authen_login_logs
+				where project_id = $1 and user_id = $2
+				order by created desc, id desc
+				offset $3
+			)
+		`, projectId, userId, retain)
+
+		if err != nil {
+			return result, fmt.Errorf("PG.LoginLogCreate (retain) - %w", err)
+		}
+	}
+
+	if rules := opts.Lockout; len(rules) > 0 {
+		lockedUntil, err := db.userLockEvaluate(ctx, projectId, userId, status, rules)
+		if err != nil {
+			return result, err
+		}
+		result.LockedUntil = lockedUntil
 	}
 
 	result.Status = data.LOGIN_LOG_CREATE_OK
 	return result, nil
 }
 
-func (db DB) LoginLogGet(opts data.LoginLogGet) (data.LoginLogGetResult, error) {
-	userId := opts.UserId
-	projectId := opts.ProjectId
+func (db DB) LoginLogGet(ctx context.Context, opts data.LoginLogGet) (result data.LoginLogGetResult, err error) {
+	_, err = db.read(ctx, func(r pg.DB) error {
+		result, err = loginLogGet(ctx, r, opts)
+		return err
+	})
+	return result, err
+}
+
+func loginLogGet(ctx context.Context, db pg.DB, opts data.LoginLogGet) (data.LoginLogGetResult, error) {
 	limit := opts.Limit
 	offset := opts.Offset
+	if opts.Cursor != nil {
+		offset = 0
+	}
 
 	var result data.LoginLogGetResult
 
-	rows, err := db.Query(context.Background(), `
-		select id, status, payload, created
+	where, args := loginLogWhere(opts)
+	n := len(args)
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(ctx, `
+		select id, status, payload, payload_key, created, ip, user_agent, method, country
 		from authen_login_logs
-		where project_id = $1 and user_id = $2
-		order by created desc
-		limit $3 offset $4
-	`, projectId, userId, limit, offset)
+		where `+where+`
+		order by created desc, id desc
+		limit $`+strconv.Itoa(n+1)+` offset $`+strconv.Itoa(n+2), args...)
 
 	if err != nil {
 		return result, fmt.Errorf("PG.LoginLogGet (select) - %w", err)
@@ -398,19 +1044,8 @@ func (db DB) LoginLogGet(opts data.LoginLogGet) (data.LoginLogGetResult, error)
 	i := 0
 	records := make([]data.LoginLogRecord, limit)
 	for rows.Next() {
-		var payload any
-		var payloadBytes *[]byte
 		var record data.LoginLogRecord
-
-		rows.Scan(&record.Id, &record.Status, &payloadBytes, &record.Created)
-		if payloadBytes != nil {
-			//rather not do this here, but it's better for our handler, so...
-			if err := json.Unmarshal(*payloadBytes, &payload); err != nil {
-				// very weird, as we've been able to deal with this as json so far
-				log.Error("login_record_payload").Err(err).String("payload", string(*payloadBytes)).Log()
-			}
-			record.Payload = payload
-		}
+		rows.Scan(&record.Id, &record.Status, &record.RawPayload, &record.PayloadKey, &record.Created, &record.Ip, &record.UserAgent, &record.Method, &record.Country)
 		records[i] = record
 		i += 1
 	}
@@ -424,7 +1059,292 @@ func (db DB) LoginLogGet(opts data.LoginLogGet) (data.LoginLogGetResult, error)
 	return result, nil
 }
 
-func (db DB) canAddTOTP(projectId string, userId string, tpe string, max int) (bool, error) {
+// Aggregated in the database: a range can cover far more logs than we'd
+// want to pull through LoginLogGet.
+func (db DB) LoginLogStats(ctx context.Context, opts data.LoginLogStats) (result data.LoginLogStatsResult, err error) {
+	_, err = db.read(ctx, func(r pg.DB) error {
+		result, err = loginLogStats(ctx, r, opts)
+		return err
+	})
+	return result, err
+}
+
+func loginLogStats(ctx context.Context, db pg.DB, opts data.LoginLogStats) (data.LoginLogStatsResult, error) {
+	var result data.LoginLogStatsResult
+
+	args := []any{opts.ProjectId, opts.Since, opts.Until}
+	where := "project_id = $1 and created >= $2 and created < $3"
+	if statuses := opts.Statuses; len(statuses) > 0 {
+		args = append(args, statuses)
+		where += " and status = any($4)"
+	}
+
+	unit := "day"
+	if opts.Hourly {
+		unit = "hour"
+	}
+
+	// date_trunc's time zone argument needs PG 12+ and isn't supported by
+	// cockroach, so created is truncated as a UTC timestamp and converted back
+	rows, err := db.Query(ctx, `
+		select date_trunc('`+unit+`', created at time zone 'UTC') at time zone 'UTC' as bucket, status, count(*)
+		from authen_login_logs
+		where `+where+`
+		group by bucket, status
+		order by bucket, status
+	`, args...)
+	if err != nil {
+		return result, fmt.Errorf("PG.LoginLogStats (buckets) - %w", err)
+	}
+	defer rows.Close()
+
+	buckets := make([]data.LoginLogStatsBucket, 0, 32)
+	for rows.Next() {
+		var bucket data.LoginLogStatsBucket
+		rows.Scan(&bucket.Time, &bucket.Status, &bucket.Count)
+		bucket.Time = bucket.Time.UTC()
+		buckets = append(buckets, bucket)
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("PG.LoginLogStats (buckets scan) - %w", err)
+	}
+	result.Buckets = buckets
+
+	distinct, err := scalar[int](ctx, db, `
+		select count(distinct user_id)
+		from authen_login_logs
+		where `+where, args...)
+	if err != nil {
+		return result, fmt.Errorf("PG.LoginLogStats (distinct) - %w", err)
+	}
+	result.DistinctUsers = distinct
+
+	failed := opts.FailedStatuses
+	if len(failed) == 0 || opts.Top == 0 {
+		return result, nil
+	}
+
+	n := len(args)
+	args = append(args, failed, opts.Top)
+	rows, err = db.Query(ctx, `
+		select user_id, count(*) as failures
+		from authen_login_logs
+		where `+where+` and status = any($`+strconv.Itoa(n+1)+`)
+		group by user_id
+		order by failures desc, user_id
+		limit $`+strconv.Itoa(n+2), args...)
+	if err != nil {
+		return result, fmt.Errorf("PG.LoginLogStats (failing) - %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]data.LoginLogStatsUser, 0, opts.Top)
+	for rows.Next() {
+		var user data.LoginLogStatsUser
+		rows.Scan(&user.UserId, &user.Count)
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("PG.LoginLogStats (failing scan) - %w", err)
+	}
+	result.TopFailing = users
+
+	return result, nil
+}
+
+func (db DB) LoginLogDelete(ctx context.Context, opts data.LoginLogDelete) (int, error) {
+	// without either, we'd delete all of the project's logs
+	if opts.UserId == "" && len(opts.Ids) == 0 {
+		return 0, nil
+	}
+
+	args := []any{opts.ProjectId}
+	where := "project_id = $1"
+	if userId := opts.UserId; userId != "" {
+		args = append(args, userId)
+		where += " and user_id = $" + strconv.Itoa(len(args))
+	}
+	if ids := opts.Ids; len(ids) > 0 {
+		args = append(args, ids)
+		where += " and id = any($" + strconv.Itoa(len(args)) + "::uuid[])"
+	}
+
+	deleted, err := db.countedDelete(ctx, db, COUNT_LOGIN_LOG, `
+		delete from authen_login_logs
+		where `+where, args...)
+
+	if err != nil {
+		return 0, fmt.Errorf("PG.LoginLogDelete - %w", err)
+	}
+	return deleted, nil
+}
+
+func (db DB) UserLockGet(ctx context.Context, opts data.UserLockGet) (data.UserLock, error) {
+	var result data.UserLock
+
+	lockedUntil, err := scalar[*time.Time](ctx, db, `
+		select locked_until
+		from authen_user_locks
+		where project_id = $1 and user_id = $2 and locked_until > now()
+	`, opts.ProjectId, opts.UserId)
+
+	if err != nil {
+		if errors.Is(err, pg.ErrNoRows) {
+			return result, nil
+		}
+		return result, fmt.Errorf("PG.UserLockGet - %w", err)
+	}
+
+	result.LockedUntil = lockedUntil
+	return result, nil
+}
+
+// Returns true if the user was locked. Whether or not they were, login
+// logs up to now no longer count towards a new lock.
+func (db DB) UserUnlock(ctx context.Context, opts data.UserLockGet) (bool, error) {
+	locked, err := scalar[bool](ctx, db, `
+		with existing as (
+			select locked_until
+			from authen_user_locks
+			where project_id = $1 and user_id = $2
+		)
+		insert into authen_user_locks (project_id, user_id, locked_until, reset)
+		values ($1, $2, null, now())
+		on conflict (project_id, user_id) do update
+		set locked_until = null, reset = excluded.reset
+		returning coalesce((select locked_until > now() from existing), false)
+	`, opts.ProjectId, opts.UserId)
+
+	if err != nil {
+		return false, fmt.Errorf("PG.UserUnlock - %w", err)
+	}
+	return locked, nil
+}
+
+// Keyset pagination (like sqlite's) so that only loginLogExportBatch rows
+// are in memory at a time, regardless of how many logs the project has.
+// Every batch is its own query: nothing is held open while fn (i.e. a
+// possibly slow client) is being called.
+func (db DB) LoginLogExport(ctx context.Context, opts data.LoginLogExport, fn func(data.LoginLogRecord) error) error {
+	args := []any{opts.ProjectId}
+	where := "project_id = $1"
+	if userId := opts.UserId; userId != "" {
+		args = append(args, userId)
+		where += " and user_id = $" + strconv.Itoa(len(args))
+	}
+	if since := opts.Since; since != nil {
+		args = append(args, *since)
+		where += " and created >= $" + strconv.Itoa(len(args))
+	}
+	if until := opts.Until; until != nil {
+		args = append(args, *until)
+		where += " and created < $" + strconv.Itoa(len(args))
+	}
+
+	n := len(args)
+	first := `
+		select id, user_id, status, payload, payload_key, created, ip, user_agent, method, country
+		from authen_login_logs
+		where ` + where + `
+		order by created, id
+		limit ` + strconv.Itoa(loginLogExportBatch)
+
+	next := `
+		select id, user_id, status, payload, payload_key, created, ip, user_agent, method, country
+		from authen_login_logs
+		where ` + where + `
+			and (created, id) > ($` + strconv.Itoa(n+1) + `, $` + strconv.Itoa(n+2) + `::uuid)
+		order by created, id
+		limit ` + strconv.Itoa(loginLogExportBatch)
+
+	sql := first
+	batch := make([]data.LoginLogRecord, 0, loginLogExportBatch)
+	for {
+		var err error
+		batch, err = db.loginLogExportBatch(ctx, opts, batch[:0], sql, args...)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range batch {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+
+		if len(batch) < loginLogExportBatch {
+			return nil
+		}
+		last := batch[len(batch)-1]
+		sql = next
+		args = append(args[:n], last.Created, last.Id)
+	}
+}
+
+func (db DB) loginLogExportBatch(ctx context.Context, opts data.LoginLogExport, batch []data.LoginLogRecord, sql string, args ...any) ([]data.LoginLogRecord, error) {
+	ctx, cancel := opts.BatchContext(ctx)
+	defer cancel()
+
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("PG.LoginLogExport - %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record data.LoginLogRecord
+		if err := rows.Scan(&record.Id, &record.UserId, &record.Status, &record.RawPayload, &record.PayloadKey, &record.Created, &record.Ip, &record.UserAgent, &record.Method, &record.Country); err != nil {
+			return nil, fmt.Errorf("PG.LoginLogExport (scan) - %w", err)
+		}
+		batch = append(batch, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("PG.LoginLogExport (rows) - %w", err)
+	}
+	return batch, nil
+}
+
+// Used to encrypt payloads created before payload encryption existed
+func (db DB) LoginLogGetUnencrypted(ctx context.Context, limit int) ([]data.LoginLogRecord, error) {
+	rows, err := db.Query(ctx, `
+		select id, payload
+		from authen_login_logs
+		where payload is not null and payload_key = 0
+		limit $1
+	`, limit)
+
+	if err != nil {
+		return nil, fmt.Errorf("PG.LoginLogGetUnencrypted (select) - %w", err)
+	}
+	defer rows.Close()
+
+	records := make([]data.LoginLogRecord, 0, limit)
+	for rows.Next() {
+		var record data.LoginLogRecord
+		if err := rows.Scan(&record.Id, &record.RawPayload); err != nil {
+			return nil, fmt.Errorf("PG.LoginLogGetUnencrypted (scan) - %w", err)
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func (db DB) LoginLogUpdatePayload(ctx context.Context, opts data.LoginLogUpdatePayload) error {
+	_, err := db.Exec(ctx, `
+		update authen_login_logs
+		set payload = $2, payload_key = $3
+		where id = $1
+	`, opts.Id, opts.Payload, opts.PayloadKey)
+
+	if err != nil {
+		return fmt.Errorf("PG.LoginLogUpdatePayload - %w", err)
+	}
+	return nil
+}
+
+func (db DB) canAddTOTP(ctx context.Context, projectId string, userId string, tpe string, max int) (bool, error) {
 	// no limit
 	if max == 0 {
 		return true, nil
@@ -432,7 +1352,7 @@ func (db DB) canAddTOTP(projectId string, userId string, tpe string, max int) (b
 
 	// if the user already exists, then we aren't adding a user
 	// and thus cannot be over any limit
-	exists, err := pg.Scalar[bool](db.DB, `
+	exists, err := scalar[bool](ctx, db, `
 		select exists (
 			select 1
 			from authen_totps
@@ -446,7 +1366,7 @@ func (db DB) canAddTOTP(projectId string, userId string, tpe string, max int) (b
 		return exists, nil
 	}
 
-	count, err := pg.Scalar[int](db.DB, `
+	count, err := scalar[int](ctx, db, `
 		select count(*)
 		from authen_totps
 		where project_id = $1
@@ -458,13 +1378,13 @@ func (db DB) canAddTOTP(projectId string, userId string, tpe string, max int) (b
 	return count < max, nil
 }
 
-func (db DB) ticketCanAdd(projectId string, max int) (bool, error) {
+func (db DB) ticketCanAdd(ctx context.Context, projectId string, max int, n int) (bool, error) {
 	// no limit
 	if max == 0 {
 		return true, nil
 	}
 
-	count, err := pg.Scalar[int](db.DB, `
+	count, err := scalar[int](ctx, db, `
 		select count(*)
 		from authen_tickets
 		where project_id = $1
@@ -473,16 +1393,31 @@ func (db DB) ticketCanAdd(projectId string, max int) (bool, error) {
 	if err != nil {
 		return false, fmt.Errorf("PG.ticketCanAdd (count) - %w", err)
 	}
-	return count < max, nil
+	return count+n <= max, nil
+}
+
+// A code wasn't found. Codes are short enough to be guessed, so every
+// miss burns an attempt from all the live codes within the scope.
+func (db DB) ticketFailedAttempt(ctx context.Context, projectId string, scope []byte) error {
+	_, err := db.Exec(ctx, `
+		update authen_tickets
+		set attempts = attempts - 1
+		where project_id = $1 and scope = $2 and attempts > 0
+	`, projectId, scope)
+
+	if err != nil {
+		return fmt.Errorf("PG.ticketFailedAttempt - %w", err)
+	}
+	return nil
 }
 
-func (db DB) loginLogCanAdd(projectId string, max int) (bool, error) {
+func (db DB) loginLogCanAdd(ctx context.Context, projectId string, max int) (bool, error) {
 	// no limit
 	if max == 0 {
 		return true, nil
 	}
 
-	count, err := pg.Scalar[int](db.DB, `
+	count, err := scalar[int](ctx, db, `
 		select count(*)
 		from authen_login_logs
 		where project_id = $1
@@ -494,21 +1429,312 @@ func (db DB) loginLogCanAdd(projectId string, max int) (bool, error) {
 	return count < max, nil
 }
 
+// Evaluates the rules which match the new login log's status and
+// returns the user's lock, which might predate this login log. Only
+// login logs newer than the user's last lock (or unlock) are counted.
+func (db DB) userLockEvaluate(ctx context.Context, projectId string, userId string, status int, rules []data.LockoutRule) (*time.Time, error) {
+	matches := false
+	for _, rule := range rules {
+		matches = matches || rule.Matches(status)
+	}
+
+	// nothing to evaluate, but the result still says if the user is locked
+	if !matches {
+		var lockedUntil *time.Time
+		err := db.QueryRow(ctx, `
+			select case when locked_until > now() then locked_until end
+			from authen_user_locks
+			where project_id = $1 and user_id = $2
+		`, projectId, userId).Scan(&lockedUntil)
+
+		if err != nil && !errors.Is(err, pg.ErrNoRows) {
+			return nil, fmt.Errorf("PG.userLockEvaluate (get) - %w", err)
+		}
+		return lockedUntil, nil
+	}
+
+	var lockedUntil *time.Time
+	err := db.beginFunc(ctx, func(tx pgx.Tx) error {
+		// The user's lock row serializes concurrent evaluations, so that
+		// each one counts the failures of those before it. A user without
+		// one gets one which isn't locked and whose reset excludes nothing
+		// (the cleaner removes it a day later).
+		_, err := tx.Exec(ctx, `
+			insert into authen_user_locks (project_id, user_id, locked_until, reset)
+			values ($1, $2, null, to_timestamp(0))
+			on conflict (project_id, user_id) do nothing
+		`, projectId, userId)
+		if err != nil {
+			return fmt.Errorf("PG.userLockEvaluate (ensure) - %w", err)
+		}
+
+		var reset time.Time
+		err = tx.QueryRow(ctx, `
+			select reset, case when locked_until > now() then locked_until end
+			from authen_user_locks
+			where project_id = $1 and user_id = $2
+			for update
+		`, projectId, userId).Scan(&reset, &lockedUntil)
+		if err != nil {
+			return fmt.Errorf("PG.userLockEvaluate (get) - %w", err)
+		}
+
+		duration := 0
+		for _, rule := range rules {
+			// a rule can only matter if it would lock for longer
+			if rule.Duration <= duration || !rule.Matches(status) {
+				continue
+			}
+
+			failures, err := scalar[int](ctx, tx, `
+				select count(*)
+				from authen_login_logs
+				where project_id = $1 and user_id = $2 and status = any($3)
+					and created > now() - $4 * interval '1 second'
+					and created > $5
+			`, projectId, userId, rule.Statuses, rule.Window, reset)
+
+			if err != nil {
+				return fmt.Errorf("PG.userLockEvaluate (count) - %w", err)
+			}
+			if failures >= rule.Failures {
+				duration = rule.Duration
+			}
+		}
+
+		if duration == 0 {
+			return nil
+		}
+
+		lockedUntil, err = scalar[*time.Time](ctx, tx, `
+			update authen_user_locks
+			set locked_until = greatest(locked_until, now() + $3 * interval '1 second'),
+				reset = now()
+			where project_id = $1 and user_id = $2
+			returning locked_until
+		`, projectId, userId, duration)
+
+		if err != nil {
+			return fmt.Errorf("PG.userLockEvaluate (lock) - %w", err)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return lockedUntil, nil
+}
+
+// canAddTOTP, but against the project's locked count. Must be called
+// within the transaction doing the insert.
+func (db DB) canAddTOTPStrict(ctx context.Context, tx pgx.Tx, projectId string, userId string, tpe string, max int) (bool, error) {
+	count, err := db.lockCount(ctx, tx, COUNT_TOTP, projectId)
+	if err != nil {
+		return false, err
+	}
+	if count < max {
+		return true, nil
+	}
+
+	// only checked after locking, else a concurrent create could add
+	// the user in between
+	var exists bool
+	err = tx.QueryRow(ctx, `
+		select exists (
+			select 1
+			from authen_totps
+			where project_id = $1 and user_id = $2 and type = $3
+		)`, projectId, userId, tpe).Scan(&exists)
+
+	if err != nil {
+		return false, fmt.Errorf("PG.canAddTOTPStrict (exists) - %w", err)
+	}
+	return exists, nil
+}
+
+// Locks the project's row in authen_project_counts for resource (until
+// the transaction ends) and returns its count. Rows are kept up to date
+// by every insert and delete, but only while we're strict, so recount
+// must have been called first (outside of the transaction). A project
+// without one has nothing to count yet and gets one at 0. On conflict,
+// "do update" (unlike "do nothing") locks the existing row.
+func (db DB) lockCount(ctx context.Context, tx pgx.Tx, resource string, projectId string) (int, error) {
+	count, err := scalar[int](ctx, tx, `
+		insert into authen_project_counts (project_id, resource, count)
+		values ($1, $2, 0)
+		on conflict (project_id, resource) do update set count = authen_project_counts.count
+		returning count
+	`, projectId, resource)
+
+	if err != nil {
+		return 0, fmt.Errorf("PG.lockCount - %w", err)
+	}
+	return count, nil
+}
+
+// Counts aren't maintained when we aren't strict, so whatever count the
+// project has might predate inserts and deletes made while we weren't.
+// The count is recounted from resource's table, once per project (and
+// resource) since we started, in its own transaction (so it sticks even
+// if the caller's is rolled back). The row is locked before counting: any
+// concurrent insert or delete has either committed (and is counted) or is
+// waiting on the lock to adjust the new count.
+func (db DB) recount(ctx context.Context, resource string, projectId string) error {
+	key := resource + ":" + projectId
+	if _, ok := db.recounted.Load(key); ok {
+		return nil
+	}
+
+	err := db.beginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			insert into authen_project_counts (project_id, resource, count)
+			values ($1, $2, 0)
+			on conflict (project_id, resource) do update set count = authen_project_counts.count
+		`, projectId, resource)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+			update authen_project_counts
+			set count = (select count(*) from `+countTables[resource]+` where project_id = $1)
+			where project_id = $1 and resource = $2
+		`, projectId, resource)
+		return err
+	})
+
+	if err != nil {
+		return fmt.Errorf("PG.recount - %w", err)
+	}
+	db.recounted.Store(key, struct{}{})
+	return nil
+}
+
+// pgx.BeginFunc, but on cockroach, where concurrent transactions touching
+// the same rows can fail with a serialization error (40001) which the
+// client is expected to retry, fn is run again in a new transaction (a
+// few times). fn must be safe to re-run.
+func (db DB) beginFunc(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := pgx.BeginFunc(ctx, db, fn)
+		if err == nil || db.tpe != "cockroach" || attempt == txRetries || ctx.Err() != nil {
+			return err
+		}
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != "40001" {
+			return err
+		}
+	}
+}
+
+// Either the pool or a transaction
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Runs sql, an insert into resource's table which can skip rows (on
+// conflict do nothing) but has no returning clause, and, when strict,
+// adds the number of inserted rows to the project's count (creating it if
+// needed), in the same statement. All inserted rows must belong to
+// projectId.
+func (db DB) countedInsert(ctx context.Context, q querier, resource string, projectId string, sql string, args ...any) (int, error) {
+	counted := ""
+	if db.strict {
+		args = append(args, projectId)
+		counted = db.countedCTE(`
+			insert into authen_project_counts (project_id, resource, count)
+			select $` + strconv.Itoa(len(args)) + `, '` + resource + `', i.n
+			from (select count(*) as n from inserted) i
+			where i.n > 0
+			on conflict (project_id, resource) do update set count = authen_project_counts.count + excluded.count
+		`)
+	}
+
+	var inserted int
+	err := q.QueryRow(ctx, `
+		with inserted as (`+sql+` returning 1)`+counted+`
+		select count(*) from inserted
+	`, args...).Scan(&inserted)
+	return inserted, err
+}
+
+// Runs sql, a delete from resource's table without a returning clause,
+// and, when strict, takes the deleted rows off of their projects' counts
+// (if they have one), in the same statement. Returns the number of
+// deleted rows.
+func (db DB) countedDelete(ctx context.Context, q querier, resource string, sql string, args ...any) (int, error) {
+	var deleted int
+	err := q.QueryRow(ctx, `
+		with deleted as (`+sql+` returning project_id)`+db.countedCTE(`
+			update authen_project_counts c
+			set count = c.count - d.n
+			from (select project_id, count(*) as n from deleted group by project_id) d
+			where c.project_id = d.project_id and c.resource = '`+resource+`'
+		`)+`
+		select count(*) from deleted
+	`, args...).Scan(&deleted)
+	return deleted, err
+}
+
+// The "counted" CTE which keeps authen_project_counts up to date, to
+// follow a with clause. Nothing when we aren't strict.
+func (db DB) countedCTE(sql string) string {
+	if !db.strict {
+		return ""
+	}
+	return ", counted as (" + sql + ")"
+}
+
+// " limit N", or nothing when there's no limit (n == 0)
+func limitClause(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return " limit " + strconv.Itoa(n)
+}
+
+// pg.Scalar, but bound to the caller's context
+func scalar[T any](ctx context.Context, q querier, sql string, args ...any) (T, error) {
+	var value T
+	err := q.QueryRow(ctx, sql, args...).Scan(&value)
+	return value, err
+}
+
 func scanProject(row pg.Row) (*data.Project, error) {
 	var id, totpIssuer string
 	var totpMax, totpSetupTTL, totpSecretLength int
 	var ticketMax, ticketMaxPayloadLength int
 	var loginLogMax, loginLogMaxPayloadLength int
+	var loginLogRetainCount, loginLogRetainDays int
+	var loginLogRetainOnInsert bool
+	var lockoutRules, successStatuses *string
 
 	err := row.Scan(&id,
 		&totpIssuer, &totpMax, &totpSetupTTL, &totpSecretLength,
 		&ticketMax, &ticketMaxPayloadLength,
-		&loginLogMax, &loginLogMaxPayloadLength)
+		&loginLogMax, &loginLogMaxPayloadLength,
+		&loginLogRetainCount, &loginLogRetainDays, &loginLogRetainOnInsert,
+		&lockoutRules, &successStatuses)
 
 	if err != nil {
 		return nil, fmt.Errorf("PG.scanProject - %w", err)
 	}
 
+	var lockout []data.LockoutRule
+	if lockoutRules != nil {
+		if err := json.Unmarshal([]byte(*lockoutRules), &lockout); err != nil {
+			return nil, fmt.Errorf("PG.scanProject (lockout_rules) - %w", err)
+		}
+	}
+
+	var success []int
+	if successStatuses != nil {
+		if err := json.Unmarshal([]byte(*successStatuses), &success); err != nil {
+			return nil, fmt.Errorf("PG.scanProject (login_log_success_statuses) - %w", err)
+		}
+	}
+
 	return &data.Project{
 		Id:                       id,
 		TOTPMax:                  totpMax,
@@ -519,5 +1745,77 @@ func scanProject(row pg.Row) (*data.Project, error) {
 		TicketMaxPayloadLength:   ticketMaxPayloadLength,
 		LoginLogMax:              loginLogMax,
 		LoginLogMaxPayloadLength: loginLogMaxPayloadLength,
+		LoginLogRetainCount:      loginLogRetainCount,
+		LoginLogRetainDays:       loginLogRetainDays,
+		LoginLogRetainOnInsert:   loginLogRetainOnInsert,
+		LockoutRules:             lockout,
+		LoginLogSuccessStatuses:  success,
 	}, nil
 }
+
+// A single multi-row insert for the whole batch.
+func ticketCreateSQL(projectId string, tickets []data.TicketCreateTicket) (string, []any) {
+	const columns = 9
+	args := make([]any, 0, len(tickets)*columns)
+
+	var sb strings.Builder
+	sb.WriteString(`
+		insert into authen_tickets (project_id, ticket, expires, uses, payload, scope, attempts, payload_encrypted, sliding_ttl)
+		values `)
+
+	for i, t := range tickets {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteByte('(')
+		for j := 1; j <= columns; j++ {
+			if j > 1 {
+				sb.WriteString(", ")
+			}
+			sb.WriteByte('$')
+			sb.WriteString(strconv.Itoa(i*columns + j))
+		}
+		sb.WriteByte(')')
+		args = append(args, projectId, t.Ticket, t.Expires, t.Uses, t.Payload, t.Scope, t.Attempts, t.PayloadEncrypted, t.SlidingTTL)
+	}
+	sb.WriteString(" on conflict do nothing")
+	return sb.String(), args
+}
+
+func loginLogWhere(opts data.LoginLogGet) (string, []any) {
+	args := []any{opts.ProjectId, opts.UserId}
+	where := "project_id = $1 and user_id = $2"
+
+	if statuses := opts.Statuses; len(statuses) > 0 {
+		args = append(args, statuses)
+		where += " and status = any($" + strconv.Itoa(len(args)) + ")"
+	}
+	if since := opts.Since; since != nil {
+		args = append(args, *since)
+		where += " and created >= $" + strconv.Itoa(len(args))
+	}
+	if until := opts.Until; until != nil {
+		args = append(args, *until)
+		where += " and created < $" + strconv.Itoa(len(args))
+	}
+	for _, f := range [...]struct {
+		column string
+		value  string
+	}{
+		{"ip", opts.Ip},
+		{"user_agent", opts.UserAgent},
+		{"method", opts.Method},
+		{"country", opts.Country},
+	} {
+		if f.value != "" {
+			args = append(args, f.value)
+			where += " and " + f.column + " = $" + strconv.Itoa(len(args))
+		}
+	}
+	if cursor := opts.Cursor; cursor != nil {
+		args = append(args, cursor.Created, cursor.Id)
+		created, id := strconv.Itoa(len(args)-1), strconv.Itoa(len(args))
+		where += " and (created < $" + created + " or (created = $" + created + " and id < $" + id + "))"
+	}
+	return where, args
+}
@@ -1,12 +1,17 @@
 package pg
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/authen/storage/pg/migrations"
 	"src.goblgobl.com/tests"
 	"src.goblgobl.com/tests/assert"
 	"src.goblgobl.com/utils/log"
@@ -55,10 +60,6 @@ func init() {
 	}
 }
 
-func Test_Ping(t *testing.T) {
-	assert.Nil(t, db.Ping())
-}
-
 func Test_Clean_Totps(t *testing.T) {
 	db.MustExec("truncate table authen_totps")
 	db.MustExec(`
@@ -69,7 +70,9 @@ func Test_Clean_Totps(t *testing.T) {
 		(null, $1, 'uid4', '', false, '')
 	`, uuid.String())
 
-	assert.Nil(t, db.Clean())
+	result, err := db.Clean(context.Background(), data.Clean{})
+	assert.Nil(t, err)
+	assert.Equal(t, result.TOTPs, 2)
 	rows, _ := db.RowsToMap("select user_id from authen_totps order by user_id")
 	assert.Equal(t, len(rows), 2)
 	assert.Equal(t, rows[0].String("user_id"), "uid3")
@@ -79,723 +82,531 @@ func Test_Clean_Totps(t *testing.T) {
 func Test_Clean_Tickets(t *testing.T) {
 	db.MustExec("truncate table authen_tickets")
 	db.MustExec(`
-		insert into authen_tickets (expires, uses, project_id, ticket) values
-		(now() - interval '1 second', null, $1, 't1'),
-		(now() - interval '999 second', null,  $1, 't2'),
-		(null, 0, $1, 't3'),
-		(now() + interval '5 second', 1, $1, 't4'),
-		(null, null, $1, 't5')
+		insert into authen_tickets (expires, uses, project_id, ticket, attempts) values
+		(now() - interval '1 second', null, $1, 't1', null),
+		(now() - interval '999 second', null,  $1, 't2', null),
+		(null, 0, $1, 't3', null),
+		(now() + interval '5 second', 1, $1, 't4', 1),
+		(null, null, $1, 't5', null),
+		(null, null, $1, 't6', 0)
 	`, uuid.String())
 
-	assert.Nil(t, db.Clean())
+	result, err := db.Clean(context.Background(), data.Clean{})
+	assert.Nil(t, err)
+	assert.Equal(t, result.Tickets, 4)
 	rows, _ := db.RowsToMap("select ticket from authen_tickets order by ticket")
 	assert.Equal(t, len(rows), 2)
 	assert.Bytes(t, rows[0].Bytes("ticket"), []byte("t4"))
 	assert.Bytes(t, rows[1].Bytes("ticket"), []byte("t5"))
 }
 
-func Test_GetProject_Unknown(t *testing.T) {
-	p, err := db.GetProject("76FBFC33-7CB1-447D-8786-C9D370737AA6")
-	assert.Nil(t, err)
-	assert.Nil(t, p)
-}
-
-func Test_GetProject_Success(t *testing.T) {
-	id := uuid.String()
-	db.MustExec("truncate table authen_projects")
+func Test_Clean_TicketDenylist(t *testing.T) {
+	db.MustExec("truncate table authen_ticket_denylist")
 	db.MustExec(`
-		insert into authen_projects (id, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length)
-		values ($1, 'goblgobl.com', 84, 124, 38, 49, 1022, 59, 1029)
-	`, id)
+		insert into authen_ticket_denylist (expires, project_id, ticket) values
+		(now() - interval '1 second', $1, 't1'),
+		(now() + interval '5 second', $1, 't2')
+	`, uuid.String())
 
-	p, err := db.GetProject(id)
+	result, err := db.Clean(context.Background(), data.Clean{})
 	assert.Nil(t, err)
-	assert.Equal(t, p.Id, id)
-	assert.Equal(t, p.TOTPMax, 84)
-	assert.Equal(t, p.TOTPSetupTTL, 124)
-	assert.Equal(t, p.TOTPSecretLength, 38)
-	assert.Equal(t, p.TOTPIssuer, "goblgobl.com")
-	assert.Equal(t, p.TicketMax, 49)
-	assert.Equal(t, p.TicketMaxPayloadLength, 1022)
-	assert.Equal(t, p.LoginLogMax, 59)
-	assert.Equal(t, p.LoginLogMaxPayloadLength, 1029)
+	assert.Equal(t, result.TicketDenylist, 1)
+	rows, _ := db.RowsToMap("select ticket from authen_ticket_denylist order by ticket")
+	assert.Equal(t, len(rows), 1)
+	assert.Bytes(t, rows[0].Bytes("ticket"), []byte("t2"))
 }
 
-func Test_GetUpdatedProjects_None(t *testing.T) {
-	id := uuid.String()
-	db.MustExec("truncate table authen_projects")
+func Test_Clean_LoginLogs(t *testing.T) {
+	// other packages insert login logs without a project in authen_projects,
+	// so the default retention isn't tested here (it would delete their rows)
+	p1, p2, p3 := uuid.String(), uuid.String(), uuid.String()
 	db.MustExec(`
-		insert into authen_projects (id, updated, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length)
-		values ($1, now() - interval '1 second', '', 0, 0, 0, 0, 0, 0, 0)
-	`, id)
-	updated, err := db.GetUpdatedProjects(time.Now())
+		insert into authen_projects (id, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length, login_log_retain_count, login_log_retain_days)
+		values
+			($1, '', 0, 0, 0, 0, 0, 0, 0, 2, 0),
+			($2, '', 0, 0, 0, 0, 0, 0, 0, 0, 1),
+			($3, '', 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	`, p1, p2, p3)
+
+	db.MustExec(`
+		insert into authen_login_logs (id, project_id, user_id, status, created) values
+		(gen_random_uuid(), $1, 'u1', 1, now()),
+		(gen_random_uuid(), $1, 'u1', 2, now() - interval '1 minute'),
+		(gen_random_uuid(), $1, 'u1', 3, now() - interval '2 minute'),
+		(gen_random_uuid(), $1, 'u2', 4, now() - interval '2 minute'),
+		(gen_random_uuid(), $2, 'u1', 5, now() - interval '23 hours'),
+		(gen_random_uuid(), $2, 'u1', 6, now() - interval '25 hours'),
+		(gen_random_uuid(), $3, 'u1', 7, now() - interval '1000 days')
+	`, p1, p2, p3)
+
+	result, err := db.Clean(context.Background(), data.Clean{})
 	assert.Nil(t, err)
-	assert.Equal(t, len(updated), 0)
+	assert.True(t, result.LoginLogs >= 2)
+	rows, _ := db.RowsToMap("select status from authen_login_logs where project_id in ($1, $2, $3) order by status", p1, p2, p3)
+	assert.Equal(t, len(rows), 5)
+	for i, status := range []int{1, 2, 4, 5, 7} {
+		assert.Equal(t, rows[i].Int("status"), status)
+	}
 }
 
-func Test_GetUpdatedProjects_Success(t *testing.T) {
-	id1, id2, id3, id4 := uuid.String(), uuid.String(), uuid.String(), uuid.String()
-	db.MustExec("truncate table authen_projects")
+func Test_Clean_UserLocks(t *testing.T) {
+	projectId := uuid.String()
 	db.MustExec(`
-		insert into authen_projects (id, updated, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length) values
-		($1, now() - interval '500 second', '', 0, 0, 0, 0, 0, 0, 0),
-		($2, now() - interval '200 second', '', 0, 0, 0, 0, 0, 0, 0),
-		($3, now() - interval '100 second', '', 0, 0, 0, 0, 0, 0, 0),
-		($4, now() - interval '10 second', '', 0, 0, 0, 0, 0, 0, 0)
-	`, id1, id2, id3, id4)
-	updated, err := db.GetUpdatedProjects(time.Now().Add(time.Second * -105))
+		insert into authen_user_locks (project_id, user_id, locked_until, reset) values
+		($1, 'u1', now() + interval '1 minute', now() - interval '2 days'),
+		($1, 'u2', now() - interval '1 minute', now() - interval '2 days'),
+		($1, 'u3', null, now() - interval '2 days'),
+		($1, 'u4', null, now() - interval '1 hour')
+	`, projectId)
+
+	result, err := db.Clean(context.Background(), data.Clean{})
 	assert.Nil(t, err)
-	assert.Equal(t, len(updated), 2)
-
-	// order isn't deterministic
-	actual1, actual2 := updated[0].Id, updated[1].Id
-	assert.True(t, actual1 != actual2)
-	assert.True(t, actual1 == id3 || actual1 == id4)
-	assert.True(t, actual2 == id3 || actual2 == id4)
+	assert.True(t, result.UserLocks >= 2)
+	rows, _ := db.RowsToMap("select user_id from authen_user_locks where project_id = $1 order by user_id", projectId)
+	assert.Equal(t, len(rows), 2)
+	assert.Equal(t, rows[0].String("user_id"), "u1")
+	assert.Equal(t, rows[1].String("user_id"), "u4")
 }
 
-func Test_TOTPCreate(t *testing.T) {
-	now := time.Now()
-	projectId1, projectId2 := uuid.String(), uuid.String()
-
+func Test_TicketUse_SlidingTTL(t *testing.T) {
+	projectId := uuid.String()
 	db.MustExec(`
-		insert into authen_totps (project_id, user_id, type, pending, secret) values
-		($1, 'u1', 't1', false, 'sec1'),
-		($2, 'u2', 't2', true, 'sec2')
-	`, projectId1, projectId1)
-
-	// Adds more when less than max
-	for i, expires := range []*time.Time{nil, &now} {
-		secret := []byte{byte(i), byte(i)}
-		tpe := fmt.Sprintf("t-%d", i)
-		res, err := db.TOTPCreate(data.TOTPCreate{
-			Max:       4,
-			UserId:    "u1",
-			Type:      tpe,
-			Secret:    secret,
-			Expires:   expires,
-			ProjectId: projectId1,
-		})
-		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TOTP_CREATE_OK)
-
-		row, _ := db.RowToMap("select * from authen_totps where project_id = $1 and user_id = $2 and type = $3 and pending = $4", projectId1, "u1", tpe, expires != nil)
-		assert.Nowish(t, row.Time("created"))
-		assert.Equal(t, row.Bool("pending"), expires != nil)
-		if expires == nil {
-			assert.Nil(t, row["expires"])
-		} else {
-			assert.Timeish(t, row.Time("expires"), *expires)
-		}
-
-		assert.Bytes(t, row.Bytes("secret"), secret)
-	}
+		insert into authen_tickets (project_id, ticket, uses, expires, sliding_ttl) values
+		($1, $2, 5, now() + interval '10 seconds', 3600),
+		($1, $3, 5, now() + interval '10 seconds', null)
+	`, projectId, []byte("t1"), []byte("t2"))
 
-	// can't add any more, pending or not:
-	for _, expires := range []*time.Time{nil, &now} {
-		res, err := db.TOTPCreate(data.TOTPCreate{
-			Max:       4,
-			UserId:    "u4",
-			Type:      "",
-			Expires:   expires,
-			ProjectId: projectId1,
-			Secret:    []byte{13, 14},
-		})
+	for _, ticket := range []string{"t1", "t2"} {
+		res, err := db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId, Ticket: []byte(ticket)})
 		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TOTP_CREATE_MAX)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+		assert.Equal(t, *res.Uses, 4)
 	}
 
-	// 0 == no limit
-	{
-		res, err := db.TOTPCreate(data.TOTPCreate{
-			Max:       0,
-			UserId:    "u4",
-			Type:      "t4",
-			ProjectId: projectId1,
-			Secret:    []byte{23, 24},
-		})
-		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TOTP_CREATE_OK)
-		row, _ := db.RowToMap("select * from authen_totps where project_id = $1 and user_id = $2 and type = $3", projectId1, "u4", "t4")
-		assert.Nowish(t, row.Time("created"))
-		assert.Nil(t, row["expires"])
-		assert.Bytes(t, row.Bytes("secret"), []byte{23, 24})
-	}
+	row, _ := db.RowToMap("select expires from authen_tickets where project_id = $1 and ticket = $2", projectId, []byte("t1"))
+	assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Hour))
 
-	// limits are per project (there's no other totp for project2)
-	{
-		res, err := db.TOTPCreate(data.TOTPCreate{
-			Max:       1,
-			UserId:    "u4",
-			Type:      "",
-			ProjectId: projectId2,
-			Secret:    []byte{23, 24},
-		})
-		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TOTP_CREATE_OK)
-		row, _ := db.RowToMap("select * from authen_totps where project_id = $1 and user_id = $2", projectId2, "u4")
-		assert.Nowish(t, row.Time("created"))
-		assert.Bytes(t, row.Bytes("secret"), []byte{23, 24})
-	}
+	row, _ = db.RowToMap("select expires from authen_tickets where project_id = $1 and ticket = $2", projectId, []byte("t2"))
+	assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Second*10))
+}
 
-	// existing users+type don't increment count
-	for _, expires := range []*time.Time{nil, &now} {
-		res, err := db.TOTPCreate(data.TOTPCreate{
-			Max:       1,
-			UserId:    "u1",
-			Type:      "t1",
+func Test_TicketExtend(t *testing.T) {
+	projectId := uuid.String()
+	db.MustExec(`
+		insert into authen_tickets (project_id, ticket, uses, expires) values
+		($1, $2, 2, now() + interval '10 seconds'),
+		($1, $3, null, null),
+		($1, $4, 0, null),
+		($1, $5, 2, now() - interval '1 second')
+	`, projectId, []byte("t1"), []byte("t2"), []byte("t3"), []byte("t4"))
+
+	assertExtend := func(ticket string, expires *time.Time, uses *int) data.TicketUseResult {
+		t.Helper()
+		res, err := db.TicketExtend(context.Background(), data.TicketExtend{
+			Uses:      uses,
 			Expires:   expires,
-			ProjectId: projectId1,
-			Secret:    []byte{33, 34},
+			Ticket:    []byte(ticket),
+			ProjectId: projectId,
 		})
-
 		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TOTP_CREATE_OK)
-		row, _ := db.RowToMap("select * from authen_totps where project_id = $1 and user_id = $2 and type = $3 and pending = $4", projectId1, "u1", "t1", expires != nil)
-		assert.Nowish(t, row.Time("created"))
-		assert.Bytes(t, row.Bytes("secret"), []byte{33, 34})
-	}
+		return res
+	}
+
+	uses := 3
+	expires := time.Now().Add(time.Hour)
+
+	// dead tickets can't be extended
+	assert.Equal(t, assertExtend("t3", nil, &uses).Status, data.TICKET_USE_NOT_FOUND)
+	assert.Equal(t, assertExtend("t4", &expires, nil).Status, data.TICKET_USE_NOT_FOUND)
+	assert.Equal(t, assertExtend("t9", &expires, nil).Status, data.TICKET_USE_NOT_FOUND)
+
+	// only uses
+	res := assertExtend("t1", nil, &uses)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+	assert.Equal(t, *res.Uses, 5)
+	row, _ := db.RowToMap("select expires from authen_tickets where project_id = $1 and ticket = $2", projectId, []byte("t1"))
+	assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Second*10))
+
+	// only expires
+	res = assertExtend("t1", &expires, nil)
+	assert.Equal(t, *res.Uses, 5)
+	row, _ = db.RowToMap("select expires from authen_tickets where project_id = $1 and ticket = $2", projectId, []byte("t1"))
+	assert.Timeish(t, row.Time("expires"), expires)
+
+	// unlimited uses stay unlimited
+	res = assertExtend("t2", &expires, &uses)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+	assert.Nil(t, res.Uses)
+	row, _ = db.RowToMap("select expires from authen_tickets where project_id = $1 and ticket = $2", projectId, []byte("t2"))
+	assert.Timeish(t, row.Time("expires"), expires)
+}
 
-	// existing users DO increment count for a different type
-	for _, expires := range []*time.Time{nil, &now} {
-		res, err := db.TOTPCreate(data.TOTPCreate{
-			Max:       1,
-			UserId:    "u1",
-			Type:      "t-new",
-			Expires:   expires,
-			ProjectId: projectId1,
-			Secret:    []byte{33, 34},
-		})
-		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TOTP_CREATE_MAX)
+func Test_TicketDeny(t *testing.T) {
+	projectId := uuid.String()
+	opts := data.TicketDeny{
+		ProjectId: projectId,
+		Ticket:    []byte("t1"),
+		Expires:   time.Now().Add(time.Minute),
 	}
-}
 
-func Test_TOTPCreate_NonPending_DeletesPending(t *testing.T) {
-	projectId1 := uuid.String()
+	res, err := db.TicketDeny(context.Background(), opts)
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
 
-	db.MustExec(`
-			insert into authen_totps (project_id, user_id, type, pending, secret) values
-			($1, 'u1', 't1', true, 'sec1')
-		`, projectId1)
-
-	res, err := db.TOTPCreate(data.TOTPCreate{
-		Type:      "t1",
-		UserId:    "u1",
-		ProjectId: projectId1,
-		Secret:    []byte{99, 98},
-	})
+	res, err = db.TicketDeny(context.Background(), opts)
 	assert.Nil(t, err)
-	assert.Equal(t, res.Status, data.TOTP_CREATE_OK)
+	assert.Equal(t, res.Status, data.TICKET_USE_NOT_FOUND)
 
-	rows, _ := db.RowsToMap("select * from authen_totps where project_id = $1", projectId1)
-	assert.Equal(t, len(rows), 1)
-	row := rows[0]
-	assert.Nil(t, row["expires"])
-	assert.False(t, row.Bool("pending"))
+	// different project
+	opts.ProjectId = uuid.String()
+	res, err = db.TicketDeny(context.Background(), opts)
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+
+	row, _ := db.RowToMap("select * from authen_ticket_denylist where project_id = $1 and ticket = $2", projectId, []byte("t1"))
+	assert.Timeish(t, row.Time("expires"), opts.Expires)
 }
 
-func Test_TOTPGet(t *testing.T) {
-	projectId1, projectId2 := uuid.String(), uuid.String()
+func Test_LoginLogExport(t *testing.T) {
+	defer func(n int) { loginLogExportBatch = n }(loginLogExportBatch)
+	loginLogExportBatch = 2
+
+	projectId := uuid.String()
 	db.MustExec(`
-			insert into authen_totps (project_id, user_id, type, pending, expires, secret) values
-			($1, 'u1', 't1', true, now() - interval '1 second', 'sec1'),
-			($1, 'u2', 't2', true, now() + interval '5 second', 'sec2'),
-			($1, 'u2', 't4', true, now() + interval '5 second', 'sec3'),
-			($1, 'u2', 't2', false, null, 'sec4'),
-			($2, 'u2', 't3', false, null, 'sec5')
-		`, projectId1, projectId2)
-
-	assertNotFound := func(opts data.TOTPGet) {
-		result, err := db.TOTPGet(opts)
+		insert into authen_login_logs (id, project_id, user_id, status, created, ip) values
+		(gen_random_uuid(), $1, 'u1', 1, now() - interval '5 minutes', '1.1.1.1'),
+		(gen_random_uuid(), $1, 'u2', 2, now() - interval '4 minutes', null),
+		(gen_random_uuid(), $1, 'u1', 3, now() - interval '3 minutes', null),
+		(gen_random_uuid(), $1, 'u1', 4, now() - interval '2 minutes', null),
+		(gen_random_uuid(), $1, 'u2', 5, now() - interval '1 minutes', null),
+		(gen_random_uuid(), $2, 'u1', 6, now(), null)
+	`, projectId, uuid.String())
+
+	export := func(opts data.LoginLogExport) []data.LoginLogRecord {
+		t.Helper()
+		var records []data.LoginLogRecord
+		opts.ProjectId = projectId
+		err := db.LoginLogExport(context.Background(), opts, func(record data.LoginLogRecord) error {
+			records = append(records, record)
+			return nil
+		})
 		assert.Nil(t, err)
-		assert.Equal(t, result.Status, data.TOTP_GET_NOT_FOUND)
+		return records
 	}
 
-	assertSecret := func(opts data.TOTPGet, secret string) {
-		result, err := db.TOTPGet(opts)
-		assert.Nil(t, err)
-		assert.Equal(t, result.Status, data.TOTP_GET_OK)
-		assert.Bytes(t, result.Secret, []byte(secret))
+	assertStatuses := func(records []data.LoginLogRecord, statuses ...int) {
+		t.Helper()
+		assert.Equal(t, len(records), len(statuses))
+		for i, status := range statuses {
+			assert.Equal(t, records[i].Status, status)
+		}
 	}
 
-	// expired
-	assertNotFound(data.TOTPGet{
-		Type:      "t1",
-		UserId:    "u1",
-		ProjectId: projectId1,
-		Pending:   true,
-	})
+	records := export(data.LoginLogExport{})
+	assertStatuses(records, 1, 2, 3, 4, 5)
+	assert.Equal(t, records[0].UserId, "u1")
+	assert.Equal(t, *records[0].Ip, "1.1.1.1")
+	assert.Equal(t, records[1].UserId, "u2")
 
-	// user doesn't have this type
-	assertNotFound(data.TOTPGet{
-		Type:      "t9",
-		UserId:    "u1",
-		ProjectId: projectId1,
-		Pending:   false,
-	})
+	// exact multiple of the batch size
+	assertStatuses(export(data.LoginLogExport{UserId: "u2"}), 2, 5)
 
-	// user doesn't have this type in non-setup
-	assertNotFound(data.TOTPGet{
-		Type:      "t4",
-		UserId:    "u1",
-		ProjectId: projectId1,
-		Pending:   false,
-	})
+	since := time.Now().Add(-210 * time.Second)
+	until := time.Now().Add(-90 * time.Second)
+	assertStatuses(export(data.LoginLogExport{Since: &since, Until: &until}), 3, 4)
 
-	// wrong project
-	assertNotFound(data.TOTPGet{
-		Type:      "t3",
-		UserId:    "u2",
-		ProjectId: projectId1,
-		Pending:   false,
+	// stops at the first error
+	n := 0
+	err := db.LoginLogExport(context.Background(), data.LoginLogExport{ProjectId: projectId}, func(record data.LoginLogRecord) error {
+		n += 1
+		if n == 3 {
+			return errors.New("stop")
+		}
+		return nil
 	})
-
-	// not expired
-	assertSecret(data.TOTPGet{
-		Type:      "t2",
-		UserId:    "u2",
-		ProjectId: projectId1,
-		Pending:   true,
-	}, "sec2")
-
-	// non-setup
-	assertSecret(data.TOTPGet{
-		Type:      "t2",
-		UserId:    "u2",
-		ProjectId: projectId1,
-		Pending:   false,
-	}, "sec4")
+	assert.Equal(t, err.Error(), "stop")
+	assert.Equal(t, n, 3)
 }
 
-func Test_TOTPDelete(t *testing.T) {
-	projectId1, projectId2 := uuid.String(), uuid.String()
-	projectIds := []string{projectId1, projectId2}
-	assertCount := func(expected int, args ...string) {
-		actual := 0
-		var err error
-
-		switch len(args) {
-		case 0:
-			// count of all, to make sure we didn't over-delete
-			actual, err = pg.Scalar[int](db.DB, "select count(*) from authen_totps where project_id = any($1)", projectIds)
-		case 2:
-			// count of all fo user
-			actual, err = pg.Scalar[int](db.DB, "select count(*) from authen_totps where project_id = $1 and user_id = $2", args[0], args[1])
-		case 3:
-			// count for user+type
-			actual, err = pg.Scalar[int](db.DB, "select count(*) from authen_totps where project_id = $1 and user_id = $2 and type = $3", args[0], args[1], args[2])
-		}
-		if err != nil {
-			panic(err)
-		}
-		assert.Equal(t, actual, expected)
-	}
-
+func Test_UserUnlock_NotLocked(t *testing.T) {
+	projectId := uuid.String()
 	db.MustExec(`
-			insert into authen_totps (project_id, user_id, type, pending, expires, secret) values
-			($1, 'u1', 't1', true, now(), 'sec1'),
-			($1, 'u2', 't2', true, now(), 'sec2'),
-			($1, 'u2', 't4', false, now(), 'sec3'),
-			($1, 'u2', 't2', false, null, 'sec4'),
-			($2, 'u2', 't3', true, null, 'sec5'),
-			($1, 'u3', 't1', true, null, 'sec5')
-		`, projectId1, projectId2)
-
-	// specific type
-	deleted, err := db.TOTPDelete(data.TOTPGet{
-		Type:      "t1",
-		UserId:    "u1",
-		ProjectId: projectId1,
-	})
+		insert into authen_user_locks (project_id, user_id, locked_until, reset)
+		values ($1, 'u1', now() - interval '1 second', now() - interval '1 hour')
+	`, projectId)
+
+	unlocked, err := db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u1"})
 	assert.Nil(t, err)
-	assert.Equal(t, deleted, 1)
-	assertCount(5)
-	assertCount(0, projectId1, "u1", "t1")
-
-	// all types for the user
-	deleted, err = db.TOTPDelete(data.TOTPGet{
-		UserId:    "u2",
-		AllTypes:  true,
-		ProjectId: projectId1,
-	})
+	assert.False(t, unlocked)
+
+	// unlocking a user without a lock resets their failures too
+	unlocked, err = db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u2"})
 	assert.Nil(t, err)
-	assert.Equal(t, deleted, 3)
+	assert.False(t, unlocked)
 
-	assertCount(2)
-	assertCount(0, projectId1, "u2")
+	row, _ := db.RowToMap("select locked_until, reset from authen_user_locks where project_id = $1 and user_id = 'u2'", projectId)
+	assert.Nil(t, row["locked_until"])
+	assert.Nowish(t, row.Time("reset"))
 }
 
-func Test_TicketCreate(t *testing.T) {
-	projectId1 := uuid.String()
+func Test_StrictLimits_Tickets(t *testing.T) {
+	ctx := context.Background()
+	projectId := uuid.String()
+	strict := db
+	strict.strict = true
 
-	assertTicket := func(ticket []byte, payload []byte, expires *time.Time, uses *int) {
-		t.Helper()
-		row, _ := db.RowToMap("select * from authen_tickets where project_id = $1 and ticket = $2", projectId1, ticket)
-		assert.Nowish(t, row.Time("created"))
-		assert.Bytes(t, row.Bytes("payload"), payload)
-		if expires == nil {
-			assert.Nil(t, row["expires"])
-		} else {
-			assert.Timeish(t, row.Time("expires"), *expires)
+	create := func(db DB, tickets ...string) data.TicketCreateStatus {
+		opts := data.TicketCreate{ProjectId: projectId, Max: 3}
+		for _, ticket := range tickets {
+			opts.Tickets = append(opts.Tickets, data.TicketCreateTicket{Ticket: []byte(ticket)})
 		}
-		if uses == nil {
-			assert.Nil(t, row["uses"])
-		} else {
-			assert.Equal(t, row.Int("uses"), *uses)
-		}
-	}
-
-	// without expiry or usage or payload
-	{
-		res, err := db.TicketCreate(data.TicketCreate{
-			Max:       2,
-			ProjectId: projectId1,
-			Ticket:    []byte{1, 2, 3},
-		})
+		res, err := db.TicketCreate(ctx, opts)
 		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TICKET_CREATE_OK)
-		assertTicket([]byte{1, 2, 3}, nil, nil, nil)
+		return res.Status
 	}
 
-	// with expiry and usage
-	{
-		uses := 9
-		expires := time.Now().Add(time.Hour)
-
-		res, err := db.TicketCreate(data.TicketCreate{
-			Max:       0,
-			ProjectId: projectId1,
-			Ticket:    []byte{4, 5, 6},
-			Payload:   []byte{0, 0, 1},
-			Expires:   &expires,
-			Uses:      &uses,
-		})
-		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TICKET_CREATE_OK)
-		assertTicket([]byte{4, 5, 6}, []byte{0, 0, 1}, &expires, &uses)
-	}
+	// counts are only kept when strict, and recounted the first time
+	// they're needed
+	assert.Equal(t, create(db, "t1"), data.TICKET_CREATE_OK)
+	assert.Equal(t, create(strict, "t2", "t3"), data.TICKET_CREATE_OK)
+	assert.Equal(t, create(strict, "t4"), data.TICKET_CREATE_MAX)
 
-	// max reached (previous 2 tests inserted a row each)
-	{
-		res, err := db.TicketCreate(data.TicketCreate{
-			Max:       2,
-			ProjectId: projectId1,
-			Ticket:    []byte{9, 9, 9},
-		})
-		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TICKET_CREATE_MAX)
+	res, err := strict.TicketDelete(ctx, data.TicketUse{ProjectId: projectId, Ticket: []byte("t1")})
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+	assert.Equal(t, projectCount(projectId, COUNT_TICKET), 2)
 
-		// no new insert
-		count, _ := pg.Scalar[int](db.DB, "select count(*) from authen_tickets where project_id = $1", projectId1)
-		assert.Equal(t, count, 2)
-	}
+	assert.Equal(t, create(strict, "t4"), data.TICKET_CREATE_OK)
+	assert.Equal(t, create(strict, "t5"), data.TICKET_CREATE_MAX)
+	assert.Equal(t, projectCount(projectId, COUNT_TICKET), 3)
+
+	// a delete when not strict leaves the count stale...
+	res, err = db.TicketDelete(ctx, data.TicketUse{ProjectId: projectId, Ticket: []byte("t2")})
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+	assert.Equal(t, projectCount(projectId, COUNT_TICKET), 3)
+
+	// ...until strict mode is (re)started
+	restarted := strict
+	restarted.recounted = new(sync.Map)
+	assert.Equal(t, create(restarted, "t5"), data.TICKET_CREATE_OK)
+	assert.Equal(t, create(restarted, "t6"), data.TICKET_CREATE_MAX)
+	assert.Equal(t, projectCount(projectId, COUNT_TICKET), 3)
 }
 
-func Test_TicketUse_Found(t *testing.T) {
+func Test_StrictLimits_TOTPs(t *testing.T) {
+	ctx := context.Background()
 	projectId := uuid.String()
+	strict := db
+	strict.strict = true
 
-	assertTicket := func(opts data.TicketUse, payload string, uses int) {
-		res, err := db.TicketUse(opts)
+	create := func(userId string, tpe string) data.TOTPCreateStatus {
+		res, err := strict.TOTPCreate(ctx, data.TOTPCreate{ProjectId: projectId, UserId: userId, Type: tpe, Max: 2, Secret: []byte("s")})
 		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TICKET_USE_OK)
-
-		if uses == -1 {
-			assert.Nil(t, res.Uses)
-		} else {
-			assert.Equal(t, *res.Uses, uses)
-		}
-
-		if payload == "" {
-			assert.Nil(t, res.Payload)
-		} else {
-			assert.Bytes(t, *res.Payload, []byte(payload))
-		}
+		return res.Status
 	}
 
-	// setup our data
-	db.MustExec(`
-		insert into authen_tickets (project_id, ticket, payload, uses, expires) values
-		($1, $2, 'd1', 1, null),
-		($1, $3, null, null, null),
-		($1, $4, null, 10, now() + interval '100 seconds')
-	`, projectId, []byte("t1"), []byte("t2"), []byte("t3"))
-
-	assertTicket(data.TicketUse{
-		ProjectId: projectId,
-		Ticket:    []byte("t1"),
-	}, "d1", 0)
+	assert.Equal(t, create("u1", ""), data.TOTP_CREATE_OK)
+	assert.Equal(t, create("u2", ""), data.TOTP_CREATE_OK)
+	assert.Equal(t, create("u3", ""), data.TOTP_CREATE_MAX)
 
-	assertTicket(data.TicketUse{
-		ProjectId: projectId,
-		Ticket:    []byte("t2"),
-	}, "", -1)
+	// updating an existing user's TOTP doesn't add a row
+	assert.Equal(t, create("u1", ""), data.TOTP_CREATE_OK)
+	assert.Equal(t, projectCount(projectId, COUNT_TOTP), 2)
 
-	assertTicket(data.TicketUse{
-		ProjectId: projectId,
-		Ticket:    []byte("t3"),
-	}, "", 9)
+	deleted, err := strict.TOTPDelete(ctx, data.TOTPGet{ProjectId: projectId, UserId: "u2", AllTypes: true})
+	assert.Nil(t, err)
+	assert.Equal(t, deleted, 1)
+	assert.Equal(t, create("u3", ""), data.TOTP_CREATE_OK)
+	assert.Equal(t, projectCount(projectId, COUNT_TOTP), 2)
 }
 
-// wrong ticket, no more use or expired
-func Test_TicketUse_NotFound(t *testing.T) {
+func Test_StrictLimits_LoginLogs_Concurrent(t *testing.T) {
 	projectId := uuid.String()
+	strict := db
+	strict.strict = true
 
-	assertNotFound := func(opts data.TicketUse) {
-		res, err := db.TicketUse(opts)
+	create := func() {
+		_, err := strict.LoginLogCreate(context.Background(), data.LoginLogCreate{
+			Id:        uuid.String(),
+			ProjectId: projectId,
+			UserId:    "u1",
+			Max:       5,
+		})
 		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TICKET_USE_NOT_FOUND)
 	}
 
-	// setup our data
-	db.MustExec(`
-		insert into authen_tickets (project_id, ticket, payload, uses, expires) values
-		($1, $2, null, 2, null),
-		($1, $3, null, null, now() - interval '1 second')
-	`, projectId, []byte("t1"), []byte("t2"))
+	// concurrent creates also race to create the project's count
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			create()
+		}()
+	}
+	wg.Wait()
 
-	// wrong project
-	assertNotFound(data.TicketUse{
-		ProjectId: "p2",
-		Ticket:    []byte("t1"),
-	})
+	count, _ := scalar[int](context.Background(), db, "select count(*) from authen_login_logs where project_id = $1", projectId)
+	assert.Equal(t, count, 5)
+	assert.Equal(t, projectCount(projectId, COUNT_LOGIN_LOG), 5)
+}
 
-	// wrong ticket
-	assertNotFound(data.TicketUse{
-		ProjectId: projectId,
-		Ticket:    []byte("t9"),
-	})
+func projectCount(projectId string, resource string) int {
+	count, err := scalar[int](context.Background(), db, "select count from authen_project_counts where project_id = $1 and resource = $2", projectId, resource)
+	if err != nil {
+		panic(err)
+	}
+	return count
+}
 
-	// expired
-	assertNotFound(data.TicketUse{
-		ProjectId: projectId,
-		Ticket:    []byte("t2"),
-	})
+func Test_Replicas_Info(t *testing.T) {
+	rdb := replicaDB(t)
+
+	info, err := rdb.Info(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, reflectString(info, "Pool"), "replica_1")
 
-	{
-		// important test, checks both our use limit, and that using
-		// a ticket decreases the limit
+	rdb.replicas.all[0].healthy.Store(false)
+	info, err = rdb.Info(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, reflectString(info, "Pool"), POOL_PRIMARY)
 
-		// this ticket has 2 uses
-		opts := data.TicketUse{
-			ProjectId: projectId,
-			Ticket:    []byte("t1"),
+	// without replicas, everything is served by the primary
+	info, err = db.Info(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, reflectString(info, "Pool"), POOL_PRIMARY)
+}
+
+func Test_Replicas_Read(t *testing.T) {
+	rdb := replicaDB(t)
+	projectId := uuid.String()
+	db.MustExec(`
+		insert into authen_login_logs (id, project_id, user_id, status)
+		values ($1, $2, 'u1', 3)
+	`, uuid.String(), projectId)
+
+	result, err := rdb.LoginLogGet(context.Background(), data.LoginLogGet{ProjectId: projectId, UserId: "u1", Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, len(result.Records), 1)
+	assert.Equal(t, result.Records[0].Status, 3)
+
+	// not found on the replica (maybe lag) is retried on the primary
+	// without marking the replica down
+	calls := 0
+	pool, err := rdb.read(context.Background(), func(r pg.DB) error {
+		calls += 1
+		return pg.ErrNoRows
+	})
+	assert.Equal(t, calls, 2)
+	assert.Equal(t, pool, POOL_PRIMARY)
+	assert.True(t, errors.Is(err, pg.ErrNoRows))
+	assert.True(t, rdb.replicas.all[0].healthy.Load())
+
+	// a connection-level error marks it down
+	_, err = rdb.read(context.Background(), func(r pg.DB) error {
+		if calls += 1; calls == 3 {
+			return errors.New("connection refused")
 		}
-		// 1st use
-		res, _ := db.TicketUse(opts)
-		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.False(t, rdb.replicas.all[0].healthy.Load())
+	assert.Nil(t, rdb.replicas.pick())
+}
 
-		// 2nd use
-		res, _ = db.TicketUse(opts)
-		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+// A DB whose single replica is the primary itself. The check frequency is
+// long enough that the background ping won't flip health mid-test.
+func replicaDB(t *testing.T) DB {
+	rdb, err := New(Config{
+		URL:                   db.url,
+		Replicas:              []string{db.url},
+		ReplicaCheckFrequency: 3600,
+	}, db.tpe)
+	assert.Nil(t, err)
+	return rdb
+}
 
-		// no more uses
-		assertNotFound(opts)
-	}
+func reflectString(v any, field string) string {
+	return reflect.ValueOf(v).FieldByName(field).String()
 }
 
-func Test_TicketDelete(t *testing.T) {
-	assertDelete := func(opts data.TicketUse, uses int) {
-		t.Helper()
-		res, err := db.TicketDelete(opts)
-		assert.Nil(t, err)
-		if uses == -2 {
-			assert.Equal(t, res.Status, data.TICKET_USE_NOT_FOUND)
-		} else if uses == -1 {
-			assert.Equal(t, res.Status, data.TICKET_USE_OK)
-			assert.Nil(t, res.Uses)
-		} else {
-			assert.Equal(t, res.Status, data.TICKET_USE_OK)
-			assert.Equal(t, *res.Uses, uses)
-		}
-	}
+func Test_MigrateTo(t *testing.T) {
+	current, latest, err := db.MigrationVersions()
+	assert.Nil(t, err)
+	assert.Equal(t, current, 17)
+	assert.Equal(t, latest, 17)
 
-	// setup our data
-	db.MustExec(`
-			insert into authen_tickets (project_id, ticket, payload, uses, expires) values
-			('p1', $1, null, null, null),
-			('p1', $2, null, 3, null),
-			('p1', $3, null, 0, null),
-			('p1', $4, null, 0, now() - interval '1 second')
-		`, []byte("t1"), []byte("t2"), []byte("t3"), []byte("t4"))
-
-	// not found
-	{
-		// wrong project
-		assertDelete(data.TicketUse{
-			ProjectId: "p2",
-			Ticket:    []byte("t1"),
-		}, -2)
-
-		// wrong ticket
-		assertDelete(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t9"),
-		}, -2)
-
-		// no more use
-		assertDelete(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t3"),
-		}, -2)
-
-		// expired
-		assertDelete(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t4"),
-		}, -2)
-	}
+	sql, err := db.MigrateToSQL(13)
+	assert.Nil(t, err)
+	assert.Equal(t, sql[0], "-- 0017 down")
+	assert.StringContains(t, strings.Join(sql, "\n"), "drop table authen_user_locks")
 
-	// found with unlimited use
-	{
-		// delete with unlimited use
-		assertDelete(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t1"),
-		}, -1)
-
-		// it's really deleted not, so not found
-		assertDelete(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t1"),
-		}, -2)
-	}
+	// a dry run doesn't change anything
+	current, _, _ = db.MigrationVersions()
+	assert.Equal(t, current, 17)
 
-	// found with use
-	{
-		// delete with unlimited use
-		assertDelete(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t2"),
-		}, 3)
-
-		// it's really deleted not, so not found
-		assertDelete(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t2"),
-		}, -2)
-	}
-}
+	assert.Nil(t, db.MigrateTo(13))
+	current, _, _ = db.MigrationVersions()
+	assert.Equal(t, current, 13)
+	assert.False(t, tableExists("authen_user_locks"))
 
-func Test_LoginLogCreate(t *testing.T) {
-	assertLoginLog := func(opts data.LoginLogCreate) {
-		t.Helper()
-		res, err := db.LoginLogCreate(opts)
-		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.LOGIN_LOG_CREATE_OK)
-
-		row, _ := db.RowToMap("select * from authen_login_logs where id = $1", opts.Id)
-		assert.Nowish(t, row.Time("created"))
-		assert.Equal(t, row.Int("status"), opts.Status)
-		assert.Equal(t, row.String("user_id"), opts.UserId)
-		assert.Equal(t, row.String("project_id"), opts.ProjectId)
-
-		if opts.Payload == nil {
-			assert.Nil(t, row["payload"])
-		} else {
-			assert.Bytes(t, row.Bytes("payload"), opts.Payload)
-		}
-	}
+	// history from before 0016 is copied into day partitions
+	db.MustExec(`
+		insert into authen_login_logs (id, project_id, user_id, status, created)
+		values (gen_random_uuid(), $1, 'u1', 1, now() - interval '40 days')
+	`, uuid.String())
 
-	//no payload
-	{
-		assertLoginLog(data.LoginLogCreate{
-			Id:        uuid.String(),
-			Status:    99,
-			UserId:    "u1",
-			ProjectId: uuid.String(),
-		})
-	}
+	assert.Nil(t, db.MigrateTo(17))
+	current, _, _ = db.MigrationVersions()
+	assert.Equal(t, current, 17)
+	assert.True(t, tableExists("authen_user_locks"))
 
-	//payload
-	{
-		assertLoginLog(data.LoginLogCreate{
-			Id:        uuid.String(),
-			Status:    2,
-			UserId:    "u2",
-			ProjectId: uuid.String(),
-			Payload:   []byte("over 9000!"),
-		})
+	if db.tpe == "postgres" {
+		assert.True(t, tableExists(migrations.LoginLogPartitionName(time.Now().AddDate(0, 0, -40))))
+		count, _ := scalar[int](context.Background(), db, "select count(*) from authen_login_logs_default")
+		assert.Equal(t, count, 0)
 	}
 }
 
-func Test_LoginLogGet(t *testing.T) {
-	assertRecord := func(actual data.LoginLogRecord, id string, status int, payloadName string) {
-		t.Helper()
-		assert.Equal(t, actual.Id, id)
-		assert.Equal(t, actual.Status, status)
-		if payloadName == "" {
-			assert.Nil(t, actual.Payload)
-		} else {
-			payload := (actual.Payload).(map[string]any)
-			assert.Equal(t, payload["name"].(string), payloadName)
-		}
+func Test_Clean_LoginLogPartitions(t *testing.T) {
+	if db.tpe != "postgres" {
+		t.Skip("cockroach's authen_login_logs isn't partitioned")
 	}
 
-	// empty result
-	{
-		res, err := db.LoginLogGet(data.LoginLogGet{
-			ProjectId: uuid.String(),
-		})
-
-		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.LOGIN_LOG_GET_OK)
-		assert.Equal(t, len(res.Records), 0)
-	}
+	// far enough back that no other test has login logs in the default
+	// partition for that day
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -5000)
+	name := migrations.LoginLogPartitionName(day)
+	db.MustExec(migrations.LoginLogPartitionSQL(day))
 
-	projectId1, projectId2 := uuid.String(), uuid.String()
-	id1, id2, id3 := uuid.String(), uuid.String(), uuid.String()
-	id4, id5, id6 := uuid.String(), uuid.String(), uuid.String()
+	projectId := uuid.String()
 	db.MustExec(`
-		insert into authen_login_logs (id, project_id, user_id, status, payload, created) values
-		($1, $7, 'u1', 1, null, now() - interval '100 seconds'),
-		($2, $7, 'u1', 2, '{"name": "idaho"}', now() - interval '110 seconds'),
-		($3, $7, 'u1', 3, null, now() - interval '120 seconds'),
-		($4, $7, 'u1', 4, '{"name": "ghanima"}', now() - interval '130 seconds'),
-		($5, $7, 'u2', 1, null, now()),
-		($6, $8, 'u1', 1, null, now());
-	`, id1, id2, id3, id4, id5, id6, projectId1, projectId2)
-
-	// first page
-	{
-		res, err := db.LoginLogGet(data.LoginLogGet{
-			Limit:     2,
-			Offset:    0,
-			UserId:    "u1",
-			ProjectId: projectId1,
-		})
-		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.LOGIN_LOG_GET_OK)
-		assert.Equal(t, len(res.Records), 2)
-		assertRecord(res.Records[0], id1, 1, "")
-		assertRecord(res.Records[1], id2, 2, "idaho")
-	}
+		insert into authen_projects (id, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length, login_log_retain_count, login_log_retain_days)
+		values ($1, '', 0, 0, 0, 0, 0, 0, 0, 0, 30)
+	`, projectId)
+	db.MustExec(`
+		insert into authen_login_logs (id, project_id, user_id, status, created) values
+		(gen_random_uuid(), $1, 'u1', 1, $2),
+		(gen_random_uuid(), $1, 'u2', 2, $2)
+	`, projectId, day.Add(time.Hour))
+	assert.True(t, tableExists(name))
 
-	// 2nd page
-	{
-		res, err := db.LoginLogGet(data.LoginLogGet{
-			Limit:     2,
-			Offset:    2,
-			UserId:    "u1",
-			ProjectId: projectId1,
-		})
-		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.LOGIN_LOG_GET_OK)
-		assert.Equal(t, len(res.Records), 2)
-		assertRecord(res.Records[0], id3, 3, "")
-		assertRecord(res.Records[1], id4, 4, "ghanima")
-	}
+	result, err := db.Clean(context.Background(), data.Clean{BatchSize: 10})
+	assert.Nil(t, err)
+	assert.True(t, result.Partitions >= 1)
+	assert.True(t, result.LoginLogs >= 2)
+	assert.False(t, tableExists(name))
 
-	// Empty page
-	{
-		res, err := db.LoginLogGet(data.LoginLogGet{
-			Limit:     4,
-			Offset:    4,
-			UserId:    "u1",
-			ProjectId: projectId1,
-		})
-		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.LOGIN_LOG_GET_OK)
-		assert.Equal(t, len(res.Records), 0)
-	}
+	// partitions are kept LOGIN_LOG_PARTITIONS_AHEAD days ahead
+	days, partitioned, err := db.loginLogPartitions(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, partitioned)
+	ahead := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, migrations.LOGIN_LOG_PARTITIONS_AHEAD)
+	assert.True(t, !days[len(days)-1].Before(ahead))
+}
+
+func tableExists(name string) bool {
+	exists, _ := scalar[bool](context.Background(), db, "select exists(select 1 from information_schema.tables where table_name = $1)", name)
+	return exists
 }
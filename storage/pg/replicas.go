@@ -0,0 +1,128 @@
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"src.goblgobl.com/utils/log"
+	"src.goblgobl.com/utils/pg"
+)
+
+const POOL_PRIMARY = "primary"
+
+type replica struct {
+	pg.DB
+
+	// replica_1, replica_2, ... (the URL could contain a password)
+	name    string
+	healthy atomic.Bool
+}
+
+type replicas struct {
+	all  []*replica
+	next atomic.Uint32
+}
+
+func newReplicas(urls []string, frequency time.Duration) (*replicas, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	all := make([]*replica, len(urls))
+	for i, url := range urls {
+		db, err := pg.New(url)
+		if err != nil {
+			return nil, fmt.Errorf("PG.New (replica %d) - %w", i+1, err)
+		}
+		r := &replica{DB: db, name: "replica_" + strconv.Itoa(i+1)}
+		r.healthy.Store(true)
+		all[i] = r
+	}
+
+	rs := &replicas{all: all}
+	go rs.check(frequency)
+	return rs, nil
+}
+
+// A healthy replica (round robin), or nil if there are none.
+func (rs *replicas) pick() *replica {
+	if rs == nil {
+		return nil
+	}
+
+	n := uint32(len(rs.all))
+	start := rs.next.Add(1)
+	for i := uint32(0); i < n; i++ {
+		if r := rs.all[(start+i)%n]; r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// Pings every replica, every frequency, for as long as the process runs.
+// A replica that's down stops getting reads until it answers again.
+func (rs *replicas) check(frequency time.Duration) {
+	for {
+		time.Sleep(frequency)
+		for _, r := range rs.all {
+			ctx, cancel := context.WithTimeout(context.Background(), frequency)
+			_, err := r.Exec(ctx, "select 1")
+			cancel()
+			r.setHealthy(err)
+		}
+	}
+}
+
+func (r *replica) setHealthy(err error) {
+	healthy := err == nil
+	if r.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		log.Info("pg_replica_up").String("replica", r.name).Log()
+	} else {
+		log.Warn("pg_replica_down").String("replica", r.name).Err(err).Log()
+	}
+}
+
+// Runs fn against a healthy replica, if there is one, else against the
+// primary. If fn fails on the replica, including not finding a row (which
+// could be replication lag), it's run again on the primary. Only errors
+// which didn't come from the server (i.e. connection problems) mark the
+// replica as down. Returns the name of the pool which served the read.
+func (db DB) read(ctx context.Context, fn func(r pg.DB) error) (string, error) {
+	if r := db.replicas.pick(); r != nil {
+		err := fn(r.DB)
+		if err == nil || ctx.Err() != nil {
+			return r.name, err
+		}
+
+		var pgErr *pgconn.PgError
+		if !errors.Is(err, pg.ErrNoRows) && !errors.As(err, &pgErr) {
+			r.setHealthy(err)
+		}
+	}
+	return POOL_PRIMARY, fn(db.DB)
+}
+
+type replicaInfo struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+}
+
+func (rs *replicas) info() []replicaInfo {
+	if rs == nil {
+		return nil
+	}
+	info := make([]replicaInfo, len(rs.all))
+	for i, r := range rs.all {
+		info[i] = replicaInfo{Name: r.name, Healthy: r.healthy.Load()}
+	}
+	return info
+}
@@ -0,0 +1,87 @@
+package pg_test
+
+import (
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/authen/storage/pg"
+	"src.goblgobl.com/authen/storage/storagetest"
+	"src.goblgobl.com/tests"
+	"src.goblgobl.com/utils/json"
+)
+
+// TestMain (in pg_test.go) skips this when we aren't testing pg or
+// cockroach. The suite doesn't need an empty database, so all the
+// tests share one. It runs a second time with strict limits, which
+// take a different path for every insert that has a max.
+func Test_StorageTest(t *testing.T) {
+	for _, name := range []string{"Default", "StrictLimits"} {
+		strict := name == "StrictLimits"
+		t.Run(name, func(t *testing.T) {
+			db := storageTestDB(strict)
+			storagetest.Run(t, func(t *testing.T) (storage.Storage, storagetest.Fixtures) {
+				return db, fixtures{db}
+			})
+		})
+	}
+}
+
+func storageTestDB(strict bool) pg.DB {
+	url := tests.PG()
+	tpe := tests.StorageType()
+	if tpe == "cockroach" {
+		url = tests.CR()
+	}
+
+	db, err := pg.New(pg.Config{URL: url, StrictLimits: strict}, tpe)
+	if err != nil {
+		panic(err)
+	}
+	if err := db.EnsureMigrations(); err != nil {
+		panic(err)
+	}
+	return db
+}
+
+type fixtures struct {
+	db pg.DB
+}
+
+func (f fixtures) Project(p data.Project, updated time.Time) {
+	rules := jsonColumn(p.LockoutRules)
+	success := jsonColumn(p.LoginLogSuccessStatuses)
+	f.db.MustExec("delete from authen_projects where id = $1", p.Id)
+	f.db.MustExec(`
+		insert into authen_projects (id, updated, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length, login_log_retain_count, login_log_retain_days, login_log_retain_on_insert, lockout_rules, login_log_success_statuses)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+	`, p.Id, updated, p.TOTPIssuer, p.TOTPMax, p.TOTPSetupTTL, p.TOTPSecretLength, p.TicketMax, p.TicketMaxPayloadLength, p.LoginLogMax, p.LoginLogMaxPayloadLength, p.LoginLogRetainCount, p.LoginLogRetainDays, p.LoginLogRetainOnInsert, rules, success)
+}
+
+func jsonColumn[T any](values []T) *string {
+	if len(values) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		panic(err)
+	}
+	s := string(encoded)
+	return &s
+}
+
+func (f fixtures) LoginLog(opts data.LoginLogCreate, created time.Time) {
+	f.db.MustExec(`
+		insert into authen_login_logs (id, project_id, user_id, status, payload, payload_key, ip, user_agent, method, country, created)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, opts.Id, opts.ProjectId, opts.UserId, opts.Status, opts.Payload, opts.PayloadKey, opts.Ip, opts.UserAgent, opts.Method, opts.Country, created)
+}
+
+func (f fixtures) UserLock(projectId string, userId string, lockedUntil *time.Time, reset time.Time) {
+	f.db.MustExec(`
+		insert into authen_user_locks (project_id, user_id, locked_until, reset)
+		values ($1, $2, $3, $4)
+		on conflict (project_id, user_id) do update set locked_until = $3, reset = $4
+	`, projectId, userId, lockedUntil, reset)
+}
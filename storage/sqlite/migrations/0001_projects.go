@@ -2,12 +2,10 @@ package migrations
 
 import (
 	"fmt"
-
-	"src.goblgobl.com/utils/sqlite"
 )
 
 // called from within a transaction
-func Migrate_0001(conn sqlite.Conn) error {
+func Migrate_0001(conn Conn) error {
 	err := conn.Exec(`
 		create table authen_projects (
 			id text not null primary key,
@@ -29,3 +27,14 @@ func Migrate_0001(conn sqlite.Conn) error {
 
 	return nil
 }
+
+// called from within a transaction
+func Down_0001(conn Conn) error {
+	if err := conn.Exec(`
+		drop table authen_projects
+	`); err != nil {
+		return fmt.Errorf("sqlite 0001 down authen_projects - %w", err)
+	}
+
+	return nil
+}
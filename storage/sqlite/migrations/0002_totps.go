@@ -2,12 +2,10 @@ package migrations
 
 import (
 	"fmt"
-
-	"src.goblgobl.com/utils/sqlite"
 )
 
 // called from within a transaction
-func Migrate_0002(conn sqlite.Conn) error {
+func Migrate_0002(conn Conn) error {
 	if err := conn.Exec(`
 		create table authen_totps (
 			project_id text not null,
@@ -30,3 +28,14 @@ func Migrate_0002(conn sqlite.Conn) error {
 
 	return nil
 }
+
+// called from within a transaction
+func Down_0002(conn Conn) error {
+	if err := conn.Exec(`
+		drop table authen_totps
+	`); err != nil {
+		return fmt.Errorf("sqlite 0002 down authen_totps - %w", err)
+	}
+
+	return nil
+}
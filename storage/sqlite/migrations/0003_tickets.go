@@ -2,12 +2,10 @@ package migrations
 
 import (
 	"fmt"
-
-	"src.goblgobl.com/utils/sqlite"
 )
 
 // called from within a transaction
-func Migrate_0003(conn sqlite.Conn) error {
+func Migrate_0003(conn Conn) error {
 	if err := conn.Exec(`
 		create table authen_tickets (
 			project_id text not null,
@@ -35,3 +33,14 @@ func Migrate_0003(conn sqlite.Conn) error {
 
 	return nil
 }
+
+// called from within a transaction
+func Down_0003(conn Conn) error {
+	if err := conn.Exec(`
+		drop table authen_tickets
+	`); err != nil {
+		return fmt.Errorf("sqlite 0003 down authen_tickets - %w", err)
+	}
+
+	return nil
+}
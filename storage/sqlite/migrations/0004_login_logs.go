@@ -2,12 +2,10 @@ package migrations
 
 import (
 	"fmt"
-
-	"src.goblgobl.com/utils/sqlite"
 )
 
 // called from within a transaction
-func Migrate_0004(conn sqlite.Conn) error {
+func Migrate_0004(conn Conn) error {
 	if err := conn.Exec(`
 		create table authen_login_logs (
 			id text not null primary key,
@@ -27,3 +25,14 @@ func Migrate_0004(conn sqlite.Conn) error {
 	}
 	return nil
 }
+
+// called from within a transaction
+func Down_0004(conn Conn) error {
+	if err := conn.Exec(`
+		drop table authen_login_logs
+	`); err != nil {
+		return fmt.Errorf("sqlite 0004 down authen_login_logs - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// called from within a transaction
+func Migrate_0005(conn Conn) error {
+	if err := conn.Exec(`
+		alter table authen_tickets add column scope blob null
+	`); err != nil {
+		return fmt.Errorf("sqlite 0005 authen_tickets.scope - %w", err)
+	}
+
+	if err := conn.Exec(`
+		alter table authen_tickets add column attempts int null
+	`); err != nil {
+		return fmt.Errorf("sqlite 0005 authen_tickets.attempts - %w", err)
+	}
+
+	if err := conn.Exec(`
+		create index authen_tickets_scope on authen_tickets(project_id, scope) where scope is not null
+	`); err != nil {
+		return fmt.Errorf("sqlite 0005 migration authen_tickets_scope - %w", err)
+	}
+
+	return nil
+}
+
+// called from within a transaction
+func Down_0005(conn Conn) error {
+	if err := conn.Exec(`
+		drop index authen_tickets_scope
+	`); err != nil {
+		return fmt.Errorf("sqlite 0005 down authen_tickets_scope - %w", err)
+	}
+
+	for _, column := range []string{"scope", "attempts"} {
+		if err := conn.Exec(`
+			alter table authen_tickets drop column ` + column + `
+		`); err != nil {
+			return fmt.Errorf("sqlite 0005 down authen_tickets.%s - %w", column, err)
+		}
+	}
+
+	return nil
+}
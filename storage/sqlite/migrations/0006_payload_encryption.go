@@ -0,0 +1,40 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// called from within a transaction
+// See the pg migration for how existing payloads are handled.
+func Migrate_0006(conn Conn) error {
+	if err := conn.Exec(`
+		alter table authen_tickets add column payload_encrypted int not null default 0
+	`); err != nil {
+		return fmt.Errorf("sqlite 0006 authen_tickets.payload_encrypted - %w", err)
+	}
+
+	if err := conn.Exec(`
+		alter table authen_login_logs add column payload_key int not null default 0
+	`); err != nil {
+		return fmt.Errorf("sqlite 0006 authen_login_logs.payload_key - %w", err)
+	}
+
+	return nil
+}
+
+// called from within a transaction
+func Down_0006(conn Conn) error {
+	if err := conn.Exec(`
+		alter table authen_tickets drop column payload_encrypted
+	`); err != nil {
+		return fmt.Errorf("sqlite 0006 down authen_tickets.payload_encrypted - %w", err)
+	}
+
+	if err := conn.Exec(`
+		alter table authen_login_logs drop column payload_key
+	`); err != nil {
+		return fmt.Errorf("sqlite 0006 down authen_login_logs.payload_key - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// called from within a transaction
+func Migrate_0007(conn Conn) error {
+	if err := conn.Exec(`
+		alter table authen_tickets add column sliding_ttl int null
+	`); err != nil {
+		return fmt.Errorf("sqlite 0007 authen_tickets.sliding_ttl - %w", err)
+	}
+
+	return nil
+}
+
+// called from within a transaction
+func Down_0007(conn Conn) error {
+	if err := conn.Exec(`
+		alter table authen_tickets drop column sliding_ttl
+	`); err != nil {
+		return fmt.Errorf("sqlite 0007 down authen_tickets.sliding_ttl - %w", err)
+	}
+
+	return nil
+}
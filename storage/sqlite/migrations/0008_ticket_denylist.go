@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// called from within a transaction
+func Migrate_0008(conn Conn) error {
+	if err := conn.Exec(`
+		create table authen_ticket_denylist (
+			project_id text not null,
+			ticket blob not null,
+			expires int not null,
+			primary key (project_id, ticket)
+	)`); err != nil {
+		return fmt.Errorf("sqlite 0008 authen_ticket_denylist - %w", err)
+	}
+
+	if err := conn.Exec(`
+		create index authen_ticket_denylist_expires on authen_ticket_denylist(expires)
+	`); err != nil {
+		return fmt.Errorf("sqlite 0008 migration authen_ticket_denylist_expires - %w", err)
+	}
+
+	return nil
+}
+
+// called from within a transaction
+func Down_0008(conn Conn) error {
+	if err := conn.Exec(`
+		drop table authen_ticket_denylist
+	`); err != nil {
+		return fmt.Errorf("sqlite 0008 down authen_ticket_denylist - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// called from within a transaction
+func Migrate_0009(conn Conn) error {
+	if err := conn.Exec(`
+		create index authen_login_logs_project_id_user_id_created on authen_login_logs(project_id, user_id, created)
+	`); err != nil {
+		return fmt.Errorf("sqlite 0009 migration authen_login_logs_project_id_user_id_created - %w", err)
+	}
+
+	if err := conn.Exec(`
+		drop index authen_login_logs_project_id_user_id
+	`); err != nil {
+		return fmt.Errorf("sqlite 0009 migration drop authen_login_logs_project_id_user_id - %w", err)
+	}
+
+	return nil
+}
+
+// called from within a transaction
+func Down_0009(conn Conn) error {
+	if err := conn.Exec(`
+		create index authen_login_logs_project_id_user_id on authen_login_logs(project_id, user_id)
+	`); err != nil {
+		return fmt.Errorf("sqlite 0009 down authen_login_logs_project_id_user_id - %w", err)
+	}
+
+	if err := conn.Exec(`
+		drop index authen_login_logs_project_id_user_id_created
+	`); err != nil {
+		return fmt.Errorf("sqlite 0009 down drop authen_login_logs_project_id_user_id_created - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// called from within a transaction
+func Migrate_0010(conn Conn) error {
+	// sqlite can only add one column per alter table
+	for _, column := range []string{"ip", "user_agent", "method", "country"} {
+		if err := conn.Exec(`
+			alter table authen_login_logs add column ` + column + ` text null
+		`); err != nil {
+			return fmt.Errorf("sqlite 0010 authen_login_logs.%s - %w", column, err)
+		}
+	}
+
+	return nil
+}
+
+// called from within a transaction
+func Down_0010(conn Conn) error {
+	for _, column := range []string{"ip", "user_agent", "method", "country"} {
+		if err := conn.Exec(`
+			alter table authen_login_logs drop column ` + column + `
+		`); err != nil {
+			return fmt.Errorf("sqlite 0010 down authen_login_logs.%s - %w", column, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// called from within a transaction
+func Migrate_0011(conn Conn) error {
+	for _, column := range []string{"ip_prefix", "device"} {
+		if err := conn.Exec(`
+			alter table authen_login_logs add column ` + column + ` text null
+		`); err != nil {
+			return fmt.Errorf("sqlite 0011 authen_login_logs.%s - %w", column, err)
+		}
+	}
+
+	if err := conn.Exec(`
+		create index authen_login_logs_project_id_user_id_ip_prefix on authen_login_logs(project_id, user_id, ip_prefix)
+		where ip_prefix is not null
+	`); err != nil {
+		return fmt.Errorf("sqlite 0011 migration authen_login_logs_project_id_user_id_ip_prefix - %w", err)
+	}
+
+	if err := conn.Exec(`
+		create index authen_login_logs_project_id_user_id_device on authen_login_logs(project_id, user_id, device)
+		where device is not null
+	`); err != nil {
+		return fmt.Errorf("sqlite 0011 migration authen_login_logs_project_id_user_id_device - %w", err)
+	}
+
+	return nil
+}
+
+// called from within a transaction
+func Down_0011(conn Conn) error {
+	// sqlite won't drop an indexed column
+	if err := conn.Exec(`
+		drop index authen_login_logs_project_id_user_id_ip_prefix
+	`); err != nil {
+		return fmt.Errorf("sqlite 0011 down authen_login_logs_project_id_user_id_ip_prefix - %w", err)
+	}
+
+	if err := conn.Exec(`
+		drop index authen_login_logs_project_id_user_id_device
+	`); err != nil {
+		return fmt.Errorf("sqlite 0011 down authen_login_logs_project_id_user_id_device - %w", err)
+	}
+
+	for _, column := range []string{"ip_prefix", "device"} {
+		if err := conn.Exec(`
+			alter table authen_login_logs drop column ` + column + `
+		`); err != nil {
+			return fmt.Errorf("sqlite 0011 down authen_login_logs.%s - %w", column, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// called from within a transaction
+func Migrate_0012(conn Conn) error {
+	for _, column := range []string{"login_log_retain_count", "login_log_retain_days", "login_log_retain_on_insert"} {
+		if err := conn.Exec(`
+			alter table authen_projects add column ` + column + ` int not null default 0
+		`); err != nil {
+			return fmt.Errorf("sqlite 0012 authen_projects.%s - %w", column, err)
+		}
+	}
+
+	return nil
+}
+
+// called from within a transaction
+func Down_0012(conn Conn) error {
+	for _, column := range []string{"login_log_retain_count", "login_log_retain_days", "login_log_retain_on_insert"} {
+		if err := conn.Exec(`
+			alter table authen_projects drop column ` + column + `
+		`); err != nil {
+			return fmt.Errorf("sqlite 0012 down authen_projects.%s - %w", column, err)
+		}
+	}
+
+	return nil
+}
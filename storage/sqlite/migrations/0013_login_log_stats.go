@@ -0,0 +1,27 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// called from within a transaction
+func Migrate_0013(conn Conn) error {
+	if err := conn.Exec(`
+		create index authen_login_logs_project_id_created on authen_login_logs(project_id, created)
+	`); err != nil {
+		return fmt.Errorf("sqlite 0013 migration authen_login_logs_project_id_created - %w", err)
+	}
+
+	return nil
+}
+
+// called from within a transaction
+func Down_0013(conn Conn) error {
+	if err := conn.Exec(`
+		drop index authen_login_logs_project_id_created
+	`); err != nil {
+		return fmt.Errorf("sqlite 0013 down authen_login_logs_project_id_created - %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// called from within a transaction
+func Migrate_0014(conn Conn) error {
+	if err := conn.Exec(`
+		alter table authen_projects add column lockout_rules text null
+	`); err != nil {
+		return fmt.Errorf("sqlite 0014 authen_projects - %w", err)
+	}
+
+	if err := conn.Exec(`
+		create table authen_user_locks (
+			project_id text not null,
+			user_id text not null,
+			locked_until int null,
+			reset int not null,
+			primary key (project_id, user_id)
+	)`); err != nil {
+		return fmt.Errorf("sqlite 0014 authen_user_locks - %w", err)
+	}
+
+	if err := conn.Exec(`
+		create index authen_user_locks_reset on authen_user_locks(reset)
+	`); err != nil {
+		return fmt.Errorf("sqlite 0014 migration authen_user_locks_reset - %w", err)
+	}
+
+	return nil
+}
+
+// called from within a transaction
+func Down_0014(conn Conn) error {
+	if err := conn.Exec(`
+		drop table authen_user_locks
+	`); err != nil {
+		return fmt.Errorf("sqlite 0014 down authen_user_locks - %w", err)
+	}
+
+	if err := conn.Exec(`
+		alter table authen_projects drop column lockout_rules
+	`); err != nil {
+		return fmt.Errorf("sqlite 0014 down authen_projects.lockout_rules - %w", err)
+	}
+
+	return nil
+}
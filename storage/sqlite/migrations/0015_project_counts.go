@@ -0,0 +1,74 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// Per-project row counts of authen_totps, authen_tickets and
+// authen_login_logs, used to enforce max limits atomically (strict_limits).
+// A project only has a row once strict mode first needs it; from then on
+// the triggers keep it up to date (with recursive_triggers off, "insert or
+// replace" doesn't fire the delete trigger, so counted tables use upserts).
+// Called from within a transaction.
+func Migrate_0015(conn Conn) error {
+	if err := conn.Exec(`
+		create table authen_project_counts (
+			project_id text not null,
+			resource text not null,
+			count int not null,
+			primary key (project_id, resource)
+	)`); err != nil {
+		return fmt.Errorf("sqlite 0015 authen_project_counts - %w", err)
+	}
+
+	tables := [][2]string{
+		{"authen_totps", "totp"},
+		{"authen_tickets", "ticket"},
+		{"authen_login_logs", "login_log"},
+	}
+
+	for _, t := range tables {
+		table, resource := t[0], t[1]
+		if err := conn.Exec(`
+			create trigger ` + table + `_count_insert after insert on ` + table + `
+			begin
+				update authen_project_counts set count = count + 1
+				where project_id = new.project_id and resource = '` + resource + `';
+			end
+		`); err != nil {
+			return fmt.Errorf("sqlite 0015 %s insert trigger - %w", table, err)
+		}
+
+		if err := conn.Exec(`
+			create trigger ` + table + `_count_delete after delete on ` + table + `
+			begin
+				update authen_project_counts set count = count - 1
+				where project_id = old.project_id and resource = '` + resource + `';
+			end
+		`); err != nil {
+			return fmt.Errorf("sqlite 0015 %s delete trigger - %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+// called from within a transaction
+func Down_0015(conn Conn) error {
+	for _, table := range []string{"authen_totps", "authen_tickets", "authen_login_logs"} {
+		if err := conn.Exec(`drop trigger ` + table + `_count_insert`); err != nil {
+			return fmt.Errorf("sqlite 0015 down %s insert trigger - %w", table, err)
+		}
+		if err := conn.Exec(`drop trigger ` + table + `_count_delete`); err != nil {
+			return fmt.Errorf("sqlite 0015 down %s delete trigger - %w", table, err)
+		}
+	}
+
+	if err := conn.Exec(`
+		drop table authen_project_counts
+	`); err != nil {
+		return fmt.Errorf("sqlite 0015 down authen_project_counts - %w", err)
+	}
+
+	return nil
+}
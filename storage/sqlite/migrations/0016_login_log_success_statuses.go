@@ -0,0 +1,27 @@
+package migrations
+
+import (
+	"fmt"
+)
+
+// login_log_success_statuses is a json array of the statuses of a
+// successful login. Only those make an ip or device known.
+func Migrate_0016(conn Conn) error {
+	if err := conn.Exec(`
+		alter table authen_projects add column login_log_success_statuses text null
+	`); err != nil {
+		return fmt.Errorf("sqlite 0016 authen_projects - %w", err)
+	}
+
+	return nil
+}
+
+func Down_0016(conn Conn) error {
+	if err := conn.Exec(`
+		alter table authen_projects drop column login_log_success_statuses
+	`); err != nil {
+		return fmt.Errorf("sqlite 0016 down authen_projects.login_log_success_statuses - %w", err)
+	}
+
+	return nil
+}
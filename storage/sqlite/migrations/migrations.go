@@ -1,15 +1,142 @@
 package migrations
 
 import (
+	"fmt"
+
+	"src.goblgobl.com/utils/log"
 	"src.goblgobl.com/utils/sqlite"
 )
 
+// What migrations are given: a sqlite.Conn (inside a transaction) or, for
+// a dry run, something which only records the SQL.
+type Conn interface {
+	Exec(sql string, args ...any) error
+}
+
+// sqlite.Migration only knows how to go up. Every step also has a Down
+// which undoes it (dropping whatever data was in the tables/columns it
+// created).
+type Step struct {
+	Version int
+	Up      func(Conn) error
+	Down    func(Conn) error
+}
+
+var steps = []Step{
+	Step{1, Migrate_0001, Down_0001},
+	Step{2, Migrate_0002, Down_0002},
+	Step{3, Migrate_0003, Down_0003},
+	Step{4, Migrate_0004, Down_0004},
+	Step{5, Migrate_0005, Down_0005},
+	Step{6, Migrate_0006, Down_0006},
+	Step{7, Migrate_0007, Down_0007},
+	Step{8, Migrate_0008, Down_0008},
+	Step{9, Migrate_0009, Down_0009},
+	Step{10, Migrate_0010, Down_0010},
+	Step{11, Migrate_0011, Down_0011},
+	Step{12, Migrate_0012, Down_0012},
+	Step{13, Migrate_0013, Down_0013},
+	Step{14, Migrate_0014, Down_0014},
+	Step{15, Migrate_0015, Down_0015},
+	Step{16, Migrate_0016, Down_0016},
+}
+
 func Run(conn sqlite.Conn) error {
-	migrations := []sqlite.Migration{
-		sqlite.Migration{1, Migrate_0001},
-		sqlite.Migration{2, Migrate_0002},
-		sqlite.Migration{3, Migrate_0003},
-		sqlite.Migration{4, Migrate_0004},
+	return Up(conn, Latest())
+}
+
+func GetCurrent(conn sqlite.Conn) (int, error) {
+	return sqlite.GetCurrentMigrationVersion(conn)
+}
+
+// The version Run migrates to
+func Latest() int {
+	return steps[len(steps)-1].Version
+}
+
+// Runs every pending migration up to, and including, version.
+func Up(conn sqlite.Conn, version int) error {
+	migrations := make([]sqlite.Migration, 0, len(steps))
+	for _, step := range steps {
+		if step.Version > version {
+			break
+		}
+		up := step.Up
+		migrations = append(migrations, sqlite.Migration{step.Version, func(conn sqlite.Conn) error {
+			return up(conn)
+		}})
 	}
 	return sqlite.MigrateAll(conn, migrations)
 }
+
+// Undoes every applied migration newer than version, newest first. Each
+// step runs in its own transaction along with removing its version from
+// gobl_migrations (the table sqlite.MigrateAll records applied versions
+// in), so a failure leaves the schema at the last step that succeeded.
+func Down(conn sqlite.Conn, version int) error {
+	current, err := GetCurrent(conn)
+	if err != nil {
+		return err
+	}
+
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if step.Version > current {
+			continue
+		}
+		if step.Version <= version {
+			break
+		}
+
+		log.Info("migration_down").String("app", "authen").String("type", "sqlite").Int("version", step.Version).Log()
+		err := conn.Transaction(func() error {
+			if err := step.Down(conn); err != nil {
+				return err
+			}
+			if err := conn.Exec("delete from gobl_migrations where version = ?", step.Version); err != nil {
+				return fmt.Errorf("sqlite %04d down record - %w", step.Version, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The SQL which Up (when from < to) or Down (when from > to) would execute
+// to go from one version to the other. Nothing is executed.
+func SQL(from int, to int) ([]string, error) {
+	conn := &recorder{}
+	if from < to {
+		for _, step := range steps {
+			if step.Version > from && step.Version <= to {
+				conn.sql = append(conn.sql, fmt.Sprintf("-- %04d up", step.Version))
+				if err := step.Up(conn); err != nil {
+					return nil, err
+				}
+			}
+		}
+	} else {
+		for i := len(steps) - 1; i >= 0; i-- {
+			step := steps[i]
+			if step.Version <= from && step.Version > to {
+				conn.sql = append(conn.sql, fmt.Sprintf("-- %04d down", step.Version))
+				if err := step.Down(conn); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return conn.sql, nil
+}
+
+type recorder struct {
+	sql []string
+}
+
+func (r *recorder) Exec(sql string, args ...any) error {
+	r.sql = append(r.sql, sql)
+	return nil
+}
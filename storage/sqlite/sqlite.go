@@ -1,22 +1,37 @@
 package sqlite
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"src.goblgobl.com/authen/storage/data"
 	"src.goblgobl.com/authen/storage/sqlite/migrations"
-	"src.goblgobl.com/utils/log"
+	"src.goblgobl.com/utils/json"
 	"src.goblgobl.com/utils/sqlite"
 )
 
+// rows read per query by LoginLogExport (a var so tests can lower it)
+var loginLogExportBatch = 1000
+
+// returned by ticketInsert, so that the batch's transaction is rolled back
+var errTicketDuplicate = errors.New("duplicate ticket")
+
 type Config struct {
 	Path string `json:"path"`
+
+	// When true, the max number of TOTPs, tickets and login logs a project
+	// can have is checked in the same transaction as the insert, against
+	// authen_project_counts, so concurrent inserts can't go over.
+	StrictLimits bool `json:"strict_limits"`
 }
 
 type Conn struct {
 	sqlite.Conn
+	strict bool
 }
 
 func New(config Config) (Conn, error) {
@@ -24,10 +39,10 @@ func New(config Config) (Conn, error) {
 	if err != nil {
 		return Conn{}, fmt.Errorf("Sqlite.New - %w", err)
 	}
-	return Conn{conn}, nil
+	return Conn{conn, config.StrictLimits}, nil
 }
 
-func (c Conn) Ping() error {
+func (c Conn) Ping(ctx context.Context) error {
 	err := c.Exec("select 1")
 	if err != nil {
 		return fmt.Errorf("Sqlite.Ping - %w", err)
@@ -39,27 +54,179 @@ func (c Conn) EnsureMigrations() error {
 	return migrations.Run(c.Conn)
 }
 
-func (c Conn) Clean() error {
-	err := c.Exec(`
-		delete from authen_totps
-		where expires < unixepoch()
-	`)
+func (c Conn) MigrationVersions() (int, int, error) {
+	current, err := migrations.GetCurrent(c.Conn)
 	if err != nil {
-		return fmt.Errorf("Sqlite.clean (totp) - %w", err)
+		return 0, 0, fmt.Errorf("Sqlite.MigrationVersions - %w", err)
 	}
+	return current, migrations.Latest(), nil
+}
 
-	err = c.Exec(`
-		delete from authen_tickets
-		where uses = 0 or expires < unixepoch()
-	`)
+func (c Conn) MigrateTo(version int) error {
+	current, err := migrations.GetCurrent(c.Conn)
+	if err != nil {
+		return fmt.Errorf("Sqlite.MigrateTo (current) - %w", err)
+	}
+	if version < current {
+		err = migrations.Down(c.Conn, version)
+	} else {
+		err = migrations.Up(c.Conn, version)
+	}
+	if err != nil {
+		return fmt.Errorf("Sqlite.MigrateTo - %w", err)
+	}
+	return nil
+}
+
+func (c Conn) MigrateToSQL(version int) ([]string, error) {
+	current, err := migrations.GetCurrent(c.Conn)
 	if err != nil {
-		return fmt.Errorf("Sqlite.clean (tickets) - %w", err)
+		return nil, fmt.Errorf("Sqlite.MigrateToSQL (current) - %w", err)
 	}
+	return migrations.SQL(current, version)
+}
 
+// Every delete is done opts.BatchSize rows at a time, so that other
+// writers get a turn in between.
+func (c Conn) Clean(ctx context.Context, opts data.Clean) (data.CleanResult, error) {
+	var err error
+	var result data.CleanResult
+
+	result.TOTPs, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return c.deleted(`
+			delete from authen_totps
+			where rowid in (
+				select rowid
+				from authen_totps
+				where expires < unixepoch()
+				` + limitClause(limit) + `
+			)
+		`)
+	})
+	if err != nil {
+		return result, fmt.Errorf("Sqlite.clean (totp) - %w", err)
+	}
+
+	result.Tickets, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return c.deleted(`
+			delete from authen_tickets
+			where rowid in (
+				select rowid
+				from authen_tickets
+				where uses = 0 or attempts = 0 or expires < unixepoch()
+				` + limitClause(limit) + `
+			)
+		`)
+	})
+	if err != nil {
+		return result, fmt.Errorf("Sqlite.clean (tickets) - %w", err)
+	}
+
+	result.TicketDenylist, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return c.deleted(`
+			delete from authen_ticket_denylist
+			where rowid in (
+				select rowid
+				from authen_ticket_denylist
+				where expires < unixepoch()
+				` + limitClause(limit) + `
+			)
+		`)
+	})
+	if err != nil {
+		return result, fmt.Errorf("Sqlite.clean (ticket denylist) - %w", err)
+	}
+
+	// login logs of a project which isn't in authen_projects (single tenancy)
+	// use the retention passed in
+	retention := opts.LoginLogRetention
+	removed, err := opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return c.deleted(`
+			delete from authen_login_logs
+			where id in (
+				select l.id
+				from authen_login_logs l
+					left join authen_projects p on p.id = l.project_id
+				where coalesce(p.login_log_retain_days, ?1) > 0
+					and l.created < unixepoch() - coalesce(p.login_log_retain_days, ?1) * 86400
+				`+limitClause(limit)+`
+			)
+		`, retention.Days)
+	})
+	result.LoginLogs += removed
+	if err != nil {
+		return result, fmt.Errorf("Sqlite.clean (login logs days) - %w", err)
+	}
+
+	removed, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return c.deleted(`
+			delete from authen_login_logs
+			where id in (
+				select id from (
+					select l.id,
+						coalesce(p.login_log_retain_count, ?1) as retain,
+						row_number() over (partition by l.project_id, l.user_id order by l.created desc, l.id desc) as n
+					from authen_login_logs l
+						left join authen_projects p on p.id = l.project_id
+				)
+				where retain > 0 and n > retain
+				`+limitClause(limit)+`
+			)
+		`, retention.Count)
+	})
+	result.LoginLogs += removed
+	if err != nil {
+		return result, fmt.Errorf("Sqlite.clean (login logs count) - %w", err)
+	}
+
+	// Expired and unlocked locks are only kept so that older login logs
+	// don't count towards a new lock, which they can't once they're older
+	// than data.MAX_LOCKOUT_WINDOW.
+	result.UserLocks, err = opts.Batches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return c.deleted(`
+			delete from authen_user_locks
+			where rowid in (
+				select rowid
+				from authen_user_locks
+				where (locked_until is null or locked_until < unixepoch())
+					and reset < unixepoch() - 86400
+				` + limitClause(limit) + `
+			)
+		`)
+	})
+	if err != nil {
+		return result, fmt.Errorf("Sqlite.clean (user locks) - %w", err)
+	}
+
+	return result, nil
+}
+
+// Runs a delete and returns the number of rows it deleted
+func (c Conn) deleted(sql string, args ...any) (int, error) {
+	if err := c.Exec(sql, args...); err != nil {
+		return 0, err
+	}
+	return c.Changes(), nil
+}
+
+// " limit N", or nothing when there's no limit (n == 0)
+func limitClause(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return " limit " + strconv.Itoa(n)
+}
+
+// sqlite is a single process, there are no other instances to tell
+func (c Conn) EventPublish(ctx context.Context, payload []byte) error {
 	return nil
 }
 
-func (c Conn) Info() (any, error) {
+func (c Conn) EventListen(fn func(payload []byte)) error {
+	return nil
+}
+
+func (c Conn) Info(ctx context.Context) (any, error) {
 	migration, err := sqlite.GetCurrentMigrationVersion(c.Conn)
 	if err != nil {
 		return nil, err
@@ -74,12 +241,14 @@ func (c Conn) Info() (any, error) {
 	}, nil
 }
 
-func (c Conn) GetProject(id string) (*data.Project, error) {
+func (c Conn) GetProject(ctx context.Context, id string) (*data.Project, error) {
 	row := c.Row(`
 		select id,
 			totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
 			ticket_max, ticket_max_payload_length,
-			login_log_max, login_log_max_payload_length
+			login_log_max, login_log_max_payload_length,
+			login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+			lockout_rules, login_log_success_statuses
 		from authen_projects
 		where id = ?1
 	`, id)
@@ -94,7 +263,7 @@ func (c Conn) GetProject(id string) (*data.Project, error) {
 	return project, nil
 }
 
-func (c Conn) GetUpdatedProjects(timestamp time.Time) ([]*data.Project, error) {
+func (c Conn) GetUpdatedProjects(ctx context.Context, timestamp time.Time) ([]*data.Project, error) {
 	// Not sure fetching the count upfront really makes much sense.
 	// But we do expect this to be 0 almost every time that it's called, so most
 	// of the time we're going to be doing a single DB call (either to get the count
@@ -111,7 +280,9 @@ func (c Conn) GetUpdatedProjects(timestamp time.Time) ([]*data.Project, error) {
 		select id,
 			totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
 			ticket_max, ticket_max_payload_length,
-			login_log_max, login_log_max_payload_length
+			login_log_max, login_log_max_payload_length,
+			login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+			lockout_rules, login_log_success_statuses
 		from authen_projects
 		where updated > ?1
 	`, timestamp)
@@ -133,7 +304,7 @@ func (c Conn) GetUpdatedProjects(timestamp time.Time) ([]*data.Project, error) {
 	return projects, nil
 }
 
-func (c Conn) TOTPCreate(opts data.TOTPCreate) (data.TOTPCreateResult, error) {
+func (c Conn) TOTPCreate(ctx context.Context, opts data.TOTPCreate) (data.TOTPCreateResult, error) {
 	max := opts.Max
 	tpe := opts.Type
 	secret := opts.Secret
@@ -144,24 +315,40 @@ func (c Conn) TOTPCreate(opts data.TOTPCreate) (data.TOTPCreateResult, error) {
 
 	var result data.TOTPCreateResult
 
-	// Since we check first, then add the user (outside of a transaction)
-	// concurrent calls to this might result in going a little over max
-	// but I'm ok with that in the name of minimizing the DB calls
-	// we need to make inside a transaction.
-	canAdd, err := c.totpCanAdd(projectId, userId, tpe, max)
-	if err != nil {
-		return result, err
-	}
+	// Unless we're strict, we check first, then add the user (outside of
+	// a transaction) so concurrent calls to this might result in going a
+	// little over max but I'm ok with that in the name of minimizing the
+	// DB calls we need to make inside a transaction.
+	if !c.strict {
+		canAdd, err := c.totpCanAdd(projectId, userId, tpe, max)
+		if err != nil {
+			return result, err
+		}
 
-	if !canAdd {
-		result.Status = data.TOTP_CREATE_MAX
-		return result, nil
+		if !canAdd {
+			result.Status = data.TOTP_CREATE_MAX
+			return result, nil
+		}
 	}
 
-	err = c.Transaction(func() error {
+	err := c.Transaction(func() error {
+		if c.strict && max > 0 {
+			canAdd, err := c.totpCanAddStrict(projectId, userId, tpe, max)
+			if err != nil {
+				return err
+			}
+			if !canAdd {
+				result.Status = data.TOTP_CREATE_MAX
+				return nil
+			}
+		}
+
+		// not "insert or replace", which wouldn't fire the delete trigger
+		// that keeps authen_project_counts up to date
 		err := c.Exec(`
-			insert or replace into authen_totps (project_id, user_id, type, pending, secret, expires)
+			insert into authen_totps (project_id, user_id, type, pending, secret, expires)
 			values (?1, ?2, ?3, ?4, ?5, ?6)
+			on conflict (project_id, user_id, type, pending) do update set secret = ?5, expires = ?6
 		`, projectId, userId, tpe, pending, secret, expires)
 
 		if err != nil {
@@ -186,14 +373,14 @@ func (c Conn) TOTPCreate(opts data.TOTPCreate) (data.TOTPCreateResult, error) {
 			return fmt.Errorf("Sqlite.TOTPCreate (delete) - %w", err)
 		}
 
+		result.Status = data.TOTP_CREATE_OK
 		return nil
 	})
 
-	result.Status = data.TOTP_CREATE_OK
 	return result, err
 }
 
-func (c Conn) TOTPGet(opts data.TOTPGet) (data.TOTPGetResult, error) {
+func (c Conn) TOTPGet(ctx context.Context, opts data.TOTPGet) (data.TOTPGetResult, error) {
 	tpe := opts.Type
 	userId := opts.UserId
 	pending := opts.Pending
@@ -225,7 +412,7 @@ func (c Conn) TOTPGet(opts data.TOTPGet) (data.TOTPGetResult, error) {
 	}, nil
 }
 
-func (c Conn) TOTPDelete(opts data.TOTPGet) (int, error) {
+func (c Conn) TOTPDelete(ctx context.Context, opts data.TOTPGet) (int, error) {
 	tpe := opts.Type
 	userId := opts.UserId
 	allTypes := opts.AllTypes
@@ -245,17 +432,34 @@ func (c Conn) TOTPDelete(opts data.TOTPGet) (int, error) {
 	return c.Changes(), nil
 }
 
-func (c Conn) TicketCreate(opts data.TicketCreate) (data.TicketCreateResult, error) {
+func (c Conn) TicketCreate(ctx context.Context, opts data.TicketCreate) (data.TicketCreateResult, error) {
 	max := opts.Max
-	uses := opts.Uses
-	ticket := opts.Ticket
-	expires := opts.Expires
-	payload := opts.Payload
+	tickets := opts.Tickets
 	projectId := opts.ProjectId
 
 	var result data.TicketCreateResult
+	if len(tickets) == 0 {
+		result.Status = data.TICKET_CREATE_OK
+		return result, nil
+	}
+
+	if c.strict && max > 0 {
+		err := c.Transaction(func() error {
+			count, err := c.projectCount(projectId, "ticket", "authen_tickets")
+			if err != nil {
+				return err
+			}
+			if count+len(tickets) > max {
+				result.Status = data.TICKET_CREATE_MAX
+				return nil
+			}
+			result.Status, err = c.ticketInsert(projectId, tickets)
+			return err
+		})
+		return ticketCreateResult(result, err)
+	}
 
-	canAdd, err := c.ticketCanAdd(projectId, max)
+	canAdd, err := c.ticketCanAdd(projectId, max, len(tickets))
 	if err != nil {
 		return result, err
 	}
@@ -265,20 +469,43 @@ func (c Conn) TicketCreate(opts data.TicketCreate) (data.TicketCreateResult, err
 		return result, nil
 	}
 
-	err = c.Exec(`
-		insert into authen_tickets (project_id, ticket, expires, uses, payload)
-		values (?1, ?2, ?3, ?4, ?5)
-	`, projectId, ticket, expires, uses, payload)
+	if len(tickets) == 1 {
+		// a single row, there's nothing else to roll back
+		result.Status, err = c.ticketInsert(projectId, tickets)
+	} else {
+		err = c.Transaction(func() error {
+			result.Status, err = c.ticketInsert(projectId, tickets)
+			return err
+		})
+	}
+	return ticketCreateResult(result, err)
+}
 
-	if err != nil {
-		return result, fmt.Errorf("Sqlite.TicketCreate - %w", err)
+// Random 20 byte tickets won't collide, but short codes can, in which
+// case the caller is expected to generate a new code and try again. A
+// duplicate is returned as errTicketDuplicate, so that, in a batch, the
+// tickets which were inserted are rolled back (see ticketCreateResult).
+func (c Conn) ticketInsert(projectId string, tickets []data.TicketCreateTicket) (data.TicketCreateStatus, error) {
+	sql, args := ticketCreateSQL(projectId, tickets)
+	if err := c.Exec(sql, args...); err != nil {
+		return 0, fmt.Errorf("Sqlite.TicketCreate - %w", err)
 	}
 
-	result.Status = data.TICKET_CREATE_OK
-	return result, nil
+	if c.Changes() != len(tickets) {
+		return data.TICKET_CREATE_DUPLICATE, errTicketDuplicate
+	}
+	return data.TICKET_CREATE_OK, nil
 }
 
-func (c Conn) TicketUse(opts data.TicketUse) (data.TicketUseResult, error) {
+func ticketCreateResult(result data.TicketCreateResult, err error) (data.TicketCreateResult, error) {
+	if errors.Is(err, errTicketDuplicate) {
+		return data.TicketCreateResult{Status: data.TICKET_CREATE_DUPLICATE}, nil
+	}
+	return result, err
+}
+
+func (c Conn) TicketUse(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error) {
+	scope := opts.Scope
 	ticket := opts.Ticket
 	projectId := opts.ProjectId
 
@@ -286,31 +513,39 @@ func (c Conn) TicketUse(opts data.TicketUse) (data.TicketUseResult, error) {
 
 	row := c.Row(`
 		update authen_tickets
-		set uses = uses - 1
+		set uses = uses - 1, expires = coalesce(unixepoch() + sliding_ttl, expires)
 		where project_id = ?1
 			and ticket = ?2
 			and (uses is null or uses > 0)
+			and (attempts is null or attempts > 0)
 			and (expires is null or expires > unixepoch())
-		returning uses, payload
+		returning uses, payload, payload_encrypted
 	`, projectId, ticket)
 
 	var uses *int
 	var payload *[]byte
-	if err := row.Scan(&uses, &payload); err != nil {
-		if err == sqlite.ErrNoRows {
-			result.Status = data.TICKET_USE_NOT_FOUND
-			return result, nil
+	var encrypted bool
+	if err := row.Scan(&uses, &payload, &encrypted); err != nil {
+		if err != sqlite.ErrNoRows {
+			return result, fmt.Errorf("Sqlite.TicketUse - %w", err)
+		}
+		if scope != nil {
+			if err := c.ticketFailedAttempt(projectId, scope); err != nil {
+				return result, err
+			}
 		}
-		return result, fmt.Errorf("Sqlite.TicketUse - %w", err)
+		result.Status = data.TICKET_USE_NOT_FOUND
+		return result, nil
 	}
 
 	result.Status = data.TICKET_USE_OK
 	result.Payload = payload
 	result.Uses = uses
+	result.PayloadEncrypted = encrypted
 	return result, nil
 }
 
-func (c Conn) TicketDelete(opts data.TicketUse) (data.TicketUseResult, error) {
+func (c Conn) TicketDelete(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error) {
 	ticket := opts.Ticket
 	projectId := opts.ProjectId
 
@@ -320,6 +555,7 @@ func (c Conn) TicketDelete(opts data.TicketUse) (data.TicketUseResult, error) {
 		delete from authen_tickets
 		where project_id = ?1 and ticket = ?2
 			and (uses is null or uses > 0)
+			and (attempts is null or attempts > 0)
 			and (expires is null or expires > unixepoch())
 		returning uses
 	`, projectId, ticket)
@@ -338,54 +574,227 @@ func (c Conn) TicketDelete(opts data.TicketUse) (data.TicketUseResult, error) {
 	return result, nil
 }
 
-func (c Conn) LoginLogCreate(opts data.LoginLogCreate) (data.LoginLogCreateResult, error) {
+func (c Conn) TicketExtend(ctx context.Context, opts data.TicketExtend) (data.TicketUseResult, error) {
+	uses := opts.Uses
+	ticket := opts.Ticket
+	expires := opts.Expires
+	projectId := opts.ProjectId
+
+	var result data.TicketUseResult
+
+	// Only live tickets can be extended. A ticket with no uses left, or
+	// which has expired, is dead (and will be removed by Clean).
+	row := c.Row(`
+		update authen_tickets
+		set expires = coalesce(?3, expires),
+			uses = uses + coalesce(?4, 0)
+		where project_id = ?1
+			and ticket = ?2
+			and (uses is null or uses > 0)
+			and (attempts is null or attempts > 0)
+			and (expires is null or expires > unixepoch())
+		returning uses
+	`, projectId, ticket, expires, uses)
+
+	var remaining *int
+	if err := row.Scan(&remaining); err != nil {
+		if err == sqlite.ErrNoRows {
+			result.Status = data.TICKET_USE_NOT_FOUND
+			return result, nil
+		}
+		return result, fmt.Errorf("Sqlite.TicketExtend - %w", err)
+	}
+
+	result.Status = data.TICKET_USE_OK
+	result.Uses = remaining
+	return result, nil
+}
+
+// Returns TICKET_USE_OK the first time a ticket is denied and
+// TICKET_USE_NOT_FOUND if it already was (i.e. it's already been used).
+func (c Conn) TicketDeny(ctx context.Context, opts data.TicketDeny) (data.TicketUseResult, error) {
+	var result data.TicketUseResult
+
+	err := c.Exec(`
+		insert into authen_ticket_denylist (project_id, ticket, expires)
+		values (?1, ?2, ?3)
+		on conflict do nothing
+	`, opts.ProjectId, opts.Ticket, opts.Expires)
+
+	if err != nil {
+		return result, fmt.Errorf("Sqlite.TicketDeny - %w", err)
+	}
+
+	if c.Changes() == 0 {
+		result.Status = data.TICKET_USE_NOT_FOUND
+		return result, nil
+	}
+
+	result.Status = data.TICKET_USE_OK
+	return result, nil
+}
+
+// What the user's successful login logs say about given, the ip_prefix
+// or device (column) derived from source. Each probe is an exists, which
+// stops at the first match; the tracked and known ones can use the
+// (project_id, user_id, column) index. Untracked history only matters
+// when nothing is tracked, so it's only looked for then.
+func (c Conn) loginHistory(opts data.LoginLogCreate, column string, source string, given *string) (data.LoginHistory, error) {
+	var history data.LoginHistory
+	if given == nil {
+		return history, nil
+	}
+
+	probe := func(condition string, args ...any) (bool, error) {
+		var found bool
+		args = append([]any{opts.ProjectId, opts.UserId}, args...)
+		where := "project_id = ?1 and user_id = ?2 and " + condition + whereIn("status", opts.SuccessStatuses, &args)
+		err := c.Row(`
+			select exists (
+				select 1 from authen_login_logs
+				where `+where+`
+			)
+		`, args...).Scan(&found)
+
+		if err != nil {
+			return false, fmt.Errorf("Sqlite.LoginLogCreate (%s) - %w", column, err)
+		}
+		return found, nil
+	}
+
+	tracked, err := probe(column + " is not null")
+	if err != nil {
+		return history, err
+	}
+	if !tracked {
+		history.Untracked, err = probe(source + " is not null and " + column + " is null")
+		return history, err
+	}
+
+	history.Tracked = true
+	history.Known, err = probe(column+" = ?3", *given)
+	return history, err
+}
+
+func (c Conn) LoginLogCreate(ctx context.Context, opts data.LoginLogCreate) (data.LoginLogCreateResult, error) {
 	id := opts.Id
 	max := opts.Max
 	payload := opts.Payload
 	userId := opts.UserId
 	status := opts.Status
 	projectId := opts.ProjectId
+	payloadKey := opts.PayloadKey
 
 	var result data.LoginLogCreateResult
 
-	canAdd, err := c.loginLogCanAdd(projectId, max)
-	if err != nil {
-		return result, err
+	if !c.strict {
+		canAdd, err := c.loginLogCanAdd(projectId, max)
+		if err != nil {
+			return result, err
+		}
+
+		if !canAdd {
+			result.Status = data.LOGIN_LOG_CREATE_MAX
+			return result, nil
+		}
 	}
 
-	if !canAdd {
-		result.Status = data.LOGIN_LOG_CREATE_MAX
-		return result, nil
+	if opts.TracksHistory() {
+		// must happen before the insert, else we'd always find ourselves
+		ip, err := c.loginHistory(opts, "ip_prefix", "ip", opts.IpPrefix)
+		if err != nil {
+			return result, err
+		}
+		device, err := c.loginHistory(opts, "device", "user_agent", opts.Device)
+		if err != nil {
+			return result, err
+		}
+		result.NewIp = ip.IsNew(opts.IpPrefix)
+		result.NewDevice = device.IsNew(opts.Device)
 	}
 
-	err = c.Exec(`
-		insert into authen_login_logs (id, project_id, user_id, status, payload)
-		values (?1, ?2, ?3, ?4, ?5)
-	`, id, projectId, userId, status, payload)
+	insert := func() error {
+		err := c.Exec(`
+			insert into authen_login_logs (id, project_id, user_id, status, payload, payload_key, ip, user_agent, method, country, ip_prefix, device)
+			values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12)
+		`, id, projectId, userId, status, payload, payloadKey, opts.Ip, opts.UserAgent, opts.Method, opts.Country, opts.IpPrefix, opts.Device)
 
+		if err != nil {
+			return fmt.Errorf("Sqlite.LoginLogCreate - %w", err)
+		}
+		return nil
+	}
+
+	var err error
+	if c.strict && max > 0 {
+		canAdd := true
+		err = c.Transaction(func() error {
+			count, err := c.projectCount(projectId, "login_log", "authen_login_logs")
+			if err != nil {
+				return err
+			}
+			if canAdd = count < max; !canAdd {
+				return nil
+			}
+			return insert()
+		})
+		if err == nil && !canAdd {
+			return data.LoginLogCreateResult{Status: data.LOGIN_LOG_CREATE_MAX}, nil
+		}
+	} else {
+		err = insert()
+	}
 	if err != nil {
-		return result, fmt.Errorf("Sqlite.LoginLogCreate - %w", err)
+		return result, err
+	}
+
+	if retain := opts.RetainCount; retain > 0 {
+		err = c.Exec(`
+			delete from authen_login_logs
+			where id in (
+				select id from authen_login_logs
+				where project_id = ?1 and user_id = ?2
+				order by created desc, id desc
+				limit -1 offset ?3
+			)
+		`, projectId, userId, retain)
+
+		if err != nil {
+			return result, fmt.Errorf("Sqlite.LoginLogCreate (retain) - %w", err)
+		}
+	}
+
+	if rules := opts.Lockout; len(rules) > 0 {
+		lockedUntil, err := c.userLockEvaluate(projectId, userId, status, rules)
+		if err != nil {
+			return result, err
+		}
+		result.LockedUntil = lockedUntil
 	}
 
 	result.Status = data.LOGIN_LOG_CREATE_OK
 	return result, nil
 }
 
-func (c Conn) LoginLogGet(opts data.LoginLogGet) (data.LoginLogGetResult, error) {
-	userId := opts.UserId
-	projectId := opts.ProjectId
+func (c Conn) LoginLogGet(ctx context.Context, opts data.LoginLogGet) (data.LoginLogGetResult, error) {
 	limit := opts.Limit
 	offset := opts.Offset
+	if opts.Cursor != nil {
+		offset = 0
+	}
 
 	var result data.LoginLogGetResult
 
+	where, args := loginLogWhere(opts)
+	n := len(args)
+	args = append(args, limit, offset)
+
 	rows := c.Rows(`
-		select id, status, payload, created
+		select id, status, payload, payload_key, created, ip, user_agent, method, country
 		from authen_login_logs
-		where project_id = ?1 and user_id = ?2
-		order by created desc
-		limit ?3 offset ?4
-	`, projectId, userId, limit, offset)
+		where `+where+`
+		order by created desc, id desc
+		limit ?`+strconv.Itoa(n+1)+` offset ?`+strconv.Itoa(n+2), args...)
 
 	if err := rows.Error(); err != nil {
 		return result, fmt.Errorf("Sqlite.LoginLogGet (select) - %w", err)
@@ -395,20 +804,8 @@ func (c Conn) LoginLogGet(opts data.LoginLogGet) (data.LoginLogGetResult, error)
 	i := 0
 	records := make([]data.LoginLogRecord, limit)
 	for rows.Next() {
-		var payload any
-		var payloadBytes *[]byte
 		var record data.LoginLogRecord
-
-		rows.Scan(&record.Id, &record.Status, &payloadBytes, &record.Created)
-		if payloadBytes != nil {
-			//rather not do this here, but it's better for our handler, so...
-			if err := json.Unmarshal(*payloadBytes, &payload); err != nil {
-				// very weird, as we've been able to deal with this as json so far
-				log.Error("login_record_payload").Err(err).String("payload", string(*payloadBytes)).Log()
-			}
-			record.Payload = payload
-		}
-
+		rows.Scan(&record.Id, &record.Status, &record.RawPayload, &record.PayloadKey, &record.Created, &record.Ip, &record.UserAgent, &record.Method, &record.Country)
 		records[i] = record
 		i += 1
 	}
@@ -422,6 +819,259 @@ func (c Conn) LoginLogGet(opts data.LoginLogGet) (data.LoginLogGetResult, error)
 	return result, nil
 }
 
+// Aggregated in the database: a range can cover far more logs than we'd
+// want to pull through LoginLogGet.
+func (c Conn) LoginLogStats(ctx context.Context, opts data.LoginLogStats) (data.LoginLogStatsResult, error) {
+	var result data.LoginLogStatsResult
+
+	args := []any{opts.ProjectId, opts.Since, opts.Until}
+	where := "project_id = ?1 and created >= ?2 and created < ?3"
+	where += whereIn("status", opts.Statuses, &args)
+
+	// created is in seconds, and unix time has no leap seconds, so
+	// truncating to a multiple of the unit gives us a UTC day/hour
+	unit := "86400"
+	if opts.Hourly {
+		unit = "3600"
+	}
+
+	rows := c.Rows(`
+		select created - created % `+unit+` as bucket, status, count(*)
+		from authen_login_logs
+		where `+where+`
+		group by bucket, status
+		order by bucket, status
+	`, args...)
+	if err := rows.Error(); err != nil {
+		return result, fmt.Errorf("Sqlite.LoginLogStats (buckets) - %w", err)
+	}
+	defer rows.Close()
+
+	buckets := make([]data.LoginLogStatsBucket, 0, 32)
+	for rows.Next() {
+		var unix int64
+		var bucket data.LoginLogStatsBucket
+		rows.Scan(&unix, &bucket.Status, &bucket.Count)
+		bucket.Time = time.Unix(unix, 0).UTC()
+		buckets = append(buckets, bucket)
+	}
+	if err := rows.Error(); err != nil {
+		return result, fmt.Errorf("Sqlite.LoginLogStats (buckets scan) - %w", err)
+	}
+	result.Buckets = buckets
+
+	distinct, err := sqlite.Scalar[int](c.Conn, `
+		select count(distinct user_id)
+		from authen_login_logs
+		where `+where, args...)
+	if err != nil {
+		return result, fmt.Errorf("Sqlite.LoginLogStats (distinct) - %w", err)
+	}
+	result.DistinctUsers = distinct
+
+	failed := opts.FailedStatuses
+	if len(failed) == 0 || opts.Top == 0 {
+		return result, nil
+	}
+
+	where += whereIn("status", failed, &args)
+	args = append(args, opts.Top)
+	failingRows := c.Rows(`
+		select user_id, count(*) as failures
+		from authen_login_logs
+		where `+where+`
+		group by user_id
+		order by failures desc, user_id
+		limit ?`+strconv.Itoa(len(args)), args...)
+	if err := failingRows.Error(); err != nil {
+		return result, fmt.Errorf("Sqlite.LoginLogStats (failing) - %w", err)
+	}
+	defer failingRows.Close()
+
+	users := make([]data.LoginLogStatsUser, 0, opts.Top)
+	for failingRows.Next() {
+		var user data.LoginLogStatsUser
+		failingRows.Scan(&user.UserId, &user.Count)
+		users = append(users, user)
+	}
+	if err := failingRows.Error(); err != nil {
+		return result, fmt.Errorf("Sqlite.LoginLogStats (failing scan) - %w", err)
+	}
+	result.TopFailing = users
+
+	return result, nil
+}
+
+func (c Conn) LoginLogDelete(ctx context.Context, opts data.LoginLogDelete) (int, error) {
+	// without either, we'd delete all of the project's logs
+	if opts.UserId == "" && len(opts.Ids) == 0 {
+		return 0, nil
+	}
+
+	args := []any{opts.ProjectId}
+	where := "project_id = ?1"
+	if userId := opts.UserId; userId != "" {
+		args = append(args, userId)
+		where += " and user_id = ?" + strconv.Itoa(len(args))
+	}
+	where += whereIn("id", opts.Ids, &args)
+
+	err := c.Exec(`
+		delete from authen_login_logs
+		where `+where, args...)
+
+	if err != nil {
+		return 0, fmt.Errorf("Sqlite.LoginLogDelete - %w", err)
+	}
+	return c.Changes(), nil
+}
+
+func (c Conn) UserLockGet(ctx context.Context, opts data.UserLockGet) (data.UserLock, error) {
+	var result data.UserLock
+
+	lockedUntil, err := sqlite.Scalar[*int64](c.Conn, `
+		select locked_until
+		from authen_user_locks
+		where project_id = ?1 and user_id = ?2 and locked_until > unixepoch()
+	`, opts.ProjectId, opts.UserId)
+
+	if err != nil {
+		if err == sqlite.ErrNoRows {
+			return result, nil
+		}
+		return result, fmt.Errorf("Sqlite.UserLockGet - %w", err)
+	}
+
+	result.LockedUntil = unixTime(lockedUntil)
+	return result, nil
+}
+
+// Returns true if the user was locked. Whether or not they were, login
+// logs up to now no longer count towards a new lock.
+func (c Conn) UserUnlock(ctx context.Context, opts data.UserLockGet) (bool, error) {
+	projectId := opts.ProjectId
+	userId := opts.UserId
+
+	locked, err := sqlite.Scalar[bool](c.Conn, `
+		select exists (
+			select 1 from authen_user_locks
+			where project_id = ?1 and user_id = ?2 and locked_until > unixepoch()
+		)
+	`, projectId, userId)
+
+	if err != nil {
+		return false, fmt.Errorf("Sqlite.UserUnlock (get) - %w", err)
+	}
+
+	err = c.Exec(`
+		insert into authen_user_locks (project_id, user_id, locked_until, reset)
+		values (?1, ?2, null, unixepoch())
+		on conflict (project_id, user_id) do update
+		set locked_until = null, reset = excluded.reset
+	`, projectId, userId)
+
+	if err != nil {
+		return false, fmt.Errorf("Sqlite.UserUnlock - %w", err)
+	}
+	return locked, nil
+}
+
+// Read in batches, each one picking up (by created, id) after the last
+// record of the previous, so that the connection isn't held for the
+// duration of the export.
+func (c Conn) LoginLogExport(ctx context.Context, opts data.LoginLogExport, fn func(data.LoginLogRecord) error) error {
+	args := []any{opts.ProjectId}
+	where := "project_id = ?1"
+	if userId := opts.UserId; userId != "" {
+		args = append(args, userId)
+		where += " and user_id = ?" + strconv.Itoa(len(args))
+	}
+	if since := opts.Since; since != nil {
+		args = append(args, *since)
+		where += " and created >= ?" + strconv.Itoa(len(args))
+	}
+	if until := opts.Until; until != nil {
+		args = append(args, *until)
+		where += " and created < ?" + strconv.Itoa(len(args))
+	}
+
+	n := len(args)
+	sql := `
+		select id, user_id, status, payload, payload_key, created, ip, user_agent, method, country
+		from authen_login_logs
+		where ` + where + `
+			and (?` + strconv.Itoa(n+1) + ` is null or created > ?` + strconv.Itoa(n+1) + ` or (created = ?` + strconv.Itoa(n+1) + ` and id > ?` + strconv.Itoa(n+2) + `))
+		order by created, id
+		limit ` + strconv.Itoa(loginLogExportBatch)
+
+	// nil for the first batch
+	var lastCreated, lastId any
+
+	batch := make([]data.LoginLogRecord, 0, loginLogExportBatch)
+	for {
+		batch = batch[:0]
+		rows := c.Rows(sql, append(args, lastCreated, lastId)...)
+		for rows.Next() {
+			var record data.LoginLogRecord
+			rows.Scan(&record.Id, &record.UserId, &record.Status, &record.RawPayload, &record.PayloadKey, &record.Created, &record.Ip, &record.UserAgent, &record.Method, &record.Country)
+			batch = append(batch, record)
+		}
+		err := rows.Error()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("Sqlite.LoginLogExport - %w", err)
+		}
+
+		for _, record := range batch {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+
+		if len(batch) < loginLogExportBatch {
+			return nil
+		}
+		last := batch[len(batch)-1]
+		lastCreated, lastId = last.Created, last.Id
+	}
+}
+
+// Used to encrypt payloads created before payload encryption existed
+func (c Conn) LoginLogGetUnencrypted(ctx context.Context, limit int) ([]data.LoginLogRecord, error) {
+	rows := c.Rows(`
+		select id, payload
+		from authen_login_logs
+		where payload is not null and payload_key = 0
+		limit ?1
+	`, limit)
+	defer rows.Close()
+
+	records := make([]data.LoginLogRecord, 0, limit)
+	for rows.Next() {
+		var record data.LoginLogRecord
+		rows.Scan(&record.Id, &record.RawPayload)
+		records = append(records, record)
+	}
+
+	if err := rows.Error(); err != nil {
+		return nil, fmt.Errorf("Sqlite.LoginLogGetUnencrypted - %w", err)
+	}
+	return records, nil
+}
+
+func (c Conn) LoginLogUpdatePayload(ctx context.Context, opts data.LoginLogUpdatePayload) error {
+	err := c.Exec(`
+		update authen_login_logs
+		set payload = ?2, payload_key = ?3
+		where id = ?1
+	`, opts.Id, opts.Payload, opts.PayloadKey)
+
+	if err != nil {
+		return fmt.Errorf("Sqlite.LoginLogUpdatePayload - %w", err)
+	}
+	return nil
+}
+
 func (c Conn) totpCanAdd(projectId string, userId string, tpe string, max int) (bool, error) {
 	// no limit
 	if max == 0 {
@@ -458,7 +1108,7 @@ func (c Conn) totpCanAdd(projectId string, userId string, tpe string, max int) (
 	return count < max, nil
 }
 
-func (c Conn) ticketCanAdd(projectId string, max int) (bool, error) {
+func (c Conn) ticketCanAdd(projectId string, max int, n int) (bool, error) {
 	// no limit
 	if max == 0 {
 		return true, nil
@@ -473,7 +1123,22 @@ func (c Conn) ticketCanAdd(projectId string, max int) (bool, error) {
 	if err != nil {
 		return false, fmt.Errorf("Sqlite.ticketCanAdd (count) - %w", err)
 	}
-	return count < max, nil
+	return count+n <= max, nil
+}
+
+// A code wasn't found. Codes are short enough to be guessed, so every
+// miss burns an attempt from all the live codes within the scope.
+func (c Conn) ticketFailedAttempt(projectId string, scope []byte) error {
+	err := c.Exec(`
+		update authen_tickets
+		set attempts = attempts - 1
+		where project_id = ?1 and scope = ?2 and attempts > 0
+	`, projectId, scope)
+
+	if err != nil {
+		return fmt.Errorf("Sqlite.ticketFailedAttempt - %w", err)
+	}
+	return nil
 }
 
 func (c Conn) loginLogCanAdd(projectId string, max int) (bool, error) {
@@ -494,21 +1159,162 @@ func (c Conn) loginLogCanAdd(projectId string, max int) (bool, error) {
 	return count < max, nil
 }
 
+// totpCanAdd, but against authen_project_counts. Must be called within
+// the transaction doing the insert.
+func (c Conn) totpCanAddStrict(projectId string, userId string, tpe string, max int) (bool, error) {
+	exists, err := sqlite.Scalar[bool](c.Conn, `
+		select exists (
+			select 1
+			from authen_totps
+			where project_id = ?1 and user_id = ?2 and type = ?3
+		)`, projectId, userId, tpe)
+
+	if err != nil {
+		return false, fmt.Errorf("Sqlite.totpCanAddStrict (exists) - %w", err)
+	}
+	if exists {
+		return true, nil
+	}
+
+	count, err := c.projectCount(projectId, "totp", "authen_totps")
+	if err != nil {
+		return false, err
+	}
+	return count < max, nil
+}
+
+// The number of rows the project has in table, as tracked (by triggers)
+// in authen_project_counts. The project's rows are only counted the first
+// time. Must be called within the transaction doing the insert, which,
+// since sqlite only has a single writer, makes the check and insert atomic.
+func (c Conn) projectCount(projectId string, resource string, table string) (int, error) {
+	count, err := sqlite.Scalar[int](c.Conn, `
+		select count
+		from authen_project_counts
+		where project_id = ?1 and resource = ?2
+	`, projectId, resource)
+
+	if err == nil {
+		return count, nil
+	}
+	if err != sqlite.ErrNoRows {
+		return 0, fmt.Errorf("Sqlite.projectCount (select) - %w", err)
+	}
+
+	count, err = sqlite.Scalar[int](c.Conn, `
+		insert into authen_project_counts (project_id, resource, count)
+		select ?1, ?2, count(*)
+		from `+table+`
+		where project_id = ?1
+		returning count
+	`, projectId, resource)
+
+	if err != nil {
+		return 0, fmt.Errorf("Sqlite.projectCount (insert) - %w", err)
+	}
+	return count, nil
+}
+
+// Evaluates the rules which match the new login log's status and
+// returns the user's lock, which might predate this login log. Only
+// login logs newer than the user's last lock (or unlock) are counted.
+func (c Conn) userLockEvaluate(projectId string, userId string, status int, rules []data.LockoutRule) (*time.Time, error) {
+	var reset, lockedUntil *int64
+	row := c.Row(`
+		select reset, case when locked_until > unixepoch() then locked_until end
+		from authen_user_locks
+		where project_id = ?1 and user_id = ?2
+	`, projectId, userId)
+
+	if err := row.Scan(&reset, &lockedUntil); err != nil && err != sqlite.ErrNoRows {
+		return nil, fmt.Errorf("Sqlite.userLockEvaluate (get) - %w", err)
+	}
+
+	duration := 0
+	for _, rule := range rules {
+		// a rule can only matter if it would lock for longer
+		if rule.Duration <= duration || !rule.Matches(status) {
+			continue
+		}
+
+		args := []any{projectId, userId, rule.Window, reset}
+		failures, err := sqlite.Scalar[int](c.Conn, `
+			select count(*)
+			from authen_login_logs
+			where project_id = ?1 and user_id = ?2
+				and created > unixepoch() - ?3
+				and (?4 is null or created > ?4)
+		`+whereIn("status", rule.Statuses, &args), args...)
+
+		if err != nil {
+			return nil, fmt.Errorf("Sqlite.userLockEvaluate (count) - %w", err)
+		}
+		if failures >= rule.Failures {
+			duration = rule.Duration
+		}
+	}
+
+	if duration == 0 {
+		return unixTime(lockedUntil), nil
+	}
+
+	lockedUntil, err := sqlite.Scalar[*int64](c.Conn, `
+		insert into authen_user_locks (project_id, user_id, locked_until, reset)
+		values (?1, ?2, unixepoch() + ?3, unixepoch())
+		on conflict (project_id, user_id) do update
+		set locked_until = max(coalesce(locked_until, 0), excluded.locked_until),
+			reset = excluded.reset
+		returning locked_until
+	`, projectId, userId, duration)
+
+	if err != nil {
+		return nil, fmt.Errorf("Sqlite.userLockEvaluate (lock) - %w", err)
+	}
+	return unixTime(lockedUntil), nil
+}
+
+func unixTime(unix *int64) *time.Time {
+	if unix == nil {
+		return nil
+	}
+	t := time.Unix(*unix, 0).UTC()
+	return &t
+}
+
 func scanProject(scanner sqlite.Scanner) (*data.Project, error) {
 	var id, totpIssuer string
 	var totpMax, totpSetupTTL, totpSecretLength int
 	var ticketMax, ticketMaxPayloadLength int
 	var loginLogMax, loginLogMaxPayloadLength int
+	var loginLogRetainCount, loginLogRetainDays int
+	var loginLogRetainOnInsert bool
+	var lockoutRules, successStatuses *string
 
 	err := scanner.Scan(&id,
 		&totpIssuer, &totpMax, &totpSetupTTL, &totpSecretLength,
 		&ticketMax, &ticketMaxPayloadLength,
-		&loginLogMax, &loginLogMaxPayloadLength)
+		&loginLogMax, &loginLogMaxPayloadLength,
+		&loginLogRetainCount, &loginLogRetainDays, &loginLogRetainOnInsert,
+		&lockoutRules, &successStatuses)
 
 	if err != nil {
 		return nil, err
 	}
 
+	var lockout []data.LockoutRule
+	if lockoutRules != nil {
+		if err := json.Unmarshal([]byte(*lockoutRules), &lockout); err != nil {
+			return nil, fmt.Errorf("Sqlite.scanProject (lockout_rules) - %w", err)
+		}
+	}
+
+	var success []int
+	if successStatuses != nil {
+		if err := json.Unmarshal([]byte(*successStatuses), &success); err != nil {
+			return nil, fmt.Errorf("Sqlite.scanProject (login_log_success_statuses) - %w", err)
+		}
+	}
+
 	return &data.Project{
 		Id:                       id,
 		TOTPMax:                  totpMax,
@@ -519,5 +1325,331 @@ func scanProject(scanner sqlite.Scanner) (*data.Project, error) {
 		TicketMaxPayloadLength:   ticketMaxPayloadLength,
 		LoginLogMax:              loginLogMax,
 		LoginLogMaxPayloadLength: loginLogMaxPayloadLength,
+		LoginLogRetainCount:      loginLogRetainCount,
+		LoginLogRetainDays:       loginLogRetainDays,
+		LoginLogRetainOnInsert:   loginLogRetainOnInsert,
+		LockoutRules:             lockout,
+		LoginLogSuccessStatuses:  success,
 	}, nil
 }
+
+// A single multi-row insert for the whole batch.
+func ticketCreateSQL(projectId string, tickets []data.TicketCreateTicket) (string, []any) {
+	const columns = 9
+	args := make([]any, 0, len(tickets)*columns)
+
+	var sb strings.Builder
+	sb.WriteString(`
+		insert into authen_tickets (project_id, ticket, expires, uses, payload, scope, attempts, payload_encrypted, sliding_ttl)
+		values `)
+
+	for i, t := range tickets {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteByte('(')
+		for j := 1; j <= columns; j++ {
+			if j > 1 {
+				sb.WriteString(", ")
+			}
+			sb.WriteByte('?')
+			sb.WriteString(strconv.Itoa(i*columns + j))
+		}
+		sb.WriteByte(')')
+		args = append(args, projectId, t.Ticket, t.Expires, t.Uses, t.Payload, t.Scope, t.Attempts, t.PayloadEncrypted, t.SlidingTTL)
+	}
+	sb.WriteString(" on conflict do nothing")
+	return sb.String(), args
+}
+
+// sqlite has no array parameters, so "column in (?n, ?n+1...)" is built
+// with a placeholder per value. Returns an empty string if there are no
+// values.
+func whereIn[T any](column string, values []T, args *[]any) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	where := " and " + column + " in ("
+	for i, value := range values {
+		if i > 0 {
+			where += ", "
+		}
+		*args = append(*args, value)
+		where += "?" + strconv.Itoa(len(*args))
+	}
+	return where + ")"
+}
+
+func loginLogWhere(opts data.LoginLogGet) (string, []any) {
+	args := []any{opts.ProjectId, opts.UserId}
+	where := "project_id = ?1 and user_id = ?2"
+
+	where += whereIn("status", opts.Statuses, &args)
+	if since := opts.Since; since != nil {
+		args = append(args, *since)
+		where += " and created >= ?" + strconv.Itoa(len(args))
+	}
+	if until := opts.Until; until != nil {
+		args = append(args, *until)
+		where += " and created < ?" + strconv.Itoa(len(args))
+	}
+	for _, f := range [...]struct {
+		column string
+		value  string
+	}{
+		{"ip", opts.Ip},
+		{"user_agent", opts.UserAgent},
+		{"method", opts.Method},
+		{"country", opts.Country},
+	} {
+		if f.value != "" {
+			args = append(args, f.value)
+			where += " and " + f.column + " = ?" + strconv.Itoa(len(args))
+		}
+	}
+	if cursor := opts.Cursor; cursor != nil {
+		args = append(args, cursor.Created, cursor.Id)
+		created, id := strconv.Itoa(len(args)-1), strconv.Itoa(len(args))
+		where += " and (created < ?" + created + " or (created = ?" + created + " and id < ?" + id + "))"
+	}
+	return where, args
+}
+
+// Calls fn for every row, table by table. Used to move from sqlite to
+// another storage (see authen.Export).
+func (c Conn) Dump(fn func(data.DumpRecord) error) error {
+	rows := c.Rows(`
+		select id,
+			totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
+			ticket_max, ticket_max_payload_length,
+			login_log_max, login_log_max_payload_length,
+			login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+			lockout_rules, login_log_success_statuses, updated
+		from authen_projects
+	`)
+	err := dumpRows(&rows, fn, func() (data.DumpRecord, error) {
+		var updated time.Time
+		project, err := scanProject(withUpdated{&rows, &updated})
+		if err != nil {
+			return data.DumpRecord{}, err
+		}
+		return data.DumpRecord{Project: &data.DumpProject{Project: *project, Updated: updated}}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("Sqlite.Dump (projects) - %w", err)
+	}
+
+	rows = c.Rows(`
+		select project_id, user_id, type, pending, secret, expires, created
+		from authen_totps
+	`)
+	err = dumpRows(&rows, fn, func() (data.DumpRecord, error) {
+		t := new(data.DumpTOTP)
+		err := rows.Scan(&t.ProjectId, &t.UserId, &t.Type, &t.Pending, &t.Secret, &t.Expires, &t.Created)
+		return data.DumpRecord{TOTP: t}, err
+	})
+	if err != nil {
+		return fmt.Errorf("Sqlite.Dump (totps) - %w", err)
+	}
+
+	rows = c.Rows(`
+		select project_id, ticket, payload, payload_encrypted, uses, expires, sliding_ttl, scope, attempts, created
+		from authen_tickets
+	`)
+	err = dumpRows(&rows, fn, func() (data.DumpRecord, error) {
+		t := new(data.DumpTicket)
+		err := rows.Scan(&t.ProjectId, &t.Ticket, &t.Payload, &t.PayloadEncrypted, &t.Uses, &t.Expires, &t.SlidingTTL, &t.Scope, &t.Attempts, &t.Created)
+		return data.DumpRecord{Ticket: t}, err
+	})
+	if err != nil {
+		return fmt.Errorf("Sqlite.Dump (tickets) - %w", err)
+	}
+
+	rows = c.Rows(`
+		select project_id, ticket, expires
+		from authen_ticket_denylist
+	`)
+	err = dumpRows(&rows, fn, func() (data.DumpRecord, error) {
+		d := new(data.DumpDenied)
+		err := rows.Scan(&d.ProjectId, &d.Ticket, &d.Expires)
+		return data.DumpRecord{Denied: d}, err
+	})
+	if err != nil {
+		return fmt.Errorf("Sqlite.Dump (ticket denylist) - %w", err)
+	}
+
+	rows = c.Rows(`
+		select id, project_id, user_id, status, payload, payload_key, created, ip, user_agent, method, country, ip_prefix, device
+		from authen_login_logs
+		order by created, id
+	`)
+	err = dumpRows(&rows, fn, func() (data.DumpRecord, error) {
+		l := new(data.DumpLoginLog)
+		err := rows.Scan(&l.Id, &l.ProjectId, &l.UserId, &l.Status, &l.Payload, &l.PayloadKey, &l.Created, &l.Ip, &l.UserAgent, &l.Method, &l.Country, &l.IpPrefix, &l.Device)
+		return data.DumpRecord{LoginLog: l}, err
+	})
+	if err != nil {
+		return fmt.Errorf("Sqlite.Dump (login logs) - %w", err)
+	}
+
+	rows = c.Rows(`
+		select project_id, user_id, locked_until, reset
+		from authen_user_locks
+	`)
+	err = dumpRows(&rows, fn, func() (data.DumpRecord, error) {
+		l := new(data.DumpUserLock)
+		err := rows.Scan(&l.ProjectId, &l.UserId, &l.LockedUntil, &l.Reset)
+		return data.DumpRecord{UserLock: l}, err
+	})
+	if err != nil {
+		return fmt.Errorf("Sqlite.Dump (user locks) - %w", err)
+	}
+
+	return nil
+}
+
+// Inserts (or replaces) the rows, in a single transaction. Counts in
+// authen_project_counts for the projects touched are removed (they're
+// re-seeded from the tables when next needed) since "insert or replace"
+// doesn't fire the delete triggers.
+func (c Conn) Load(records []data.DumpRecord) error {
+	err := c.Transaction(func() error {
+		projectIds := make(map[string]struct{})
+		for _, record := range records {
+			var err error
+			switch {
+			case record.Project != nil:
+				p := record.Project
+				var lockoutRules, successStatuses *string
+				if lockoutRules, err = encodeList(p.LockoutRules); err != nil {
+					return err
+				}
+				if successStatuses, err = encodeList(p.LoginLogSuccessStatuses); err != nil {
+					return err
+				}
+				err = c.Exec(`
+					insert or replace into authen_projects (id,
+						totp_issuer, totp_max, totp_setup_ttl, totp_secret_length,
+						ticket_max, ticket_max_payload_length,
+						login_log_max, login_log_max_payload_length,
+						login_log_retain_count, login_log_retain_days, login_log_retain_on_insert,
+						lockout_rules, login_log_success_statuses, updated)
+					values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15)
+				`, p.Id,
+					p.TOTPIssuer, p.TOTPMax, p.TOTPSetupTTL, p.TOTPSecretLength,
+					p.TicketMax, p.TicketMaxPayloadLength,
+					p.LoginLogMax, p.LoginLogMaxPayloadLength,
+					p.LoginLogRetainCount, p.LoginLogRetainDays, p.LoginLogRetainOnInsert,
+					lockoutRules, successStatuses, p.Updated)
+			case record.TOTP != nil:
+				t := record.TOTP
+				projectIds[t.ProjectId] = struct{}{}
+				err = c.Exec(`
+					insert or replace into authen_totps (project_id, user_id, type, pending, secret, expires, created)
+					values (?1, ?2, ?3, ?4, ?5, ?6, ?7)
+				`, t.ProjectId, t.UserId, t.Type, t.Pending, t.Secret, t.Expires, t.Created)
+			case record.Ticket != nil:
+				t := record.Ticket
+				projectIds[t.ProjectId] = struct{}{}
+				err = c.Exec(`
+					insert or replace into authen_tickets (project_id, ticket, payload, payload_encrypted, uses, expires, sliding_ttl, scope, attempts, created)
+					values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10)
+				`, t.ProjectId, t.Ticket, t.Payload, t.PayloadEncrypted, t.Uses, t.Expires, t.SlidingTTL, t.Scope, t.Attempts, t.Created)
+			case record.Denied != nil:
+				d := record.Denied
+				err = c.Exec(`
+					insert or replace into authen_ticket_denylist (project_id, ticket, expires)
+					values (?1, ?2, ?3)
+				`, d.ProjectId, d.Ticket, d.Expires)
+			case record.LoginLog != nil:
+				l := record.LoginLog
+				projectIds[l.ProjectId] = struct{}{}
+				err = c.Exec(`
+					insert or replace into authen_login_logs (id, project_id, user_id, status, payload, payload_key, created, ip, user_agent, method, country, ip_prefix, device)
+					values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13)
+				`, l.Id, l.ProjectId, l.UserId, l.Status, l.Payload, l.PayloadKey, l.Created, l.Ip, l.UserAgent, l.Method, l.Country, l.IpPrefix, l.Device)
+			case record.UserLock != nil:
+				l := record.UserLock
+				err = c.Exec(`
+					insert or replace into authen_user_locks (project_id, user_id, locked_until, reset)
+					values (?1, ?2, ?3, ?4)
+				`, l.ProjectId, l.UserId, l.LockedUntil, l.Reset)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		for projectId := range projectIds {
+			if err := c.Exec("delete from authen_project_counts where project_id = ?1", projectId); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("Sqlite.Load - %w", err)
+	}
+	return nil
+}
+
+// The number of rows of each kind (keyed by data.DumpRecord.Kind), so
+// that an import can be checked without reading everything back.
+func (c Conn) Counts() (map[string]int, error) {
+	var projects, totps, tickets, denied, loginLogs, userLocks int
+	err := c.Row(`
+		select
+			(select count(*) from authen_projects),
+			(select count(*) from authen_totps),
+			(select count(*) from authen_tickets),
+			(select count(*) from authen_ticket_denylist),
+			(select count(*) from authen_login_logs),
+			(select count(*) from authen_user_locks)
+	`).Scan(&projects, &totps, &tickets, &denied, &loginLogs, &userLocks)
+
+	if err != nil {
+		return nil, fmt.Errorf("Sqlite.Counts - %w", err)
+	}
+	return data.DumpCounts(projects, totps, tickets, denied, loginLogs, userLocks), nil
+}
+
+// what's stored in authen_projects' json columns, lockout_rules and
+// login_log_success_statuses (the reverse of scanProject)
+func encodeList[T any](values []T) (*string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	text := string(encoded)
+	return &text, nil
+}
+
+// Closes rows
+func dumpRows(rows *sqlite.Rows, fn func(data.DumpRecord) error, scan func() (data.DumpRecord, error)) error {
+	defer rows.Close()
+	for rows.Next() {
+		record, err := scan()
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Error()
+}
+
+// Lets Dump use scanProject, with updated as an extra, last, column
+type withUpdated struct {
+	sqlite.Scanner
+	updated *time.Time
+}
+
+func (s withUpdated) Scan(dest ...any) error {
+	return s.Scanner.Scan(append(dest, s.updated)...)
+}
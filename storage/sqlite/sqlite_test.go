@@ -1,7 +1,9 @@
 package sqlite
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
@@ -22,12 +24,6 @@ func init() {
 	}
 }
 
-func Test_Ping(t *testing.T) {
-	withTestDB(func(conn Conn) {
-		assert.Nil(t, conn.Ping())
-	})
-}
-
 func Test_Clean_Totps(t *testing.T) {
 	withTestDB(func(conn Conn) {
 		conn.MustExec(`
@@ -38,7 +34,9 @@ func Test_Clean_Totps(t *testing.T) {
 			(null, ?1, 'uid4', '', false, '')
 		`, uuid.String())
 
-		assert.Nil(t, conn.Clean())
+		result, err := conn.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.TOTPs, 2)
 		rows, _ := conn.RowsToMap("select user_id from authen_totps order by user_id")
 		assert.Equal(t, len(rows), 2)
 		assert.Equal(t, rows[0].String("user_id"), "uid3")
@@ -49,15 +47,18 @@ func Test_Clean_Totps(t *testing.T) {
 func Test_Clean_Tickets(t *testing.T) {
 	withTestDB(func(conn Conn) {
 		conn.MustExec(`
-			insert into authen_tickets (expires, uses, project_id, ticket) values
-			(unixepoch() - 1, null, ?1, 't1'),
-			(unixepoch() - 999, null, ?1, 't2'),
-			(null, 0, ?1, 't3'),
-			(unixepoch() + 5, 1, ?1, 't4'),
-			(null, null, ?1, 't5')
+			insert into authen_tickets (expires, uses, project_id, ticket, attempts) values
+			(unixepoch() - 1, null, ?1, 't1', null),
+			(unixepoch() - 999, null, ?1, 't2', null),
+			(null, 0, ?1, 't3', null),
+			(unixepoch() + 5, 1, ?1, 't4', 1),
+			(null, null, ?1, 't5', null),
+			(null, null, ?1, 't6', 0)
 		`, uuid.String())
 
-		assert.Nil(t, conn.Clean())
+		result, err := conn.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.Tickets, 4)
 		rows, _ := conn.RowsToMap("select ticket from authen_tickets order by ticket")
 		assert.Equal(t, len(rows), 2)
 		assert.Bytes(t, rows[0].Bytes("ticket"), []byte("t4"))
@@ -65,725 +66,455 @@ func Test_Clean_Tickets(t *testing.T) {
 	})
 }
 
-func Test_GetProject_Unknown(t *testing.T) {
+func Test_Clean_TicketDenylist(t *testing.T) {
 	withTestDB(func(conn Conn) {
-		p, err := conn.GetProject("unknown")
+		conn.MustExec(`
+			insert into authen_ticket_denylist (expires, project_id, ticket) values
+			(unixepoch() - 1, ?1, 't1'),
+			(unixepoch() + 5, ?1, 't2')
+		`, uuid.String())
+
+		result, err := conn.Clean(context.Background(), data.Clean{})
 		assert.Nil(t, err)
-		assert.Nil(t, p)
+		assert.Equal(t, result.TicketDenylist, 1)
+		rows, _ := conn.RowsToMap("select ticket from authen_ticket_denylist order by ticket")
+		assert.Equal(t, len(rows), 1)
+		assert.Bytes(t, rows[0].Bytes("ticket"), []byte("t2"))
 	})
 }
 
-func Test_GetProject_Success(t *testing.T) {
+func Test_Clean_LoginLogs(t *testing.T) {
 	withTestDB(func(conn Conn) {
 		conn.MustExec(`
-			insert into authen_projects (id, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length)
-			values ('p1', 'is1', 93, 121, 39, 49, 1021, 59, 1029)
+			insert into authen_projects (id, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length, login_log_retain_count, login_log_retain_days)
+			values
+				('p1', '', 0, 0, 0, 0, 0, 0, 0, 2, 0),
+				('p2', '', 0, 0, 0, 0, 0, 0, 0, 0, 1),
+				('p3', '', 0, 0, 0, 0, 0, 0, 0, 0, 0)
 		`)
-		p, err := conn.GetProject("p1")
-		assert.Nil(t, err)
-		assert.Equal(t, p.Id, "p1")
-		assert.Equal(t, p.TOTPMax, 93)
-		assert.Equal(t, p.TOTPIssuer, "is1")
-		assert.Equal(t, p.TOTPSecretLength, 39)
-		assert.Equal(t, p.TOTPSetupTTL, 121)
-		assert.Equal(t, p.TicketMax, 49)
-		assert.Equal(t, p.TicketMaxPayloadLength, 1021)
-		assert.Equal(t, p.LoginLogMax, 59)
-		assert.Equal(t, p.LoginLogMaxPayloadLength, 1029)
-	})
-}
 
-func Test_GetUpdatedProjects_None(t *testing.T) {
-	withTestDB(func(conn Conn) {
 		conn.MustExec(`
-			insert into authen_projects (id, updated, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length)
-			values ('p1', 0, '', 0, 0, 0, 0, 0, 0, 0)
+			insert into authen_login_logs (id, project_id, user_id, status, created) values
+			('l1', 'p1', 'u1', 1, unixepoch()),
+			('l2', 'p1', 'u1', 2, unixepoch() - 60),
+			('l3', 'p1', 'u1', 3, unixepoch() - 120),
+			('l4', 'p1', 'u2', 4, unixepoch() - 120),
+			('l5', 'p2', 'u1', 5, unixepoch() - 82800),
+			('l6', 'p2', 'u1', 6, unixepoch() - 90000),
+			('l7', 'p3', 'u1', 7, unixepoch() - 86400000),
+			('l8', 'st', 'u1', 8, unixepoch()),
+			('l9', 'st', 'u1', 9, unixepoch() - 60),
+			('l10', 'st', 'u2', 10, unixepoch() - 172800)
 		`)
-		updated, err := conn.GetUpdatedProjects(time.Now())
+
+		assertStatuses := func(statuses ...int) {
+			t.Helper()
+			rows, _ := conn.RowsToMap("select status from authen_login_logs order by status")
+			assert.Equal(t, len(rows), len(statuses))
+			for i, status := range statuses {
+				assert.Equal(t, rows[i].Int("status"), status)
+			}
+		}
+
+		// no default retention, logs without a project are kept
+		result, err := conn.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.LoginLogs, 2)
+		assertStatuses(1, 2, 4, 5, 7, 8, 9, 10)
+
+		result, err = conn.Clean(context.Background(), data.Clean{LoginLogRetention: data.LoginLogRetention{Days: 1}})
+		assert.Nil(t, err)
+		assert.Equal(t, result.LoginLogs, 1)
+		assertStatuses(1, 2, 4, 5, 7, 8, 9)
+
+		result, err = conn.Clean(context.Background(), data.Clean{LoginLogRetention: data.LoginLogRetention{Count: 1}})
 		assert.Nil(t, err)
-		assert.Equal(t, len(updated), 0)
+		assert.Equal(t, result.LoginLogs, 1)
+		assertStatuses(1, 2, 4, 5, 7, 8)
 	})
 }
 
-func Test_GetUpdatedProjects_Success(t *testing.T) {
+func Test_Clean_UserLocks(t *testing.T) {
 	withTestDB(func(conn Conn) {
 		conn.MustExec(`
-			insert into authen_projects (id, updated, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length) values
-			('p1', unixepoch() - 500, '', 0, 0, 0, 0, 0, 0, 0),
-			('p2', unixepoch() - 200, '', 0, 0, 0, 0, 0, 0, 0),
-			('p3', unixepoch() - 100, '', 0, 0, 0, 0, 0, 0, 0),
-			('p4', unixepoch() - 10, '', 0, 0, 0, 0, 0, 0, 0)
+			insert into authen_user_locks (project_id, user_id, locked_until, reset) values
+			('p1', 'u1', unixepoch() + 60, unixepoch() - 172800),
+			('p1', 'u2', unixepoch() - 60, unixepoch() - 172800),
+			('p1', 'u3', null, unixepoch() - 172800),
+			('p1', 'u4', null, unixepoch() - 3600)
 		`)
-		updated, err := conn.GetUpdatedProjects(time.Now().Add(time.Second * -105))
-		assert.Nil(t, err)
-		assert.Equal(t, len(updated), 2)
 
-		// order isn't deterministic
-		id1, id2 := updated[0].Id, updated[1].Id
-		assert.True(t, id1 != id2)
-		assert.True(t, id1 == "p3" || id1 == "p4")
-		assert.True(t, id2 == "p3" || id2 == "p4")
+		result, err := conn.Clean(context.Background(), data.Clean{})
+		assert.Nil(t, err)
+		assert.Equal(t, result.UserLocks, 2)
+		rows, _ := conn.RowsToMap("select user_id from authen_user_locks order by user_id")
+		assert.Equal(t, len(rows), 2)
+		assert.Equal(t, rows[0].String("user_id"), "u1")
+		assert.Equal(t, rows[1].String("user_id"), "u4")
 	})
 }
 
-func Test_TOTPCreate(t *testing.T) {
+func Test_TicketUse_SlidingTTL(t *testing.T) {
 	withTestDB(func(conn Conn) {
-		now := time.Now()
-		projectId1, projectId2 := uuid.String(), uuid.String()
-
+		projectId := uuid.String()
 		conn.MustExec(`
-			insert into authen_totps (project_id, user_id, type, pending, secret) values
-			(?1, 'u1', 't1', 0, 'sec1'),
-			(?1, 'u2', 't2', 1, 'sec2')
-		`, projectId1)
-
-		// Adds more when less than max
-		for i, expires := range []*time.Time{nil, &now} {
-			secret := []byte{byte(i), byte(i)}
-			tpe := fmt.Sprintf("t-%d", i)
-			res, err := conn.TOTPCreate(data.TOTPCreate{
-				Max:       4,
-				UserId:    "u1",
-				Type:      tpe,
-				Secret:    secret,
-				Expires:   expires,
-				ProjectId: projectId1,
-			})
-			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.TOTP_CREATE_OK)
-
-			row, _ := conn.RowToMap("select * from authen_totps where project_id = ?1 and user_id = ?2 and type = ?3 and pending = ?4", projectId1, "u1", tpe, expires != nil)
-			assert.Nowish(t, row.Time("created"))
-			assert.Equal(t, row.Bool("pending"), expires != nil)
-			if expires == nil {
-				assert.Nil(t, row["expires"])
-			} else {
-				assert.Timeish(t, row.Time("expires"), *expires)
-			}
+			insert into authen_tickets (project_id, ticket, uses, expires, sliding_ttl) values
+			(?1, ?2, 5, unixepoch() + 10, 3600),
+			(?1, ?3, 5, unixepoch() + 10, null)
+		`, projectId, []byte("t1"), []byte("t2"))
 
-			assert.Bytes(t, row.Bytes("secret"), secret)
-		}
-
-		// can't add any more, pending or not:
-		for _, expires := range []*time.Time{nil, &now} {
-			res, err := conn.TOTPCreate(data.TOTPCreate{
-				Max:       4,
-				UserId:    "u4",
-				Type:      "",
-				Expires:   expires,
-				ProjectId: projectId1,
-				Secret:    []byte{13, 14},
-			})
+		for _, ticket := range []string{"t1", "t2"} {
+			res, err := conn.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId, Ticket: []byte(ticket)})
 			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.TOTP_CREATE_MAX)
+			assert.Equal(t, res.Status, data.TICKET_USE_OK)
+			assert.Equal(t, *res.Uses, 4)
 		}
 
-		// 0 == no limit
-		{
-			res, err := conn.TOTPCreate(data.TOTPCreate{
-				Max:       0,
-				UserId:    "u4",
-				Type:      "t4",
-				ProjectId: projectId1,
-				Secret:    []byte{23, 24},
-			})
-			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.TOTP_CREATE_OK)
-			row, _ := conn.RowToMap("select * from authen_totps where project_id = ?1 and user_id = ?2 and type = ?3", projectId1, "u4", "t4")
-			assert.Nowish(t, row.Time("created"))
-			assert.Nil(t, row["expires"])
-			assert.Bytes(t, row.Bytes("secret"), []byte{23, 24})
-		}
+		row, _ := conn.RowToMap("select expires from authen_tickets where project_id = $1 and ticket = $2", projectId, []byte("t1"))
+		assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Hour))
 
-		// limits are per project (there's no other totp for project2)
-		{
-			res, err := conn.TOTPCreate(data.TOTPCreate{
-				Max:       1,
-				UserId:    "u4",
-				Type:      "",
-				ProjectId: projectId2,
-				Secret:    []byte{23, 24},
-			})
-			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.TOTP_CREATE_OK)
-			row, _ := conn.RowToMap("select * from authen_totps where project_id = ?1 and user_id = ?2", projectId2, "u4")
-			assert.Nowish(t, row.Time("created"))
-			assert.Bytes(t, row.Bytes("secret"), []byte{23, 24})
-		}
+		row, _ = conn.RowToMap("select expires from authen_tickets where project_id = $1 and ticket = $2", projectId, []byte("t2"))
+		assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Second*10))
+	})
+}
 
-		// existing users+type don't increment count
-		for _, expires := range []*time.Time{nil, &now} {
-			res, err := conn.TOTPCreate(data.TOTPCreate{
-				Max:       1,
-				UserId:    "u1",
-				Type:      "t1",
+func Test_TicketExtend(t *testing.T) {
+	withTestDB(func(conn Conn) {
+		projectId := uuid.String()
+		conn.MustExec(`
+			insert into authen_tickets (project_id, ticket, uses, expires) values
+			(?1, ?2, 2, unixepoch() + 10),
+			(?1, ?3, null, null),
+			(?1, ?4, 0, null),
+			(?1, ?5, 2, unixepoch() - 1)
+		`, projectId, []byte("t1"), []byte("t2"), []byte("t3"), []byte("t4"))
+
+		assertExtend := func(ticket string, expires *time.Time, uses *int) data.TicketUseResult {
+			t.Helper()
+			res, err := conn.TicketExtend(context.Background(), data.TicketExtend{
+				Uses:      uses,
 				Expires:   expires,
-				ProjectId: projectId1,
-				Secret:    []byte{33, 34},
+				Ticket:    []byte(ticket),
+				ProjectId: projectId,
 			})
 			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.TOTP_CREATE_OK)
-			row, _ := conn.RowToMap("select * from authen_totps where project_id = ?1 and user_id = ?2 and type = ?3 and pending = ?4", projectId1, "u1", "t1", expires != nil)
-			assert.Nowish(t, row.Time("created"))
-			assert.Bytes(t, row.Bytes("secret"), []byte{33, 34})
+			return res
 		}
 
-		// existing users DO increment count for a different type
-		for _, expires := range []*time.Time{nil, &now} {
-			res, err := conn.TOTPCreate(data.TOTPCreate{
-				Max:       1,
-				UserId:    "u1",
-				Type:      "t-new",
-				Expires:   expires,
-				ProjectId: projectId1,
-				Secret:    []byte{33, 34},
-			})
-			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.TOTP_CREATE_MAX)
-		}
+		uses := 3
+		expires := time.Now().Add(time.Hour)
+
+		// dead tickets can't be extended
+		assert.Equal(t, assertExtend("t3", nil, &uses).Status, data.TICKET_USE_NOT_FOUND)
+		assert.Equal(t, assertExtend("t4", &expires, nil).Status, data.TICKET_USE_NOT_FOUND)
+		assert.Equal(t, assertExtend("t9", &expires, nil).Status, data.TICKET_USE_NOT_FOUND)
+
+		// only uses
+		res := assertExtend("t1", nil, &uses)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+		assert.Equal(t, *res.Uses, 5)
+		row, _ := conn.RowToMap("select expires from authen_tickets where project_id = $1 and ticket = $2", projectId, []byte("t1"))
+		assert.Timeish(t, row.Time("expires"), time.Now().Add(time.Second*10))
+
+		// only expires
+		res = assertExtend("t1", &expires, nil)
+		assert.Equal(t, *res.Uses, 5)
+		row, _ = conn.RowToMap("select expires from authen_tickets where project_id = $1 and ticket = $2", projectId, []byte("t1"))
+		assert.Timeish(t, row.Time("expires"), expires)
+
+		// unlimited uses stay unlimited
+		res = assertExtend("t2", &expires, &uses)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+		assert.Nil(t, res.Uses)
+		row, _ = conn.RowToMap("select expires from authen_tickets where project_id = $1 and ticket = $2", projectId, []byte("t2"))
+		assert.Timeish(t, row.Time("expires"), expires)
 	})
 }
 
-func Test_TOTPCreate_NonPending_DeletesPending(t *testing.T) {
+func Test_TicketDeny(t *testing.T) {
 	withTestDB(func(conn Conn) {
-		projectId1 := uuid.String()
+		opts := data.TicketDeny{
+			ProjectId: "p1",
+			Ticket:    []byte("t1"),
+			Expires:   time.Now().Add(time.Minute),
+		}
 
-		conn.MustExec(`
-			insert into authen_totps (project_id, user_id, type, pending, secret) values
-			(?1, 'u1', 't1', 1, 'sec1')
-		`, projectId1)
-
-		res, err := conn.TOTPCreate(data.TOTPCreate{
-			Type:      "t1",
-			UserId:    "u1",
-			ProjectId: projectId1,
-			Secret:    []byte{99, 98},
-		})
+		res, err := conn.TicketDeny(context.Background(), opts)
 		assert.Nil(t, err)
-		assert.Equal(t, res.Status, data.TOTP_CREATE_OK)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
 
-		rows, _ := conn.RowsToMap("select * from authen_totps where project_id = ?1", projectId1)
-		assert.Equal(t, len(rows), 1)
-		row := rows[0]
-		assert.Nil(t, row["expires"])
-		assert.False(t, row.Bool("pending"))
+		res, err = conn.TicketDeny(context.Background(), opts)
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.TICKET_USE_NOT_FOUND)
+
+		// different project
+		opts.ProjectId = "p2"
+		res, err = conn.TicketDeny(context.Background(), opts)
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+
+		row, _ := conn.RowToMap("select * from authen_ticket_denylist where project_id = $1 and ticket = $2", "p1", []byte("t1"))
+		assert.Timeish(t, row.Time("expires"), opts.Expires)
 	})
 }
 
-func Test_TOTPGet(t *testing.T) {
+func Test_LoginLogExport(t *testing.T) {
+	defer func(n int) { loginLogExportBatch = n }(loginLogExportBatch)
+	loginLogExportBatch = 2
+
 	withTestDB(func(conn Conn) {
+		// l3 and l4 share a created, so batches have to continue by id
 		conn.MustExec(`
-			insert into authen_totps (project_id, user_id, type, pending, expires, secret) values
-			('p1', 'u1', 't1', 1, unixepoch() - 1, 'sec1'),
-			('p1', 'u2', 't2', 1, unixepoch() + 5, 'sec2'),
-			('p1', 'u2', 't4', 1, unixepoch() + 5, 'sec3'),
-			('p1', 'u2', 't2', 0, null, 'sec4'),
-			('p2', 'u2', 't3', 0, null, 'sec5')
+			insert into authen_login_logs (id, project_id, user_id, status, created, ip) values
+			('l1', 'p1', 'u1', 1, unixepoch() - 300, '1.1.1.1'),
+			('l2', 'p1', 'u2', 2, unixepoch() - 240, null),
+			('l3', 'p1', 'u1', 3, unixepoch() - 180, null),
+			('l4', 'p1', 'u1', 4, unixepoch() - 180, null),
+			('l5', 'p1', 'u2', 5, unixepoch() - 60, null),
+			('l6', 'p2', 'u1', 6, unixepoch(), null)
 		`)
 
-		assertNotFound := func(opts data.TOTPGet) {
-			result, err := conn.TOTPGet(opts)
+		export := func(opts data.LoginLogExport) []data.LoginLogRecord {
+			t.Helper()
+			var records []data.LoginLogRecord
+			opts.ProjectId = "p1"
+			err := conn.LoginLogExport(context.Background(), opts, func(record data.LoginLogRecord) error {
+				records = append(records, record)
+				return nil
+			})
 			assert.Nil(t, err)
-			assert.Equal(t, result.Status, data.TOTP_GET_NOT_FOUND)
+			return records
 		}
 
-		assertSecret := func(opts data.TOTPGet, secret string) {
-			result, err := conn.TOTPGet(opts)
-			assert.Nil(t, err)
-			assert.Equal(t, result.Status, data.TOTP_GET_OK)
-			assert.Bytes(t, result.Secret, []byte(secret))
+		assertStatuses := func(records []data.LoginLogRecord, statuses ...int) {
+			t.Helper()
+			assert.Equal(t, len(records), len(statuses))
+			for i, status := range statuses {
+				assert.Equal(t, records[i].Status, status)
+			}
 		}
 
-		// expired
-		assertNotFound(data.TOTPGet{
-			Type:      "t1",
-			UserId:    "u1",
-			ProjectId: "p1",
-			Pending:   true,
-		})
-
-		// user doesn't have this type
-		assertNotFound(data.TOTPGet{
-			Type:      "t9",
-			UserId:    "u1",
-			ProjectId: "p1",
-			Pending:   false,
-		})
-
-		// user doesn't have this type in non-setup
-		assertNotFound(data.TOTPGet{
-			Type:      "t4",
-			UserId:    "u1",
-			ProjectId: "p1",
-			Pending:   false,
-		})
-
-		// wrong project
-		assertNotFound(data.TOTPGet{
-			Type:      "t3",
-			UserId:    "u2",
-			ProjectId: "p1",
-			Pending:   false,
+		records := export(data.LoginLogExport{})
+		assertStatuses(records, 1, 2, 3, 4, 5)
+		assert.Equal(t, records[0].UserId, "u1")
+		assert.Equal(t, *records[0].Ip, "1.1.1.1")
+		assert.Equal(t, records[1].UserId, "u2")
+
+		// exact multiple of the batch size
+		assertStatuses(export(data.LoginLogExport{UserId: "u2"}), 2, 5)
+
+		since := time.Now().Add(-210 * time.Second)
+		until := time.Now().Add(-90 * time.Second)
+		assertStatuses(export(data.LoginLogExport{Since: &since, Until: &until}), 3, 4)
+
+		// stops at the first error
+		n := 0
+		err := conn.LoginLogExport(context.Background(), data.LoginLogExport{ProjectId: "p1"}, func(record data.LoginLogRecord) error {
+			n += 1
+			if n == 3 {
+				return errors.New("stop")
+			}
+			return nil
 		})
-
-		// not expired
-		assertSecret(data.TOTPGet{
-			Type:      "t2",
-			UserId:    "u2",
-			ProjectId: "p1",
-			Pending:   true,
-		}, "sec2")
-
-		// non-setup
-		assertSecret(data.TOTPGet{
-			Type:      "t2",
-			UserId:    "u2",
-			ProjectId: "p1",
-			Pending:   false,
-		}, "sec4")
+		assert.Equal(t, err.Error(), "stop")
+		assert.Equal(t, n, 3)
 	})
 }
 
-func Test_TOTPDelete(t *testing.T) {
+func Test_UserUnlock(t *testing.T) {
 	withTestDB(func(conn Conn) {
-		assertCount := func(expected int, args ...string) {
-			actual := 0
-			var err error
-
-			switch len(args) {
-			case 0:
-				// count of all, to make sure we didn't over-delete
-				actual, err = sqlite.Scalar[int](conn.Conn, "select count(*) from authen_totps")
-			case 2:
-				// count of all fo user
-				actual, err = sqlite.Scalar[int](conn.Conn, "select count(*) from authen_totps where project_id = ?1 and user_id = ?2", args[0], args[1])
-			case 3:
-				// count for user+type
-				actual, err = sqlite.Scalar[int](conn.Conn, "select count(*) from authen_totps where project_id = ?1 and user_id = ?2 and type = ?3", args[0], args[1], args[2])
-			}
-			if err != nil {
-				panic(err)
-			}
-			assert.Equal(t, actual, expected)
-		}
-
 		conn.MustExec(`
-			insert into authen_totps (project_id, user_id, type, pending, expires, secret) values
-			('p1', 'u1', 't1', 1, unixepoch() - 1, 'sec1'),
-			('p1', 'u2', 't2', 1, unixepoch() + 5, 'sec2'),
-			('p1', 'u2', 't4', 0, unixepoch() + 5, 'sec3'),
-			('p1', 'u2', 't2', 0, null, 'sec4'),
-			('p2', 'u2', 't3', 1, null, 'sec5'),
-			('p1', 'u3', 't1', 1, null, 'sec5')
+			insert into authen_user_locks (project_id, user_id, locked_until, reset) values
+			('p1', 'u1', unixepoch() + 60, unixepoch() - 3600),
+			('p1', 'u2', unixepoch() - 1, unixepoch() - 3600)
 		`)
 
-		// specific type
-		deleted, err := conn.TOTPDelete(data.TOTPGet{
-			Type:      "t1",
-			UserId:    "u1",
-			ProjectId: "p1",
-		})
-		assert.Nil(t, err)
-		assert.Equal(t, deleted, 1)
-		assertCount(5)
-		assertCount(0, "p1", "u1", "t1")
-
-		// all types for the user
-		deleted, err = conn.TOTPDelete(data.TOTPGet{
-			UserId:    "u2",
-			AllTypes:  true,
-			ProjectId: "p1",
-		})
+		unlocked, err := conn.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u1"})
 		assert.Nil(t, err)
-		assert.Equal(t, deleted, 3)
-		assertCount(2)
-		assertCount(0, "p1", "u2")
-	})
-}
-
-func Test_TicketCreate(t *testing.T) {
-	withTestDB(func(conn Conn) {
-		projectId1 := uuid.String()
+		assert.True(t, unlocked)
 
-		assertTicket := func(ticket []byte, payload []byte, expires *time.Time, uses *int) {
-			t.Helper()
-			row, _ := conn.RowToMap("select * from authen_tickets where project_id = ?1 and ticket = ?2", projectId1, ticket)
-			assert.Nowish(t, row.Time("created"))
-			assert.Bytes(t, row.Bytes("payload"), payload)
-			if expires == nil {
-				assert.Nil(t, row["expires"])
-			} else {
-				assert.Timeish(t, row.Time("expires"), *expires)
-			}
-			if uses == nil {
-				assert.Nil(t, row["uses"])
-			} else {
-				assert.Equal(t, row.Int("uses"), *uses)
-			}
-		}
+		unlocked, _ = conn.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u1"})
+		assert.False(t, unlocked)
 
-		// without expiry or usage or payload
-		{
-			res, err := conn.TicketCreate(data.TicketCreate{
-				ProjectId: projectId1,
-				Ticket:    []byte{1, 2, 3},
-			})
-			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.TICKET_CREATE_OK)
-			assertTicket([]byte{1, 2, 3}, nil, nil, nil)
-		}
+		lock, _ := conn.UserLockGet(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u1"})
+		assert.True(t, lock.LockedUntil == nil)
 
-		// with expiry and usage
-		{
-			uses := 9
-			expires := time.Now().Add(time.Hour)
-
-			res, err := conn.TicketCreate(data.TicketCreate{
-				ProjectId: projectId1,
-				Ticket:    []byte{4, 5, 6},
-				Payload:   []byte{0, 0, 1},
-				Expires:   &expires,
-				Uses:      &uses,
-			})
-			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.TICKET_CREATE_OK)
-			assertTicket([]byte{4, 5, 6}, []byte{0, 0, 1}, &expires, &uses)
-		}
+		unlocked, _ = conn.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u2"})
+		assert.False(t, unlocked)
 
-		// max reached (previous 2 tests inserted a row each)
-		{
-			res, err := conn.TicketCreate(data.TicketCreate{
-				Max:       2,
-				ProjectId: projectId1,
-				Ticket:    []byte{9, 9, 9},
-			})
-			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.TICKET_CREATE_MAX)
+		// unlocking a user without a lock resets their failures too
+		unlocked, _ = conn.UserUnlock(context.Background(), data.UserLockGet{ProjectId: "p1", UserId: "u3"})
+		assert.False(t, unlocked)
 
-			// no new insert
-			count, _ := sqlite.Scalar[int](conn.Conn, "select count(*) from authen_tickets where project_id = ?1", projectId1)
-			assert.Equal(t, count, 2)
+		rows, _ := conn.RowsToMap("select user_id, locked_until, reset from authen_user_locks order by user_id")
+		assert.Equal(t, len(rows), 3)
+		for _, row := range rows {
+			assert.Nil(t, row["locked_until"])
+			assert.Nowish(t, time.Unix(int64(row.Int("reset")), 0))
 		}
 	})
 }
 
-func Test_TicketUse_Found(t *testing.T) {
+func Test_Dump(t *testing.T) {
 	withTestDB(func(conn Conn) {
-		assertTicket := func(opts data.TicketUse, payload string, uses int) {
-			res, err := conn.TicketUse(opts)
-			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.TICKET_USE_OK)
-
-			if uses == -1 {
-				assert.Nil(t, res.Uses)
-			} else {
-				assert.Equal(t, *res.Uses, uses)
-			}
-
-			if payload == "" {
-				assert.Nil(t, res.Payload)
-			} else {
-				assert.Bytes(t, *res.Payload, []byte(payload))
-			}
-		}
-
-		// setup our data
 		conn.MustExec(`
-			insert into authen_tickets (project_id, ticket, payload, uses, expires) values
-			('p1', ?1, 'd1', 1, null),
-			('p1', ?2, null, null, null),
-			('p1', ?3, null, 10, unixepoch() + 100)
-		`, []byte("t1"), []byte("t2"), []byte("t3"))
-
-		assertTicket(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t1"),
-		}, "d1", 0)
-
-		assertTicket(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t2"),
-		}, "", -1)
-
-		assertTicket(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t3"),
-		}, "", 9)
-
-	})
-}
-
-// wrong ticket, no more use or expired
-func Test_TicketUse_NotFound(t *testing.T) {
-	withTestDB(func(conn Conn) {
-		assertNotFound := func(opts data.TicketUse) {
-			res, err := conn.TicketUse(opts)
-			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.TICKET_USE_NOT_FOUND)
-		}
-
-		// setup our data
+			insert into authen_projects (id, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length, lockout_rules)
+			values ('p1', 'gobl', 1, 2, 3, 4, 5, 6, 7, '[{"statuses": [2], "failures": 3, "window": 60, "duration": 120}]')
+		`)
 		conn.MustExec(`
-			insert into authen_tickets (project_id, ticket, payload, uses, expires) values
-			('p1', ?1, null, 2, null),
-			('p1', ?2, null, null, unixepoch() - 1)
-		`, []byte("t1"), []byte("t2"))
-
-		// wrong project
-		assertNotFound(data.TicketUse{
-			ProjectId: "p2",
-			Ticket:    []byte("t1"),
-		})
-
-		// wrong ticket
-		assertNotFound(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t9"),
-		})
+			insert into authen_totps (project_id, user_id, type, pending, secret, expires) values
+			('p1', 'u1', 't1', true, 'sec1', unixepoch() + 60)
+		`)
+		conn.MustExec(`
+			insert into authen_tickets (project_id, ticket, uses, scope, attempts) values
+			('p1', 't1', 2, 's1', 3)
+		`)
+		conn.MustExec(`
+			insert into authen_ticket_denylist (project_id, ticket, expires) values
+			('p1', 't2', unixepoch() + 60)
+		`)
+		conn.MustExec(`
+			insert into authen_login_logs (id, project_id, user_id, status, payload, payload_key, ip, device, created) values
+			('l2', 'p1', 'u1', 3, 'pl2', 1, '1.2.3.4', 'd1', unixepoch()),
+			('l1', 'p1', 'u1', 2, null, 0, null, null, unixepoch() - 10)
+		`)
+		conn.MustExec(`
+			insert into authen_user_locks (project_id, user_id, locked_until, reset) values
+			('p1', 'u1', null, unixepoch())
+		`)
 
-		// expired
-		assertNotFound(data.TicketUse{
-			ProjectId: "p1",
-			Ticket:    []byte("t2"),
+		var records []data.DumpRecord
+		err := conn.Dump(func(record data.DumpRecord) error {
+			records = append(records, record)
+			return nil
 		})
-
-		{
-			// important test, checks both our use limit, and that using
-			// a ticket decreases the limit
-
-			// this ticket has 2 uses
-			opts := data.TicketUse{
-				ProjectId: "p1",
-				Ticket:    []byte("t1"),
-			}
-			// 1st use
-			res, _ := conn.TicketUse(opts)
-			assert.Equal(t, res.Status, data.TICKET_USE_OK)
-
-			// 2nd use
-			res, _ = conn.TicketUse(opts)
-			assert.Equal(t, res.Status, data.TICKET_USE_OK)
-
-			// no more uses
-			assertNotFound(opts)
-		}
+		assert.Nil(t, err)
+		assert.Equal(t, len(records), 7)
+
+		p := records[0].Project
+		assert.Equal(t, p.TOTPIssuer, "gobl")
+		assert.Equal(t, p.LoginLogMaxPayloadLength, 7)
+		assert.Equal(t, p.LockoutRules[0].Duration, 120)
+		assert.Nowish(t, p.Updated)
+
+		totp := records[1].TOTP
+		assert.True(t, totp.Pending)
+		assert.Bytes(t, totp.Secret, []byte("sec1"))
+		assert.Timeish(t, *totp.Expires, time.Now().Add(time.Minute))
+
+		ticket := records[2].Ticket
+		assert.Equal(t, *ticket.Uses, 2)
+		assert.Equal(t, *ticket.Attempts, 3)
+		assert.Bytes(t, ticket.Scope, []byte("s1"))
+		assert.True(t, ticket.Expires == nil)
+
+		assert.Bytes(t, records[3].Denied.Ticket, []byte("t2"))
+
+		// oldest first
+		assert.Equal(t, records[4].LoginLog.Id, "l1")
+		assert.True(t, records[4].LoginLog.Payload == nil)
+		l := records[5].LoginLog
+		assert.Equal(t, l.Id, "l2")
+		assert.Equal(t, l.PayloadKey, 1)
+		assert.Equal(t, *l.Ip, "1.2.3.4")
+		assert.Equal(t, *l.Device, "d1")
+
+		assert.Equal(t, records[6].UserLock.UserId, "u1")
+		assert.True(t, records[6].UserLock.LockedUntil == nil)
 	})
 }
 
-func Test_TicketDelete(t *testing.T) {
-	withTestDB(func(conn Conn) {
-		assertDelete := func(opts data.TicketUse, uses int) {
-			t.Helper()
-			res, err := conn.TicketDelete(opts)
-			assert.Nil(t, err)
-			if uses == -2 {
-				assert.Equal(t, res.Status, data.TICKET_USE_NOT_FOUND)
-			} else if uses == -1 {
-				assert.Equal(t, res.Status, data.TICKET_USE_OK)
-				assert.Nil(t, res.Uses)
-			} else {
-				assert.Equal(t, res.Status, data.TICKET_USE_OK)
-				assert.Equal(t, *res.Uses, uses)
-			}
-		}
-
-		// setup our data
-		conn.MustExec(`
-			insert into authen_tickets (project_id, ticket, payload, uses, expires) values
-			('p1', ?1, null, null, null),
-			('p1', ?2, null, 3, null),
-			('p1', ?3, null, 0, null),
-			('p1', ?4, null, 0, unixepoch() - 1)
-		`, []byte("t1"), []byte("t2"), []byte("t3"), []byte("t4"))
-
-		// not found
-		{
-			// wrong project
-			assertDelete(data.TicketUse{
-				ProjectId: "p2",
-				Ticket:    []byte("t1"),
-			}, -2)
-
-			// wrong ticket
-			assertDelete(data.TicketUse{
-				ProjectId: "p1",
-				Ticket:    []byte("t9"),
-			}, -2)
-
-			// no more use
-			assertDelete(data.TicketUse{
-				ProjectId: "p1",
-				Ticket:    []byte("t3"),
-			}, -2)
-
-			// expired
-			assertDelete(data.TicketUse{
-				ProjectId: "p1",
-				Ticket:    []byte("t4"),
-			}, -2)
-		}
-
-		// found with unlimited use
-		{
-			// delete with unlimited use
-			assertDelete(data.TicketUse{
-				ProjectId: "p1",
-				Ticket:    []byte("t1"),
-			}, -1)
-
-			// it's really deleted not, so not found
-			assertDelete(data.TicketUse{
-				ProjectId: "p1",
-				Ticket:    []byte("t1"),
-			}, -2)
-		}
-
-		// found with use
-		{
-			// delete with unlimited use
-			assertDelete(data.TicketUse{
-				ProjectId: "p1",
-				Ticket:    []byte("t2"),
-			}, 3)
-
-			// it's really deleted not, so not found
-			assertDelete(data.TicketUse{
-				ProjectId: "p1",
-				Ticket:    []byte("t2"),
-			}, -2)
-		}
-	})
+func withTestDB(fn func(conn Conn)) {
+	conn, err := New(Config{Path: ":memory:"})
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	if err := conn.EnsureMigrations(); err != nil {
+		panic(err)
+	}
+	fn(conn)
 }
 
-func Test_LoginLogCreate(t *testing.T) {
+func Test_StrictLimits(t *testing.T) {
 	withTestDB(func(conn Conn) {
-		assertLoginLog := func(opts data.LoginLogCreate) {
-			t.Helper()
-			res, err := conn.LoginLogCreate(opts)
-			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.LOGIN_LOG_CREATE_OK)
-
-			row, _ := conn.RowToMap("select * from authen_login_logs where id = $1", opts.Id)
-			assert.Nowish(t, row.Time("created"))
-			assert.Equal(t, row.Int("status"), opts.Status)
-			assert.Equal(t, row.String("user_id"), opts.UserId)
-			assert.Equal(t, row.String("project_id"), opts.ProjectId)
-
-			if opts.Payload == nil {
-				assert.Nil(t, row["payload"])
-			} else {
-				assert.Bytes(t, row.Bytes("payload"), opts.Payload)
-			}
-		}
-
-		//no payload
-		{
-			assertLoginLog(data.LoginLogCreate{
-				Id:        "l1",
-				Status:    99,
-				UserId:    "u1",
-				ProjectId: uuid.String(),
-			})
-		}
-
-		//payload
-		{
-			assertLoginLog(data.LoginLogCreate{
-				Id:        "l2",
-				Status:    2,
-				UserId:    "u2",
-				ProjectId: uuid.String(),
-				Payload:   []byte("over 9000!"),
-			})
-		}
-	})
-}
-
-func Test_LoginLogGet(t *testing.T) {
-	assertRecord := func(actual data.LoginLogRecord, id string, status int, payloadName string) {
-		t.Helper()
-		assert.Equal(t, actual.Id, id)
-		assert.Equal(t, actual.Status, status)
-		if payloadName == "" {
-			assert.Nil(t, actual.Payload)
-		} else {
-			payload := (actual.Payload).(map[string]any)
-			assert.Equal(t, payload["name"].(string), payloadName)
-		}
-	}
+		ctx := context.Background()
+		strict := conn
+		strict.strict = true
 
-	withTestDB(func(conn Conn) {
-		// empty result
-		{
-			res, err := conn.LoginLogGet(data.LoginLogGet{})
+		createTicket := func(c Conn, ticket string) data.TicketCreateStatus {
+			res, err := c.TicketCreate(ctx, data.TicketCreate{ProjectId: "p1", Max: 2, Tickets: []data.TicketCreateTicket{{Ticket: []byte(ticket)}}})
 			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.LOGIN_LOG_GET_OK)
-			assert.Equal(t, len(res.Records), 0)
+			return res.Status
 		}
 
-		conn.MustExec(`
-			insert into authen_login_logs (id, project_id, user_id, status, payload, created) values
-			('id1', 'p1', 'u1', 1, null, unixepoch() - 100),
-			('id2', 'p1', 'u1', 2, '{"name": "idaho"}', unixepoch() - 110),
-			('id3', 'p1', 'u1', 3, null, unixepoch() - 120),
-			('id4', 'p1', 'u1', 4, '{"name": "ghanima"}', unixepoch() - 130),
-			('id5', 'p1', 'u2', 1, null, unixepoch()),
-			('id6', 'p2', 'u1', 1, null, unixepoch());
-		`)
+		// existing tickets are counted the first time strict mode needs them
+		assert.Equal(t, createTicket(conn, "t1"), data.TICKET_CREATE_OK)
+		assert.Equal(t, createTicket(strict, "t2"), data.TICKET_CREATE_OK)
+		assert.Equal(t, createTicket(strict, "t3"), data.TICKET_CREATE_MAX)
 
-		// first page
-		{
-			res, err := conn.LoginLogGet(data.LoginLogGet{
-				Limit:     2,
-				Offset:    0,
-				UserId:    "u1",
-				ProjectId: "p1",
-			})
-			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.LOGIN_LOG_GET_OK)
-			assert.Equal(t, len(res.Records), 2)
-			assertRecord(res.Records[0], "id1", 1, "")
-			assertRecord(res.Records[1], "id2", 2, "idaho")
-		}
+		// after which, the triggers keep it up to date
+		conn.TicketDelete(ctx, data.TicketUse{ProjectId: "p1", Ticket: []byte("t1")})
+		assert.Equal(t, createTicket(strict, "t3"), data.TICKET_CREATE_OK)
+		assert.Equal(t, projectCount(conn, "p1", "ticket"), 2)
 
-		// 2nd page
-		{
-			res, err := conn.LoginLogGet(data.LoginLogGet{
-				Limit:     2,
-				Offset:    2,
-				UserId:    "u1",
-				ProjectId: "p1",
-			})
+		createTOTP := func(userId string) data.TOTPCreateStatus {
+			res, err := strict.TOTPCreate(ctx, data.TOTPCreate{ProjectId: "p1", UserId: userId, Max: 1, Secret: []byte("s")})
 			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.LOGIN_LOG_GET_OK)
-			assert.Equal(t, len(res.Records), 2)
-			assertRecord(res.Records[0], "id3", 3, "")
-			assertRecord(res.Records[1], "id4", 4, "ghanima")
+			return res.Status
 		}
+		assert.Equal(t, createTOTP("u1"), data.TOTP_CREATE_OK)
+		assert.Equal(t, createTOTP("u1"), data.TOTP_CREATE_OK)
+		assert.Equal(t, createTOTP("u2"), data.TOTP_CREATE_MAX)
+		assert.Equal(t, projectCount(conn, "p1", "totp"), 1)
 
-		// Empty page
-		{
-			res, err := conn.LoginLogGet(data.LoginLogGet{
-				Limit:     4,
-				Offset:    4,
-				UserId:    "u1",
-				ProjectId: "p1",
-			})
+		for i := 0; i < 3; i++ {
+			res, err := strict.LoginLogCreate(ctx, data.LoginLogCreate{Id: uuid.String(), ProjectId: "p1", UserId: "u1", Max: 2})
 			assert.Nil(t, err)
-			assert.Equal(t, res.Status, data.LOGIN_LOG_GET_OK)
-			assert.Equal(t, len(res.Records), 0)
+			if i < 2 {
+				assert.Equal(t, res.Status, data.LOGIN_LOG_CREATE_OK)
+			} else {
+				assert.Equal(t, res.Status, data.LOGIN_LOG_CREATE_MAX)
+			}
 		}
+		assert.Equal(t, projectCount(conn, "p1", "login_log"), 2)
 	})
 }
 
-func withTestDB(fn func(conn Conn)) {
-	conn, err := New(Config{Path: ":memory:"})
+func projectCount(conn Conn, projectId string, resource string) int {
+	count, err := sqlite.Scalar[int](conn.Conn, "select count from authen_project_counts where project_id = ?1 and resource = ?2", projectId, resource)
 	if err != nil {
 		panic(err)
 	}
-	defer conn.Close()
-	if err := conn.EnsureMigrations(); err != nil {
-		panic(err)
-	}
-	fn(conn)
+	return count
+}
+
+func Test_MigrateTo(t *testing.T) {
+	withTestDB(func(conn Conn) {
+		current, latest, err := conn.MigrationVersions()
+		assert.Nil(t, err)
+		assert.Equal(t, current, 16)
+		assert.Equal(t, latest, 16)
+
+		sql, err := conn.MigrateToSQL(13)
+		assert.Nil(t, err)
+		assert.Equal(t, sql[0], "-- 0016 down")
+		assert.StringContains(t, strings.Join(sql, "\n"), "drop table authen_user_locks")
+
+		// a dry run doesn't change anything
+		current, _, _ = conn.MigrationVersions()
+		assert.Equal(t, current, 16)
+
+		assert.Nil(t, conn.MigrateTo(13))
+		current, _, _ = conn.MigrationVersions()
+		assert.Equal(t, current, 13)
+		exists, _ := sqlite.Scalar[int](conn.Conn, "select count(*) from sqlite_master where name = 'authen_user_locks'")
+		assert.Equal(t, exists, 0)
+
+		assert.Nil(t, conn.MigrateTo(16))
+		current, _, _ = conn.MigrationVersions()
+		assert.Equal(t, current, 16)
+		exists, _ = sqlite.Scalar[int](conn.Conn, "select count(*) from sqlite_master where name = 'authen_user_locks'")
+		assert.Equal(t, exists, 1)
+	})
 }
@@ -0,0 +1,77 @@
+package sqlite_test
+
+import (
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/authen/storage/sqlite"
+	"src.goblgobl.com/authen/storage/storagetest"
+	"src.goblgobl.com/utils/json"
+)
+
+// Runs a second time with strict limits, which take a different path
+// for every insert that has a max.
+func Test_StorageTest(t *testing.T) {
+	for _, name := range []string{"Default", "StrictLimits"} {
+		strict := name == "StrictLimits"
+		t.Run(name, func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) (storage.Storage, storagetest.Fixtures) {
+				conn, err := sqlite.New(sqlite.Config{Path: ":memory:", StrictLimits: strict})
+				if err != nil {
+					panic(err)
+				}
+				t.Cleanup(func() { conn.Close() })
+				if err := conn.EnsureMigrations(); err != nil {
+					panic(err)
+				}
+				return conn, fixtures{conn}
+			})
+		})
+	}
+}
+
+type fixtures struct {
+	conn sqlite.Conn
+}
+
+func (f fixtures) Project(p data.Project, updated time.Time) {
+	rules := jsonColumn(p.LockoutRules)
+	success := jsonColumn(p.LoginLogSuccessStatuses)
+	f.conn.MustExec(`
+		insert or replace into authen_projects (id, updated, totp_issuer, totp_max, totp_setup_ttl, totp_secret_length, ticket_max, ticket_max_payload_length, login_log_max, login_log_max_payload_length, login_log_retain_count, login_log_retain_days, login_log_retain_on_insert, lockout_rules, login_log_success_statuses)
+		values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15)
+	`, p.Id, updated.Unix(), p.TOTPIssuer, p.TOTPMax, p.TOTPSetupTTL, p.TOTPSecretLength, p.TicketMax, p.TicketMaxPayloadLength, p.LoginLogMax, p.LoginLogMaxPayloadLength, p.LoginLogRetainCount, p.LoginLogRetainDays, p.LoginLogRetainOnInsert, rules, success)
+}
+
+func jsonColumn[T any](values []T) *string {
+	if len(values) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		panic(err)
+	}
+	s := string(encoded)
+	return &s
+}
+
+func (f fixtures) LoginLog(opts data.LoginLogCreate, created time.Time) {
+	f.conn.MustExec(`
+		insert into authen_login_logs (id, project_id, user_id, status, payload, payload_key, ip, user_agent, method, country, created)
+		values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11)
+	`, opts.Id, opts.ProjectId, opts.UserId, opts.Status, opts.Payload, opts.PayloadKey, opts.Ip, opts.UserAgent, opts.Method, opts.Country, created.Unix())
+}
+
+func (f fixtures) UserLock(projectId string, userId string, lockedUntil *time.Time, reset time.Time) {
+	var until *int64
+	if lockedUntil != nil {
+		u := lockedUntil.Unix()
+		until = &u
+	}
+	f.conn.MustExec(`
+		insert or replace into authen_user_locks (project_id, user_id, locked_until, reset)
+		values (?1, ?2, ?3, ?4)
+	`, projectId, userId, until, reset.Unix())
+}
@@ -1,11 +1,16 @@
 package storage
 
 import (
+	"context"
+	"io"
 	"strings"
 	"time"
 
 	"src.goblgobl.com/authen/codes"
+	"src.goblgobl.com/authen/storage/bolt"
 	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/authen/storage/memory"
+	"src.goblgobl.com/authen/storage/mysql"
 	"src.goblgobl.com/authen/storage/pg"
 	"src.goblgobl.com/authen/storage/sqlite"
 	"src.goblgobl.com/utils/log"
@@ -14,34 +19,63 @@ import (
 // singleton
 var DB Storage
 
+// see Config.Timeout
+var timeout time.Duration
+
+// Every call which talks to the storage takes a context, which bounds
+// how long it can run. Storage which can't be interrupted (sqlite, bolt,
+// memory) ignores it.
 type Storage interface {
 	// health check the storage, returns nil if everything is ok
-	Ping() error
+	Ping(ctx context.Context) error
 
 	// return information about the storage
-	Info() (any, error)
+	Info(ctx context.Context) (any, error)
 
-	// clean any data that needs cleaning
-	Clean() error
+	// clean any data that needs cleaning, returning what was removed
+	Clean(ctx context.Context, opts data.Clean) (data.CleanResult, error)
 
 	EnsureMigrations() error
 
-	GetProject(id string) (*data.Project, error)
-	GetUpdatedProjects(timestamp time.Time) ([]*data.Project, error)
+	GetProject(ctx context.Context, id string) (*data.Project, error)
+	GetUpdatedProjects(ctx context.Context, timestamp time.Time) ([]*data.Project, error)
+
+	TOTPGet(ctx context.Context, opts data.TOTPGet) (data.TOTPGetResult, error)
+	TOTPCreate(ctx context.Context, opts data.TOTPCreate) (data.TOTPCreateResult, error)
+	TOTPDelete(ctx context.Context, opts data.TOTPGet) (int, error)
+
+	TicketUse(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error)
+	TicketDelete(ctx context.Context, opts data.TicketUse) (data.TicketUseResult, error)
+	TicketExtend(ctx context.Context, opts data.TicketExtend) (data.TicketUseResult, error)
+	TicketDeny(ctx context.Context, opts data.TicketDeny) (data.TicketUseResult, error)
+	TicketCreate(ctx context.Context, opts data.TicketCreate) (data.TicketCreateResult, error)
 
-	TOTPGet(opts data.TOTPGet) (data.TOTPGetResult, error)
-	TOTPCreate(opts data.TOTPCreate) (data.TOTPCreateResult, error)
-	TOTPDelete(opts data.TOTPGet) (int, error)
+	LoginLogGet(ctx context.Context, opts data.LoginLogGet) (data.LoginLogGetResult, error)
+	LoginLogCreate(ctx context.Context, opts data.LoginLogCreate) (data.LoginLogCreateResult, error)
+	LoginLogGetUnencrypted(ctx context.Context, limit int) ([]data.LoginLogRecord, error)
+	LoginLogUpdatePayload(ctx context.Context, opts data.LoginLogUpdatePayload) error
+	LoginLogStats(ctx context.Context, opts data.LoginLogStats) (data.LoginLogStatsResult, error)
+	LoginLogDelete(ctx context.Context, opts data.LoginLogDelete) (int, error)
 
-	TicketUse(opts data.TicketUse) (data.TicketUseResult, error)
-	TicketDelete(opts data.TicketUse) (data.TicketUseResult, error)
-	TicketCreate(opts data.TicketCreate) (data.TicketCreateResult, error)
+	// Users are locked by LoginLogCreate, based on the project's lockout
+	// rules. UserUnlock returns true if the user was locked.
+	UserLockGet(ctx context.Context, opts data.UserLockGet) (data.UserLock, error)
+	UserUnlock(ctx context.Context, opts data.UserLockGet) (bool, error)
 
-	LoginLogGet(opts data.LoginLogGet) (data.LoginLogGetResult, error)
-	LoginLogCreate(opts data.LoginLogCreate) (data.LoginLogCreateResult, error)
+	// Cross-instance events. EventPublish sends the payload to every
+	// instance which is listening (including this one). EventListen calls
+	// fn with each payload, in the background, until the process exits.
+	// Storage without a way to do this (sqlite, cockroach) does nothing.
+	EventPublish(ctx context.Context, payload []byte) error
+	EventListen(fn func(payload []byte)) error
+
+	// Calls fn for each matching login log, oldest first, without loading
+	// them all into memory. Stops at, and returns, the first error from fn.
+	LoginLogExport(ctx context.Context, opts data.LoginLogExport, fn func(data.LoginLogRecord) error) error
 }
 
 func Configure(config Config) (err error) {
+	timeout = time.Duration(config.Timeout) * time.Millisecond
 	switch strings.ToLower(config.Type) {
 	case "postgres":
 		DB, err = pg.New(config.Postgres, "postgres")
@@ -49,8 +83,63 @@ func Configure(config Config) (err error) {
 		DB, err = pg.New(config.Cockroach, "cockroach")
 	case "sqlite":
 		DB, err = sqlite.New(config.Sqlite)
+	case "memory":
+		DB, err = memory.New(config.Memory)
+	case "mysql":
+		DB, err = mysql.New(config.MySQL)
+	case "bolt":
+		DB, err = bolt.New(config.Bolt)
 	default:
-		err = log.Errf(codes.ERR_INVALID_STORAGE_TYPE, "storage.type is invalid. Should be one of: postgres, cockroach or sqlite")
+		err = log.Errf(codes.ERR_INVALID_STORAGE_TYPE, "storage.type is invalid. Should be one of: postgres, cockroach, mysql, sqlite, bolt or memory")
 	}
 	return
 }
+
+// see Config.Timeout (0 == no limit)
+func Timeout() time.Duration {
+	return timeout
+}
+
+// A context for storage calls made outside of a request.
+func Context() (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// Storage which can copy all of its rows out (see authen.Export).
+type Dumper interface {
+	Dump(fn func(data.DumpRecord) error) error
+}
+
+// Storage which can insert rows copied out of another storage (see
+// authen.Import). Existing rows with the same key are replaced.
+type Loader interface {
+	Load(records []data.DumpRecord) error
+
+	// the number of rows of each kind, keyed by data.DumpRecord.Kind
+	Counts() (map[string]int, error)
+}
+
+// Storage with versioned schema migrations (pg and sqlite) which can be
+// inspected and moved to a specific version, up or down.
+type Migrator interface {
+	// the schema's current version and the latest available
+	MigrationVersions() (int, int, error)
+
+	// runs up (or down) migrations until the schema is at version
+	MigrateTo(version int) error
+
+	// the SQL MigrateTo(version) would execute, without executing it
+	MigrateToSQL(version int) ([]string, error)
+}
+
+// Storage which needs to do something on shutdown (e.g. memory, which
+// can write a snapshot) implements io.Closer.
+func Close() error {
+	if closer, ok := DB.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package storage
 import (
 	"testing"
 
+	"src.goblgobl.com/authen/storage/memory"
+	"src.goblgobl.com/authen/storage/mysql"
 	"src.goblgobl.com/authen/storage/pg"
 	"src.goblgobl.com/authen/storage/sqlite"
 	"src.goblgobl.com/tests"
@@ -11,7 +13,7 @@ import (
 
 func Test_Configure_InvalidType(t *testing.T) {
 	err := Configure(Config{Type: "invalid"})
-	assert.Equal(t, err.Error(), "code: 103003 - storage.type is invalid. Should be one of: postgres, cockroach or sqlite")
+	assert.Equal(t, err.Error(), "code: 103003 - storage.type is invalid. Should be one of: postgres, cockroach, mysql, sqlite, bolt or memory")
 }
 
 func Test_Configure_Sqlite(t *testing.T) {
@@ -25,6 +27,27 @@ func Test_Configure_Sqlite(t *testing.T) {
 	assert.True(t, ok)
 }
 
+func Test_Configure_Memory(t *testing.T) {
+	err := Configure(Config{Type: "memory"})
+	assert.Nil(t, err)
+	_, ok := DB.(*memory.DB)
+	assert.True(t, ok)
+	assert.Nil(t, Close())
+}
+
+func Test_Configure_MySQL(t *testing.T) {
+	// connections are lazy, this doesn't need a running server
+	config := Config{
+		Type:  "mysql",
+		MySQL: mysql.Config{URL: "root@tcp(localhost:3306)/gobl_test"},
+	}
+	err := Configure(config)
+	assert.Nil(t, err)
+	_, ok := DB.(mysql.DB)
+	assert.True(t, ok)
+	assert.Nil(t, Close())
+}
+
 func Test_Configure_PG(t *testing.T) {
 	if tests.StorageType() != "postgres" {
 		return
@@ -0,0 +1,1665 @@
+// Package storagetest is a conformance suite for storage.Storage. A
+// storage (or anything wrapping one) proves that it behaves like the
+// built-in storages by calling Run from one of its tests.
+//
+// The suite only talks to the storage through storage.Storage, plus
+// Fixtures for the few things which can't be set up that way. Every test
+// uses its own project ids, so the storage can be shared between tests
+// (and with other tests) but must not be cleaned between them.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/authen/storage"
+	"src.goblgobl.com/authen/storage/data"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/utils/uuid"
+)
+
+// Inserts data directly into the storage. These are things the
+// storage.Storage interface can't create, like a login log created
+// in the past.
+type Fixtures interface {
+	// Inserts the project, or replaces it if it already exists
+	Project(project data.Project, updated time.Time)
+
+	// Inserts a login log with the given created time (the id, project_id,
+	// user_id, status, payload, payload_key, ip, user_agent, method and
+	// country of opts are used, the rest is ignored)
+	LoginLog(opts data.LoginLogCreate, created time.Time)
+
+	// Inserts the user lock, or replaces it if it already exists
+	UserLock(projectId string, userId string, lockedUntil *time.Time, reset time.Time)
+}
+
+type test struct {
+	name string
+	fn   func(t *testing.T, db storage.Storage, fixtures Fixtures)
+}
+
+// setup is called for each test. It can return the same storage every
+// time, or a new one (which it can close with t.Cleanup).
+func Run(t *testing.T, setup func(t *testing.T) (storage.Storage, Fixtures)) {
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			db, fixtures := setup(t)
+			test.fn(t, db, fixtures)
+		})
+	}
+}
+
+var tests = []test{
+	{"Ping", testPing},
+	{"Clean_TOTPs", testCleanTOTPs},
+	{"Clean_Tickets", testCleanTickets},
+	{"Clean_TicketDenylist", testCleanTicketDenylist},
+	{"Clean_LoginLogs", testCleanLoginLogs},
+	{"Clean_UserLocks", testCleanUserLocks},
+	{"Clean_Batches", testCleanBatches},
+	{"GetProject_Unknown", testGetProjectUnknown},
+	{"GetProject_Success", testGetProjectSuccess},
+	{"GetUpdatedProjects", testGetUpdatedProjects},
+	{"TOTPCreate", testTOTPCreate},
+	{"TOTPCreate_NonPending_DeletesPending", testTOTPCreateNonPendingDeletesPending},
+	{"TOTPGet", testTOTPGet},
+	{"TOTPDelete", testTOTPDelete},
+	{"TicketCreate", testTicketCreate},
+	{"TicketUse_Found", testTicketUseFound},
+	{"TicketUse_NotFound", testTicketUseNotFound},
+	{"TicketUse_Scope", testTicketUseScope},
+	{"TicketUse_SlidingTTL", testTicketUseSlidingTTL},
+	{"TicketDelete", testTicketDelete},
+	{"TicketExtend", testTicketExtend},
+	{"TicketDeny", testTicketDeny},
+	{"LoginLogCreate", testLoginLogCreate},
+	{"LoginLogCreate_Max", testLoginLogCreateMax},
+	{"LoginLogCreate_RetainCount", testLoginLogCreateRetainCount},
+	{"LoginLogCreate_NewIpAndDevice", testLoginLogCreateNewIpAndDevice},
+	{"LoginLogCreate_NewIpAndDeviceHistory", testLoginLogCreateNewIpAndDeviceHistory},
+	{"LoginLogCreate_Lockout", testLoginLogCreateLockout},
+	{"LoginLogCreate_Lockout_Reset", testLoginLogCreateLockoutReset},
+	{"LoginLogGet", testLoginLogGet},
+	{"LoginLogGet_Filters", testLoginLogGetFilters},
+	{"LoginLogGet_Cursor", testLoginLogGetCursor},
+	{"LoginLogStats", testLoginLogStats},
+	{"LoginLogDelete", testLoginLogDelete},
+	{"LoginLogExport", testLoginLogExport},
+	{"LoginLogGetUnencrypted_And_UpdatePayload", testLoginLogGetUnencryptedAndUpdatePayload},
+	{"UserUnlock", testUserUnlock},
+	{"Dump_Load", testDumpLoad},
+}
+
+func testPing(t *testing.T, db storage.Storage, _ Fixtures) {
+	assert.Nil(t, db.Ping(context.Background()))
+}
+
+// Expired TOTPs count towards the project's max until they're cleaned
+func testCleanTOTPs(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	expired := time.Now().Add(-time.Second)
+	create := func(userId string, expires *time.Time) data.TOTPCreateStatus {
+		t.Helper()
+		res, err := db.TOTPCreate(context.Background(), data.TOTPCreate{Max: 2, ProjectId: projectId, UserId: userId, Expires: expires, Secret: []byte("s")})
+		assert.Nil(t, err)
+		return res.Status
+	}
+
+	assert.Equal(t, create("u1", &expired), data.TOTP_CREATE_OK)
+	assert.Equal(t, create("u2", nil), data.TOTP_CREATE_OK)
+	assert.Equal(t, create("u3", nil), data.TOTP_CREATE_MAX)
+
+	assert.True(t, clean(t, db, data.Clean{}).TOTPs >= 1)
+	assert.Equal(t, create("u3", nil), data.TOTP_CREATE_OK)
+
+	res, _ := db.TOTPGet(context.Background(), data.TOTPGet{ProjectId: projectId, UserId: "u2"})
+	assert.Equal(t, res.Status, data.TOTP_GET_OK)
+}
+
+// Dead tickets count towards the project's max until they're cleaned
+func testCleanTickets(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	zero, one := 0, 1
+	expired, expires := time.Now().Add(-time.Second), time.Now().Add(time.Minute)
+
+	res, err := db.TicketCreate(context.Background(), data.TicketCreate{
+		ProjectId: projectId,
+		Tickets: []data.TicketCreateTicket{
+			{Ticket: []byte("t1"), Expires: &expired},
+			{Ticket: []byte("t2"), Uses: &zero},
+			{Ticket: []byte("t3"), Attempts: &zero},
+			{Ticket: []byte("t4"), Expires: &expires, Uses: &one, Attempts: &one},
+			{Ticket: []byte("t5")},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TICKET_CREATE_OK)
+
+	opts := data.TicketCreate{Max: 5, ProjectId: projectId, Tickets: []data.TicketCreateTicket{{Ticket: []byte("t6")}}}
+	res, _ = db.TicketCreate(context.Background(), opts)
+	assert.Equal(t, res.Status, data.TICKET_CREATE_MAX)
+
+	assert.True(t, clean(t, db, data.Clean{}).Tickets >= 3)
+	res, _ = db.TicketCreate(context.Background(), opts)
+	assert.Equal(t, res.Status, data.TICKET_CREATE_OK)
+
+	for _, ticket := range []string{"t4", "t5"} {
+		use, _ := db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId, Ticket: []byte(ticket)})
+		assert.Equal(t, use.Status, data.TICKET_USE_OK)
+	}
+}
+
+// An expired denylist entry no longer denies once cleaned
+func testCleanTicketDenylist(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	deny := func(ticket string, expires time.Time) data.TicketUseStatus {
+		t.Helper()
+		res, err := db.TicketDeny(context.Background(), data.TicketDeny{ProjectId: projectId, Ticket: []byte(ticket), Expires: expires})
+		assert.Nil(t, err)
+		return res.Status
+	}
+
+	deny("t1", time.Now().Add(-time.Second))
+	deny("t2", time.Now().Add(time.Minute))
+
+	assert.True(t, clean(t, db, data.Clean{}).TicketDenylist >= 1)
+	assert.Equal(t, deny("t1", time.Now().Add(time.Minute)), data.TICKET_USE_OK)
+	assert.Equal(t, deny("t2", time.Now().Add(time.Minute)), data.TICKET_USE_NOT_FOUND)
+}
+
+func clean(t *testing.T, db storage.Storage, opts data.Clean) data.CleanResult {
+	t.Helper()
+	result, err := db.Clean(context.Background(), opts)
+	assert.Nil(t, err)
+	return result
+}
+
+// Logs without a project use the default retention. That isn't tested
+// here since a shared storage could have such logs from other tests.
+func testCleanLoginLogs(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	p1, p2, p3 := uuid.String(), uuid.String(), uuid.String()
+	fixtures.Project(data.Project{Id: p1, LoginLogRetainCount: 2}, time.Now())
+	fixtures.Project(data.Project{Id: p2, LoginLogRetainDays: 1}, time.Now())
+	fixtures.Project(data.Project{Id: p3}, time.Now())
+
+	now := time.Now()
+	for _, l := range []struct {
+		projectId string
+		userId    string
+		status    int
+		created   time.Duration
+	}{
+		{p1, "u1", 1, 0},
+		{p1, "u1", 2, -time.Minute},
+		{p1, "u1", 3, -2 * time.Minute},
+		{p1, "u2", 4, -2 * time.Minute},
+		{p2, "u1", 5, -23 * time.Hour},
+		{p2, "u1", 6, -25 * time.Hour},
+		{p3, "u1", 7, -1000 * 24 * time.Hour},
+	} {
+		fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: l.projectId, UserId: l.userId, Status: l.status}, now.Add(l.created))
+	}
+
+	assert.True(t, clean(t, db, data.Clean{}).LoginLogs >= 2)
+	assertStatuses(t, loginLogs(t, db, p1, "u1"), 1, 2)
+	assertStatuses(t, loginLogs(t, db, p1, "u2"), 4)
+	assertStatuses(t, loginLogs(t, db, p2, "u1"), 5)
+	assertStatuses(t, loginLogs(t, db, p3, "u1"), 7)
+}
+
+// Only stale locks are cleaned, which isn't something we can observe,
+// but active ones must survive
+func testCleanUserLocks(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	projectId := uuid.String()
+	now := time.Now()
+	lockedUntil, expired := now.Add(time.Minute), now.Add(-time.Minute)
+	fixtures.UserLock(projectId, "u1", &lockedUntil, now.Add(-48*time.Hour))
+	fixtures.UserLock(projectId, "u2", &expired, now.Add(-48*time.Hour))
+	fixtures.UserLock(projectId, "u3", nil, now.Add(-48*time.Hour))
+
+	assert.True(t, clean(t, db, data.Clean{}).UserLocks >= 2)
+
+	lock, err := db.UserLockGet(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u1"})
+	assert.Nil(t, err)
+	assert.Timeish(t, *lock.LockedUntil, lockedUntil)
+
+	lock, _ = db.UserLockGet(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u2"})
+	assert.True(t, lock.LockedUntil == nil)
+}
+
+// SQL storages delete in batches of BatchSize rows, the others ignore it.
+// Either way, everything gets cleaned.
+func testCleanBatches(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	projectId := uuid.String()
+	fixtures.Project(data.Project{Id: projectId, LoginLogRetainCount: 1}, time.Now())
+
+	zero := 0
+	tickets := make([]data.TicketCreateTicket, 7)
+	for i := range tickets {
+		tickets[i] = data.TicketCreateTicket{Ticket: []byte(fmt.Sprintf("t%d", i)), Uses: &zero}
+	}
+	_, err := db.TicketCreate(context.Background(), data.TicketCreate{ProjectId: projectId, Tickets: tickets})
+	assert.Nil(t, err)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: projectId, UserId: "u1", Status: i}, now.Add(-time.Duration(i)*time.Minute))
+	}
+
+	result := clean(t, db, data.Clean{BatchSize: 2, Pause: time.Millisecond})
+	assert.True(t, result.Tickets >= 7)
+	assert.True(t, result.LoginLogs >= 4)
+	assertStatuses(t, loginLogs(t, db, projectId, "u1"), 0)
+
+	res, err := db.TicketCreate(context.Background(), data.TicketCreate{Max: 1, ProjectId: projectId, Tickets: []data.TicketCreateTicket{{Ticket: []byte("t")}}})
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TICKET_CREATE_OK)
+
+	// a cancelled context stops between batches, with what was removed so far
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.Clean(ctx, data.Clean{BatchSize: 1})
+	if err != nil {
+		assert.True(t, errors.Is(err, context.Canceled))
+	}
+}
+
+func testGetProjectUnknown(t *testing.T, db storage.Storage, _ Fixtures) {
+	p, err := db.GetProject(context.Background(), uuid.String())
+	assert.Nil(t, err)
+	assert.True(t, p == nil)
+}
+
+func testGetProjectSuccess(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	id := uuid.String()
+	fixtures.Project(data.Project{
+		Id:                       id,
+		TOTPMax:                  84,
+		TOTPIssuer:               "goblgobl.com",
+		TOTPSetupTTL:             124,
+		TOTPSecretLength:         38,
+		TicketMax:                49,
+		TicketMaxPayloadLength:   1022,
+		LoginLogMax:              59,
+		LoginLogMaxPayloadLength: 1029,
+		LoginLogRetainCount:      12,
+		LoginLogRetainDays:       30,
+		LoginLogRetainOnInsert:   true,
+		LockoutRules:             []data.LockoutRule{{Statuses: []int{2, 3}, Failures: 5, Window: 900, Duration: 1800}},
+		LoginLogSuccessStatuses:  []int{0, 1},
+	}, time.Now())
+
+	p, err := db.GetProject(context.Background(), id)
+	assert.Nil(t, err)
+	assert.Equal(t, p.Id, id)
+	assert.Equal(t, p.TOTPMax, 84)
+	assert.Equal(t, p.TOTPSetupTTL, 124)
+	assert.Equal(t, p.TOTPSecretLength, 38)
+	assert.Equal(t, p.TOTPIssuer, "goblgobl.com")
+	assert.Equal(t, p.TicketMax, 49)
+	assert.Equal(t, p.TicketMaxPayloadLength, 1022)
+	assert.Equal(t, p.LoginLogMax, 59)
+	assert.Equal(t, p.LoginLogMaxPayloadLength, 1029)
+	assert.Equal(t, p.LoginLogRetainCount, 12)
+	assert.Equal(t, p.LoginLogRetainDays, 30)
+	assert.True(t, p.LoginLogRetainOnInsert)
+	assert.Equal(t, len(p.LockoutRules), 1)
+	assert.Equal(t, len(p.LockoutRules[0].Statuses), 2)
+	assert.Equal(t, p.LockoutRules[0].Statuses[0], 2)
+	assert.Equal(t, p.LockoutRules[0].Statuses[1], 3)
+	assert.Equal(t, p.LockoutRules[0].Failures, 5)
+	assert.Equal(t, p.LockoutRules[0].Window, 900)
+	assert.Equal(t, p.LockoutRules[0].Duration, 1800)
+	assert.Equal(t, len(p.LoginLogSuccessStatuses), 2)
+	assert.Equal(t, p.LoginLogSuccessStatuses[0], 0)
+	assert.Equal(t, p.LoginLogSuccessStatuses[1], 1)
+}
+
+// Other tests might have updated projects, so we only check for ours
+func testGetUpdatedProjects(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	now := time.Now()
+	id1, id2, id3, id4 := uuid.String(), uuid.String(), uuid.String(), uuid.String()
+	fixtures.Project(data.Project{Id: id1}, now.Add(-500*time.Second))
+	fixtures.Project(data.Project{Id: id2}, now.Add(-200*time.Second))
+	fixtures.Project(data.Project{Id: id3}, now.Add(-100*time.Second))
+	fixtures.Project(data.Project{Id: id4}, now.Add(-10*time.Second))
+
+	updated := func(timestamp time.Time) map[string]bool {
+		t.Helper()
+		projects, err := db.GetUpdatedProjects(context.Background(), timestamp)
+		assert.Nil(t, err)
+		lookup := make(map[string]bool, len(projects))
+		for _, p := range projects {
+			lookup[p.Id] = true
+		}
+		return lookup
+	}
+
+	lookup := updated(now.Add(-105 * time.Second))
+	assert.False(t, lookup[id1])
+	assert.False(t, lookup[id2])
+	assert.True(t, lookup[id3])
+	assert.True(t, lookup[id4])
+
+	lookup = updated(now.Add(time.Second))
+	assert.False(t, lookup[id4])
+}
+
+func testTOTPCreate(t *testing.T, db storage.Storage, _ Fixtures) {
+	now := time.Now().Add(time.Minute)
+	projectId1, projectId2 := uuid.String(), uuid.String()
+
+	create := func(opts data.TOTPCreate) data.TOTPCreateStatus {
+		t.Helper()
+		res, err := db.TOTPCreate(context.Background(), opts)
+		assert.Nil(t, err)
+		return res.Status
+	}
+
+	assertSecret := func(projectId string, userId string, tpe string, pending bool, secret []byte) {
+		t.Helper()
+		res, err := db.TOTPGet(context.Background(), data.TOTPGet{ProjectId: projectId, UserId: userId, Type: tpe, Pending: pending})
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.TOTP_GET_OK)
+		assert.Bytes(t, res.Secret, secret)
+	}
+
+	create(data.TOTPCreate{ProjectId: projectId1, UserId: "u1", Type: "t1", Secret: []byte("sec1")})
+	create(data.TOTPCreate{ProjectId: projectId1, UserId: "u2", Type: "t2", Secret: []byte("sec2"), Expires: &now})
+
+	// Adds more when less than max
+	for i, expires := range []*time.Time{nil, &now} {
+		secret := []byte{byte(i), byte(i)}
+		tpe := fmt.Sprintf("t-%d", i)
+		status := create(data.TOTPCreate{Max: 4, UserId: "u1", Type: tpe, Secret: secret, Expires: expires, ProjectId: projectId1})
+		assert.Equal(t, status, data.TOTP_CREATE_OK)
+		assertSecret(projectId1, "u1", tpe, expires != nil, secret)
+	}
+
+	// can't add any more, pending or not
+	for _, expires := range []*time.Time{nil, &now} {
+		status := create(data.TOTPCreate{Max: 4, UserId: "u4", Expires: expires, ProjectId: projectId1, Secret: []byte{13, 14}})
+		assert.Equal(t, status, data.TOTP_CREATE_MAX)
+	}
+
+	// 0 == no limit
+	status := create(data.TOTPCreate{Max: 0, UserId: "u4", Type: "t4", ProjectId: projectId1, Secret: []byte{23, 24}})
+	assert.Equal(t, status, data.TOTP_CREATE_OK)
+	assertSecret(projectId1, "u4", "t4", false, []byte{23, 24})
+
+	// limits are per project (there's no other totp for project2)
+	status = create(data.TOTPCreate{Max: 1, UserId: "u4", ProjectId: projectId2, Secret: []byte{23, 24}})
+	assert.Equal(t, status, data.TOTP_CREATE_OK)
+	assertSecret(projectId2, "u4", "", false, []byte{23, 24})
+
+	// existing users+type don't increment count
+	for _, expires := range []*time.Time{nil, &now} {
+		status := create(data.TOTPCreate{Max: 1, UserId: "u2", Type: "t2", Expires: expires, ProjectId: projectId1, Secret: []byte{33, 34}})
+		assert.Equal(t, status, data.TOTP_CREATE_OK)
+	}
+	assertSecret(projectId1, "u2", "t2", true, []byte{33, 34})
+
+	// existing users DO increment count for a different type
+	for _, expires := range []*time.Time{nil, &now} {
+		status := create(data.TOTPCreate{Max: 1, UserId: "u1", Type: "t-new", Expires: expires, ProjectId: projectId1, Secret: []byte{33, 34}})
+		assert.Equal(t, status, data.TOTP_CREATE_MAX)
+	}
+}
+
+func testTOTPCreateNonPendingDeletesPending(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	expires := time.Now().Add(time.Minute)
+	db.TOTPCreate(context.Background(), data.TOTPCreate{ProjectId: projectId, UserId: "u1", Type: "t1", Secret: []byte("sec1"), Expires: &expires})
+
+	res, err := db.TOTPCreate(context.Background(), data.TOTPCreate{ProjectId: projectId, UserId: "u1", Type: "t1", Secret: []byte{99, 98}})
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TOTP_CREATE_OK)
+
+	get, _ := db.TOTPGet(context.Background(), data.TOTPGet{ProjectId: projectId, UserId: "u1", Type: "t1", Pending: true})
+	assert.Equal(t, get.Status, data.TOTP_GET_NOT_FOUND)
+
+	get, _ = db.TOTPGet(context.Background(), data.TOTPGet{ProjectId: projectId, UserId: "u1", Type: "t1"})
+	assert.Equal(t, get.Status, data.TOTP_GET_OK)
+	assert.Bytes(t, get.Secret, []byte{99, 98})
+}
+
+func testTOTPGet(t *testing.T, db storage.Storage, _ Fixtures) {
+	p1, p2 := uuid.String(), uuid.String()
+	expired, expires := time.Now().Add(-time.Second), time.Now().Add(5*time.Second)
+	for _, opts := range []data.TOTPCreate{
+		{ProjectId: p1, UserId: "u1", Type: "t1", Expires: &expired, Secret: []byte("sec1")},
+		{ProjectId: p1, UserId: "u2", Type: "t2", Expires: &expires, Secret: []byte("sec2")},
+		{ProjectId: p1, UserId: "u2", Type: "t4", Expires: &expires, Secret: []byte("sec3")},
+		{ProjectId: p1, UserId: "u2", Type: "t2", Secret: []byte("sec4")},
+		{ProjectId: p2, UserId: "u2", Type: "t3", Secret: []byte("sec5")},
+	} {
+		// the non-pending u2/t2 would delete the pending one
+		if opts.Expires == nil && opts.Type == "t2" {
+			continue
+		}
+		_, err := db.TOTPCreate(context.Background(), opts)
+		assert.Nil(t, err)
+	}
+
+	assertNotFound := func(opts data.TOTPGet) {
+		t.Helper()
+		result, err := db.TOTPGet(context.Background(), opts)
+		assert.Nil(t, err)
+		assert.Equal(t, result.Status, data.TOTP_GET_NOT_FOUND)
+	}
+
+	assertSecret := func(opts data.TOTPGet, secret string) {
+		t.Helper()
+		result, err := db.TOTPGet(context.Background(), opts)
+		assert.Nil(t, err)
+		assert.Equal(t, result.Status, data.TOTP_GET_OK)
+		assert.Bytes(t, result.Secret, []byte(secret))
+	}
+
+	// expired
+	assertNotFound(data.TOTPGet{Type: "t1", UserId: "u1", ProjectId: p1, Pending: true})
+
+	// user doesn't have this type
+	assertNotFound(data.TOTPGet{Type: "t9", UserId: "u1", ProjectId: p1})
+
+	// user doesn't have this type in non-setup
+	assertNotFound(data.TOTPGet{Type: "t4", UserId: "u2", ProjectId: p1})
+
+	// wrong project
+	assertNotFound(data.TOTPGet{Type: "t3", UserId: "u2", ProjectId: p1})
+
+	// not expired
+	assertSecret(data.TOTPGet{Type: "t2", UserId: "u2", ProjectId: p1, Pending: true}, "sec2")
+
+	// non-setup
+	assertSecret(data.TOTPGet{Type: "t3", UserId: "u2", ProjectId: p2}, "sec5")
+}
+
+func testTOTPDelete(t *testing.T, db storage.Storage, _ Fixtures) {
+	p1, p2 := uuid.String(), uuid.String()
+	expires := time.Now().Add(time.Minute)
+	for _, opts := range []data.TOTPCreate{
+		{ProjectId: p1, UserId: "u1", Type: "t1", Expires: &expires},
+		{ProjectId: p1, UserId: "u2", Type: "t2", Expires: &expires},
+		{ProjectId: p1, UserId: "u2", Type: "t4"},
+		{ProjectId: p1, UserId: "u2", Type: "t3"},
+		{ProjectId: p2, UserId: "u2", Type: "t3"},
+		{ProjectId: p1, UserId: "u3", Type: "t1"},
+	} {
+		opts.Secret = []byte("sec")
+		_, err := db.TOTPCreate(context.Background(), opts)
+		assert.Nil(t, err)
+	}
+
+	exists := func(projectId string, userId string, tpe string, pending bool) bool {
+		t.Helper()
+		res, err := db.TOTPGet(context.Background(), data.TOTPGet{ProjectId: projectId, UserId: userId, Type: tpe, Pending: pending})
+		assert.Nil(t, err)
+		return res.Status == data.TOTP_GET_OK
+	}
+
+	// specific type
+	deleted, err := db.TOTPDelete(context.Background(), data.TOTPGet{Type: "t1", UserId: "u1", ProjectId: p1})
+	assert.Nil(t, err)
+	assert.Equal(t, deleted, 1)
+	assert.False(t, exists(p1, "u1", "t1", true))
+	assert.True(t, exists(p1, "u3", "t1", false))
+
+	// all types for the user
+	deleted, err = db.TOTPDelete(context.Background(), data.TOTPGet{UserId: "u2", AllTypes: true, ProjectId: p1})
+	assert.Nil(t, err)
+	assert.Equal(t, deleted, 3)
+	assert.False(t, exists(p1, "u2", "t2", true))
+	assert.False(t, exists(p1, "u2", "t4", false))
+	assert.True(t, exists(p2, "u2", "t3", false))
+	assert.True(t, exists(p1, "u3", "t1", false))
+}
+
+func testTicketCreate(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId1 := uuid.String()
+
+	create := func(opts data.TicketCreate) data.TicketCreateStatus {
+		t.Helper()
+		res, err := db.TicketCreate(context.Background(), opts)
+		assert.Nil(t, err)
+		return res.Status
+	}
+
+	// without expiry or usage or payload
+	status := create(data.TicketCreate{ProjectId: projectId1, Tickets: []data.TicketCreateTicket{{Ticket: []byte{1, 2, 3}}}})
+	assert.Equal(t, status, data.TICKET_CREATE_OK)
+
+	// with expiry and usage
+	uses := 9
+	expires := time.Now().Add(time.Hour)
+	status = create(data.TicketCreate{
+		ProjectId: projectId1,
+		Tickets: []data.TicketCreateTicket{{
+			Ticket:  []byte{4, 5, 6},
+			Payload: []byte{0, 0, 1},
+			Expires: &expires,
+			Uses:    &uses,
+		}},
+	})
+	assert.Equal(t, status, data.TICKET_CREATE_OK)
+
+	// max reached (previous 2 created a ticket each)
+	status = create(data.TicketCreate{Max: 2, ProjectId: projectId1, Tickets: []data.TicketCreateTicket{{Ticket: []byte{9, 9, 9}}}})
+	assert.Equal(t, status, data.TICKET_CREATE_MAX)
+	use, _ := db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId1, Ticket: []byte{9, 9, 9}})
+	assert.Equal(t, use.Status, data.TICKET_USE_NOT_FOUND)
+
+	// duplicate
+	status = create(data.TicketCreate{ProjectId: projectId1, Tickets: []data.TicketCreateTicket{{Ticket: []byte{1, 2, 3}}}})
+	assert.Equal(t, status, data.TICKET_CREATE_DUPLICATE)
+
+	use, _ = db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId1, Ticket: []byte{1, 2, 3}})
+	assert.Equal(t, use.Status, data.TICKET_USE_OK)
+	assert.True(t, use.Uses == nil)
+	assert.True(t, use.Payload == nil)
+
+	use, _ = db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId1, Ticket: []byte{4, 5, 6}})
+	assert.Equal(t, use.Status, data.TICKET_USE_OK)
+	assert.Equal(t, *use.Uses, 8)
+	assert.Bytes(t, *use.Payload, []byte{0, 0, 1})
+
+	// batch
+	projectId2 := uuid.String()
+	uses = 2
+	status = create(data.TicketCreate{
+		Max:       3,
+		ProjectId: projectId2,
+		Tickets: []data.TicketCreateTicket{
+			{Ticket: []byte{1}},
+			{Ticket: []byte{2}, Uses: &uses, Payload: []byte{9}},
+			{Ticket: []byte{3}},
+		},
+	})
+	assert.Equal(t, status, data.TICKET_CREATE_OK)
+
+	use, _ = db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId2, Ticket: []byte{2}})
+	assert.Equal(t, use.Status, data.TICKET_USE_OK)
+	assert.Equal(t, *use.Uses, 1)
+	assert.Bytes(t, *use.Payload, []byte{9})
+
+	// max is for the whole batch, so even though there's room for 1
+	// more, none of these are inserted
+	status = create(data.TicketCreate{
+		Max:       4,
+		ProjectId: projectId2,
+		Tickets: []data.TicketCreateTicket{
+			{Ticket: []byte{4}},
+			{Ticket: []byte{5}},
+		},
+	})
+	assert.Equal(t, status, data.TICKET_CREATE_MAX)
+	use, _ = db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId2, Ticket: []byte{4}})
+	assert.Equal(t, use.Status, data.TICKET_USE_NOT_FOUND)
+
+	// a duplicate, of an existing ticket or within the batch, means none
+	// of the batch is inserted
+	status = create(data.TicketCreate{
+		ProjectId: projectId2,
+		Tickets: []data.TicketCreateTicket{
+			{Ticket: []byte{6}},
+			{Ticket: []byte{1}},
+			{Ticket: []byte{7}},
+		},
+	})
+	assert.Equal(t, status, data.TICKET_CREATE_DUPLICATE)
+
+	status = create(data.TicketCreate{
+		ProjectId: projectId2,
+		Tickets: []data.TicketCreateTicket{
+			{Ticket: []byte{8}},
+			{Ticket: []byte{9}},
+			{Ticket: []byte{8}},
+		},
+	})
+	assert.Equal(t, status, data.TICKET_CREATE_DUPLICATE)
+
+	for _, ticket := range []byte{6, 7, 8, 9} {
+		use, _ = db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId2, Ticket: []byte{ticket}})
+		assert.Equal(t, use.Status, data.TICKET_USE_NOT_FOUND)
+	}
+
+	// and none of it was counted
+	status = create(data.TicketCreate{Max: 4, ProjectId: projectId2, Tickets: []data.TicketCreateTicket{{Ticket: []byte{10}}}})
+	assert.Equal(t, status, data.TICKET_CREATE_OK)
+}
+
+func testTicketUseFound(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	one, ten := 1, 10
+	expires := time.Now().Add(100 * time.Second)
+	createTickets(t, db, projectId,
+		data.TicketCreateTicket{Ticket: []byte("t1"), Payload: []byte("d1"), Uses: &one},
+		data.TicketCreateTicket{Ticket: []byte("t2")},
+		data.TicketCreateTicket{Ticket: []byte("t3"), Uses: &ten, Expires: &expires},
+	)
+
+	assertTicket := func(ticket string, payload string, uses int) {
+		t.Helper()
+		res, err := db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId, Ticket: []byte(ticket)})
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+
+		if uses == -1 {
+			assert.True(t, res.Uses == nil)
+		} else {
+			assert.Equal(t, *res.Uses, uses)
+		}
+
+		if payload == "" {
+			assert.True(t, res.Payload == nil)
+		} else {
+			assert.Bytes(t, *res.Payload, []byte(payload))
+		}
+	}
+
+	assertTicket("t1", "d1", 0)
+	assertTicket("t2", "", -1)
+	assertTicket("t3", "", 9)
+}
+
+// wrong ticket, no more use or expired
+func testTicketUseNotFound(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	two := 2
+	expired := time.Now().Add(-time.Second)
+	createTickets(t, db, projectId,
+		data.TicketCreateTicket{Ticket: []byte("t1"), Uses: &two},
+		data.TicketCreateTicket{Ticket: []byte("t2"), Expires: &expired},
+	)
+
+	assertNotFound := func(projectId string, ticket string) {
+		t.Helper()
+		res, err := db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId, Ticket: []byte(ticket)})
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.TICKET_USE_NOT_FOUND)
+	}
+
+	assertNotFound(uuid.String(), "t1") // wrong project
+	assertNotFound(projectId, "t9")     // wrong ticket
+	assertNotFound(projectId, "t2")     // expired
+
+	// checks both our use limit, and that using a ticket decreases it
+	opts := data.TicketUse{ProjectId: projectId, Ticket: []byte("t1")}
+	res, _ := db.TicketUse(context.Background(), opts)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+	res, _ = db.TicketUse(context.Background(), opts)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+	assertNotFound(projectId, "t1")
+}
+
+func testTicketUseScope(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	one, three := 1, 3
+	createTickets(t, db, projectId,
+		data.TicketCreateTicket{Ticket: []byte("c1"), Scope: []byte("s1"), Attempts: &three},
+		data.TicketCreateTicket{Ticket: []byte("c2"), Scope: []byte("s1"), Attempts: &one},
+		data.TicketCreateTicket{Ticket: []byte("c3"), Scope: []byte("s2"), Attempts: &one},
+	)
+
+	use := func(ticket string, scope []byte) data.TicketUseStatus {
+		t.Helper()
+		res, err := db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId, Ticket: []byte(ticket), Scope: scope})
+		assert.Nil(t, err)
+		return res.Status
+	}
+
+	// no scope, no attempt tracking
+	assert.Equal(t, use("c9", nil), data.TICKET_USE_NOT_FOUND)
+
+	// a miss consumes an attempt from every code in the scope, c2 is
+	// now out of attempts (and using it is a miss, so c1 is down to 1)
+	assert.Equal(t, use("c9", []byte("s1")), data.TICKET_USE_NOT_FOUND)
+	assert.Equal(t, use("c2", []byte("s1")), data.TICKET_USE_NOT_FOUND)
+
+	// a hit doesn't consume an attempt
+	assert.Equal(t, use("c1", []byte("s1")), data.TICKET_USE_OK)
+	assert.Equal(t, use("c1", []byte("s1")), data.TICKET_USE_OK)
+
+	// other scopes are untouched
+	assert.Equal(t, use("c3", []byte("s2")), data.TICKET_USE_OK)
+}
+
+func testTicketUseSlidingTTL(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	five, ttl := 5, 3600
+	expires := time.Now().Add(10 * time.Second)
+	createTickets(t, db, projectId,
+		data.TicketCreateTicket{Ticket: []byte("t1"), Uses: &five, Expires: &expires, SlidingTTL: &ttl},
+		data.TicketCreateTicket{Ticket: []byte("t2"), Uses: &five, Expires: &expires},
+	)
+
+	for _, ticket := range []string{"t1", "t2"} {
+		res, err := db.TicketUse(context.Background(), data.TicketUse{ProjectId: projectId, Ticket: []byte(ticket)})
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.TICKET_USE_OK)
+		assert.Equal(t, *res.Uses, 4)
+	}
+}
+
+func testTicketDelete(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	three, zero := 3, 0
+	expired := time.Now().Add(-time.Second)
+	createTickets(t, db, projectId,
+		data.TicketCreateTicket{Ticket: []byte("t1")},
+		data.TicketCreateTicket{Ticket: []byte("t2"), Uses: &three},
+		data.TicketCreateTicket{Ticket: []byte("t3"), Uses: &zero},
+		data.TicketCreateTicket{Ticket: []byte("t4"), Expires: &expired},
+	)
+
+	// -2 == not found, -1 == found with unlimited uses
+	assertDelete := func(projectId string, ticket string, uses int) {
+		t.Helper()
+		res, err := db.TicketDelete(context.Background(), data.TicketUse{ProjectId: projectId, Ticket: []byte(ticket)})
+		assert.Nil(t, err)
+		if uses == -2 {
+			assert.Equal(t, res.Status, data.TICKET_USE_NOT_FOUND)
+		} else if uses == -1 {
+			assert.Equal(t, res.Status, data.TICKET_USE_OK)
+			assert.True(t, res.Uses == nil)
+		} else {
+			assert.Equal(t, res.Status, data.TICKET_USE_OK)
+			assert.Equal(t, *res.Uses, uses)
+		}
+	}
+
+	assertDelete(uuid.String(), "t1", -2) // wrong project
+	assertDelete(projectId, "t9", -2)     // wrong ticket
+	assertDelete(projectId, "t3", -2)     // no more use
+	assertDelete(projectId, "t4", -2)     // expired
+
+	// it's really deleted, so not found the 2nd time
+	assertDelete(projectId, "t1", -1)
+	assertDelete(projectId, "t1", -2)
+
+	assertDelete(projectId, "t2", 3)
+	assertDelete(projectId, "t2", -2)
+}
+
+func testTicketExtend(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	two, zero := 2, 0
+	soon, expired := time.Now().Add(2*time.Second), time.Now().Add(-time.Second)
+	createTickets(t, db, projectId,
+		data.TicketCreateTicket{Ticket: []byte("t1"), Uses: &two, Expires: &soon},
+		data.TicketCreateTicket{Ticket: []byte("t2")},
+		data.TicketCreateTicket{Ticket: []byte("t3"), Uses: &zero},
+		data.TicketCreateTicket{Ticket: []byte("t4"), Uses: &two, Expires: &expired},
+	)
+
+	extend := func(ticket string, expires *time.Time, uses *int) data.TicketUseResult {
+		t.Helper()
+		res, err := db.TicketExtend(context.Background(), data.TicketExtend{
+			Uses:      uses,
+			Expires:   expires,
+			Ticket:    []byte(ticket),
+			ProjectId: projectId,
+		})
+		assert.Nil(t, err)
+		return res
+	}
+
+	uses := 3
+	expires := time.Now().Add(time.Hour)
+
+	// dead tickets can't be extended
+	assert.Equal(t, extend("t3", nil, &uses).Status, data.TICKET_USE_NOT_FOUND)
+	assert.Equal(t, extend("t4", &expires, nil).Status, data.TICKET_USE_NOT_FOUND)
+	assert.Equal(t, extend("t9", &expires, nil).Status, data.TICKET_USE_NOT_FOUND)
+
+	// only uses
+	res := extend("t1", nil, &uses)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+	assert.Equal(t, *res.Uses, 5)
+
+	// only expires
+	res = extend("t1", &expires, nil)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+	assert.Equal(t, *res.Uses, 5)
+
+	// unlimited uses stay unlimited
+	res = extend("t2", &expires, &uses)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+	assert.True(t, res.Uses == nil)
+}
+
+func testTicketDeny(t *testing.T, db storage.Storage, _ Fixtures) {
+	opts := data.TicketDeny{
+		ProjectId: uuid.String(),
+		Ticket:    []byte("t1"),
+		Expires:   time.Now().Add(time.Minute),
+	}
+
+	res, err := db.TicketDeny(context.Background(), opts)
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+
+	res, err = db.TicketDeny(context.Background(), opts)
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TICKET_USE_NOT_FOUND)
+
+	// different project
+	opts.ProjectId = uuid.String()
+	res, err = db.TicketDeny(context.Background(), opts)
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TICKET_USE_OK)
+}
+
+func testLoginLogCreate(t *testing.T, db storage.Storage, _ Fixtures) {
+	assertLoginLog := func(opts data.LoginLogCreate) {
+		t.Helper()
+		opts.Id = uuid.String()
+		opts.ProjectId = uuid.String()
+		res, err := db.LoginLogCreate(context.Background(), opts)
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.LOGIN_LOG_CREATE_OK)
+
+		records := loginLogs(t, db, opts.ProjectId, opts.UserId)
+		assert.Equal(t, len(records), 1)
+		record := records[0]
+		assert.Equal(t, record.Id, opts.Id)
+		assert.Nowish(t, record.Created)
+		assert.Equal(t, record.Status, opts.Status)
+		assert.Equal(t, record.PayloadKey, opts.PayloadKey)
+		for _, f := range []struct {
+			actual   *string
+			expected *string
+		}{
+			{record.Ip, opts.Ip},
+			{record.UserAgent, opts.UserAgent},
+			{record.Method, opts.Method},
+			{record.Country, opts.Country},
+		} {
+			if f.expected == nil {
+				assert.True(t, f.actual == nil)
+			} else {
+				assert.Equal(t, *f.actual, *f.expected)
+			}
+		}
+
+		if opts.Payload == nil {
+			assert.True(t, record.RawPayload == nil)
+		} else {
+			assert.Bytes(t, record.RawPayload, opts.Payload)
+		}
+	}
+
+	// no payload
+	assertLoginLog(data.LoginLogCreate{Status: 99, UserId: "u1"})
+
+	// payload
+	assertLoginLog(data.LoginLogCreate{Status: 2, UserId: "u2", Payload: []byte("over 9000!")})
+
+	// encrypted payload
+	assertLoginLog(data.LoginLogCreate{Status: 2, UserId: "u2", Payload: []byte("encrypted"), PayloadKey: 2})
+
+	// fields
+	ip, ua, method, country := "1.2.3.4", "curl/7", "totp", "CA"
+	assertLoginLog(data.LoginLogCreate{Status: 1, UserId: "u3", Ip: &ip, UserAgent: &ua, Method: &method, Country: &country})
+}
+
+// max is per project, regardless of user
+func testLoginLogCreateMax(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	create := func(projectId string, userId string) data.LoginLogCreateStatus {
+		t.Helper()
+		res, err := db.LoginLogCreate(context.Background(), data.LoginLogCreate{Id: uuid.String(), ProjectId: projectId, UserId: userId, Max: 2})
+		assert.Nil(t, err)
+		return res.Status
+	}
+
+	assert.Equal(t, create(projectId, "u1"), data.LOGIN_LOG_CREATE_OK)
+	assert.Equal(t, create(projectId, "u2"), data.LOGIN_LOG_CREATE_OK)
+	assert.Equal(t, create(projectId, "u3"), data.LOGIN_LOG_CREATE_MAX)
+	assert.Equal(t, create(uuid.String(), "u3"), data.LOGIN_LOG_CREATE_OK)
+}
+
+func testLoginLogCreateRetainCount(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	for i := 1; i <= 4; i++ {
+		_, err := db.LoginLogCreate(context.Background(), data.LoginLogCreate{
+			Id:          uuid.String(),
+			Status:      i,
+			UserId:      "u1",
+			ProjectId:   projectId,
+			RetainCount: 2,
+		})
+		assert.Nil(t, err)
+	}
+	db.LoginLogCreate(context.Background(), data.LoginLogCreate{Id: uuid.String(), Status: 9, UserId: "u2", ProjectId: projectId, RetainCount: 2})
+
+	// created might only have a 1 second resolution, so we can't tell
+	// which were kept
+	assert.Equal(t, len(loginLogs(t, db, projectId, "u1")), 2)
+	assert.Equal(t, len(loginLogs(t, db, projectId, "u2")), 1)
+}
+
+func testLoginLogCreateNewIpAndDevice(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	create := func(userId string, ipPrefix *string, device *string) data.LoginLogCreateResult {
+		t.Helper()
+		res, err := db.LoginLogCreate(context.Background(), data.LoginLogCreate{
+			Id:              uuid.String(),
+			UserId:          userId,
+			ProjectId:       projectId,
+			IpPrefix:        ipPrefix,
+			Device:          device,
+			SuccessStatuses: []int{0},
+		})
+		assert.Nil(t, err)
+		return res
+	}
+
+	p1, p2, d1, d2 := "1.2.3.0/24", "1.2.4.0/24", "d1", "d2"
+
+	res := create("u1", nil, nil)
+	assert.False(t, res.NewIp)
+	assert.False(t, res.NewDevice)
+
+	res = create("u1", &p1, &d1)
+	assert.True(t, res.NewIp)
+	assert.True(t, res.NewDevice)
+
+	res = create("u1", &p1, &d1)
+	assert.False(t, res.NewIp)
+	assert.False(t, res.NewDevice)
+
+	res = create("u1", &p2, &d1)
+	assert.True(t, res.NewIp)
+	assert.False(t, res.NewDevice)
+
+	res = create("u1", &p1, &d2)
+	assert.False(t, res.NewIp)
+	assert.True(t, res.NewDevice)
+
+	res = create("u2", &p1, &d1)
+	assert.True(t, res.NewIp)
+	assert.True(t, res.NewDevice)
+
+	// without success statuses, nothing is ever new
+	res, err := db.LoginLogCreate(context.Background(), data.LoginLogCreate{
+		Id:        uuid.String(),
+		UserId:    "u3",
+		ProjectId: projectId,
+		IpPrefix:  &p1,
+		Device:    &d1,
+	})
+	assert.Nil(t, err)
+	assert.False(t, res.NewIp)
+	assert.False(t, res.NewDevice)
+}
+
+func testLoginLogCreateNewIpAndDeviceHistory(t *testing.T, db storage.Storage, _ Fixtures) {
+	projectId := uuid.String()
+	create := func(userId string, status int, ip string, ipPrefix *string, userAgent string, device *string) data.LoginLogCreateResult {
+		t.Helper()
+		res, err := db.LoginLogCreate(context.Background(), data.LoginLogCreate{
+			Id:              uuid.String(),
+			UserId:          userId,
+			Status:          status,
+			ProjectId:       projectId,
+			Ip:              &ip,
+			IpPrefix:        ipPrefix,
+			UserAgent:       &userAgent,
+			Device:          device,
+			SuccessStatuses: []int{1, 3},
+		})
+		assert.Nil(t, err)
+		return res
+	}
+
+	p1, p2, d1, d2 := "1.2.3.0/24", "1.2.4.0/24", "d1", "d2"
+
+	// only successful logins are history
+	create("u1", 2, "1.2.3.4", &p1, "ua", &d1)
+	res := create("u1", 1, "1.2.3.4", &p1, "ua", &d1)
+	assert.True(t, res.NewIp)
+	assert.True(t, res.NewDevice)
+
+	res = create("u1", 3, "1.2.3.4", &p1, "ua", &d1)
+	assert.False(t, res.NewIp)
+	assert.False(t, res.NewDevice)
+
+	create("u1", 2, "1.2.4.4", &p2, "ua2", &d2)
+	res = create("u1", 1, "1.2.4.4", &p2, "ua2", &d2)
+	assert.True(t, res.NewIp)
+	assert.True(t, res.NewDevice)
+
+	// only login logs from before ip_prefix / device: can't tell
+	create("u2", 1, "1.2.3.4", nil, "ua", nil)
+	res = create("u2", 1, "1.2.4.4", &p2, "ua2", &d2)
+	assert.False(t, res.NewIp)
+	assert.False(t, res.NewDevice)
+
+	// now we can
+	res = create("u2", 1, "1.2.3.4", &p1, "ua", &d1)
+	assert.True(t, res.NewIp)
+	assert.True(t, res.NewDevice)
+}
+
+func testLoginLogCreateLockout(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	projectId := uuid.String()
+	rules := []data.LockoutRule{
+		data.LockoutRule{Statuses: []int{2, 3}, Failures: 3, Window: 60, Duration: 600},
+		data.LockoutRule{Statuses: []int{3}, Failures: 2, Window: 60, Duration: 60},
+	}
+	create := func(userId string, status int) *time.Time {
+		t.Helper()
+		res, err := db.LoginLogCreate(context.Background(), data.LoginLogCreate{
+			Id:        uuid.String(),
+			Status:    status,
+			UserId:    userId,
+			ProjectId: projectId,
+			Lockout:   rules,
+		})
+		assert.Nil(t, err)
+		return res.LockedUntil
+	}
+
+	// outside of the window
+	fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: projectId, UserId: "u1", Status: 2}, time.Now().Add(-2*time.Minute))
+
+	assert.True(t, create("u1", 2) == nil)
+	assert.True(t, create("u1", 1) == nil)
+	assert.True(t, create("u2", 2) == nil)
+	assert.True(t, create("u1", 2) == nil)
+
+	lockedUntil := create("u1", 3)
+	assert.True(t, lockedUntil != nil)
+	assert.Timeish(t, *lockedUntil, time.Now().Add(600*time.Second))
+
+	// still locked, even by a login log which doesn't match any rule
+	lockedUntil = create("u1", 1)
+	assert.True(t, lockedUntil != nil)
+	assert.Timeish(t, *lockedUntil, time.Now().Add(600*time.Second))
+
+	lock, err := db.UserLockGet(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u1"})
+	assert.Nil(t, err)
+	assert.Timeish(t, *lock.LockedUntil, time.Now().Add(600*time.Second))
+
+	lock, err = db.UserLockGet(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u2"})
+	assert.Nil(t, err)
+	assert.True(t, lock.LockedUntil == nil)
+}
+
+// Only login logs after the user's last lock (or unlock) count
+func testLoginLogCreateLockoutReset(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	projectId := uuid.String()
+	rules := []data.LockoutRule{
+		data.LockoutRule{Statuses: []int{3}, Failures: 2, Window: 60, Duration: 60},
+	}
+
+	// created might only have a 1 second resolution, so login logs are
+	// inserted relative to the reset rather than created one after the other
+	now := time.Now()
+	fixtures.UserLock(projectId, "u1", nil, now.Add(-5*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: projectId, UserId: "u1", Status: 3}, now.Add(-10*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: projectId, UserId: "u1", Status: 3}, now.Add(-8*time.Second))
+
+	res, err := db.LoginLogCreate(context.Background(), data.LoginLogCreate{Id: uuid.String(), Status: 3, UserId: "u1", ProjectId: projectId, Lockout: rules})
+	assert.Nil(t, err)
+	assert.True(t, res.LockedUntil == nil)
+
+	res, _ = db.LoginLogCreate(context.Background(), data.LoginLogCreate{Id: uuid.String(), Status: 3, UserId: "u1", ProjectId: projectId, Lockout: rules})
+	assert.True(t, res.LockedUntil != nil)
+	assert.Timeish(t, *res.LockedUntil, time.Now().Add(60*time.Second))
+}
+
+func testLoginLogGet(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	assertRecord := func(actual data.LoginLogRecord, id string, status int, payload string, payloadKey int) {
+		t.Helper()
+		assert.Equal(t, actual.Id, id)
+		assert.Equal(t, actual.Status, status)
+		assert.Equal(t, actual.PayloadKey, payloadKey)
+		if payload == "" {
+			assert.True(t, actual.RawPayload == nil)
+		} else {
+			assert.Equal(t, string(actual.RawPayload), payload)
+		}
+	}
+
+	// empty result
+	res, err := db.LoginLogGet(context.Background(), data.LoginLogGet{ProjectId: uuid.String()})
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.LOGIN_LOG_GET_OK)
+	assert.Equal(t, len(res.Records), 0)
+
+	projectId1, projectId2 := uuid.String(), uuid.String()
+	id1, id2, id3 := uuid.String(), uuid.String(), uuid.String()
+	id4, id5, id6 := uuid.String(), uuid.String(), uuid.String()
+
+	now := time.Now()
+	fixtures.LoginLog(data.LoginLogCreate{Id: id1, ProjectId: projectId1, UserId: "u1", Status: 1}, now.Add(-100*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: id2, ProjectId: projectId1, UserId: "u1", Status: 2, Payload: []byte(`{"name": "idaho"}`)}, now.Add(-110*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: id3, ProjectId: projectId1, UserId: "u1", Status: 3}, now.Add(-120*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: id4, ProjectId: projectId1, UserId: "u1", Status: 4, Payload: []byte("ghanima"), PayloadKey: 3}, now.Add(-130*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: id5, ProjectId: projectId1, UserId: "u2", Status: 1}, now)
+	fixtures.LoginLog(data.LoginLogCreate{Id: id6, ProjectId: projectId2, UserId: "u1", Status: 1}, now)
+
+	page := func(limit int, offset int) []data.LoginLogRecord {
+		t.Helper()
+		res, err := db.LoginLogGet(context.Background(), data.LoginLogGet{Limit: limit, Offset: offset, UserId: "u1", ProjectId: projectId1})
+		assert.Nil(t, err)
+		assert.Equal(t, res.Status, data.LOGIN_LOG_GET_OK)
+		return res.Records
+	}
+
+	// first page
+	records := page(2, 0)
+	assert.Equal(t, len(records), 2)
+	assertRecord(records[0], id1, 1, "", 0)
+	assertRecord(records[1], id2, 2, `{"name": "idaho"}`, 0)
+
+	// 2nd page
+	records = page(2, 2)
+	assert.Equal(t, len(records), 2)
+	assertRecord(records[0], id3, 3, "", 0)
+	assertRecord(records[1], id4, 4, "ghanima", 3)
+
+	// empty page
+	assert.Equal(t, len(page(4, 4)), 0)
+}
+
+func testLoginLogGetFilters(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	projectId := uuid.String()
+	ip1, ip2, ua1, ua2, password, totp, ca, us := "1.1.1.1", "2.2.2.2", "ua1", "ua2", "password", "totp", "CA", "US"
+	id1, id2, id3, id4, id5 := uuid.String(), uuid.String(), uuid.String(), uuid.String(), uuid.String()
+
+	now := time.Now()
+	fixtures.LoginLog(data.LoginLogCreate{Id: id1, ProjectId: projectId, UserId: "u1", Status: 1, Ip: &ip1, UserAgent: &ua1, Method: &password, Country: &ca}, now.Add(-600*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: id2, ProjectId: projectId, UserId: "u1", Status: 2, Ip: &ip1, UserAgent: &ua2, Method: &totp}, now.Add(-1200*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: id3, ProjectId: projectId, UserId: "u1", Status: 3}, now.Add(-1800*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: id4, ProjectId: projectId, UserId: "u1", Status: 2, Ip: &ip2, UserAgent: &ua1, Method: &password, Country: &us}, now.Add(-48*time.Hour))
+	fixtures.LoginLog(data.LoginLogCreate{Id: id5, ProjectId: projectId, UserId: "u2", Status: 2, Ip: &ip1, UserAgent: &ua1, Method: &password, Country: &ca}, now.Add(-600*time.Second))
+
+	assertIds := func(opts data.LoginLogGet, expected ...string) {
+		t.Helper()
+		opts.Limit = 10
+		opts.UserId = "u1"
+		opts.ProjectId = projectId
+		res, err := db.LoginLogGet(context.Background(), opts)
+		assert.Nil(t, err)
+		assert.Equal(t, len(res.Records), len(expected))
+		for i, id := range expected {
+			assert.Equal(t, res.Records[i].Id, id)
+		}
+	}
+
+	dayAgo := now.Add(-24 * time.Hour)
+	minutesAgo := now.Add(-15 * time.Minute)
+
+	assertIds(data.LoginLogGet{}, id1, id2, id3, id4)
+	assertIds(data.LoginLogGet{Statuses: []int{2}}, id2, id4)
+	assertIds(data.LoginLogGet{Statuses: []int{1, 3}}, id1, id3)
+	assertIds(data.LoginLogGet{Statuses: []int{9}})
+	assertIds(data.LoginLogGet{Since: &dayAgo}, id1, id2, id3)
+	assertIds(data.LoginLogGet{Until: &minutesAgo}, id2, id3, id4)
+	assertIds(data.LoginLogGet{Since: &dayAgo, Until: &minutesAgo}, id2, id3)
+	assertIds(data.LoginLogGet{Since: &dayAgo, Until: &minutesAgo, Statuses: []int{2}}, id2)
+	assertIds(data.LoginLogGet{Ip: "1.1.1.1"}, id1, id2)
+	assertIds(data.LoginLogGet{UserAgent: "ua1"}, id1, id4)
+	assertIds(data.LoginLogGet{Method: "password", Country: "US"}, id4)
+	assertIds(data.LoginLogGet{Ip: "1.1.1.1", Statuses: []int{2}, Method: "totp"}, id2)
+
+	res, _ := db.LoginLogGet(context.Background(), data.LoginLogGet{Limit: 10, UserId: "u1", ProjectId: projectId, Country: "CA"})
+	record := res.Records[0]
+	assert.Equal(t, *record.Ip, "1.1.1.1")
+	assert.Equal(t, *record.UserAgent, "ua1")
+	assert.Equal(t, *record.Method, "password")
+	assert.Equal(t, *record.Country, "CA")
+}
+
+func testLoginLogGetCursor(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	projectId := uuid.String()
+
+	// id2 and id3 have the same created, so the id breaks the tie
+	// (ids have to be uuids, so we order them rather than pick them)
+	id1, id2, id3, id4 := uuid.String(), uuid.String(), uuid.String(), uuid.String()
+	if id2 > id3 {
+		id2, id3 = id3, id2
+	}
+
+	now := time.Now()
+	fixtures.LoginLog(data.LoginLogCreate{Id: id1, ProjectId: projectId, UserId: "u1", Status: 1}, now.Add(-60*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: id2, ProjectId: projectId, UserId: "u1", Status: 2}, now.Add(-61*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: id3, ProjectId: projectId, UserId: "u1", Status: 3}, now.Add(-61*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: id4, ProjectId: projectId, UserId: "u1", Status: 4}, now.Add(-3600*time.Second))
+
+	page := func(cursor *data.LoginLogCursor) []data.LoginLogRecord {
+		t.Helper()
+		res, err := db.LoginLogGet(context.Background(), data.LoginLogGet{
+			Limit:     2,
+			Offset:    10, // ignored with a cursor
+			UserId:    "u1",
+			ProjectId: projectId,
+			Cursor:    cursor,
+		})
+		assert.Nil(t, err)
+		return res.Records
+	}
+
+	records := page(&data.LoginLogCursor{Id: "ffffffff-ffff-ffff-ffff-ffffffffffff", Created: time.Now().Add(time.Second)})
+	assert.Equal(t, len(records), 2)
+	assert.Equal(t, records[0].Id, id1)
+	assert.Equal(t, records[1].Id, id3)
+
+	records = page(&data.LoginLogCursor{Id: records[1].Id, Created: records[1].Created})
+	assert.Equal(t, len(records), 2)
+	assert.Equal(t, records[0].Id, id2)
+	assert.Equal(t, records[1].Id, id4)
+
+	records = page(&data.LoginLogCursor{Id: records[1].Id, Created: records[1].Created})
+	assert.Equal(t, len(records), 0)
+}
+
+func testLoginLogStats(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	p1, p2 := uuid.String(), uuid.String()
+	day := time.Date(2022, 3, 10, 0, 0, 0, 0, time.UTC)
+	for _, l := range []struct {
+		projectId string
+		userId    string
+		status    int
+		offset    int
+	}{
+		{p1, "u1", 1, 3600},
+		{p1, "u1", 2, 5400},
+		{p1, "u2", 2, 10800},
+		{p1, "u2", 2, 93600},
+		{p1, "u3", 3, 97200},
+		{p1, "u4", 1, 432000},
+		{p2, "u1", 2, 3600},
+	} {
+		fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: l.projectId, UserId: l.userId, Status: l.status}, day.Add(time.Duration(l.offset)*time.Second))
+	}
+
+	stats := func(opts data.LoginLogStats) data.LoginLogStatsResult {
+		t.Helper()
+		opts.ProjectId = p1
+		opts.Since = day
+		opts.Until = day.Add(48 * time.Hour)
+		res, err := db.LoginLogStats(context.Background(), opts)
+		assert.Nil(t, err)
+		return res
+	}
+
+	res := stats(data.LoginLogStats{FailedStatuses: []int{2, 3}, Top: 2})
+	assert.Equal(t, res.DistinctUsers, 3)
+	assert.Equal(t, len(res.Buckets), 4)
+	assertBucket(t, res.Buckets[0], day, 1, 1)
+	assertBucket(t, res.Buckets[1], day, 2, 2)
+	assertBucket(t, res.Buckets[2], day.Add(24*time.Hour), 2, 1)
+	assertBucket(t, res.Buckets[3], day.Add(24*time.Hour), 3, 1)
+	assert.Equal(t, len(res.TopFailing), 2)
+	assert.Equal(t, res.TopFailing[0].UserId, "u2")
+	assert.Equal(t, res.TopFailing[0].Count, 2)
+	assert.Equal(t, res.TopFailing[1].UserId, "u1")
+	assert.Equal(t, res.TopFailing[1].Count, 1)
+
+	res = stats(data.LoginLogStats{Hourly: true, Statuses: []int{2}})
+	assert.Equal(t, res.DistinctUsers, 2)
+	assert.Equal(t, len(res.Buckets), 3)
+	assertBucket(t, res.Buckets[0], day.Add(time.Hour), 2, 1)
+	assertBucket(t, res.Buckets[1], day.Add(3*time.Hour), 2, 1)
+	assertBucket(t, res.Buckets[2], day.Add(26*time.Hour), 2, 1)
+	assert.Equal(t, len(res.TopFailing), 0)
+}
+
+func testLoginLogDelete(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	p1, p2 := uuid.String(), uuid.String()
+	l1, l3, l5 := uuid.String(), uuid.String(), uuid.String()
+	now := time.Now()
+	fixtures.LoginLog(data.LoginLogCreate{Id: l1, ProjectId: p1, UserId: "u1", Status: 1}, now)
+	fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: p1, UserId: "u1", Status: 2}, now)
+	fixtures.LoginLog(data.LoginLogCreate{Id: l3, ProjectId: p1, UserId: "u2", Status: 3}, now)
+	fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: p1, UserId: "u3", Status: 4}, now)
+	fixtures.LoginLog(data.LoginLogCreate{Id: l5, ProjectId: p2, UserId: "u1", Status: 5}, now)
+
+	remaining := func(statuses ...int) {
+		t.Helper()
+		var records []data.LoginLogRecord
+		for _, userId := range []string{"u1", "u2", "u3"} {
+			records = append(records, loginLogs(t, db, p1, userId)...)
+		}
+		records = append(records, loginLogs(t, db, p2, "u1")...)
+		actual := make(map[int]bool, len(records))
+		for _, record := range records {
+			actual[record.Status] = true
+		}
+		assert.Equal(t, len(actual), len(statuses))
+		for _, status := range statuses {
+			assert.True(t, actual[status])
+		}
+	}
+
+	// neither a user nor ids, nothing is deleted
+	deleted, err := db.LoginLogDelete(context.Background(), data.LoginLogDelete{ProjectId: p1})
+	assert.Nil(t, err)
+	assert.Equal(t, deleted, 0)
+	remaining(1, 2, 3, 4, 5)
+
+	// wrong user
+	deleted, _ = db.LoginLogDelete(context.Background(), data.LoginLogDelete{ProjectId: p1, UserId: "u2", Ids: []string{l1}})
+	assert.Equal(t, deleted, 0)
+
+	// l5 belongs to another project
+	deleted, _ = db.LoginLogDelete(context.Background(), data.LoginLogDelete{ProjectId: p1, Ids: []string{l3, l5}})
+	assert.Equal(t, deleted, 1)
+	remaining(1, 2, 4, 5)
+
+	deleted, _ = db.LoginLogDelete(context.Background(), data.LoginLogDelete{ProjectId: p1, UserId: "u1"})
+	assert.Equal(t, deleted, 2)
+	remaining(4, 5)
+}
+
+func testLoginLogExport(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	p1, p2 := uuid.String(), uuid.String()
+	ip := "1.1.1.1"
+
+	// l3 and l4 share a created, so batches have to continue by id
+	l3, l4 := uuid.String(), uuid.String()
+	if l3 > l4 {
+		l3, l4 = l4, l3
+	}
+
+	now := time.Now()
+	fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: p1, UserId: "u1", Status: 1, Ip: &ip}, now.Add(-300*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: p1, UserId: "u2", Status: 2}, now.Add(-240*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: l3, ProjectId: p1, UserId: "u1", Status: 3}, now.Add(-180*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: l4, ProjectId: p1, UserId: "u1", Status: 4}, now.Add(-180*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: p1, UserId: "u2", Status: 5}, now.Add(-60*time.Second))
+	fixtures.LoginLog(data.LoginLogCreate{Id: uuid.String(), ProjectId: p2, UserId: "u1", Status: 6}, now)
+
+	export := func(opts data.LoginLogExport) []data.LoginLogRecord {
+		t.Helper()
+		var records []data.LoginLogRecord
+		opts.ProjectId = p1
+		err := db.LoginLogExport(context.Background(), opts, func(record data.LoginLogRecord) error {
+			records = append(records, record)
+			return nil
+		})
+		assert.Nil(t, err)
+		return records
+	}
+
+	records := export(data.LoginLogExport{})
+	assertStatuses(t, records, 1, 2, 3, 4, 5)
+	assert.Equal(t, records[0].UserId, "u1")
+	assert.Equal(t, *records[0].Ip, "1.1.1.1")
+	assert.Equal(t, records[1].UserId, "u2")
+
+	assertStatuses(t, export(data.LoginLogExport{UserId: "u2"}), 2, 5)
+
+	since := now.Add(-210 * time.Second)
+	until := now.Add(-90 * time.Second)
+	assertStatuses(t, export(data.LoginLogExport{Since: &since, Until: &until}), 3, 4)
+
+	// stops at the first error
+	n := 0
+	err := db.LoginLogExport(context.Background(), data.LoginLogExport{ProjectId: p1}, func(record data.LoginLogRecord) error {
+		n += 1
+		if n == 3 {
+			return errors.New("stop")
+		}
+		return nil
+	})
+	assert.Equal(t, err.Error(), "stop")
+	assert.Equal(t, n, 3)
+}
+
+// Other tests might have unencrypted payloads too
+func testLoginLogGetUnencryptedAndUpdatePayload(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	projectId := uuid.String()
+	id1, id2, id3, id4 := uuid.String(), uuid.String(), uuid.String(), uuid.String()
+	now := time.Now()
+	fixtures.LoginLog(data.LoginLogCreate{Id: id1, ProjectId: projectId, UserId: "u1", Status: 1}, now)
+	fixtures.LoginLog(data.LoginLogCreate{Id: id2, ProjectId: projectId, UserId: "u1", Status: 1, Payload: []byte("p2")}, now)
+	fixtures.LoginLog(data.LoginLogCreate{Id: id3, ProjectId: projectId, UserId: "u1", Status: 1, Payload: []byte("p3"), PayloadKey: 1}, now)
+	fixtures.LoginLog(data.LoginLogCreate{Id: id4, ProjectId: projectId, UserId: "u1", Status: 1, Payload: []byte("p4")}, now)
+
+	unencrypted := func() map[string]string {
+		t.Helper()
+		records, err := db.LoginLogGetUnencrypted(context.Background(), 100_000)
+		assert.Nil(t, err)
+		lookup := make(map[string]string, len(records))
+		for _, record := range records {
+			lookup[record.Id] = string(record.RawPayload)
+		}
+		return lookup
+	}
+
+	lookup := unencrypted()
+	assert.Equal(t, lookup[id2], "p2")
+	assert.Equal(t, lookup[id4], "p4")
+	_, exists := lookup[id1]
+	assert.False(t, exists)
+	_, exists = lookup[id3]
+	assert.False(t, exists)
+
+	records, err := db.LoginLogGetUnencrypted(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, len(records), 1)
+
+	err = db.LoginLogUpdatePayload(context.Background(), data.LoginLogUpdatePayload{
+		Id:         id2,
+		Payload:    []byte("e2"),
+		PayloadKey: 4,
+	})
+	assert.Nil(t, err)
+
+	for _, record := range loginLogs(t, db, projectId, "u1") {
+		if record.Id == id2 {
+			assert.Bytes(t, record.RawPayload, []byte("e2"))
+			assert.Equal(t, record.PayloadKey, 4)
+		}
+	}
+
+	lookup = unencrypted()
+	_, exists = lookup[id2]
+	assert.False(t, exists)
+	assert.Equal(t, lookup[id4], "p4")
+}
+
+func testUserUnlock(t *testing.T, db storage.Storage, fixtures Fixtures) {
+	projectId := uuid.String()
+	now := time.Now()
+	lockedUntil, expired := now.Add(time.Minute), now.Add(-time.Second)
+	fixtures.UserLock(projectId, "u1", &lockedUntil, now.Add(-time.Hour))
+	fixtures.UserLock(projectId, "u2", &expired, now.Add(-time.Hour))
+
+	unlocked, err := db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u1"})
+	assert.Nil(t, err)
+	assert.True(t, unlocked)
+
+	unlocked, _ = db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u1"})
+	assert.False(t, unlocked)
+
+	lock, _ := db.UserLockGet(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u1"})
+	assert.True(t, lock.LockedUntil == nil)
+
+	// an expired lock isn't a lock
+	unlocked, _ = db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u2"})
+	assert.False(t, unlocked)
+
+	unlocked, err = db.UserUnlock(context.Background(), data.UserLockGet{ProjectId: projectId, UserId: "u3"})
+	assert.Nil(t, err)
+	assert.False(t, unlocked)
+}
+
+// Rows loaded come back out of Dump as they went in (encrypted secrets
+// and payloads are opaque bytes to the storage), and loading a row again
+// replaces it. Only for storages which implement storage.Dumper and
+// storage.Loader.
+func testDumpLoad(t *testing.T, db storage.Storage, _ Fixtures) {
+	dumper, canDump := db.(storage.Dumper)
+	loader, canLoad := db.(storage.Loader)
+	if !canDump || !canLoad {
+		t.Skip("storage does not implement storage.Dumper and storage.Loader")
+	}
+
+	ip := "1.2.3.4"
+	logId := uuid.String()
+	projectId := uuid.String()
+	uses, attempts, slidingTTL := 2, 3, 60
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	expires := created.Add(2 * time.Hour)
+
+	// the storage can be shared with other tests, so Counts is checked
+	// relative to before
+	before, err := loader.Counts()
+	assert.Nil(t, err)
+
+	assert.Nil(t, loader.Load([]data.DumpRecord{
+		{Project: &data.DumpProject{Project: data.Project{
+			Id:                      projectId,
+			TOTPIssuer:              "gobl",
+			TicketMax:               9,
+			LockoutRules:            []data.LockoutRule{{Statuses: []int{2}, Failures: 3, Window: 60, Duration: 120}},
+			LoginLogSuccessStatuses: []int{1},
+		}, Updated: created}},
+		{TOTP: &data.DumpTOTP{ProjectId: projectId, UserId: "u1", Type: "t1", Pending: true, Secret: []byte("encrypted"), Expires: &expires, Created: created}},
+		{Ticket: &data.DumpTicket{ProjectId: projectId, Ticket: []byte("t1"), Payload: []byte("p1"), PayloadEncrypted: true, Uses: &uses, Expires: &expires, SlidingTTL: &slidingTTL, Scope: []byte("s1"), Attempts: &attempts, Created: created}},
+		{Denied: &data.DumpDenied{ProjectId: projectId, Ticket: []byte("t2"), Expires: expires}},
+		{LoginLog: &data.DumpLoginLog{Id: logId, ProjectId: projectId, UserId: "u1", Status: 3, Payload: []byte("pl1"), PayloadKey: 1, Created: created, Ip: &ip}},
+		{UserLock: &data.DumpUserLock{ProjectId: projectId, UserId: "u1", LockedUntil: &expires, Reset: created}},
+	}))
+
+	records := dumpProject(t, dumper, projectId)
+	assert.Equal(t, len(records), 6)
+	assertCountsAdded(t, loader, before, 1)
+
+	p := records["project"].Project
+	assert.Equal(t, p.TOTPIssuer, "gobl")
+	assert.Equal(t, p.TicketMax, 9)
+	assert.Equal(t, p.LockoutRules[0].Duration, 120)
+	assert.Equal(t, p.LoginLogSuccessStatuses[0], 1)
+	assert.True(t, p.Updated.Equal(created))
+
+	totp := records["totp"].TOTP
+	assert.True(t, totp.Pending)
+	assert.Equal(t, totp.Type, "t1")
+	assert.Bytes(t, totp.Secret, []byte("encrypted"))
+	assert.True(t, totp.Expires.Equal(expires))
+	assert.True(t, totp.Created.Equal(created))
+
+	ticket := records["ticket"].Ticket
+	assert.Bytes(t, ticket.Ticket, []byte("t1"))
+	assert.Bytes(t, ticket.Payload, []byte("p1"))
+	assert.True(t, ticket.PayloadEncrypted)
+	assert.Equal(t, *ticket.Uses, 2)
+	assert.Equal(t, *ticket.Attempts, 3)
+	assert.Equal(t, *ticket.SlidingTTL, 60)
+	assert.Bytes(t, ticket.Scope, []byte("s1"))
+	assert.True(t, ticket.Expires.Equal(expires))
+
+	denied := records["denied"].Denied
+	assert.Bytes(t, denied.Ticket, []byte("t2"))
+	assert.True(t, denied.Expires.Equal(expires))
+
+	l := records["login_log"].LoginLog
+	assert.Equal(t, l.Id, logId)
+	assert.Equal(t, l.Status, 3)
+	assert.Bytes(t, l.Payload, []byte("pl1"))
+	assert.Equal(t, l.PayloadKey, 1)
+	assert.Equal(t, *l.Ip, "1.2.3.4")
+	assert.True(t, l.Device == nil)
+	assert.True(t, l.Created.Equal(created))
+
+	lock := records["user_lock"].UserLock
+	assert.True(t, lock.LockedUntil.Equal(expires))
+	assert.True(t, lock.Reset.Equal(created))
+
+	// loaded rows are usable through the rest of the interface
+	res, err := db.TOTPGet(context.Background(), data.TOTPGet{ProjectId: projectId, UserId: "u1", Type: "t1", Pending: true})
+	assert.Nil(t, err)
+	assert.Bytes(t, res.Secret, []byte("encrypted"))
+
+	// replaced, not duplicated
+	assert.Nil(t, loader.Load([]data.DumpRecord{
+		{LoginLog: &data.DumpLoginLog{Id: logId, ProjectId: projectId, UserId: "u2", Status: 4, Created: created}},
+	}))
+	records = dumpProject(t, dumper, projectId)
+	assert.Equal(t, len(records), 6)
+	assertCountsAdded(t, loader, before, 1)
+	assert.Equal(t, records["login_log"].LoginLog.Status, 4)
+	assert.Equal(t, len(loginLogs(t, db, projectId, "u1")), 0)
+	assert.Equal(t, len(loginLogs(t, db, projectId, "u2")), 1)
+}
+
+// Every kind has n more rows than before
+func assertCountsAdded(t *testing.T, loader storage.Loader, before map[string]int, n int) {
+	t.Helper()
+	counts, err := loader.Counts()
+	assert.Nil(t, err)
+	for _, kind := range []string{"project", "totp", "ticket", "denied", "login_log", "user_lock"} {
+		assert.Equal(t, counts[kind], before[kind]+n)
+	}
+}
+
+// The project's dumped records, by kind (the tests only have one of each)
+func dumpProject(t *testing.T, dumper storage.Dumper, projectId string) map[string]data.DumpRecord {
+	t.Helper()
+	records := make(map[string]data.DumpRecord)
+	err := dumper.Dump(func(record data.DumpRecord) error {
+		var id string
+		switch {
+		case record.Project != nil:
+			id = record.Project.Id
+		case record.TOTP != nil:
+			id = record.TOTP.ProjectId
+		case record.Ticket != nil:
+			id = record.Ticket.ProjectId
+		case record.Denied != nil:
+			id = record.Denied.ProjectId
+		case record.LoginLog != nil:
+			id = record.LoginLog.ProjectId
+		case record.UserLock != nil:
+			id = record.UserLock.ProjectId
+		}
+		if id == projectId {
+			records[record.Kind()] = record
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	return records
+}
+
+func createTickets(t *testing.T, db storage.Storage, projectId string, tickets ...data.TicketCreateTicket) {
+	t.Helper()
+	res, err := db.TicketCreate(context.Background(), data.TicketCreate{ProjectId: projectId, Tickets: tickets})
+	assert.Nil(t, err)
+	assert.Equal(t, res.Status, data.TICKET_CREATE_OK)
+}
+
+// all of the user's login logs, newest first
+func loginLogs(t *testing.T, db storage.Storage, projectId string, userId string) []data.LoginLogRecord {
+	t.Helper()
+	res, err := db.LoginLogGet(context.Background(), data.LoginLogGet{ProjectId: projectId, UserId: userId, Limit: 1000})
+	assert.Nil(t, err)
+	return res.Records
+}
+
+func assertStatuses(t *testing.T, records []data.LoginLogRecord, statuses ...int) {
+	t.Helper()
+	assert.Equal(t, len(records), len(statuses))
+	for i, status := range statuses {
+		assert.Equal(t, records[i].Status, status)
+	}
+}
+
+func assertBucket(t *testing.T, actual data.LoginLogStatsBucket, bucket time.Time, status int, count int) {
+	t.Helper()
+	assert.Equal(t, actual.Time.Unix(), bucket.Unix())
+	assert.Equal(t, actual.Status, status)
+	assert.Equal(t, actual.Count, count)
+}
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"time"
 
@@ -18,6 +19,7 @@ type factory struct {
 	TOTP     f.Table
 	Ticket   f.Table
 	LoginLog f.Table
+	UserLock f.Table
 }
 
 var (
@@ -30,6 +32,19 @@ var (
 func init() {
 	f.DB = storage.DB.(f.SQLStorage)
 	Factory.Project = f.NewTable("authen_projects", func(args f.KV) f.KV {
+		jsonColumn := func(name string) *string {
+			value, ok := args[name]
+			if !ok {
+				return nil
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				panic(err)
+			}
+			s := string(encoded)
+			return &s
+		}
+
 		return f.KV{
 			"id":                           args.UUID("id", uuid.String()),
 			"totp_max":                     args.Int("totp_max", 100),
@@ -40,6 +55,11 @@ func init() {
 			"ticket_max_payload_length":    args.Int("ticket_max_payload_length", 128),
 			"login_log_max":                args.Int("login_log_max", 100),
 			"login_log_max_payload_length": args.Int("login_log_max_payload_length", 128),
+			"login_log_retain_count":       args.Int("login_log_retain_count", 0),
+			"login_log_retain_days":        args.Int("login_log_retain_days", 0),
+			"login_log_retain_on_insert":   args.Bool("login_log_retain_on_insert", false),
+			"lockout_rules":                jsonColumn("lockout_rules"),
+			"login_log_success_statuses":   jsonColumn("login_log_success_statuses"),
 			"created":                      args.Time("created", time.Now()),
 			"updated":                      args.Time("updated", time.Now()),
 		}
@@ -91,14 +111,28 @@ func init() {
 
 		ticket := args.String("ticket", uuid.String()).(string)
 		ticketHash := sha256.Sum256([]byte(ticket))
+		hash := ticketHash[:]
+
+		// codes are hashed with their scope (see http/tickets/tickets.go)
+		var scope []byte
+		if code, ok := args["code"]; ok {
+			scopeHash := sha256.Sum256([]byte(args.String("scope", "").(string)))
+			scope = scopeHash[:]
+			raw := append([]byte("authen:code:"), scope...)
+			codeHash := sha512.Sum512_256(append(raw, []byte(code.(string))...))
+			hash = codeHash[:]
+		}
 
 		return f.KV{
-			"project_id": args.UUID("project_id", uuid.String()),
-			"ticket":     ticketHash[:],
-			"expires":    args.Time("expires"),
-			"uses":       args.Int("uses"),
-			"payload":    payload,
-			"created":    args.Time("created", time.Now()),
+			"project_id":  args.UUID("project_id", uuid.String()),
+			"ticket":      hash,
+			"expires":     args.Time("expires"),
+			"uses":        args.Int("uses"),
+			"payload":     payload,
+			"scope":       scope,
+			"attempts":    args.Int("attempts"),
+			"sliding_ttl": args.Int("sliding_ttl"),
+			"created":     args.Time("created", time.Now()),
 		}
 	})
 
@@ -118,7 +152,20 @@ func init() {
 			"user_id":    args.String("user_id", uuid.String()),
 			"status":     args.Int("status", 0),
 			"payload":    payload,
+			"ip":         args.String("ip", nil),
+			"user_agent": args.String("user_agent", nil),
+			"method":     args.String("method", nil),
+			"country":    args.String("country", nil),
 			"created":    args.Time("created", time.Now()),
 		}
 	})
+
+	Factory.UserLock = f.NewTable("authen_user_locks", func(args f.KV) f.KV {
+		return f.KV{
+			"project_id":   args.UUID("project_id", uuid.String()),
+			"user_id":      args.String("user_id", uuid.String()),
+			"locked_until": args.Time("locked_until", nil),
+			"reset":        args.Time("reset", time.Now()),
+		}
+	})
 }